@@ -0,0 +1,201 @@
+// Package certloader contains a TLS certificate loader.
+package certloader
+
+import (
+	"bytes"
+	"crypto/tls"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+// wait some time after the last change, in order to allow
+// the writer to replace both the certificate and the key.
+const reloadDelay = 1 * time.Second
+
+// Parent is the parent of a CertLoader.
+type Parent interface {
+	Log(logger.Level, string, ...interface{})
+}
+
+// CertLoader is a TLS certificate loader.
+// It watches the certificate and key files and reloads them when they change,
+// without affecting existing connections.
+type CertLoader struct {
+	certPath string
+	keyPath  string
+	parent   Parent
+	watcher  *fsnotify.Watcher
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	certByts []byte
+	keyByts  []byte
+
+	reloads      uint64
+	reloadErrors uint64
+
+	done chan struct{}
+}
+
+// New allocates a CertLoader.
+func New(certPath string, keyPath string, parent Parent) (*CertLoader, error) {
+	certByts, err := os.ReadFile(certPath)
+	if err != nil {
+		return nil, err
+	}
+
+	keyByts, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	cert, err := tls.X509KeyPair(certByts, keyByts)
+	if err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	// watch parent directories in order to support files that are
+	// replaced or symlinked (i.e. by certbot or Kubernetes).
+	dirs := make(map[string]struct{})
+	for _, fpath := range []string{certPath, keyPath} {
+		// use absolute paths to support Darwin
+		absolutePath, _ := filepath.Abs(fpath)
+		dirs[filepath.Dir(absolutePath)] = struct{}{}
+	}
+
+	for dir := range dirs {
+		err := watcher.Add(dir)
+		if err != nil {
+			watcher.Close()
+			return nil, err
+		}
+	}
+
+	cl := &CertLoader{
+		certPath: certPath,
+		keyPath:  keyPath,
+		parent:   parent,
+		watcher:  watcher,
+		cert:     &cert,
+		certByts: certByts,
+		keyByts:  keyByts,
+		done:     make(chan struct{}),
+	}
+
+	go cl.run()
+
+	return cl, nil
+}
+
+// Close closes a CertLoader.
+func (cl *CertLoader) Close() {
+	cl.watcher.Close()
+	<-cl.done
+}
+
+func (cl *CertLoader) run() {
+	defer close(cl.done)
+
+	t := time.NewTimer(0)
+	<-t.C
+	defer t.Stop()
+
+	for {
+		select {
+		case _, ok := <-cl.watcher.Events:
+			if !ok {
+				return
+			}
+
+			t.Stop()
+			select {
+			case <-t.C:
+			default:
+			}
+			t.Reset(reloadDelay)
+
+		case _, ok := <-cl.watcher.Errors:
+			if !ok {
+				return
+			}
+
+		case <-t.C:
+			cl.reload()
+		}
+	}
+}
+
+func (cl *CertLoader) reload() {
+	certByts, err := os.ReadFile(cl.certPath)
+	if err != nil {
+		cl.reloadFailed(err)
+		return
+	}
+
+	keyByts, err := os.ReadFile(cl.keyPath)
+	if err != nil {
+		cl.reloadFailed(err)
+		return
+	}
+
+	cl.mutex.RLock()
+	unchanged := bytes.Equal(certByts, cl.certByts) && bytes.Equal(keyByts, cl.keyByts)
+	cl.mutex.RUnlock()
+
+	if unchanged {
+		return
+	}
+
+	cert, err := tls.X509KeyPair(certByts, keyByts)
+	if err != nil {
+		cl.reloadFailed(err)
+		return
+	}
+
+	cl.mutex.Lock()
+	cl.cert = &cert
+	cl.certByts = certByts
+	cl.keyByts = keyByts
+	cl.mutex.Unlock()
+
+	atomic.AddUint64(&cl.reloads, 1)
+	cl.log(logger.Info, "certificate '%s' reloaded", cl.certPath)
+}
+
+func (cl *CertLoader) reloadFailed(err error) {
+	atomic.AddUint64(&cl.reloadErrors, 1)
+	cl.log(logger.Error, "unable to reload certificate '%s': %v", cl.certPath, err)
+}
+
+func (cl *CertLoader) log(level logger.Level, format string, args ...interface{}) {
+	cl.parent.Log(level, "[TLS] "+format, args...)
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (cl *CertLoader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cl.mutex.RLock()
+	defer cl.mutex.RUnlock()
+	return cl.cert, nil
+}
+
+// Reloads returns the number of successful reloads.
+func (cl *CertLoader) Reloads() uint64 {
+	return atomic.LoadUint64(&cl.reloads)
+}
+
+// ReloadErrors returns the number of failed reloads.
+func (cl *CertLoader) ReloadErrors() uint64 {
+	return atomic.LoadUint64(&cl.reloadErrors)
+}
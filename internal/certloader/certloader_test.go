@@ -0,0 +1,106 @@
+package certloader
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+func generateCert(t *testing.T, commonName string) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func commonName(t *testing.T, cl *CertLoader) string {
+	cert, err := cl.GetCertificate(nil)
+	require.NoError(t, err)
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	require.NoError(t, err)
+
+	return leaf.Subject.CommonName
+}
+
+type nilParent struct{}
+
+func (nilParent) Log(logger.Level, string, ...interface{}) {}
+
+func TestCertLoader(t *testing.T) {
+	dir, err := os.MkdirTemp("", "certloader")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	certPath := filepath.Join(dir, "server.crt")
+	keyPath := filepath.Join(dir, "server.key")
+
+	certByts, keyByts := generateCert(t, "first")
+	err = os.WriteFile(certPath, certByts, 0o644)
+	require.NoError(t, err)
+	err = os.WriteFile(keyPath, keyByts, 0o644)
+	require.NoError(t, err)
+
+	cl, err := New(certPath, keyPath, nilParent{})
+	require.NoError(t, err)
+	defer cl.Close()
+
+	require.Equal(t, "first", commonName(t, cl))
+
+	t.Run("invalid", func(t *testing.T) {
+		err := os.WriteFile(certPath, []byte("invalid"), 0o644)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return cl.ReloadErrors() == 1
+		}, 5*time.Second, 100*time.Millisecond)
+
+		// previous certificate is kept
+		require.Equal(t, "first", commonName(t, cl))
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		certByts, keyByts := generateCert(t, "second")
+		err := os.WriteFile(certPath, certByts, 0o644)
+		require.NoError(t, err)
+		err = os.WriteFile(keyPath, keyByts, 0o644)
+		require.NoError(t, err)
+
+		require.Eventually(t, func() bool {
+			return cl.Reloads() == 1
+		}, 5*time.Second, 100*time.Millisecond)
+
+		require.Equal(t, "second", commonName(t, cl))
+	})
+}
+
+func TestCertLoaderNoFile(t *testing.T) {
+	_, err := New("/nonexistent.crt", "/nonexistent.key", nilParent{})
+	require.Error(t, err)
+}
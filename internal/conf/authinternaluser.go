@@ -0,0 +1,136 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// AuthAction is an action that can be performed by an internal user.
+type AuthAction string
+
+// actions.
+const (
+	AuthActionPublish  AuthAction = "publish"
+	AuthActionRead     AuthAction = "read"
+	AuthActionPlayback AuthAction = "playback"
+	AuthActionAPI      AuthAction = "api"
+	AuthActionAPIAdmin AuthAction = "apiAdmin"
+	AuthActionMetrics  AuthAction = "metrics"
+	AuthActionPPROF    AuthAction = "pprof"
+)
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (d *AuthAction) UnmarshalJSON(b []byte) error {
+	var in string
+	if err := json.Unmarshal(b, &in); err != nil {
+		return err
+	}
+
+	switch AuthAction(in) {
+	case AuthActionPublish,
+		AuthActionRead,
+		AuthActionPlayback,
+		AuthActionAPI,
+		AuthActionAPIAdmin,
+		AuthActionMetrics,
+		AuthActionPPROF:
+
+	default:
+		return fmt.Errorf("invalid action: %s", in)
+	}
+
+	*d = AuthAction(in)
+	return nil
+}
+
+// Includes checks whether the action includes another one.
+// The apiAdmin action includes the read-only api action.
+func (d AuthAction) Includes(other AuthAction) bool {
+	return d == other || (d == AuthActionAPIAdmin && other == AuthActionAPI)
+}
+
+// AuthInternalUserPermission is a permission granted to an internal user.
+type AuthInternalUserPermission struct {
+	Action AuthAction `json:"action"`
+	Path   string     `json:"path"`
+
+	Regexp *regexp.Regexp `json:"-"` // filled by Check()
+}
+
+// MatchesPath checks whether the permission applies to a path.
+func (p AuthInternalUserPermission) MatchesPath(path string) bool {
+	switch {
+	case p.Path == "":
+		return true
+
+	case p.Regexp != nil:
+		return p.Regexp.MatchString(path)
+
+	default:
+		return p.Path == path
+	}
+}
+
+// AuthInternalUser is an entry of the internal user database.
+type AuthInternalUser struct {
+	User              Credential                   `json:"user"`
+	Pass              Credential                   `json:"pass"`
+	Token             Credential                   `json:"token"`
+	IPs               IPsOrCIDRs                   `json:"ips"`
+	Permissions       []AuthInternalUserPermission `json:"permissions"`
+	PublisherPriority int                          `json:"publisherPriority"`
+}
+
+// IsAny returns whether the entry matches any user, including anonymous ones.
+func (u AuthInternalUser) IsAny() bool {
+	return u.User == "any"
+}
+
+// AuthInternalUsers is the authInternalUsers parameter.
+type AuthInternalUsers []AuthInternalUser
+
+// unmarshalEnv implements envUnmarshaler.
+func (d *AuthInternalUsers) unmarshalEnv(s string) error {
+	return json.Unmarshal([]byte(s), d)
+}
+
+// Check checks the user database for errors and compiles regular expressions.
+func (d AuthInternalUsers) Check() error {
+	for i, u := range d {
+		if u.User == "" {
+			return fmt.Errorf("'authInternalUsers': user %d has an empty username", i+1)
+		}
+
+		if u.IsAny() && u.Pass != "" {
+			return fmt.Errorf("'authInternalUsers': user 'any' can't have a password")
+		}
+
+		if u.IsAny() && u.Token != "" {
+			return fmt.Errorf("'authInternalUsers': user 'any' can't have a token")
+		}
+
+		if !u.IsAny() && u.Pass == "" {
+			return fmt.Errorf("'authInternalUsers': user %d has an empty password", i+1)
+		}
+
+		for j, p := range u.Permissions {
+			if p.Action == "" {
+				return fmt.Errorf("'authInternalUsers': permission %d of user %d has no action", j+1, i+1)
+			}
+
+			if strings.HasPrefix(p.Path, "~") {
+				re, err := regexp.Compile(p.Path[1:])
+				if err != nil {
+					return fmt.Errorf("'authInternalUsers': invalid regular expression: %s", p.Path[1:])
+				}
+				d[i].Permissions[j].Regexp = re
+			} else {
+				d[i].Permissions[j].Regexp = nil
+			}
+		}
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@
 package conf
 
 import (
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -25,6 +26,10 @@ func decrypt(key string, byts []byte) ([]byte, error) {
 		return nil, err
 	}
 
+	if len(enc) < 24 {
+		return nil, fmt.Errorf("decryption error")
+	}
+
 	var secretKey [32]byte
 	copy(secretKey[:], key)
 
@@ -38,32 +43,70 @@ func decrypt(key string, byts []byte) ([]byte, error) {
 	return decrypted, nil
 }
 
-func loadFromFile(fpath string, conf *Conf) (bool, error) {
+func encrypt(key string, byts []byte) ([]byte, error) {
+	var secretKey [32]byte
+	copy(secretKey[:], key)
+
+	var nonce [24]byte
+	_, err := rand.Read(nonce[:])
+	if err != nil {
+		return nil, err
+	}
+
+	enc := secretbox.Seal(nonce[:], byts, &nonce, &secretKey)
+
+	return []byte(base64.StdEncoding.EncodeToString(enc)), nil
+}
+
+// readFile reads and decrypts a configuration file.
+func readFile(fpath string) ([]byte, bool, error) {
 	// rtsp-simple-server.yml is optional
 	// other configuration files are not
 	if fpath == "rtsp-simple-server.yml" {
 		if _, err := os.Stat(fpath); err != nil {
-			return false, nil
+			return nil, false, nil
 		}
 	}
 
 	byts, err := os.ReadFile(fpath)
 	if err != nil {
-		return true, err
+		return nil, true, err
 	}
 
-	if key, ok := os.LookupEnv("RTSP_CONFKEY"); ok {
-		byts, err = decrypt(key, byts)
-		if err != nil {
-			return true, err
-		}
+	// the whole file or single values can be encrypted
+	byts, err = DecryptFile(os.Getenv("RTSP_CONFKEY"), byts)
+	if err != nil {
+		return nil, true, err
+	}
+
+	return byts, true, nil
+}
+
+func loadFromFile(fpath string, conf *Conf) (bool, error) {
+	byts, found, err := readFile(fpath)
+	if !found || err != nil {
+		return found, err
 	}
 
+	err = loadFromYAML(byts, conf)
+	if err != nil {
+		return true, err
+	}
+
+	_, err = loadIncludes(fpath, conf)
+	return true, err
+}
+
+func loadFromYAML(byts []byte, conf *Conf) error {
+	return loadYAML(byts, conf, true)
+}
+
+func loadYAML(byts []byte, conf *Conf, interpolate bool) error {
 	// load YAML config into a generic map
 	var temp interface{}
-	err = yaml.Unmarshal(byts, &temp)
+	err := yaml.Unmarshal(byts, &temp)
 	if err != nil {
-		return true, err
+		return err
 	}
 
 	// convert interface{} keys into string keys to avoid JSON errors
@@ -100,7 +143,16 @@ func loadFromFile(fpath string, conf *Conf) (bool, error) {
 	}
 	temp, err = convert(temp)
 	if err != nil {
-		return false, err
+		return err
+	}
+
+	// resolve ${env:NAME} and ${file:/path} references
+	var in interpolation
+	if interpolate {
+		temp, err = in.expand(temp)
+		if err != nil {
+			return err
+		}
 	}
 
 	// check for non-existent parameters
@@ -148,42 +200,94 @@ func loadFromFile(fpath string, conf *Conf) (bool, error) {
 	}
 	err = checkNonExistentFields(temp, Conf{})
 	if err != nil {
-		return true, err
+		return err
 	}
 
 	// convert the generic map into JSON
 	byts, err = json.Marshal(temp)
 	if err != nil {
-		return true, err
+		return err
 	}
 
 	// load the configuration from JSON
 	err = json.Unmarshal(byts, conf)
 	if err != nil {
-		return true, err
+		return err
+	}
+
+	if m, ok := temp.(map[string]interface{}); ok {
+		conf.MarkSetFields(m)
 	}
 
-	return true, nil
+	conf.secrets = append(conf.secrets, in.secrets...)
+	conf.referencedFiles = append(conf.referencedFiles, in.files...)
+
+	return nil
 }
 
 // Conf is a configuration.
 type Conf struct {
 	// general
-	LogLevel                  LogLevel        `json:"logLevel"`
-	LogDestinations           LogDestinations `json:"logDestinations"`
-	LogFile                   string          `json:"logFile"`
-	ReadTimeout               StringDuration  `json:"readTimeout"`
-	WriteTimeout              StringDuration  `json:"writeTimeout"`
-	ReadBufferCount           int             `json:"readBufferCount"`
-	ExternalAuthenticationURL string          `json:"externalAuthenticationURL"`
-	API                       bool            `json:"api"`
-	APIAddress                string          `json:"apiAddress"`
-	Metrics                   bool            `json:"metrics"`
-	MetricsAddress            string          `json:"metricsAddress"`
-	PPROF                     bool            `json:"pprof"`
-	PPROFAddress              string          `json:"pprofAddress"`
-	RunOnConnect              string          `json:"runOnConnect"`
-	RunOnConnectRestart       bool            `json:"runOnConnectRestart"`
+	LogLevel                               LogLevel          `json:"logLevel"`
+	LogDestinations                        LogDestinations   `json:"logDestinations"`
+	LogFile                                string            `json:"logFile"`
+	ReadTimeout                            StringDuration    `json:"readTimeout"`
+	WriteTimeout                           StringDuration    `json:"writeTimeout"`
+	ReadBufferCount                        int               `json:"readBufferCount"`
+	DrainTimeout                           StringDuration    `json:"drainTimeout"`
+	DrainDelay                             StringDuration    `json:"drainDelay"`
+	AuthInternalUsers                      AuthInternalUsers `json:"authInternalUsers"`
+	ExternalAuthenticationURL              string            `json:"externalAuthenticationURL"`
+	ExternalAuthenticationTimeout          StringDuration    `json:"externalAuthenticationTimeout"`
+	ExternalAuthenticationMaxIdleConns     int               `json:"externalAuthenticationMaxIdleConns"`
+	ExternalAuthenticationHeaders          []string          `json:"externalAuthenticationHeaders"`
+	ExternalAuthenticationBearerToken      string            `json:"externalAuthenticationBearerToken"`
+	ExternalAuthenticationCacheTTL         StringDuration    `json:"externalAuthenticationCacheTTL"`
+	ExternalAuthenticationNegativeCacheTTL StringDuration    `json:"externalAuthenticationNegativeCacheTTL"`
+	SignedURLSecret                        string            `json:"signedURLSecret"`
+	ClientCertUsernameField                string            `json:"clientCertUsernameField"`
+	AuthBanMaxFailures                     int               `json:"authBanMaxFailures"`
+	AuthBanWindow                          StringDuration    `json:"authBanWindow"`
+	AuthBanDuration                        StringDuration    `json:"authBanDuration"`
+	MaxConnsPerIP                          int               `json:"maxConnsPerIP"`
+	MaxReaders                             int               `json:"maxReaders"`
+	ReaderBandwidthLimit                   int               `json:"readerBandwidthLimit"`
+	WebhookURL                             string            `json:"webhookURL"`
+	WebhookSecret                          string            `json:"webhookSecret"`
+	WebhookTimeout                         StringDuration    `json:"webhookTimeout"`
+	WebhookMaxRetries                      int               `json:"webhookMaxRetries"`
+	API                                    bool              `json:"api"`
+	APIAddress                             string            `json:"apiAddress"`
+	APIEncryption                          bool              `json:"apiEncryption"`
+	APIServerKey                           string            `json:"apiServerKey"`
+	APIServerCert                          string            `json:"apiServerCert"`
+	APIPersistConf                         bool              `json:"apiPersistConf"`
+	Metrics                                bool              `json:"metrics"`
+	MetricsAddress                         string            `json:"metricsAddress"`
+	MetricsEncryption                      bool              `json:"metricsEncryption"`
+	MetricsServerKey                       string            `json:"metricsServerKey"`
+	MetricsServerCert                      string            `json:"metricsServerCert"`
+	PPROF                                  bool              `json:"pprof"`
+	PPROFAddress                           string            `json:"pprofAddress"`
+	PPROFEncryption                        bool              `json:"pprofEncryption"`
+	PPROFServerKey                         string            `json:"pprofServerKey"`
+	PPROFServerCert                        string            `json:"pprofServerCert"`
+	RunOnConnect                           string            `json:"runOnConnect"`
+	RunOnConnectRestart                    bool              `json:"runOnConnectRestart"`
+	RunOnDisconnect                        string            `json:"runOnDisconnect"`
+	ConfURL                                string            `json:"confURL"`
+	ConfURLInterval                        StringDuration    `json:"confURLInterval"`
+	ConfURLLongPoll                        bool              `json:"confURLLongPoll"`
+	ConfURLPublicKey                       string            `json:"confURLPublicKey"`
+	ConfURLCacheFile                       string            `json:"confURLCacheFile"`
+	ClusterOrigins                         []string          `json:"clusterOrigins"`
+	ClusterOriginRTSPPort                  int               `json:"clusterOriginRTSPPort"`
+	ClusterTimeout                         StringDuration    `json:"clusterTimeout"`
+	ClusterNodes                           []string          `json:"clusterNodes"`
+	ClusterPublicHost                      string            `json:"clusterPublicHost"`
+	ClusterMaxReaders                      int               `json:"clusterMaxReaders"`
+	ClusterMaxBandwidth                    int               `json:"clusterMaxBandwidth"`
+	ClusterLoadInterval                    StringDuration    `json:"clusterLoadInterval"`
 
 	// RTSP
 	RTSPDisable       bool        `json:"rtspDisable"`
@@ -198,6 +302,7 @@ type Conf struct {
 	MulticastRTCPPort int         `json:"multicastRTCPPort"`
 	ServerKey         string      `json:"serverKey"`
 	ServerCert        string      `json:"serverCert"`
+	ClientCA          string      `json:"clientCA"`
 	AuthMethods       AuthMethods `json:"authMethods"`
 
 	// RTMP
@@ -207,6 +312,7 @@ type Conf struct {
 	RTMPSAddress   string     `json:"rtmpsAddress"`
 	RTMPServerKey  string     `json:"rtmpServerKey"`
 	RTMPServerCert string     `json:"rtmpServerCert"`
+	RTMPClientCA   string     `json:"rtmpClientCA"`
 
 	// HLS
 	HLSDisable         bool           `json:"hlsDisable"`
@@ -214,6 +320,7 @@ type Conf struct {
 	HLSEncryption      bool           `json:"hlsEncryption"`
 	HLSServerKey       string         `json:"hlsServerKey"`
 	HLSServerCert      string         `json:"hlsServerCert"`
+	HLSClientCA        string         `json:"hlsClientCA"`
 	HLSAlwaysRemux     bool           `json:"hlsAlwaysRemux"`
 	HLSVariant         HLSVariant     `json:"hlsVariant"`
 	HLSSegmentCount    int            `json:"hlsSegmentCount"`
@@ -230,6 +337,7 @@ type Conf struct {
 	WebRTCEncryption        bool       `json:"webrtcEncryption"`
 	WebRTCServerKey         string     `json:"webrtcServerKey"`
 	WebRTCServerCert        string     `json:"webrtcServerCert"`
+	WebRTCClientCA          string     `json:"webrtcClientCA"`
 	WebRTCAllowOrigin       string     `json:"webrtcAllowOrigin"`
 	WebRTCTrustedProxies    IPsOrCIDRs `json:"webrtcTrustedProxies"`
 	WebRTCICEServers        []string   `json:"webrtcICEServers"`
@@ -238,11 +346,31 @@ type Conf struct {
 	WebRTCICETCPMuxAddress  string     `json:"webrtcICETCPMuxAddress"`
 
 	// paths
-	Paths map[string]*PathConf `json:"paths"`
+	PathDefaults  PathConf             `json:"pathDefaults"`
+	PathTemplates map[string]*PathConf `json:"pathTemplates"`
+	Include       []string             `json:"include"`
+	Paths         map[string]*PathConf `json:"paths"`
+
+	// values and files obtained from references
+	secrets         []string
+	referencedFiles []string
+
+	// parameters explicitly set in paths and templates
+	pathsSet     setFields
+	templatesSet setFields
+
+	// parameters applied to paths, computed by CheckAndFillMissing
+	effectivePaths map[string]*PathConf
 }
 
 // Load loads a Conf.
 func Load(fpath string) (*Conf, bool, error) {
+	return LoadWithRemote(fpath, nil)
+}
+
+// LoadWithRemote loads a Conf and overrides its parameters with the ones
+// contained in a remote configuration, if provided.
+func LoadWithRemote(fpath string, remote []byte) (*Conf, bool, error) {
 	conf := &Conf{}
 
 	found, err := loadFromFile(fpath, conf)
@@ -250,7 +378,14 @@ func Load(fpath string) (*Conf, bool, error) {
 		return nil, false, err
 	}
 
-	err = loadFromEnvironment("RTSP", conf)
+	if remote != nil {
+		err = loadFromRemote(remote, conf)
+		if err != nil {
+			return nil, false, fmt.Errorf("remote configuration: %s", err)
+		}
+	}
+
+	err = loadConfFromEnvironment("RTSP", conf)
 	if err != nil {
 		return nil, false, err
 	}
@@ -292,16 +427,150 @@ func (conf *Conf) CheckAndFillMissing() error {
 			!strings.HasPrefix(conf.ExternalAuthenticationURL, "https://") {
 			return fmt.Errorf("'externalAuthenticationURL' must be a HTTP URL")
 		}
+
+		if len(conf.AuthInternalUsers) != 0 {
+			return fmt.Errorf("'authInternalUsers' can't be used with 'externalAuthenticationURL'")
+		}
+	}
+	if conf.ExternalAuthenticationTimeout == 0 {
+		conf.ExternalAuthenticationTimeout = 10 * StringDuration(time.Second)
+	}
+	if conf.ExternalAuthenticationMaxIdleConns == 0 {
+		conf.ExternalAuthenticationMaxIdleConns = 10
+	}
+	for _, h := range conf.ExternalAuthenticationHeaders {
+		parts := strings.SplitN(h, ":", 2)
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return fmt.Errorf("invalid external authentication header '%s': must be in format 'Name: value'", h)
+		}
+	}
+	if conf.SignedURLSecret != "" && len(conf.SignedURLSecret) < 16 {
+		return fmt.Errorf("'signedURLSecret' must be at least 16 characters long")
+	}
+	switch conf.ClientCertUsernameField {
+	case "":
+		conf.ClientCertUsernameField = "commonName"
+
+	case "commonName", "dnsName", "emailAddress", "uri":
+
+	default:
+		return fmt.Errorf("invalid 'clientCertUsernameField': %s", conf.ClientCertUsernameField)
+	}
+	if conf.AuthBanMaxFailures < 0 {
+		return fmt.Errorf("'authBanMaxFailures' can't be negative")
+	}
+	if conf.AuthBanWindow == 0 {
+		conf.AuthBanWindow = 60 * StringDuration(time.Second)
+	}
+	if conf.AuthBanDuration == 0 {
+		conf.AuthBanDuration = 10 * 60 * StringDuration(time.Second)
+	}
+	if conf.MaxConnsPerIP < 0 {
+		return fmt.Errorf("'maxConnsPerIP' can't be negative")
+	}
+	if conf.MaxReaders < 0 {
+		return fmt.Errorf("'maxReaders' can't be negative")
+	}
+	if conf.ReaderBandwidthLimit < 0 {
+		return fmt.Errorf("'readerBandwidthLimit' can't be negative")
+	}
+	if conf.WebhookURL != "" &&
+		!strings.HasPrefix(conf.WebhookURL, "http://") &&
+		!strings.HasPrefix(conf.WebhookURL, "https://") {
+		return fmt.Errorf("'webhookURL' must be a HTTP URL")
+	}
+	if conf.WebhookTimeout == 0 {
+		conf.WebhookTimeout = 10 * StringDuration(time.Second)
+	}
+	if conf.WebhookMaxRetries < 0 {
+		return fmt.Errorf("'webhookMaxRetries' can't be negative")
+	}
+	if conf.WebhookMaxRetries == 0 {
+		conf.WebhookMaxRetries = 3
+	}
+	err := conf.AuthInternalUsers.Check()
+	if err != nil {
+		return err
 	}
 	if conf.APIAddress == "" {
 		conf.APIAddress = "127.0.0.1:9997"
 	}
+	if conf.APIServerKey == "" {
+		conf.APIServerKey = "server.key"
+	}
+	if conf.APIServerCert == "" {
+		conf.APIServerCert = "server.crt"
+	}
 	if conf.MetricsAddress == "" {
 		conf.MetricsAddress = "127.0.0.1:9998"
 	}
+	if conf.MetricsServerKey == "" {
+		conf.MetricsServerKey = "server.key"
+	}
+	if conf.MetricsServerCert == "" {
+		conf.MetricsServerCert = "server.crt"
+	}
+	if conf.ConfURL != "" {
+		if !strings.HasPrefix(conf.ConfURL, "http://") &&
+			!strings.HasPrefix(conf.ConfURL, "https://") {
+			return fmt.Errorf("'confURL' must be a HTTP URL")
+		}
+
+		if conf.APIPersistConf {
+			return fmt.Errorf("'apiPersistConf' can't be used with 'confURL'")
+		}
+
+		if conf.ConfURLPublicKey == "" {
+			return fmt.Errorf("'confURLPublicKey' is required when 'confURL' is set")
+		}
+	}
+	if conf.ConfURLInterval == 0 {
+		conf.ConfURLInterval = 30 * StringDuration(time.Second)
+	}
+	if conf.ConfURLPublicKey != "" {
+		if _, err := decodePublicKey(conf.ConfURLPublicKey); err != nil {
+			return fmt.Errorf("invalid 'confURLPublicKey': %s", err)
+		}
+	}
+	if conf.ConfURLCacheFile == "" {
+		conf.ConfURLCacheFile = "rtsp-simple-server.remote.yml"
+	}
+	for _, origin := range conf.ClusterOrigins {
+		if !strings.HasPrefix(origin, "http://") &&
+			!strings.HasPrefix(origin, "https://") {
+			return fmt.Errorf("invalid cluster origin '%s': must be a HTTP URL", origin)
+		}
+	}
+	if conf.ClusterOriginRTSPPort == 0 {
+		conf.ClusterOriginRTSPPort = 8554
+	}
+	if conf.ClusterTimeout == 0 {
+		conf.ClusterTimeout = 5 * StringDuration(time.Second)
+	}
+	for _, node := range conf.ClusterNodes {
+		if !strings.HasPrefix(node, "http://") &&
+			!strings.HasPrefix(node, "https://") {
+			return fmt.Errorf("invalid cluster node '%s': must be a HTTP URL", node)
+		}
+	}
+	if conf.ClusterMaxReaders < 0 {
+		return fmt.Errorf("'clusterMaxReaders' can't be negative")
+	}
+	if conf.ClusterMaxBandwidth < 0 {
+		return fmt.Errorf("'clusterMaxBandwidth' can't be negative")
+	}
+	if conf.ClusterLoadInterval == 0 {
+		conf.ClusterLoadInterval = 5 * StringDuration(time.Second)
+	}
 	if conf.PPROFAddress == "" {
 		conf.PPROFAddress = "127.0.0.1:9999"
 	}
+	if conf.PPROFServerKey == "" {
+		conf.PPROFServerKey = "server.key"
+	}
+	if conf.PPROFServerCert == "" {
+		conf.PPROFServerCert = "server.crt"
+	}
 
 	// RTSP
 	if len(conf.Protocols) == 0 {
@@ -419,12 +688,16 @@ func (conf *Conf) CheckAndFillMissing() error {
 		conf.Paths = make(map[string]*PathConf)
 	}
 
-	// "all" is an alias for "~^.*$"
-	if _, ok := conf.Paths["all"]; ok {
-		conf.Paths["~^.*$"] = conf.Paths["all"]
-		delete(conf.Paths, "all")
+	conf.normalizePathNames()
+
+	err = conf.checkPathTemplates()
+	if err != nil {
+		return err
 	}
 
+	conf.templatesSet.prune(conf.PathTemplates)
+	conf.pathsSet.prune(conf.Paths)
+
 	sortedNames := make([]string, len(conf.Paths))
 	i := 0
 	for name := range conf.Paths {
@@ -433,18 +706,35 @@ func (conf *Conf) CheckAndFillMissing() error {
 	}
 	sort.Strings(sortedNames)
 
+	// parameters of paths are kept as they are set, while the ones that are applied
+	// are computed each time, in order to follow changes of templates and 'pathDefaults'.
+	conf.effectivePaths = make(map[string]*PathConf, len(conf.Paths))
+
 	for _, name := range sortedNames {
-		pconf := conf.Paths[name]
-		if pconf == nil {
-			pconf = &PathConf{}
-			conf.Paths[name] = pconf
+		if conf.Paths[name] == nil {
+			conf.Paths[name] = &PathConf{}
 		}
 
-		err := pconf.checkAndFillMissing(conf, name)
+		pconf, err := conf.effectivePath(name)
 		if err != nil {
 			return err
 		}
+
+		conf.effectivePaths[name] = pconf
 	}
 
 	return nil
 }
+
+// normalizePathNames replaces the "all" path, that is an alias for "~^.*$".
+func (conf *Conf) normalizePathNames() {
+	if _, ok := conf.Paths["all"]; ok {
+		conf.Paths["~^.*$"] = conf.Paths["all"]
+		delete(conf.Paths, "all")
+
+		if keys, ok := conf.pathsSet["all"]; ok {
+			conf.pathsSet["~^.*$"] = keys
+			delete(conf.pathsSet, "all")
+		}
+	}
+}
@@ -1,10 +1,15 @@
 package conf
 
 import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"regexp"
 	"strings"
+
+	"golang.org/x/crypto/argon2"
 )
 
 var reCredential = regexp.MustCompile(`^[a-zA-Z0-9!\$\(\)\*\+\.;<=>\[\]\^_\-\{\}]+$`)
@@ -12,6 +17,7 @@ var reCredential = regexp.MustCompile(`^[a-zA-Z0-9!\$\(\)\*\+\.;<=>\[\]\^_\-\{\}
 const credentialSupportedChars = "A-Z,0-9,!,$,(,),*,+,.,;,<,=,>,[,],^,_,-,{,}"
 
 // Credential is a parameter that is used as username or password.
+// It can be in plain text or hashed with "sha256:" or "argon2:" prefixes.
 type Credential string
 
 // MarshalJSON implements json.Marshaler.
@@ -26,10 +32,20 @@ func (d *Credential) UnmarshalJSON(b []byte) error {
 		return err
 	}
 
-	if in != "" &&
-		!strings.HasPrefix(in, "sha256:") &&
-		!reCredential.MatchString(in) {
-		return fmt.Errorf("contains unsupported characters (supported are %s)", credentialSupportedChars)
+	switch {
+	case in == "":
+
+	case strings.HasPrefix(in, "sha256:"):
+
+	case strings.HasPrefix(in, "argon2:"):
+		if _, err := parseArgon2Hash(in[len("argon2:"):]); err != nil {
+			return err
+		}
+
+	default:
+		if !reCredential.MatchString(in) {
+			return fmt.Errorf("contains unsupported characters (supported are %s)", credentialSupportedChars)
+		}
 	}
 
 	*d = Credential(in)
@@ -40,3 +56,112 @@ func (d *Credential) UnmarshalJSON(b []byte) error {
 func (d *Credential) unmarshalEnv(s string) error {
 	return d.UnmarshalJSON([]byte(`"` + s + `"`))
 }
+
+// IsHashed returns whether the credential is hashed.
+func (d Credential) IsHashed() bool {
+	return strings.HasPrefix(string(d), "sha256:") ||
+		strings.HasPrefix(string(d), "argon2:")
+}
+
+// Check returns whether a plain text value matches the credential.
+func (d Credential) Check(guess string) bool {
+	switch {
+	case strings.HasPrefix(string(d), "sha256:"):
+		sum := sha256.Sum256([]byte(guess))
+		return subtle.ConstantTimeCompare(
+			[]byte(base64.StdEncoding.EncodeToString(sum[:])),
+			[]byte(d[len("sha256:"):])) == 1
+
+	case strings.HasPrefix(string(d), "argon2:"):
+		h, err := parseArgon2Hash(string(d[len("argon2:"):]))
+		if err != nil {
+			return false
+		}
+		return h.check(guess)
+
+	default:
+		return subtle.ConstantTimeCompare([]byte(guess), []byte(d)) == 1
+	}
+}
+
+// maximum memory of Argon2 hashes, in KiB (1 GiB).
+// Every check of a hash allocates this amount of memory.
+const argon2MaxMemory = 1024 * 1024
+
+// argon2Hash is an Argon2 hash in PHC string format, i.e.
+// $argon2id$v=19$m=4096,t=3,p=1$salt$hash
+type argon2Hash struct {
+	variant string
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	hash    []byte
+}
+
+func parseArgon2Hash(s string) (*argon2Hash, error) {
+	parts := strings.Split(s, "$")
+	if len(parts) != 6 || parts[0] != "" {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+
+	h := &argon2Hash{
+		variant: parts[1],
+	}
+
+	if h.variant != "argon2i" && h.variant != "argon2id" {
+		return nil, fmt.Errorf("unsupported argon2 variant: %s", h.variant)
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2 version: %d", version)
+	}
+
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &h.memory, &h.time, &h.threads)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+
+	// argon2.Key() and argon2.IDKey() panic with these values
+	if h.time < 1 {
+		return nil, fmt.Errorf("invalid argon2 hash: t must be at least 1")
+	}
+	if h.threads < 1 {
+		return nil, fmt.Errorf("invalid argon2 hash: p must be at least 1")
+	}
+
+	if h.memory > argon2MaxMemory {
+		return nil, fmt.Errorf("invalid argon2 hash: m can't be greater than %d", argon2MaxMemory)
+	}
+
+	h.salt, err = base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+
+	h.hash, err = base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2 hash")
+	}
+
+	if len(h.salt) == 0 || len(h.hash) == 0 {
+		return nil, fmt.Errorf("invalid argon2 hash: salt and hash can't be empty")
+	}
+
+	return h, nil
+}
+
+func (h *argon2Hash) check(guess string) bool {
+	var cmp []byte
+	if h.variant == "argon2i" {
+		cmp = argon2.Key([]byte(guess), h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	} else {
+		cmp = argon2.IDKey([]byte(guess), h.salt, h.time, h.memory, h.threads, uint32(len(h.hash)))
+	}
+	return subtle.ConstantTimeCompare(cmp, h.hash) == 1
+}
@@ -0,0 +1,75 @@
+package conf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCredentialCheck(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		cred Credential
+	}{
+		{
+			"plain",
+			"testpass",
+		},
+		{
+			"sha256",
+			"sha256:E9JJ8stBJ7QM+nV4ZoUCeHk/gU3tPFh/5YieiJp6n2w=",
+		},
+		{
+			"argon2",
+			"argon2:$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$gDBkkpLgQ+mIitUIfibdtWlZ8WIBZN46GZxcRceYFS8",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			require.Equal(t, true, ca.cred.Check("testpass"))
+			require.Equal(t, false, ca.cred.Check("testpass2"))
+		})
+	}
+}
+
+func TestCredentialErrors(t *testing.T) {
+	for _, ca := range []struct {
+		name string
+		cred string
+		err  string
+	}{
+		{
+			"argon2 zero rounds",
+			"argon2:$argon2id$v=19$m=1024,t=0,p=1$c2FsdHNhbHRzYWx0$gDBkkpLgQ+mIitUIfibdtWlZ8WIBZN46GZxcRceYFS8",
+			"invalid argon2 hash: t must be at least 1",
+		},
+		{
+			"argon2 zero parallelism",
+			"argon2:$argon2id$v=19$m=1024,t=1,p=0$c2FsdHNhbHRzYWx0$gDBkkpLgQ+mIitUIfibdtWlZ8WIBZN46GZxcRceYFS8",
+			"invalid argon2 hash: p must be at least 1",
+		},
+		{
+			"argon2 too much memory",
+			"argon2:$argon2id$v=19$m=2097152,t=1,p=1$c2FsdHNhbHRzYWx0$gDBkkpLgQ+mIitUIfibdtWlZ8WIBZN46GZxcRceYFS8",
+			"invalid argon2 hash: m can't be greater than 1048576",
+		},
+		{
+			"argon2 empty salt",
+			"argon2:$argon2id$v=19$m=1024,t=1,p=1$$gDBkkpLgQ+mIitUIfibdtWlZ8WIBZN46GZxcRceYFS8",
+			"invalid argon2 hash: salt and hash can't be empty",
+		},
+		{
+			"argon2 empty hash",
+			"argon2:$argon2id$v=19$m=1024,t=1,p=1$c2FsdHNhbHRzYWx0$",
+			"invalid argon2 hash: salt and hash can't be empty",
+		},
+	} {
+		t.Run(ca.name, func(t *testing.T) {
+			var c Credential
+			err := c.UnmarshalJSON([]byte(`"` + ca.cred + `"`))
+			require.EqualError(t, err, ca.err)
+
+			// checks don't panic even if the credential has not been validated
+			require.Equal(t, false, Credential(ca.cred).Check("testpass"))
+		})
+	}
+}
@@ -121,7 +121,7 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 			f := rt.Field(i)
 
 			// load only public fields
-			if f.Tag.Get("json") == "-" {
+			if f.Tag.Get("json") == "-" || !f.IsExported() {
 				continue
 			}
 
@@ -148,12 +148,27 @@ func loadEnvInternal(env map[string]string, prefix string, rv reflect.Value) err
 	return fmt.Errorf("unsupported type: %v", rt)
 }
 
-func loadFromEnvironment(prefix string, v interface{}) error {
+func environ() map[string]string {
 	env := make(map[string]string)
 	for _, kv := range os.Environ() {
 		tmp := strings.SplitN(kv, "=", 2)
 		env[tmp[0]] = tmp[1]
 	}
+	return env
+}
+
+func loadFromEnvironment(prefix string, v interface{}) error {
+	return loadEnvInternal(environ(), prefix, reflect.ValueOf(v).Elem())
+}
+
+func loadConfFromEnvironment(prefix string, conf *Conf) error {
+	env := environ()
+
+	err := loadEnvInternal(env, prefix, reflect.ValueOf(conf).Elem())
+	if err != nil {
+		return err
+	}
 
-	return loadEnvInternal(env, prefix, reflect.ValueOf(v).Elem())
+	conf.markEnvSetFields(env, prefix)
+	return nil
 }
@@ -0,0 +1,125 @@
+package conf
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/yaml.v2"
+)
+
+// IncludePatterns returns the patterns in 'include' as absolute paths.
+// Relative patterns are relative to the directory of the configuration file.
+func (conf *Conf) IncludePatterns(fpath string) []string {
+	ret := make([]string, len(conf.Include))
+	for i, pattern := range conf.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(fpath), pattern)
+		}
+		ret[i], _ = filepath.Abs(pattern)
+	}
+	return ret
+}
+
+func normalizedPathName(name string) string {
+	// "all" is an alias for "~^.*$"
+	if name == "all" {
+		return "~^.*$"
+	}
+	return name
+}
+
+// loadIncludes loads paths from the files listed in 'include'.
+// It returns the file that defines each included path.
+func loadIncludes(fpath string, conf *Conf) (map[string]string, error) {
+	if len(conf.Include) == 0 {
+		return nil, nil
+	}
+
+	sources := make(map[string]string)
+	for name := range conf.Paths {
+		sources[normalizedPathName(name)] = fpath
+	}
+
+	included := make(map[string]string)
+
+	for _, pattern := range conf.IncludePatterns(fpath) {
+		if hasMeta(filepath.Dir(pattern)) {
+			return nil, fmt.Errorf("'include' supports wildcards in file names only (%s)", pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid 'include' pattern (%s): %s", pattern, err)
+		}
+		sort.Strings(matches)
+
+		for _, match := range matches {
+			tmp, err := loadIncludedFile(match)
+			if err != nil {
+				return nil, fmt.Errorf("included file %s: %s", match, err)
+			}
+			paths := tmp.Paths
+			conf.secrets = append(conf.secrets, tmp.secrets...)
+			conf.referencedFiles = append(conf.referencedFiles, tmp.referencedFiles...)
+
+			if conf.Paths == nil && len(paths) != 0 {
+				conf.Paths = make(map[string]*PathConf)
+			}
+
+			for name, pconf := range paths {
+				if src, ok := sources[normalizedPathName(name)]; ok {
+					return nil, fmt.Errorf("path '%s' is defined in both %s and %s", name, src, match)
+				}
+				sources[normalizedPathName(name)] = match
+				included[normalizedPathName(name)] = match
+				conf.Paths[name] = pconf
+				if keys, ok := tmp.pathsSet[name]; ok {
+					if conf.pathsSet == nil {
+						conf.pathsSet = make(setFields)
+					}
+					conf.pathsSet[name] = keys
+				}
+			}
+		}
+	}
+
+	return included, nil
+}
+
+func loadIncludedFile(fpath string) (*Conf, error) {
+	byts, _, err := readFile(fpath)
+	if err != nil {
+		return nil, err
+	}
+
+	var temp map[string]interface{}
+	err = yaml.Unmarshal(byts, &temp)
+	if err != nil {
+		return nil, err
+	}
+
+	for k := range temp {
+		if k != "paths" {
+			return nil, fmt.Errorf("included files can contain 'paths' only, found '%s'", k)
+		}
+	}
+
+	var tmp Conf
+	err = loadFromYAML(byts, &tmp)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tmp, nil
+}
+
+func hasMeta(s string) bool {
+	for _, c := range s {
+		switch c {
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
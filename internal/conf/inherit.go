@@ -0,0 +1,270 @@
+package conf
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// setFields contains, for each path or template, the parameters that are
+// explicitly set, including the ones that are set to their zero value.
+type setFields map[string]map[string]struct{}
+
+func (s setFields) clone() setFields {
+	if s == nil {
+		return nil
+	}
+
+	ret := make(setFields, len(s))
+	for name, keys := range s {
+		ret[name] = make(map[string]struct{}, len(keys))
+		for key := range keys {
+			ret[name][key] = struct{}{}
+		}
+	}
+	return ret
+}
+
+func (s setFields) set(name string, m map[string]interface{}, replace bool) setFields {
+	if s == nil {
+		s = make(setFields)
+	}
+
+	if replace || s[name] == nil {
+		s[name] = make(map[string]struct{}, len(m))
+	}
+
+	for key := range m {
+		s[name][key] = struct{}{}
+	}
+	return s
+}
+
+// prune removes the entries of paths or templates that do not exist anymore.
+func (s setFields) prune(confs map[string]*PathConf) {
+	for name := range s {
+		if _, ok := confs[name]; !ok {
+			delete(s, name)
+		}
+	}
+}
+
+// isSet checks whether a parameter of a PathConf is set, that is, it is explicitly
+// set or it has a value different from zero.
+func isSet(rv reflect.Value, i int, key string, keys map[string]struct{}) bool {
+	if _, ok := keys[key]; ok {
+		return true
+	}
+	return !rv.Field(i).IsZero()
+}
+
+// inherit fills the parameters of a PathConf that are not set
+// with the ones of another PathConf that are set.
+// keys contains the parameters that are set, and is updated with the inherited ones.
+func (pconf *PathConf) inherit(keys map[string]struct{}, base *PathConf, baseKeys map[string]struct{}) {
+	rv := reflect.ValueOf(pconf).Elem()
+	rvbase := reflect.ValueOf(base).Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		j := rt.Field(i).Tag.Get("json")
+		if j == "-" || j == "extends" {
+			continue
+		}
+
+		if isSet(rv, i, j, keys) || !isSet(rvbase, i, j, baseKeys) {
+			continue
+		}
+
+		rv.Field(i).Set(rvbase.Field(i))
+		keys[j] = struct{}{}
+	}
+}
+
+// templateChain returns the names of the templates extended by a path,
+// from the nearest to the farthest.
+func (conf *Conf) templateChain(extends string) ([]string, error) {
+	var ret []string
+	visited := make(map[string]struct{})
+
+	for extends != "" {
+		if _, ok := visited[extends]; ok {
+			return nil, fmt.Errorf("'pathTemplates' contain a cycle (%s)",
+				strings.Join(append(ret, extends), " -> "))
+		}
+		visited[extends] = struct{}{}
+
+		tmpl, ok := conf.PathTemplates[extends]
+		if !ok || tmpl == nil {
+			return nil, fmt.Errorf("template '%s' does not exist", extends)
+		}
+
+		ret = append(ret, extends)
+		extends = tmpl.Extends
+	}
+
+	return ret, nil
+}
+
+func (conf *Conf) checkPathTemplates() error {
+	if conf.PathDefaults.Extends != "" {
+		return fmt.Errorf("'extends' can't be used in 'pathDefaults'")
+	}
+
+	names := make([]string, 0, len(conf.PathTemplates))
+	for name := range conf.PathTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "" {
+			return fmt.Errorf("template names can't be empty")
+		}
+
+		_, err := conf.templateChain(name)
+		if err != nil {
+			return fmt.Errorf("invalid template '%s': %s", name, err)
+		}
+	}
+
+	return nil
+}
+
+// applyPathDefaults fills the parameters of a path that are not set with the ones
+// of the templates extended by the path and, after that, with the ones in 'pathDefaults'.
+// keys contains the parameters that are explicitly set in the path.
+func (conf *Conf) applyPathDefaults(pconf *PathConf, keys map[string]struct{}) error {
+	chain, err := conf.templateChain(pconf.Extends)
+	if err != nil {
+		return err
+	}
+
+	set := make(map[string]struct{}, len(keys))
+	for key := range keys {
+		set[key] = struct{}{}
+	}
+
+	for _, tmplName := range chain {
+		pconf.inherit(set, conf.PathTemplates[tmplName], conf.templatesSet[tmplName])
+	}
+
+	pconf.inherit(set, &conf.PathDefaults, nil)
+	return nil
+}
+
+// mergedPath returns the parameters of a path of the configuration merged with
+// the ones of its templates and with 'pathDefaults'.
+// The parameters of the path are left untouched.
+func (conf *Conf) mergedPath(name string) (*PathConf, error) {
+	pconf := &PathConf{}
+	if p := conf.Paths[name]; p != nil {
+		*pconf = *p
+	}
+
+	err := conf.applyPathDefaults(pconf, conf.pathsSet[name])
+	if err != nil {
+		return nil, fmt.Errorf("path '%s': %s", name, err)
+	}
+
+	return pconf, nil
+}
+
+// effectivePath returns the parameters that are applied to a path of the configuration,
+// that are the merged ones, with missing parameters filled with default values.
+func (conf *Conf) effectivePath(name string) (*PathConf, error) {
+	pconf, err := conf.mergedPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = pconf.checkAndFillMissing(conf, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return pconf, nil
+}
+
+// EffectivePaths returns the parameters that are applied to each path,
+// computed by CheckAndFillMissing.
+func (conf *Conf) EffectivePaths() map[string]*PathConf {
+	return conf.effectivePaths
+}
+
+// MarkSetFields records the parameters that are explicitly set in the paths and
+// in the path templates of a configuration in generic form.
+// Paths and templates contained in the configuration are considered as a whole,
+// therefore the parameters that were recorded before for them are discarded.
+func (conf *Conf) MarkSetFields(m map[string]interface{}) {
+	if templates, ok := m["pathTemplates"].(map[string]interface{}); ok {
+		for name, tmpl := range templates {
+			tm, _ := tmpl.(map[string]interface{})
+			conf.templatesSet = conf.templatesSet.set(name, tm, true)
+		}
+	}
+
+	if paths, ok := m["paths"].(map[string]interface{}); ok {
+		for name, path := range paths {
+			pm, _ := path.(map[string]interface{})
+			conf.pathsSet = conf.pathsSet.set(name, pm, true)
+		}
+	}
+}
+
+// MarkSetPathFields records the parameters that are explicitly set in a path
+// by an edit in generic form, in addition to the ones recorded before.
+func (conf *Conf) MarkSetPathFields(name string, m map[string]interface{}) {
+	conf.pathsSet = conf.pathsSet.set(name, m, false)
+}
+
+// markEnvSetFields records the parameters of paths and templates
+// that are explicitly set by environment variables.
+func (conf *Conf) markEnvSetFields(env map[string]string, prefix string) {
+	keysByEnv := make(map[string]string)
+	rt := reflect.TypeOf(PathConf{})
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if j := f.Tag.Get("json"); j != "-" && f.IsExported() {
+			keysByEnv[strings.ToUpper(f.Name)] = j
+		}
+	}
+
+	mark := func(mapPrefix string, confs map[string]*PathConf, s setFields) setFields {
+		for k := range env {
+			if !strings.HasPrefix(k, mapPrefix) {
+				continue
+			}
+
+			parts := strings.SplitN(k[len(mapPrefix):], "_", 2)
+			if len(parts) != 2 {
+				continue
+			}
+
+			name := strings.ToLower(parts[0])
+			if _, ok := confs[name]; !ok {
+				continue
+			}
+
+			if key, ok := keysByEnv[parts[1]]; ok {
+				s = s.set(name, map[string]interface{}{key: nil}, false)
+			}
+		}
+		return s
+	}
+
+	conf.templatesSet = mark(prefix+"_PATHTEMPLATES_", conf.PathTemplates, conf.templatesSet)
+	conf.pathsSet = mark(prefix+"_PATHS_", conf.Paths, conf.pathsSet)
+}
+
+// FillPathConf fills the parameters of a path that is not part of the configuration,
+// with the same rules that are applied to paths of the configuration.
+func (conf *Conf) FillPathConf(pconf *PathConf, name string) error {
+	err := conf.applyPathDefaults(pconf, nil)
+	if err != nil {
+		return fmt.Errorf("path '%s': %s", name, err)
+	}
+
+	return pconf.checkAndFillMissing(conf, name)
+}
@@ -0,0 +1,237 @@
+package conf
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// reReference matches ${env:NAME} and ${file:/path} references.
+// References prefixed with an additional $ are escaped.
+var reReference = regexp.MustCompile(`\$?\$\{(env|file):([^}]*)\}`)
+
+// redactedValue is the value that replaces secrets in redacted configurations.
+const redactedValue = "******"
+
+// interpolation resolves references inside string values.
+type interpolation struct {
+	secrets []string
+	files   []string
+}
+
+func (in *interpolation) resolve(kind string, name string) (string, error) {
+	switch kind {
+	case "env":
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable '%s' is not set", name)
+		}
+		return v, nil
+
+	default: // file
+		byts, err := os.ReadFile(name)
+		if err != nil {
+			return "", err
+		}
+
+		if abs, err := filepath.Abs(name); err == nil {
+			in.files = append(in.files, abs)
+		}
+
+		// remove the trailing newline that is usually present in files
+		return strings.TrimRight(string(byts), "\r\n"), nil
+	}
+}
+
+func (in *interpolation) expandString(s string) (string, error) {
+	var err error
+
+	ret := reReference.ReplaceAllStringFunc(s, func(m string) string {
+		if err != nil {
+			return ""
+		}
+
+		if strings.HasPrefix(m, "$$") {
+			return m[1:]
+		}
+
+		sm := reReference.FindStringSubmatch(m)
+
+		var v string
+		v, err = in.resolve(sm[1], sm[2])
+		if err != nil {
+			return ""
+		}
+
+		if v != "" {
+			in.secrets = append(in.secrets, v)
+		}
+		return v
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return ret, nil
+}
+
+// expand resolves references inside all string values of a generic map.
+func (in *interpolation) expand(i interface{}) (interface{}, error) {
+	switch x := i.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			v2, err := in.expand(v)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", k, err)
+			}
+			x[k] = v2
+		}
+
+	case []interface{}:
+		for j, v := range x {
+			v2, err := in.expand(v)
+			if err != nil {
+				return nil, err
+			}
+			x[j] = v2
+		}
+
+	case string:
+		return in.expandString(x)
+	}
+
+	return i, nil
+}
+
+// ReferencedFiles returns the files that are referenced with ${file:} inside the configuration.
+func (conf *Conf) ReferencedFiles() []string {
+	return conf.referencedFiles
+}
+
+// Clone returns a deep copy of the configuration.
+func (conf *Conf) Clone() *Conf {
+	var dest Conf
+	enc, _ := json.Marshal(conf)
+	_ = json.Unmarshal(enc, &dest)
+
+	dest.secrets = conf.secrets
+	dest.referencedFiles = conf.referencedFiles
+	dest.pathsSet = conf.pathsSet.clone()
+	dest.templatesSet = conf.templatesSet.clone()
+	dest.effectivePaths = conf.effectivePaths
+	return &dest
+}
+
+// Redacted returns the configuration in generic form, in which values
+// obtained from references are replaced, in order not to expose secrets.
+func (conf *Conf) Redacted() (map[string]interface{}, error) {
+	m, err := toGenericMap(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.redact(m)
+	return m, nil
+}
+
+// RedactedPath returns a path configuration in generic form, in which values
+// obtained from references of the configuration are replaced.
+func (conf *Conf) RedactedPath(pconf *PathConf) (map[string]interface{}, error) {
+	m, err := toGenericMap(pconf)
+	if err != nil {
+		return nil, err
+	}
+
+	conf.redact(m)
+	return m, nil
+}
+
+func (conf *Conf) redact(i interface{}) interface{} {
+	if len(conf.secrets) == 0 {
+		return i
+	}
+
+	switch x := i.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = conf.redact(v)
+		}
+
+	case []interface{}:
+		for j, v := range x {
+			x[j] = conf.redact(v)
+		}
+
+	case string:
+		for _, secret := range conf.secrets {
+			x = strings.ReplaceAll(x, secret, redactedValue)
+		}
+		return x
+	}
+
+	return i
+}
+
+// RestoreRedacted replaces, inside parameters sent by a client, values that are
+// equal to the ones returned by Redacted() with the original ones, in order to allow
+// clients to send back a redacted configuration without overwriting secrets.
+// keys is the position of the parameters inside the configuration,
+// i.e. "paths" and the path name when parameters belong to a path.
+func (conf *Conf) RestoreRedacted(in map[string]interface{}, keys ...string) error {
+	if len(conf.secrets) == 0 {
+		return nil
+	}
+
+	orig, err := toGenericMap(conf)
+	if err != nil {
+		return err
+	}
+
+	red, err := toGenericMap(conf)
+	if err != nil {
+		return err
+	}
+	conf.redact(red)
+
+	for _, k := range keys {
+		o, ok1 := orig[k].(map[string]interface{})
+		r, ok2 := red[k].(map[string]interface{})
+		if !ok1 || !ok2 {
+			return nil
+		}
+		orig, red = o, r
+	}
+
+	restoreRedacted(in, orig, red)
+	return nil
+}
+
+func restoreRedacted(in interface{}, orig interface{}, red interface{}) interface{} {
+	switch x := in.(type) {
+	case map[string]interface{}:
+		o, _ := orig.(map[string]interface{})
+		r, _ := red.(map[string]interface{})
+		for k, v := range x {
+			x[k] = restoreRedacted(v, o[k], r[k])
+		}
+
+	case []interface{}:
+		o, _ := orig.([]interface{})
+		r, _ := red.([]interface{})
+		for j, v := range x {
+			if j < len(o) && j < len(r) {
+				x[j] = restoreRedacted(v, o[j], r[j])
+			}
+		}
+
+	case string:
+		if strings.Contains(x, redactedValue) && x == red {
+			return orig
+		}
+	}
+
+	return in
+}
@@ -38,6 +38,9 @@ func IsValidPathName(name string) error {
 type PathConf struct {
 	Regexp *regexp.Regexp `json:"-"`
 
+	// inheritance
+	Extends string `json:"extends"`
+
 	// source
 	Source                     string         `json:"source"`
 	SourceProtocol             SourceProtocol `json:"sourceProtocol"`
@@ -48,6 +51,8 @@ type PathConf struct {
 	SourceOnDemandCloseAfter   StringDuration `json:"sourceOnDemandCloseAfter"`
 	SourceRedirect             string         `json:"sourceRedirect"`
 	DisablePublisherOverride   bool           `json:"disablePublisherOverride"`
+	PublisherStandby           bool           `json:"publisherStandby"`
+	PublisherStandbyTimeout    StringDuration `json:"publisherStandbyTimeout"`
 	Fallback                   string         `json:"fallback"`
 	RPICameraCamID             int            `json:"rpiCameraCamID"`
 	RPICameraWidth             int            `json:"rpiCameraWidth"`
@@ -87,6 +92,12 @@ type PathConf struct {
 	ReadPass    Credential `json:"readPass"`
 	ReadIPs     IPsOrCIDRs `json:"readIPs"`
 
+	// limits
+	MaxReaders           int `json:"maxReaders"`
+	MaxBandwidth         int `json:"maxBandwidth"`
+	ReaderBandwidthLimit int `json:"readerBandwidthLimit"`
+	BandwidthLimit       int `json:"bandwidthLimit"`
+
 	// external commands
 	RunOnInit               string         `json:"runOnInit"`
 	RunOnInitRestart        bool           `json:"runOnInitRestart"`
@@ -96,8 +107,14 @@ type PathConf struct {
 	RunOnDemandCloseAfter   StringDuration `json:"runOnDemandCloseAfter"`
 	RunOnReady              string         `json:"runOnReady"`
 	RunOnReadyRestart       bool           `json:"runOnReadyRestart"`
+	RunOnNotReady           string         `json:"runOnNotReady"`
 	RunOnRead               string         `json:"runOnRead"`
 	RunOnReadRestart        bool           `json:"runOnReadRestart"`
+	RunOnUnread             string         `json:"runOnUnread"`
+
+	// webhooks
+	WebhookURL    string `json:"webhookURL"`
+	WebhookSecret string `json:"webhookSecret"`
 }
 
 func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
@@ -194,11 +211,11 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 				"a path with a regular expression (or path 'all') cannot have 'rpiCamera' as source. use another path")
 		}
 
-		for otherName, otherPath := range conf.Paths {
-			if otherPath != pconf && otherPath != nil &&
+		for otherName, otherPath := range conf.effectivePaths {
+			if otherName != name && otherPath != nil &&
 				otherPath.Source == "rpiCamera" && otherPath.RPICameraCamID == pconf.RPICameraCamID {
 				return fmt.Errorf("'rpiCamera' with same camera ID %d is used as source in two paths, '%s' and '%s'",
-					pconf.RPICameraCamID, name, otherName)
+					pconf.RPICameraCamID, otherName, name)
 			}
 		}
 
@@ -251,6 +268,24 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		pconf.SourceOnDemandCloseAfter = 10 * StringDuration(time.Second)
 	}
 
+	if pconf.PublisherStandby {
+		if pconf.Source != "publisher" {
+			return fmt.Errorf("'publisherStandby' is useless when source is not 'publisher'")
+		}
+
+		if pconf.DisablePublisherOverride {
+			return fmt.Errorf("'publisherStandby' can't be used with 'disablePublisherOverride'")
+		}
+
+		if pconf.RunOnDemand != "" {
+			return fmt.Errorf("'publisherStandby' can't be used with 'runOnDemand'")
+		}
+	}
+
+	if pconf.PublisherStandbyTimeout == 0 {
+		pconf.PublisherStandbyTimeout = 2 * StringDuration(time.Second)
+	}
+
 	if pconf.Fallback != "" {
 		if strings.HasPrefix(pconf.Fallback, "/") {
 			err := IsValidPathName(pconf.Fallback[1:])
@@ -279,6 +314,10 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		return fmt.Errorf("'publishUser' can't be used with 'externalAuthenticationURL'")
 	}
 
+	if pconf.PublishUser != "" && len(conf.AuthInternalUsers) != 0 {
+		return fmt.Errorf("'publishUser' can't be used with 'authInternalUsers'")
+	}
+
 	if len(pconf.PublishIPs) > 0 && pconf.Source != "publisher" {
 		return fmt.Errorf("'publishIPs' is useless when source is not 'publisher', since " +
 			"the stream is not provided by a publisher, but by a fixed source")
@@ -297,10 +336,34 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		return fmt.Errorf("'readUser' can't be used with 'externalAuthenticationURL'")
 	}
 
+	if pconf.ReadUser != "" && len(conf.AuthInternalUsers) != 0 {
+		return fmt.Errorf("'readUser' can't be used with 'authInternalUsers'")
+	}
+
 	if len(pconf.ReadIPs) > 0 && conf.ExternalAuthenticationURL != "" {
 		return fmt.Errorf("'readIPs' can't be used with 'externalAuthenticationURL'")
 	}
 
+	if pconf.MaxReaders < 0 {
+		return fmt.Errorf("'maxReaders' can't be negative")
+	}
+
+	if pconf.MaxBandwidth < 0 {
+		return fmt.Errorf("'maxBandwidth' can't be negative")
+	}
+
+	if pconf.ReaderBandwidthLimit < 0 {
+		return fmt.Errorf("'readerBandwidthLimit' can't be negative")
+	}
+
+	if pconf.ReaderBandwidthLimit == 0 {
+		pconf.ReaderBandwidthLimit = conf.ReaderBandwidthLimit
+	}
+
+	if pconf.BandwidthLimit < 0 {
+		return fmt.Errorf("'bandwidthLimit' can't be negative")
+	}
+
 	if pconf.RunOnInit != "" && pconf.Regexp != nil {
 		return fmt.Errorf("a path with a regular expression does not support option 'runOnInit'; use another path")
 	}
@@ -317,6 +380,16 @@ func (pconf *PathConf) checkAndFillMissing(conf *Conf, name string) error {
 		pconf.RunOnDemandCloseAfter = 10 * StringDuration(time.Second)
 	}
 
+	if pconf.WebhookURL != "" &&
+		!strings.HasPrefix(pconf.WebhookURL, "http://") &&
+		!strings.HasPrefix(pconf.WebhookURL, "https://") {
+		return fmt.Errorf("'webhookURL' must be a HTTP URL")
+	}
+
+	if pconf.WebhookSecret == "" {
+		pconf.WebhookSecret = conf.WebhookSecret
+	}
+
 	return nil
 }
 
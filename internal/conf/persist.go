@@ -0,0 +1,454 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// jsonKeys returns the JSON keys of a struct, in order of declaration.
+func jsonKeys(rt reflect.Type) []string {
+	var ret []string
+	for i := 0; i < rt.NumField(); i++ {
+		key := rt.Field(i).Tag.Get("json")
+		if key != "" && key != "-" {
+			ret = append(ret, key)
+		}
+	}
+	return ret
+}
+
+// normalizeNumbers converts JSON numbers into integers or floats,
+// in order to encode them as YAML numbers.
+func normalizeNumbers(i interface{}) interface{} {
+	switch x := i.(type) {
+	case map[string]interface{}:
+		for k, v := range x {
+			x[k] = normalizeNumbers(v)
+		}
+
+	case []interface{}:
+		for j, v := range x {
+			x[j] = normalizeNumbers(v)
+		}
+
+	case json.Number:
+		if v, err := x.Int64(); err == nil {
+			return v
+		}
+		v, _ := x.Float64()
+		return v
+	}
+
+	return i
+}
+
+// toGenericMap converts a struct into a generic map, using the JSON representation.
+func toGenericMap(v interface{}) (map[string]interface{}, error) {
+	byts, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(byts))
+	dec.UseNumber()
+
+	var m map[string]interface{}
+	err = dec.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+
+	normalizeNumbers(m)
+	return m, nil
+}
+
+func yamlMappingIndex(n *yamlv3.Node, key string) int {
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		if n.Content[i].Value == key {
+			return i + 1
+		}
+	}
+	return -1
+}
+
+func yamlMappingDelete(n *yamlv3.Node, key string) {
+	i := yamlMappingIndex(n, key)
+	if i >= 0 {
+		n.Content = append(n.Content[:i-1], n.Content[i+1:]...)
+	}
+}
+
+// yamlMappingReplace sets the value of a key, preserving comments of the existing value.
+func yamlMappingReplace(n *yamlv3.Node, key string, vn *yamlv3.Node) {
+	n.Style &^= yamlv3.FlowStyle
+
+	i := yamlMappingIndex(n, key)
+	if i < 0 {
+		n.Content = append(n.Content,
+			&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: key},
+			vn)
+		return
+	}
+
+	old := n.Content[i]
+	if vn.LineComment == "" {
+		vn.LineComment = old.LineComment
+	}
+	if vn.FootComment == "" {
+		vn.FootComment = old.FootComment
+	}
+	n.Content[i] = vn
+}
+
+func yamlMappingSet(n *yamlv3.Node, key string, value interface{}) error {
+	var vn yamlv3.Node
+	err := vn.Encode(value)
+	if err != nil {
+		return err
+	}
+
+	yamlMappingReplace(n, key, &vn)
+	return nil
+}
+
+// yamlMappingChild returns the mapping associated with a key, creating it if needed.
+func yamlMappingChild(n *yamlv3.Node, key string) *yamlv3.Node {
+	i := yamlMappingIndex(n, key)
+	if i >= 0 && n.Content[i].Kind == yamlv3.MappingNode {
+		n.Content[i].Style &^= yamlv3.FlowStyle
+		return n.Content[i]
+	}
+
+	child := &yamlv3.Node{Kind: yamlv3.MappingNode, Tag: "!!map"}
+	yamlMappingReplace(n, key, child)
+	return child
+}
+
+// yamlMappingSetChanged sets the values that are different between two generic maps.
+func yamlMappingSetChanged(n *yamlv3.Node, keys []string, cur map[string]interface{}, next map[string]interface{}) error {
+	for _, key := range keys {
+		if !reflect.DeepEqual(cur[key], next[key]) {
+			err := yamlMappingSet(n, key, next[key])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// yamlMappingSetMarked sets the values that are explicitly set in next and not in cur,
+// including the ones that are equal to their zero value.
+func yamlMappingSetMarked(n *yamlv3.Node, keys []string, curKeys map[string]struct{},
+	nextKeys map[string]struct{}, next map[string]interface{},
+) error {
+	for _, key := range keys {
+		_, inNext := nextKeys[key]
+		_, inCur := curKeys[key]
+		if inNext && !inCur && yamlMappingIndex(n, key) < 0 {
+			err := yamlMappingSet(n, key, next[key])
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pathKey returns the key of a path inside the configuration file.
+func pathKey(pathsNode *yamlv3.Node, name string) string {
+	// "all" is an alias for "~^.*$"
+	if name == "~^.*$" && yamlMappingIndex(pathsNode, name) < 0 &&
+		yamlMappingIndex(pathsNode, "all") >= 0 {
+		return "all"
+	}
+	return name
+}
+
+// Encode encodes the configuration in order to write it into fpath.
+// The existing file is used as base: only parameters that have been changed
+// are overwritten, while the other parameters and comments are preserved.
+// Parameters are compared with the ones in the file after applying environment
+// variables, therefore values coming from environment variables are not written.
+// If RTSP_CONFKEY is set and the existing file is encrypted, entirely or value by value,
+// the result is encrypted in the same way; plain files are left plain.
+func (conf *Conf) Encode(fpath string) ([]byte, error) {
+	raw, _, err := readFile(fpath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	cur := &Conf{}
+	var included map[string]string
+	if raw != nil {
+		err = loadFromYAML(raw, cur)
+		if err != nil {
+			return nil, err
+		}
+
+		included, err = loadIncludes(fpath, cur)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = loadConfFromEnvironment("RTSP", cur)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cur.CheckAndFillMissing()
+	if err != nil {
+		return nil, err
+	}
+
+	var doc yamlv3.Node
+	if len(bytes.TrimSpace(raw)) != 0 {
+		err = yamlv3.Unmarshal(raw, &doc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 {
+		doc = yamlv3.Node{Kind: yamlv3.DocumentNode}
+		doc.Content = []*yamlv3.Node{{Kind: yamlv3.MappingNode, Tag: "!!map"}}
+	}
+
+	root := doc.Content[0]
+	if root.Kind != yamlv3.MappingNode {
+		return nil, fmt.Errorf("configuration file is not a map")
+	}
+
+	curMap, err := toGenericMap(cur)
+	if err != nil {
+		return nil, err
+	}
+
+	nextMap, err := toGenericMap(conf)
+	if err != nil {
+		return nil, err
+	}
+
+	var keys []string
+	for _, key := range jsonKeys(reflect.TypeOf(Conf{})) {
+		if key != "pathDefaults" && key != "pathTemplates" && key != "paths" {
+			keys = append(keys, key)
+		}
+	}
+
+	err = yamlMappingSetChanged(root, keys, curMap, nextMap)
+	if err != nil {
+		return nil, err
+	}
+
+	pathKeys := jsonKeys(reflect.TypeOf(PathConf{}))
+
+	curDefaults, _ := curMap["pathDefaults"].(map[string]interface{})
+	nextDefaults, _ := nextMap["pathDefaults"].(map[string]interface{})
+
+	if !reflect.DeepEqual(curDefaults, nextDefaults) {
+		err := yamlMappingSetChanged(yamlMappingChild(root, "pathDefaults"), pathKeys, curDefaults, nextDefaults)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	curTemplates, _ := curMap["pathTemplates"].(map[string]interface{})
+	nextTemplates, _ := nextMap["pathTemplates"].(map[string]interface{})
+
+	if !reflect.DeepEqual(curTemplates, nextTemplates) ||
+		!reflect.DeepEqual(cur.templatesSet, conf.templatesSet) {
+		templatesNode := yamlMappingChild(root, "pathTemplates")
+
+		for name := range curTemplates {
+			if _, ok := nextTemplates[name]; !ok {
+				yamlMappingDelete(templatesNode, name)
+			}
+		}
+
+		templateNames := make([]string, 0, len(nextTemplates))
+		for name := range nextTemplates {
+			templateNames = append(templateNames, name)
+		}
+		sort.Strings(templateNames)
+
+		emptyTemplate, _ := toGenericMap(&PathConf{})
+
+		for _, name := range templateNames {
+			nextTemplate, _ := nextTemplates[name].(map[string]interface{})
+
+			curTemplate, ok := curTemplates[name].(map[string]interface{})
+			if !ok {
+				curTemplate = emptyTemplate
+			} else if reflect.DeepEqual(curTemplate, nextTemplate) &&
+				reflect.DeepEqual(cur.templatesSet[name], conf.templatesSet[name]) {
+				continue
+			}
+
+			templateNode := yamlMappingChild(templatesNode, name)
+
+			err := yamlMappingSetChanged(templateNode, pathKeys, curTemplate, nextTemplate)
+			if err != nil {
+				return nil, err
+			}
+
+			err = yamlMappingSetMarked(templateNode, pathKeys, cur.templatesSet[name],
+				conf.templatesSet[name], nextTemplate)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	curPaths, _ := curMap["paths"].(map[string]interface{})
+	nextPaths, _ := nextMap["paths"].(map[string]interface{})
+
+	if !reflect.DeepEqual(curPaths, nextPaths) ||
+		!reflect.DeepEqual(cur.pathsSet, conf.pathsSet) {
+		pathsNode := yamlMappingChild(root, "paths")
+
+		for name := range curPaths {
+			if _, ok := nextPaths[name]; !ok {
+				if src, ok := included[name]; ok {
+					return nil, fmt.Errorf("path '%s' is defined in included file %s and can't be removed", name, src)
+				}
+				yamlMappingDelete(pathsNode, pathKey(pathsNode, name))
+			}
+		}
+
+		emptyPath, _ := toGenericMap(&PathConf{})
+
+		names := make([]string, 0, len(nextPaths))
+		for name := range nextPaths {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			nextPath, _ := nextPaths[name].(map[string]interface{})
+
+			// new paths are compared with an empty path, since parameters
+			// that are not set are not written
+			curPath, ok := curPaths[name].(map[string]interface{})
+			if !ok {
+				curPath = emptyPath
+			} else if reflect.DeepEqual(curPath, nextPath) &&
+				reflect.DeepEqual(cur.pathsSet[name], conf.pathsSet[name]) {
+				continue
+			}
+
+			if src, ok := included[name]; ok {
+				return nil, fmt.Errorf("path '%s' is defined in included file %s and can't be changed", name, src)
+			}
+
+			pathNode := yamlMappingChild(pathsNode, pathKey(pathsNode, name))
+
+			err := yamlMappingSetChanged(pathNode, pathKeys, curPath, nextPath)
+			if err != nil {
+				return nil, err
+			}
+
+			err = yamlMappingSetMarked(pathNode, pathKeys, cur.pathsSet[name], conf.pathsSet[name], nextPath)
+			if err != nil {
+				return nil, err
+			}
+
+			// paths without parameters are written as empty
+			if len(pathNode.Content) == 0 {
+				yamlMappingReplace(pathsNode, pathKey(pathsNode, name),
+					&yamlv3.Node{Kind: yamlv3.ScalarNode, Tag: "!!null"})
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err = enc.Encode(&doc)
+	if err != nil {
+		return nil, err
+	}
+	enc.Close()
+
+	byts := buf.Bytes()
+
+	// make sure that the result can be loaded
+	err = loadFromYAML(byts, &Conf{})
+	if err != nil {
+		return nil, err
+	}
+
+	if key, ok := os.LookupEnv("RTSP_CONFKEY"); ok {
+		// keep the encryption of the existing file
+		orig, _ := os.ReadFile(fpath)
+		switch {
+		case isEncryptedFile(orig):
+			byts, err = encrypt(key, byts)
+
+		case hasEncryptedValues(orig):
+			byts, err = encryptSecrets(key, byts)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return byts, nil
+}
+
+// WriteFile writes a configuration file atomically, by writing a temporary file
+// and renaming it, in order not to leave a partially-written file in case of failures.
+func WriteFile(fpath string, byts []byte) error {
+	// replace the target of symlinks, not the symlinks themselves
+	if p, err := filepath.EvalSymlinks(fpath); err == nil {
+		fpath = p
+	}
+
+	perm := os.FileMode(0o644)
+	if fi, err := os.Stat(fpath); err == nil {
+		perm = fi.Mode().Perm()
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(fpath), "."+filepath.Base(fpath)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := f.Name()
+
+	err = func() error {
+		defer f.Close()
+
+		_, err := f.Write(byts)
+		if err != nil {
+			return err
+		}
+
+		err = f.Chmod(perm)
+		if err != nil {
+			return err
+		}
+
+		return f.Sync()
+	}()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = os.Rename(tmpPath, fpath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package conf
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// remoteForbiddenParams are the parameters that can only be set in the local configuration.
+var remoteForbiddenParams = map[string]struct{}{
+	"confURL":          {},
+	"confURLInterval":  {},
+	"confURLLongPoll":  {},
+	"confURLPublicKey": {},
+	"confURLCacheFile": {},
+	"include":          {},
+	"apiPersistConf":   {},
+}
+
+// loadFromRemote overrides parameters with the ones of a remote configuration.
+// References are not resolved, in order not to expose local files and
+// environment variables to the remote server.
+func loadFromRemote(byts []byte, conf *Conf) error {
+	var temp map[string]interface{}
+	err := yaml.Unmarshal(byts, &temp)
+	if err != nil {
+		return err
+	}
+
+	for k := range temp {
+		if _, ok := remoteForbiddenParams[k]; ok {
+			return fmt.Errorf("'%s' can't be set remotely", k)
+		}
+	}
+
+	return loadYAML(byts, conf, false)
+}
+
+func decodePublicKey(s string) (ed25519.PublicKey, error) {
+	byts, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(byts) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("key must be a base64-encoded Ed25519 public key")
+	}
+
+	return ed25519.PublicKey(byts), nil
+}
+
+// RemoteSignedContent returns the content that is signed by the server
+// that provides a remote configuration, that is the version of the configuration,
+// followed by a newline and by the configuration itself.
+// The version prevents older configurations from being replayed.
+func RemoteSignedContent(version uint64, byts []byte) []byte {
+	return append([]byte(strconv.FormatUint(version, 10)+"\n"), byts...)
+}
+
+// VerifyRemote checks the signature of a remote configuration.
+// The signature is a base64-encoded Ed25519 signature of RemoteSignedContent().
+func VerifyRemote(publicKey string, version uint64, byts []byte, signature string) error {
+	key, err := decodePublicKey(publicKey)
+	if err != nil {
+		return err
+	}
+
+	if signature == "" {
+		return fmt.Errorf("signature is missing")
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+
+	if !ed25519.Verify(key, RemoteSignedContent(version, byts), sig) {
+		return fmt.Errorf("signature doesn't match")
+	}
+
+	return nil
+}
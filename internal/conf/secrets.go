@@ -0,0 +1,218 @@
+package conf
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// encryptedValuePrefix is the prefix of values that are encrypted one by one.
+const encryptedValuePrefix = "enc:"
+
+// secretParams are the parameters that are encrypted when only secrets are encrypted.
+var secretParams = map[string]struct{}{
+	"externalAuthenticationBearerToken": {},
+	"signedURLSecret":                   {},
+	"webhookSecret":                     {},
+	"user":                              {}, // authInternalUsers
+	"pass":                              {}, // authInternalUsers
+	"token":                             {}, // authInternalUsers
+	"publishUser":                       {},
+	"publishPass":                       {},
+	"readUser":                          {},
+	"readPass":                          {},
+}
+
+// urlParams are the parameters that are encrypted when only secrets are encrypted,
+// if they contain a URL, since URLs can contain credentials and tokens.
+var urlParams = map[string]struct{}{
+	"source":                    {},
+	"externalAuthenticationURL": {},
+	"webhookURL":                {},
+}
+
+// isSecret checks whether a value must be encrypted when only secrets are encrypted.
+func isSecret(key string, value string) bool {
+	if _, ok := secretParams[key]; ok {
+		return true
+	}
+
+	if _, ok := urlParams[key]; ok {
+		return strings.Contains(value, "://")
+	}
+
+	return false
+}
+
+// isEncryptedFile checks whether the whole content of a configuration file is encrypted.
+func isEncryptedFile(byts []byte) bool {
+	enc, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(byts)))
+	return err == nil && len(enc) > 24
+}
+
+// walkScalars calls cb for every scalar value of a YAML node, together with its key.
+func walkScalars(n *yamlv3.Node, key string, cb func(key string, n *yamlv3.Node) error) error {
+	switch n.Kind {
+	case yamlv3.DocumentNode, yamlv3.SequenceNode:
+		for _, c := range n.Content {
+			err := walkScalars(c, key, cb)
+			if err != nil {
+				return err
+			}
+		}
+
+	case yamlv3.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			err := walkScalars(n.Content[i+1], n.Content[i].Value, cb)
+			if err != nil {
+				return err
+			}
+		}
+
+	case yamlv3.ScalarNode:
+		return cb(key, n)
+	}
+
+	return nil
+}
+
+func encodeYAML(doc *yamlv3.Node) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yamlv3.NewEncoder(&buf)
+	enc.SetIndent(2)
+	err := enc.Encode(doc)
+	if err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return buf.Bytes(), nil
+}
+
+// encryptSecrets encrypts the values of secret parameters, leaving the rest of the file in plain text.
+func encryptSecrets(key string, byts []byte) ([]byte, error) {
+	var doc yamlv3.Node
+	err := yamlv3.Unmarshal(byts, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	err = walkScalars(&doc, "", func(k string, n *yamlv3.Node) error {
+		if !isSecret(k, n.Value) || n.Value == "" ||
+			strings.HasPrefix(n.Value, encryptedValuePrefix) {
+			return nil
+		}
+
+		enc, err := encrypt(key, []byte(n.Value))
+		if err != nil {
+			return err
+		}
+
+		n.Value = encryptedValuePrefix + string(enc)
+		n.Tag = "!!str"
+		n.Style = 0
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return encodeYAML(&doc)
+}
+
+// hasEncryptedValues checks whether a configuration file contains values encrypted one by one.
+func hasEncryptedValues(byts []byte) bool {
+	return bytes.Contains(byts, []byte(encryptedValuePrefix))
+}
+
+// decryptValues decrypts values that are encrypted one by one.
+func decryptValues(key string, byts []byte) ([]byte, error) {
+	if !hasEncryptedValues(byts) {
+		return byts, nil
+	}
+
+	var doc yamlv3.Node
+	err := yamlv3.Unmarshal(byts, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	found := false
+
+	err = walkScalars(&doc, "", func(k string, n *yamlv3.Node) error {
+		if !strings.HasPrefix(n.Value, encryptedValuePrefix) {
+			return nil
+		}
+
+		if key == "" {
+			return fmt.Errorf("'%s' is encrypted, but RTSP_CONFKEY is not set", k)
+		}
+
+		dec, err := decrypt(key, []byte(n.Value[len(encryptedValuePrefix):]))
+		if err != nil {
+			return fmt.Errorf("unable to decrypt '%s': %s", k, err)
+		}
+
+		n.Value = string(dec)
+		found = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found {
+		return byts, nil
+	}
+
+	return encodeYAML(&doc)
+}
+
+// EncryptFile encrypts a configuration file with a key.
+// If secretsOnly is true, only values of parameters that contain
+// credentials or secrets are encrypted.
+func EncryptFile(key string, byts []byte, secretsOnly bool) ([]byte, error) {
+	if isEncryptedFile(byts) {
+		return nil, fmt.Errorf("file is already encrypted")
+	}
+
+	if secretsOnly {
+		return encryptSecrets(key, byts)
+	}
+
+	byts, err := decryptValues(key, byts)
+	if err != nil {
+		return nil, err
+	}
+
+	enc, err := encrypt(key, byts)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(enc, '\n'), nil
+}
+
+// DecryptFile decrypts a configuration file that is entirely encrypted or
+// that contains values encrypted one by one.
+func DecryptFile(key string, byts []byte) ([]byte, error) {
+	if isEncryptedFile(byts) {
+		if key == "" {
+			return nil, fmt.Errorf("file is encrypted, but RTSP_CONFKEY is not set")
+		}
+		return decrypt(key, byts)
+	}
+	return decryptValues(key, byts)
+}
+
+// ConfKey returns the key that is used to encrypt and decrypt configuration files.
+func ConfKey() (string, error) {
+	key, ok := os.LookupEnv("RTSP_CONFKEY")
+	if !ok || key == "" {
+		return "", fmt.Errorf("RTSP_CONFKEY is not set")
+	}
+	return key, nil
+}
@@ -0,0 +1,446 @@
+package conf
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"regexp"
+	"sort"
+
+	"github.com/aler9/gortsplib/v2"
+	yamlv3 "gopkg.in/yaml.v3"
+)
+
+// ValidationMessage is an error or a warning found by Validate.
+type ValidationMessage struct {
+	// line of the configuration file, or zero when the message is not
+	// related to a specific line.
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func (m ValidationMessage) String() string {
+	if m.Line == 0 {
+		return m.Message
+	}
+	return fmt.Sprintf("line %d: %s", m.Line, m.Message)
+}
+
+// ValidationResult is the result of Validate.
+type ValidationResult struct {
+	Errors   []ValidationMessage `json:"errors"`
+	Warnings []ValidationMessage `json:"warnings"`
+}
+
+// OK returns whether the configuration has no errors.
+func (r *ValidationResult) OK() bool {
+	return len(r.Errors) == 0
+}
+
+func (r *ValidationResult) addError(line int, format string, args ...interface{}) {
+	r.Errors = append(r.Errors, ValidationMessage{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+func (r *ValidationResult) addWarning(line int, format string, args ...interface{}) {
+	r.Warnings = append(r.Warnings, ValidationMessage{Line: line, Message: fmt.Sprintf(format, args...)})
+}
+
+var reQuotedParam = regexp.MustCompile(`^'([a-zA-Z0-9]+)'`)
+
+// validator checks a configuration file, collecting all errors instead of
+// stopping at the first one.
+type validator struct {
+	res  ValidationResult
+	root *yamlv3.Node
+}
+
+// line returns the line of a key of the root mapping, or of a key of a sub-mapping.
+func (v *validator) line(keys ...string) int {
+	n := v.root
+	line := 0
+
+	for _, key := range keys {
+		if n == nil || n.Kind != yamlv3.MappingNode {
+			return line
+		}
+
+		i := yamlMappingIndex(n, key)
+		if i < 0 {
+			return line
+		}
+
+		line = n.Content[i-1].Line
+		n = n.Content[i]
+	}
+
+	return line
+}
+
+// pathLine returns the line of a path.
+func (v *validator) pathLine(name string) int {
+	// "all" is an alias for "~^.*$"
+	if l := v.line("paths", name); l != 0 || name != "~^.*$" {
+		return l
+	}
+	return v.line("paths", "all")
+}
+
+// errorLine returns the line of the parameter mentioned at the beginning of an error, if any.
+func (v *validator) errorLine(err error, keys ...string) int {
+	if m := reQuotedParam.FindStringSubmatch(err.Error()); m != nil {
+		if l := v.line(append(keys, m[1])...); l != 0 {
+			return l
+		}
+	}
+	return v.line(keys...)
+}
+
+// resetParam resets the parameter mentioned at the beginning of an error.
+func resetParam(conf *Conf, err error) bool {
+	m := reQuotedParam.FindStringSubmatch(err.Error())
+	if m == nil {
+		return false
+	}
+
+	rv := reflect.ValueOf(conf).Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		if rt.Field(i).Tag.Get("json") == m[1] {
+			f := rv.Field(i)
+			if f.IsZero() {
+				return false
+			}
+			f.Set(reflect.Zero(f.Type()))
+			return true
+		}
+	}
+
+	return false
+}
+
+// loadParam loads a single parameter, wrapped into its parents, into a Conf.
+func loadParam(conf *Conf, value *yamlv3.Node, keys ...string) error {
+	n := value
+	for i := len(keys) - 1; i >= 0; i-- {
+		n = &yamlv3.Node{
+			Kind: yamlv3.MappingNode,
+			Tag:  "!!map",
+			Content: []*yamlv3.Node{
+				{Kind: yamlv3.ScalarNode, Tag: "!!str", Value: keys[i]},
+				n,
+			},
+		}
+	}
+
+	byts, err := yamlv3.Marshal(n)
+	if err != nil {
+		return err
+	}
+
+	return loadFromYAML(byts, conf)
+}
+
+// loadMapping loads the parameters of a mapping one by one, in order to find all
+// invalid parameters. Invalid parameters are reported and removed from the mapping.
+func (v *validator) loadMapping(n *yamlv3.Node, keys ...string) {
+	var content []*yamlv3.Node
+
+	for i := 0; i+1 < len(n.Content); i += 2 {
+		kn, vn := n.Content[i], n.Content[i+1]
+
+		err := loadParam(&Conf{}, vn, append(keys, kn.Value)...)
+		if err != nil {
+			v.res.addError(kn.Line, "%s", err)
+			continue
+		}
+
+		content = append(content, kn, vn)
+	}
+
+	n.Content = content
+}
+
+func (v *validator) load(byts []byte) *Conf {
+	var doc yamlv3.Node
+	err := yamlv3.Unmarshal(byts, &doc)
+	if err != nil {
+		v.res.addError(0, "%s", err)
+		return nil
+	}
+
+	if doc.Kind != yamlv3.DocumentNode || len(doc.Content) == 0 {
+		return &Conf{}
+	}
+
+	v.root = doc.Content[0]
+	if v.root.Kind != yamlv3.MappingNode {
+		v.res.addError(v.root.Line, "configuration file is not a map")
+		return nil
+	}
+
+	// load a copy of the file, from which invalid parameters are removed
+	var clean yamlv3.Node
+	err = yamlv3.Unmarshal(byts, &clean)
+	if err != nil {
+		v.res.addError(0, "%s", err)
+		return nil
+	}
+	root := clean.Content[0]
+
+	var content []*yamlv3.Node
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		kn, vn := root.Content[i], root.Content[i+1]
+
+		switch {
+		case kn.Value == "pathDefaults" && vn.Kind == yamlv3.MappingNode:
+			v.loadMapping(vn, kn.Value)
+
+		case (kn.Value == "paths" || kn.Value == "pathTemplates") && vn.Kind == yamlv3.MappingNode:
+			for j := 0; j+1 < len(vn.Content); j += 2 {
+				if vn.Content[j+1].Kind == yamlv3.MappingNode {
+					v.loadMapping(vn.Content[j+1], kn.Value, vn.Content[j].Value)
+				}
+			}
+		}
+
+		err := loadParam(&Conf{}, vn, kn.Value)
+		if err != nil {
+			v.res.addError(kn.Line, "%s", err)
+			continue
+		}
+
+		content = append(content, kn, vn)
+	}
+
+	root.Content = content
+
+	cleanByts, err := yamlv3.Marshal(&clean)
+	if err != nil {
+		v.res.addError(0, "%s", err)
+		return nil
+	}
+
+	conf := &Conf{}
+	err = loadFromYAML(cleanByts, conf)
+	if err != nil {
+		v.res.addError(0, "%s", err)
+		return nil
+	}
+
+	return conf
+}
+
+// check performs the checks of CheckAndFillMissing, collecting all errors.
+func (v *validator) check(conf *Conf) {
+	paths := conf.Paths
+
+	// when an error is about a parameter, reset the parameter and check again,
+	// in order to find the remaining errors.
+	for {
+		conf.Paths = nil
+
+		err := conf.CheckAndFillMissing()
+		if err == nil {
+			break
+		}
+
+		v.res.addError(v.errorLine(err), "%s", err)
+
+		if !resetParam(conf, err) {
+			break
+		}
+	}
+
+	conf.Paths = paths
+	if conf.Paths == nil {
+		conf.Paths = make(map[string]*PathConf)
+	}
+
+	conf.normalizePathNames()
+
+	names := make([]string, 0, len(conf.Paths))
+	for name := range conf.Paths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	conf.effectivePaths = make(map[string]*PathConf, len(conf.Paths))
+
+	for _, name := range names {
+		pconf, err := conf.mergedPath(name)
+		if err == nil {
+			err = pconf.checkAndFillMissing(conf, name)
+			if err != nil {
+				err = fmt.Errorf("path '%s': %s", name, err)
+			}
+		}
+		if err != nil {
+			v.res.addError(v.pathLine(name), "%s", err)
+			continue
+		}
+
+		conf.effectivePaths[name] = pconf
+	}
+}
+
+type validatorListener struct {
+	param   string
+	address string
+	network string
+}
+
+func listeners(conf *Conf) []validatorListener {
+	var ret []validatorListener
+
+	add := func(enabled bool, param string, address string, network string) {
+		if enabled && address != "" {
+			ret = append(ret, validatorListener{param, address, network})
+		}
+	}
+
+	rtsp := !conf.RTSPDisable && conf.Encryption != EncryptionStrict
+	rtsps := !conf.RTSPDisable && conf.Encryption != EncryptionNo
+	_, useUDP := conf.Protocols[Protocol(gortsplib.TransportUDP)]
+	add(rtsp, "rtspAddress", conf.RTSPAddress, "tcp")
+	add(rtsp && useUDP, "rtpAddress", conf.RTPAddress, "udp")
+	add(rtsp && useUDP, "rtcpAddress", conf.RTCPAddress, "udp")
+	add(rtsps, "rtspsAddress", conf.RTSPSAddress, "tcp")
+
+	add(!conf.RTMPDisable && conf.RTMPEncryption != EncryptionStrict, "rtmpAddress", conf.RTMPAddress, "tcp")
+	add(!conf.RTMPDisable && conf.RTMPEncryption != EncryptionNo, "rtmpsAddress", conf.RTMPSAddress, "tcp")
+	add(!conf.HLSDisable, "hlsAddress", conf.HLSAddress, "tcp")
+	add(!conf.WebRTCDisable, "webrtcAddress", conf.WebRTCAddress, "tcp")
+	add(!conf.WebRTCDisable, "webrtcICEUDPMuxAddress", conf.WebRTCICEUDPMuxAddress, "udp")
+	add(!conf.WebRTCDisable, "webrtcICETCPMuxAddress", conf.WebRTCICETCPMuxAddress, "tcp")
+	add(conf.API, "apiAddress", conf.APIAddress, "tcp")
+	add(conf.Metrics, "metricsAddress", conf.MetricsAddress, "tcp")
+	add(conf.PPROF, "pprofAddress", conf.PPROFAddress, "tcp")
+
+	return ret
+}
+
+func isUnspecifiedHost(host string) bool {
+	if host == "" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// checkPortConflicts warns about listeners that use the same port.
+func (v *validator) checkPortConflicts(conf *Conf) {
+	ls := listeners(conf)
+
+	for i, l1 := range ls {
+		host1, port1, err := net.SplitHostPort(l1.address)
+		if err != nil {
+			v.res.addWarning(v.line(l1.param), "'%s' is not a valid address (%s)", l1.param, l1.address)
+			continue
+		}
+
+		for _, l2 := range ls[i+1:] {
+			host2, port2, err := net.SplitHostPort(l2.address)
+			if err != nil {
+				continue
+			}
+
+			if l1.network == l2.network && port1 == port2 &&
+				(host1 == host2 || isUnspecifiedHost(host1) || isUnspecifiedHost(host2)) {
+				line := v.line(l2.param)
+				if line == 0 {
+					line = v.line(l1.param)
+				}
+				v.res.addWarning(line, "'%s' and '%s' use the same port (%s/%s)",
+					l1.param, l2.param, port1, l1.network)
+			}
+		}
+	}
+}
+
+// checkShadowedPaths warns about paths whose parameters are not applied
+// to streams because another path matches them first.
+func (v *validator) checkShadowedPaths(conf *Conf) {
+	var names []string
+	var regexpNames []string
+	for name, pconf := range conf.effectivePaths {
+		if pconf.Regexp != nil {
+			regexpNames = append(regexpNames, name)
+		} else {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	sort.Strings(regexpNames)
+
+	// paths with a fixed name have priority over regular expressions
+	for _, name := range names {
+		for _, rname := range regexpNames {
+			if conf.effectivePaths[rname].Regexp.MatchString(name) {
+				v.res.addWarning(v.pathLine(name),
+					"path '%s' is also matched by '%s'; parameters of '%s' (like source) are not applied to it",
+					name, rname, rname)
+			}
+		}
+	}
+
+	// the regular expression that is used, among the ones that match a path, is not defined
+	for i, rname1 := range regexpNames {
+		for _, rname2 := range regexpNames[i+1:] {
+			re1 := conf.effectivePaths[rname1].Regexp
+			re2 := conf.effectivePaths[rname2].Regexp
+			prefix1, _ := re1.LiteralPrefix()
+			prefix2, _ := re2.LiteralPrefix()
+
+			if re1.MatchString(prefix2) || re2.MatchString(prefix1) {
+				v.res.addWarning(v.pathLine(rname2),
+					"paths '%s' and '%s' can match the same streams; the one used for a stream is not defined",
+					rname1, rname2)
+			}
+		}
+	}
+}
+
+// Validate checks a configuration, collecting all errors and warnings.
+// Environment variables and included files are applied as in Load.
+// fpath is used to find included files.
+func Validate(byts []byte, fpath string) *ValidationResult {
+	v := &validator{}
+
+	conf := v.load(byts)
+	if conf == nil {
+		return &v.res
+	}
+
+	_, err := loadIncludes(fpath, conf)
+	if err != nil {
+		v.res.addError(v.line("include"), "%s", err)
+	}
+
+	err = loadConfFromEnvironment("RTSP", conf)
+	if err != nil {
+		v.res.addError(0, "%s", err)
+	}
+
+	v.check(conf)
+	v.checkPortConflicts(conf)
+	v.checkShadowedPaths(conf)
+
+	return &v.res
+}
+
+// ValidateFile checks a configuration file, collecting all errors and warnings.
+func ValidateFile(fpath string) *ValidationResult {
+	byts, found, err := readFile(fpath)
+	if err != nil || !found {
+		res := &ValidationResult{}
+		if err == nil {
+			err = fmt.Errorf("file not found: %s", fpath)
+		}
+		res.addError(0, "%s", err)
+		return res
+	}
+
+	return Validate(byts, fpath)
+}
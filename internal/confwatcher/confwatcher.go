@@ -2,8 +2,12 @@
 package confwatcher
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
@@ -19,6 +23,12 @@ type ConfWatcher struct {
 	inner       *fsnotify.Watcher
 	watchedPath string
 
+	mutex         sync.Mutex
+	ignoredHash   []byte
+	watchedDirs   map[string]struct{}
+	includes      []string
+	includedFiles map[string]string
+
 	// out
 	signal chan struct{}
 	done   chan struct{}
@@ -48,6 +58,7 @@ func New(confPath string) (*ConfWatcher, error) {
 	w := &ConfWatcher{
 		inner:       inner,
 		watchedPath: absolutePath,
+		watchedDirs: map[string]struct{}{parentPath: {}},
 		signal:      make(chan struct{}),
 		done:        make(chan struct{}),
 	}
@@ -84,6 +95,8 @@ outer:
 			currentWatchedPath, _ := filepath.EvalSymlinks(w.watchedPath)
 			eventPath, _ := filepath.Abs(event.Name)
 
+			mainChanged := false
+
 			if currentWatchedPath == "" {
 				// watched file was removed; wait for write event to trigger reload
 				previousWatchedPath = ""
@@ -91,9 +104,19 @@ outer:
 				(eventPath == currentWatchedPath &&
 					((event.Op&fsnotify.Write) == fsnotify.Write ||
 						(event.Op&fsnotify.Create) == fsnotify.Create)) {
+				previousWatchedPath = currentWatchedPath
+				mainChanged = true
+			}
+
+			includesChanged := w.includesChanged(eventPath, event.Op)
+
+			if mainChanged || includesChanged {
 				// wait some additional time to allow the writer to complete its job
 				time.Sleep(additionalWait)
-				previousWatchedPath = currentWatchedPath
+
+				if !includesChanged && w.isIgnored() {
+					continue
+				}
 
 				lastCalled = time.Now()
 				w.signal <- struct{}{}
@@ -107,6 +130,109 @@ outer:
 	close(w.signal)
 }
 
+// SetIncludes sets the patterns of included files.
+// Files that match the patterns are watched too, and adding or removing
+// a file that matches the patterns is considered a change.
+func (w *ConfWatcher) SetIncludes(patterns []string) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	for _, pattern := range patterns {
+		dir := filepath.Dir(pattern)
+		if _, ok := w.watchedDirs[dir]; ok {
+			continue
+		}
+
+		err := w.inner.Add(dir)
+		if err != nil {
+			return err
+		}
+		w.watchedDirs[dir] = struct{}{}
+	}
+
+	w.includes = patterns
+	w.includedFiles = matchIncludes(patterns)
+	return nil
+}
+
+// matchIncludes returns the files that match the patterns, with their symlink targets.
+func matchIncludes(patterns []string) map[string]string {
+	ret := make(map[string]string)
+	for _, pattern := range patterns {
+		matches, _ := filepath.Glob(pattern)
+		for _, match := range matches {
+			ret[match], _ = filepath.EvalSymlinks(match)
+		}
+	}
+	return ret
+}
+
+// includesChanged checks whether an event changed the included files.
+func (w *ConfWatcher) includesChanged(eventPath string, op fsnotify.Op) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.includes) == 0 {
+		return false
+	}
+
+	files := matchIncludes(w.includes)
+	changed := !reflect.DeepEqual(files, w.includedFiles)
+	w.includedFiles = files
+
+	if changed {
+		return true
+	}
+
+	if op == fsnotify.Chmod {
+		return false
+	}
+
+	for match, target := range files {
+		if eventPath == match || eventPath == target {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IgnoreWrite sets the content of a write that is going to be performed by
+// the caller, that must not be notified as a change.
+// It must be called before writing the file.
+func (w *ConfWatcher) IgnoreWrite(byts []byte) {
+	h := sha256.Sum256(byts)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.ignoredHash = h[:]
+}
+
+// isIgnored checks whether the file contains the content passed to IgnoreWrite().
+func (w *ConfWatcher) isIgnored() bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.ignoredHash == nil {
+		return false
+	}
+
+	byts, err := os.ReadFile(w.watchedPath)
+	if err != nil {
+		return false
+	}
+
+	h := sha256.Sum256(byts)
+	if bytes.Equal(h[:], w.ignoredHash) {
+		return true
+	}
+
+	// the file has been changed by someone else
+	w.ignoredHash = nil
+	return false
+}
+
 // Watch returns a channel that is called after the configuration file has changed.
 func (w *ConfWatcher) Watch() chan struct{} {
 	return w.signal
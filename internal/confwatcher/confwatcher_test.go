@@ -2,6 +2,7 @@ package confwatcher
 
 import (
 	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
@@ -153,3 +154,83 @@ func TestSymlinkDeleteCreate(t *testing.T) {
 		return
 	}
 }
+
+func TestIgnoreWrite(t *testing.T) {
+	fpath, err := writeTempFile([]byte("{}"))
+	require.NoError(t, err)
+	defer os.Remove(fpath)
+
+	w, err := New(fpath)
+	require.NoError(t, err)
+	defer w.Close()
+
+	w.IgnoreWrite([]byte("paths:\n"))
+
+	err = os.WriteFile(fpath, []byte("paths:\n"), 0o644)
+	require.NoError(t, err)
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-w.Watch():
+		t.Errorf("should not happen")
+		return
+	}
+
+	err = os.WriteFile(fpath, []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	select {
+	case <-w.Watch():
+	case <-time.After(500 * time.Millisecond):
+		t.Errorf("timed out")
+		return
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir, err := os.MkdirTemp("", "confwatcher-")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	fpath := filepath.Join(dir, "main.yml")
+	err = os.WriteFile(fpath, []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	err = os.Mkdir(filepath.Join(dir, "conf.d"), 0o755)
+	require.NoError(t, err)
+
+	err = os.WriteFile(filepath.Join(dir, "conf.d", "a.yml"), []byte("{}"), 0o644)
+	require.NoError(t, err)
+
+	w, err := New(fpath)
+	require.NoError(t, err)
+	defer w.Close()
+
+	err = w.SetIncludes([]string{filepath.Join(dir, "conf.d", "*.yml")})
+	require.NoError(t, err)
+
+	for _, fname := range []string{"a.yml", "b.yml"} {
+		err = os.WriteFile(filepath.Join(dir, "conf.d", fname), []byte("paths:\n"), 0o644)
+		require.NoError(t, err)
+
+		select {
+		case <-w.Watch():
+		case <-time.After(500 * time.Millisecond):
+			t.Errorf("timed out")
+			return
+		}
+
+		// wait for the minimum interval between signals
+		time.Sleep(1 * time.Second)
+	}
+
+	// files that don't match the patterns are not watched
+	err = os.WriteFile(filepath.Join(dir, "conf.d", "c.txt"), []byte("paths:\n"), 0o644)
+	require.NoError(t, err)
+
+	select {
+	case <-time.After(500 * time.Millisecond):
+	case <-w.Watch():
+		t.Errorf("should not happen")
+	}
+}
@@ -3,18 +3,42 @@ package core
 import (
 	"context"
 	"encoding/json"
-	"log"
-	"net"
+	"fmt"
 	"net/http"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/gin-gonic/gin"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+const (
+	// interval between comments sent to keep the event stream alive.
+	apiEventsKeepaliveInterval = 15 * time.Second
+)
+
+type apiExternalCmdsListItem struct {
+	Name         string              `json:"name"`
+	Path         string              `json:"path"`
+	Cmd          string              `json:"cmd"`
+	Created      time.Time           `json:"created"`
+	Running      bool                `json:"running"`
+	PID          int                 `json:"pid"`
+	Uptime       conf.StringDuration `json:"uptime"`
+	Restarts     int                 `json:"restarts"`
+	LastExitCode *int                `json:"lastExitCode"`
+}
+
+type apiExternalCmdsListData struct {
+	Items map[string]apiExternalCmdsListItem `json:"items"`
+}
+
 func interfaceIsEmpty(i interface{}) bool {
 	return reflect.ValueOf(i).Kind() != reflect.Ptr || reflect.ValueOf(i).IsNil()
 }
@@ -50,7 +74,7 @@ func generateStructWithOptionalFields(model interface{}) interface{} {
 		f := rt.Field(i)
 		j := f.Tag.Get("json")
 
-		if j != "-" && j != "paths" {
+		if j != "-" && j != "paths" && f.IsExported() {
 			fields = append(fields, reflect.StructField{
 				Name: f.Name,
 				Type: reflect.PtrTo(f.Type),
@@ -62,24 +86,57 @@ func generateStructWithOptionalFields(model interface{}) interface{} {
 	return reflect.New(reflect.StructOf(fields)).Interface()
 }
 
-func loadConfData(ctx *gin.Context) (interface{}, error) {
-	in := generateStructWithOptionalFields(conf.Conf{})
-	err := json.NewDecoder(ctx.Request.Body).Decode(in)
+// decodeConfData decodes parameters sent by a client.
+// Values that were redacted by the API and are sent back unchanged keep their original value.
+func decodeConfData(ctx *gin.Context, c *conf.Conf, dest interface{}, keys ...string) (map[string]interface{}, error) {
+	var m map[string]interface{}
+	dec := json.NewDecoder(ctx.Request.Body)
+	dec.UseNumber()
+	err := dec.Decode(&m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.RestoreRedacted(m, keys...)
 	if err != nil {
 		return nil, err
 	}
 
-	return in, err
+	byts, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(byts, dest)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
 }
 
-func loadConfPathData(ctx *gin.Context) (interface{}, error) {
+// loadConfData returns the configuration in the request, with optional fields,
+// and the same configuration in generic form.
+func loadConfData(ctx *gin.Context, c *conf.Conf) (interface{}, map[string]interface{}, error) {
+	in := generateStructWithOptionalFields(conf.Conf{})
+	m, err := decodeConfData(ctx, c, in)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return in, m, err
+}
+
+// loadConfPathData returns the path configuration in the request, with optional fields,
+// and the same path configuration in generic form.
+func loadConfPathData(ctx *gin.Context, c *conf.Conf, name string) (interface{}, map[string]interface{}, error) {
 	in := generateStructWithOptionalFields(conf.PathConf{})
-	err := json.NewDecoder(ctx.Request.Body).Decode(in)
+	m, err := decodeConfData(ctx, c, in, "paths", name)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return in, err
+	return in, m, err
 }
 
 type apiPathManager interface {
@@ -112,24 +169,39 @@ type apiWebRTCServer interface {
 }
 
 type api struct {
-	conf         *conf.Conf
-	pathManager  apiPathManager
-	rtspServer   apiRTSPServer
-	rtspsServer  apiRTSPServer
-	rtmpServer   apiRTMPServer
-	rtmpsServer  apiRTMPServer
-	hlsServer    apiHLSServer
-	webRTCServer apiWebRTCServer
-	parent       apiParent
-
-	ln    net.Listener
-	mutex sync.Mutex
-	s     *http.Server
+	conf            *conf.Conf
+	confPath        string
+	authManager     *authManager
+	eventBus        *eventBus
+	clusterManager  *clusterManager
+	externalCmdPool *externalcmd.Pool
+	pathManager     apiPathManager
+	rtspServer      apiRTSPServer
+	rtspsServer     apiRTSPServer
+	rtmpServer      apiRTMPServer
+	rtmpsServer     apiRTMPServer
+	hlsServer       apiHLSServer
+	webRTCServer    apiWebRTCServer
+	parent          apiParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	httpServer *httpServer
+	mutex      sync.Mutex
+	draining   atomic.Bool
 }
 
 func newAPI(
 	address string,
-	conf *conf.Conf,
+	encryption bool,
+	serverKey string,
+	serverCert string,
+	cnf *conf.Conf,
+	confPath string,
+	authManager *authManager,
+	eventBus *eventBus,
+	clusterManager *clusterManager,
+	externalCmdPool *externalcmd.Pool,
 	pathManager apiPathManager,
 	rtspServer apiRTSPServer,
 	rtspsServer apiRTSPServer,
@@ -139,35 +211,47 @@ func newAPI(
 	webRTCServer apiWebRTCServer,
 	parent apiParent,
 ) (*api, error) {
-	ln, err := net.Listen("tcp", address)
-	if err != nil {
-		return nil, err
-	}
+	ctx, ctxCancel := context.WithCancel(context.Background())
 
 	a := &api{
-		conf:         conf,
-		pathManager:  pathManager,
-		rtspServer:   rtspServer,
-		rtspsServer:  rtspsServer,
-		rtmpServer:   rtmpServer,
-		rtmpsServer:  rtmpsServer,
-		hlsServer:    hlsServer,
-		webRTCServer: webRTCServer,
-		parent:       parent,
-		ln:           ln,
+		conf:            cnf,
+		confPath:        confPath,
+		authManager:     authManager,
+		eventBus:        eventBus,
+		clusterManager:  clusterManager,
+		externalCmdPool: externalCmdPool,
+		pathManager:     pathManager,
+		rtspServer:      rtspServer,
+		rtspsServer:     rtspsServer,
+		rtmpServer:      rtmpServer,
+		rtmpsServer:     rtmpsServer,
+		hlsServer:       hlsServer,
+		webRTCServer:    webRTCServer,
+		parent:          parent,
+		ctx:             ctx,
+		ctxCancel:       ctxCancel,
 	}
 
 	router := gin.New()
 	router.SetTrustedProxies(nil)
 	mwLog := httpLoggerMiddleware(a)
 	router.NoRoute(mwLog)
-	group := router.Group("/", mwLog)
 
-	group.GET("/v1/config/get", a.onConfigGet)
-	group.POST("/v1/config/set", a.onConfigSet)
-	group.POST("/v1/config/paths/add/*name", a.onConfigPathsAdd)
-	group.POST("/v1/config/paths/edit/*name", a.onConfigPathsEdit)
-	group.POST("/v1/config/paths/remove/*name", a.onConfigPathsDelete)
+	// load balancers must be able to check readiness without credentials
+	router.GET("/v1/health/ready", mwLog, a.onHealthReady)
+
+	// read-only endpoints
+	group := router.Group("/", mwLog, httpAuthMiddleware(a.authManager, conf.AuthActionAPI, a))
+
+	// endpoints that change the state of the server or expose credentials
+	adminGroup := router.Group("/", mwLog, httpAuthMiddleware(a.authManager, conf.AuthActionAPIAdmin, a))
+
+	adminGroup.GET("/v1/config/get", a.onConfigGet)
+	adminGroup.POST("/v1/config/set", a.onConfigSet)
+	adminGroup.POST("/v1/config/validate", a.onConfigValidate)
+	adminGroup.POST("/v1/config/paths/add/*name", a.onConfigPathsAdd)
+	adminGroup.POST("/v1/config/paths/edit/*name", a.onConfigPathsEdit)
+	adminGroup.POST("/v1/config/paths/remove/*name", a.onConfigPathsDelete)
 
 	if !interfaceIsEmpty(a.hlsServer) {
 		group.GET("/v1/hlsmuxers/list", a.onHLSMuxersList)
@@ -175,49 +259,66 @@ func newAPI(
 
 	group.GET("/v1/paths/list", a.onPathsList)
 
+	group.GET("/v1/events", a.onEvents)
+
+	group.GET("/v1/cluster/load", a.onClusterLoad)
+
+	// commands may contain credentials
+	adminGroup.GET("/v1/externalcmds/list", a.onExternalCmdsList)
+
+	group.GET("/v1/bans/list", a.onBansList)
+	adminGroup.POST("/v1/bans/remove/:ip", a.onBansRemove)
+
 	if !interfaceIsEmpty(a.rtspServer) {
 		group.GET("/v1/rtspconns/list", a.onRTSPConnsList)
 		group.GET("/v1/rtspsessions/list", a.onRTSPSessionsList)
-		group.POST("/v1/rtspsessions/kick/:id", a.onRTSPSessionsKick)
+		adminGroup.POST("/v1/rtspsessions/kick/:id", a.onRTSPSessionsKick)
 	}
 
 	if !interfaceIsEmpty(a.rtspsServer) {
 		group.GET("/v1/rtspsconns/list", a.onRTSPSConnsList)
 		group.GET("/v1/rtspssessions/list", a.onRTSPSSessionsList)
-		group.POST("/v1/rtspssessions/kick/:id", a.onRTSPSSessionsKick)
+		adminGroup.POST("/v1/rtspssessions/kick/:id", a.onRTSPSSessionsKick)
 	}
 
 	if !interfaceIsEmpty(a.rtmpServer) {
 		group.GET("/v1/rtmpconns/list", a.onRTMPConnsList)
-		group.POST("/v1/rtmpconns/kick/:id", a.onRTMPConnsKick)
+		adminGroup.POST("/v1/rtmpconns/kick/:id", a.onRTMPConnsKick)
 	}
 
 	if !interfaceIsEmpty(a.rtmpsServer) {
 		group.GET("/v1/rtmpsconns/list", a.onRTMPSConnsList)
-		group.POST("/v1/rtmpsconns/kick/:id", a.onRTMPSConnsKick)
+		adminGroup.POST("/v1/rtmpsconns/kick/:id", a.onRTMPSConnsKick)
 	}
 
 	if !interfaceIsEmpty(a.webRTCServer) {
 		group.GET("/v1/webrtcconns/list", a.onWebRTCConnsList)
-		group.POST("/v1/webrtcconns/kick/:id", a.onWebRTCConnsKick)
+		adminGroup.POST("/v1/webrtcconns/kick/:id", a.onWebRTCConnsKick)
 	}
 
-	a.s = &http.Server{
-		Handler:  router,
-		ErrorLog: log.New(&nilWriter{}, "", 0),
+	var err error
+	a.httpServer, err = newHTTPServer(address, encryption, serverKey, serverCert, authManager, router, parent)
+	if err != nil {
+		ctxCancel()
+		return nil, err
 	}
 
-	go a.s.Serve(ln)
-
 	a.log(logger.Info, "listener opened on "+address)
+	warnUnauthenticatedListener(authManager, address, a)
 
 	return a, nil
 }
 
 func (a *api) close() {
 	a.log(logger.Info, "listener is closing")
-	a.s.Shutdown(context.Background())
-	a.ln.Close() // in case Shutdown() is called before Serve()
+	a.ctxCancel() // close event streams, that would block Shutdown()
+	a.httpServer.close()
+}
+
+// drainStart marks the server as not ready, in order to allow load balancers
+// to stop routing new clients to it.
+func (a *api) drainStart() {
+	a.draining.Store(true)
 }
 
 func (a *api) log(level logger.Level, format string, args ...interface{}) {
@@ -229,22 +330,29 @@ func (a *api) onConfigGet(ctx *gin.Context) {
 	c := a.conf
 	a.mutex.Unlock()
 
-	ctx.JSON(http.StatusOK, c)
+	// values obtained from references are secrets
+	out, err := c.Redacted()
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, out)
 }
 
 func (a *api) onConfigSet(ctx *gin.Context) {
-	in, err := loadConfData(ctx)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	in, m, err := loadConfData(ctx, a.conf)
 	if err != nil {
 		ctx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-
-	var newConf conf.Conf
-	cloneStruct(&newConf, a.conf)
-	fillStruct(&newConf, in)
+	newConf := a.conf.Clone()
+	fillStruct(newConf, in)
+	newConf.MarkSetFields(m)
 
 	err = newConf.CheckAndFillMissing()
 	if err != nil {
@@ -252,15 +360,32 @@ func (a *api) onConfigSet(ctx *gin.Context) {
 		return
 	}
 
-	a.conf = &newConf
+	a.conf = newConf
 
 	// since reloading the configuration can cause the shutdown of the API,
 	// call it in a goroutine
-	go a.parent.apiConfigSet(&newConf)
+	go a.parent.apiConfigSet(newConf)
 
 	ctx.Status(http.StatusOK)
 }
 
+func (a *api) onConfigValidate(ctx *gin.Context) {
+	byts, err := ctx.GetRawData()
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	res := conf.Validate(byts, a.confPath)
+
+	if !res.OK() {
+		ctx.JSON(http.StatusBadRequest, res)
+		return
+	}
+
+	ctx.JSON(http.StatusOK, res)
+}
+
 func (a *api) onConfigPathsAdd(ctx *gin.Context) {
 	name := ctx.Param("name")
 	if len(name) < 2 || name[0] != '/' {
@@ -269,17 +394,16 @@ func (a *api) onConfigPathsAdd(ctx *gin.Context) {
 	}
 	name = name[1:]
 
-	in, err := loadConfPathData(ctx)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	in, m, err := loadConfPathData(ctx, a.conf, name)
 	if err != nil {
 		ctx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-
-	var newConf conf.Conf
-	cloneStruct(&newConf, a.conf)
+	newConf := a.conf.Clone()
 
 	if _, ok := newConf.Paths[name]; ok {
 		ctx.AbortWithStatus(http.StatusBadRequest)
@@ -290,6 +414,7 @@ func (a *api) onConfigPathsAdd(ctx *gin.Context) {
 	fillStruct(newConfPath, in)
 
 	newConf.Paths[name] = newConfPath
+	newConf.MarkSetFields(map[string]interface{}{"paths": map[string]interface{}{name: m}})
 
 	err = newConf.CheckAndFillMissing()
 	if err != nil {
@@ -297,11 +422,11 @@ func (a *api) onConfigPathsAdd(ctx *gin.Context) {
 		return
 	}
 
-	a.conf = &newConf
+	a.conf = newConf
 
 	// since reloading the configuration can cause the shutdown of the API,
 	// call it in a goroutine
-	go a.parent.apiConfigSet(&newConf)
+	go a.parent.apiConfigSet(newConf)
 
 	ctx.Status(http.StatusOK)
 }
@@ -314,17 +439,16 @@ func (a *api) onConfigPathsEdit(ctx *gin.Context) {
 	}
 	name = name[1:]
 
-	in, err := loadConfPathData(ctx)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	in, m, err := loadConfPathData(ctx, a.conf, name)
 	if err != nil {
 		ctx.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	a.mutex.Lock()
-	defer a.mutex.Unlock()
-
-	var newConf conf.Conf
-	cloneStruct(&newConf, a.conf)
+	newConf := a.conf.Clone()
 
 	newConfPath, ok := newConf.Paths[name]
 	if !ok {
@@ -333,6 +457,7 @@ func (a *api) onConfigPathsEdit(ctx *gin.Context) {
 	}
 
 	fillStruct(newConfPath, in)
+	newConf.MarkSetPathFields(name, m)
 
 	err = newConf.CheckAndFillMissing()
 	if err != nil {
@@ -340,11 +465,11 @@ func (a *api) onConfigPathsEdit(ctx *gin.Context) {
 		return
 	}
 
-	a.conf = &newConf
+	a.conf = newConf
 
 	// since reloading the configuration can cause the shutdown of the API,
 	// call it in a goroutine
-	go a.parent.apiConfigSet(&newConf)
+	go a.parent.apiConfigSet(newConf)
 
 	ctx.Status(http.StatusOK)
 }
@@ -360,8 +485,7 @@ func (a *api) onConfigPathsDelete(ctx *gin.Context) {
 	a.mutex.Lock()
 	defer a.mutex.Unlock()
 
-	var newConf conf.Conf
-	cloneStruct(&newConf, a.conf)
+	newConf := a.conf.Clone()
 
 	if _, ok := newConf.Paths[name]; !ok {
 		ctx.AbortWithStatus(http.StatusBadRequest)
@@ -376,11 +500,11 @@ func (a *api) onConfigPathsDelete(ctx *gin.Context) {
 		return
 	}
 
-	a.conf = &newConf
+	a.conf = newConf
 
 	// since reloading the configuration can cause the shutdown of the API,
 	// call it in a goroutine
-	go a.parent.apiConfigSet(&newConf)
+	go a.parent.apiConfigSet(newConf)
 
 	ctx.Status(http.StatusOK)
 }
@@ -392,9 +516,131 @@ func (a *api) onPathsList(ctx *gin.Context) {
 		return
 	}
 
+	a.mutex.Lock()
+	c := a.conf
+	a.mutex.Unlock()
+
+	// values obtained from references are secrets
+	for name, item := range res.data.Items {
+		pconf, ok := item.Conf.(*conf.PathConf)
+		if !ok {
+			continue
+		}
+
+		red, err := c.RedactedPath(pconf)
+		if err != nil {
+			ctx.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		item.Conf = red
+		res.data.Items[name] = item
+	}
+
 	ctx.JSON(http.StatusOK, res.data)
 }
 
+func (a *api) onExternalCmdsList(ctx *gin.Context) {
+	data := apiExternalCmdsListData{
+		Items: make(map[string]apiExternalCmdsListItem),
+	}
+
+	now := time.Now()
+
+	for _, info := range a.externalCmdPool.List() {
+		item := apiExternalCmdsListItem{
+			Name:         info.Name,
+			Path:         info.Path,
+			Cmd:          info.Cmd,
+			Created:      info.Created,
+			Running:      info.PID != 0,
+			PID:          info.PID,
+			Restarts:     info.Restarts,
+			LastExitCode: info.LastExitCode,
+		}
+
+		if item.Running {
+			item.Uptime = conf.StringDuration(now.Sub(info.Started).Round(time.Second))
+		}
+
+		data.Items[info.ID.String()] = item
+	}
+
+	ctx.JSON(http.StatusOK, data)
+}
+
+func (a *api) onEvents(ctx *gin.Context) {
+	lastIDStr := ctx.GetHeader("Last-Event-ID")
+	if lastIDStr == "" {
+		lastIDStr = ctx.Query("lastEventId")
+	}
+
+	var lastID uint64
+	if lastIDStr != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastIDStr, 10, 64)
+		if err != nil {
+			ctx.AbortWithStatus(http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, missed := a.eventBus.subscribe(lastID)
+	defer a.eventBus.unsubscribe(sub)
+
+	ctx.Writer.Header().Set("Content-Type", "text/event-stream")
+	ctx.Writer.Header().Set("Cache-Control", "no-cache")
+	ctx.Writer.Header().Set("Connection", "keep-alive")
+	ctx.Writer.WriteHeader(http.StatusOK)
+	ctx.Writer.Flush()
+
+	write := func(e *event) error {
+		enc, _ := json.Marshal(e)
+		_, err := fmt.Fprintf(ctx.Writer, "id: %d\nevent: %s\ndata: %s\n\n", e.ID, e.Type, enc)
+		return err
+	}
+
+	for _, e := range missed {
+		err := write(e)
+		if err != nil {
+			return
+		}
+	}
+	ctx.Writer.Flush()
+
+	keepalive := time.NewTicker(apiEventsKeepaliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			// subscriber has been removed because it was too slow
+			if !ok {
+				return
+			}
+
+			err := write(e)
+			if err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+
+		case <-keepalive.C:
+			_, err := ctx.Writer.WriteString(":\n\n")
+			if err != nil {
+				return
+			}
+			ctx.Writer.Flush()
+
+		case <-ctx.Request.Context().Done():
+			return
+
+		case <-a.ctx.Done():
+			return
+		}
+	}
+}
+
 func (a *api) onRTSPConnsList(ctx *gin.Context) {
 	res := a.rtspServer.apiConnsList()
 	if res.err != nil {
@@ -415,6 +661,37 @@ func (a *api) onRTSPSessionsList(ctx *gin.Context) {
 	ctx.JSON(http.StatusOK, res.data)
 }
 
+type apiHealthReady struct {
+	Ready bool `json:"ready"`
+}
+
+func (a *api) onHealthReady(ctx *gin.Context) {
+	if a.draining.Load() {
+		ctx.JSON(http.StatusServiceUnavailable, apiHealthReady{Ready: false})
+		return
+	}
+
+	ctx.JSON(http.StatusOK, apiHealthReady{Ready: true})
+}
+
+func (a *api) onClusterLoad(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, a.clusterManager.apiLoad())
+}
+
+func (a *api) onBansList(ctx *gin.Context) {
+	ctx.JSON(http.StatusOK, a.authManager.bans.apiBansList())
+}
+
+func (a *api) onBansRemove(ctx *gin.Context) {
+	err := a.authManager.bans.apiBansRemove(ctx.Param("ip"))
+	if err != nil {
+		ctx.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+
+	ctx.Status(http.StatusOK)
+}
+
 func (a *api) onRTSPSessionsKick(ctx *gin.Context) {
 	id := ctx.Param("id")
 
@@ -0,0 +1,447 @@
+package core
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+type authManagerParent interface {
+	Log(logger.Level, string, ...interface{})
+}
+
+// authManager checks credentials against the internal user database
+// and the external authentication server, and bans IPs that fail too many times.
+// It is shared between all servers and can be reloaded without restarting them.
+type authManager struct {
+	eventBus *eventBus
+	parent   authManagerParent
+	bans     *ipBanTracker
+
+	mutex           sync.RWMutex
+	conf            *conf.Conf
+	internalUsers   conf.AuthInternalUsers
+	externalAuth    *externalAuthClient
+	signedURLSecret string
+	clientCertField string
+}
+
+func newAuthManager(cnf *conf.Conf, eventBus *eventBus, parent authManagerParent) *authManager {
+	m := &authManager{
+		eventBus: eventBus,
+		parent:   parent,
+		bans:     newIPBanTracker(),
+	}
+	m.confReload(cnf)
+	return m
+}
+
+func (m *authManager) close() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.externalAuth != nil {
+		m.externalAuth.close()
+		m.externalAuth = nil
+	}
+}
+
+// confReload is called by core.
+func (m *authManager) confReload(cnf *conf.Conf) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.internalUsers = cnf.AuthInternalUsers
+	m.bans.setConf(cnf.AuthBanMaxFailures, time.Duration(cnf.AuthBanWindow), time.Duration(cnf.AuthBanDuration))
+	m.signedURLSecret = cnf.SignedURLSecret
+	m.clientCertField = cnf.ClientCertUsernameField
+
+	// recreate the external authentication client, and its cache,
+	// only when its settings change.
+	if m.conf == nil ||
+		cnf.ExternalAuthenticationURL != m.conf.ExternalAuthenticationURL ||
+		cnf.ExternalAuthenticationTimeout != m.conf.ExternalAuthenticationTimeout ||
+		cnf.ExternalAuthenticationMaxIdleConns != m.conf.ExternalAuthenticationMaxIdleConns ||
+		!reflect.DeepEqual(cnf.ExternalAuthenticationHeaders, m.conf.ExternalAuthenticationHeaders) ||
+		cnf.ExternalAuthenticationBearerToken != m.conf.ExternalAuthenticationBearerToken ||
+		cnf.ExternalAuthenticationCacheTTL != m.conf.ExternalAuthenticationCacheTTL ||
+		cnf.ExternalAuthenticationNegativeCacheTTL != m.conf.ExternalAuthenticationNegativeCacheTTL {
+		if m.externalAuth != nil {
+			m.externalAuth.close()
+			m.externalAuth = nil
+		}
+
+		if cnf.ExternalAuthenticationURL != "" {
+			m.externalAuth = newExternalAuthClient(
+				cnf.ExternalAuthenticationURL,
+				cnf.ExternalAuthenticationTimeout,
+				cnf.ExternalAuthenticationMaxIdleConns,
+				cnf.ExternalAuthenticationHeaders,
+				cnf.ExternalAuthenticationBearerToken,
+				cnf.ExternalAuthenticationCacheTTL,
+				cnf.ExternalAuthenticationNegativeCacheTTL)
+		}
+	}
+
+	m.conf = cnf
+}
+
+func (m *authManager) log(level logger.Level, format string, args ...interface{}) {
+	m.parent.Log(level, "[auth] "+format, args...)
+}
+
+// onFailure records an authentication failure of an IP,
+// in order to ban IPs that fail too many times.
+func (m *authManager) onFailure(ip net.IP, path string, message string) {
+	m.eventBus.publish(event{
+		Type:  eventTypeAuthFailure,
+		Path:  path,
+		IP:    ip.String(),
+		Error: message,
+	})
+
+	if m.bans.onFailure(ip) {
+		m.log(logger.Warn, "IP %v banned for %v after too many authentication failures",
+			ip, time.Duration(m.confSafe().AuthBanDuration))
+	}
+}
+
+// isBanned returns whether an IP is banned.
+func (m *authManager) isBanned(ip net.IP) bool {
+	return m.bans.isBanned(ip)
+}
+
+func (m *authManager) confSafe() *conf.Conf {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.conf
+}
+
+// hasInternalUsers returns whether the internal user database is in use.
+func (m *authManager) hasInternalUsers() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return len(m.internalUsers) != 0
+}
+
+// hasExternalAuth returns whether external authentication is in use.
+func (m *authManager) hasExternalAuth() bool {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.externalAuth != nil
+}
+
+// authenticateExternal performs external authentication.
+// It returns the time at which the session must be closed,
+// or a zero time if the session never expires.
+func (m *authManager) authenticateExternal(req externalAuthReq) (time.Time, error) {
+	m.mutex.RLock()
+	ea := m.externalAuth
+	m.mutex.RUnlock()
+
+	if ea == nil {
+		return time.Time{}, nil
+	}
+
+	return ea.authenticate(req)
+}
+
+// clientCertUser returns the username associated with the client certificate
+// of a TLS connection, or an empty string if there's no verified certificate.
+func (m *authManager) clientCertUser(state *tls.ConnectionState) string {
+	m.mutex.RLock()
+	field := m.clientCertField
+	m.mutex.RUnlock()
+
+	return clientCertUsername(state, field)
+}
+
+// authenticateClientCert checks whether the user associated with
+// a client certificate is allowed to perform an action on a path.
+// Users are authenticated by the certificate, therefore passwords are not checked.
+func (m *authManager) authenticateClientCert(
+	ip net.IP,
+	certUser string,
+	action conf.AuthAction,
+	path string,
+) error {
+	_, err := m.authenticateWith(ip, certUser, func(conf.Credential) bool {
+		return true
+	}, action, path)
+	return err
+}
+
+// authenticateSignedURL checks whether the query of a reader URL contains
+// a valid signature. It returns whether the URL is signed and, in this case,
+// the time at which the session must be closed.
+func (m *authManager) authenticateSignedURL(ip net.IP, path string, rawQuery string) (time.Time, bool, error) {
+	m.mutex.RLock()
+	secret := m.signedURLSecret
+	m.mutex.RUnlock()
+
+	if secret == "" {
+		return time.Time{}, false, nil
+	}
+
+	return signedURLCheck(secret, ip, path, rawQuery)
+}
+
+// authenticate checks whether an user with a plain text password
+// is allowed to perform an action on a path.
+func (m *authManager) authenticate(
+	ip net.IP,
+	user string,
+	pass string,
+	action conf.AuthAction,
+	path string,
+) error {
+	_, err := m.authenticateUser(ip, user, pass, action, path)
+	return err
+}
+
+// authenticateUser is like authenticate, but it also returns the user whose
+// credentials have been verified, that is empty when access has been granted
+// without valid credentials, i.e. by the "any" user.
+func (m *authManager) authenticateUser(
+	ip net.IP,
+	user string,
+	pass string,
+	action conf.AuthAction,
+	path string,
+) (string, error) {
+	return m.authenticateWith(ip, user, func(c conf.Credential) bool {
+		return c.Check(pass)
+	}, action, path)
+}
+
+// authenticateWith checks whether an user is allowed to perform an action on a path,
+// and returns the user whose credentials have been verified.
+// checkPass is used to verify the password of the matched user, and allows
+// to support challenge-response methods.
+func (m *authManager) authenticateWith(
+	ip net.IP,
+	user string,
+	checkPass func(conf.Credential) bool,
+	action conf.AuthAction,
+	path string,
+) (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, u := range m.internalUsers {
+		if !u.IsAny() {
+			if user == "" || !u.User.Check(user) || !checkPass(u.Pass) {
+				continue
+			}
+		}
+
+		if len(u.IPs) != 0 && !ipEqualOrInRange(ip, u.IPs) {
+			continue
+		}
+
+		for _, p := range u.Permissions {
+			if p.Action.Includes(action) && p.MatchesPath(path) {
+				if !u.IsAny() {
+					return user, nil
+				}
+				return m.verifiedUser(user, checkPass), nil
+			}
+		}
+	}
+
+	if user == "" {
+		return "", fmt.Errorf("authentication required")
+	}
+
+	if path == "" {
+		return "", fmt.Errorf("user '%s' is not allowed to perform action '%s'", user, action)
+	}
+
+	return "", fmt.Errorf("user '%s' is not allowed to perform action '%s' on path '%s'", user, action, path)
+}
+
+// verifiedUser returns the user if its credentials are valid, or an empty string otherwise.
+// It must be called with the mutex locked.
+func (m *authManager) verifiedUser(user string, checkPass func(conf.Credential) bool) string {
+	if user == "" {
+		return ""
+	}
+
+	for _, u := range m.internalUsers {
+		if !u.IsAny() && u.User.Check(user) && checkPass(u.Pass) {
+			return user
+		}
+	}
+
+	return ""
+}
+
+// publisherPriority returns the publisher priority of an internal user.
+// The user must have been verified by authenticate.
+func (m *authManager) publisherPriority(user string) int {
+	if user == "" {
+		return 0
+	}
+
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, u := range m.internalUsers {
+		if !u.IsAny() && u.User.Check(user) {
+			return u.PublisherPriority
+		}
+	}
+
+	return 0
+}
+
+// authenticateToken checks whether a bearer token is allowed to perform an action on a path.
+// Tokens are compared with the tokens of the internal users, that are distinct from passwords.
+func (m *authManager) authenticateToken(
+	ip net.IP,
+	token string,
+	action conf.AuthAction,
+	path string,
+) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	for _, u := range m.internalUsers {
+		if u.IsAny() || u.Token == "" || !u.Token.Check(token) {
+			continue
+		}
+
+		if len(u.IPs) != 0 && !ipEqualOrInRange(ip, u.IPs) {
+			continue
+		}
+
+		for _, p := range u.Permissions {
+			if p.Action.Includes(action) && p.MatchesPath(path) {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("token is not allowed to perform action '%s'", action)
+}
+
+// authenticateHTTP checks the credentials of a HTTP request,
+// that can be provided with basic or bearer authentication.
+func (m *authManager) authenticateHTTP(r *http.Request, action conf.AuthAction) error {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		return m.authenticateToken(ip, strings.TrimPrefix(h, "Bearer "), action, "")
+	}
+
+	user, pass, _ := r.BasicAuth()
+	return m.authenticate(ip, user, pass, action, "")
+}
+
+// authenticateHTTPExternal checks the credentials of a HTTP request
+// with the external authentication server.
+// Bearer tokens are sent in place of the password.
+func (m *authManager) authenticateHTTPExternal(r *http.Request, action conf.AuthAction) error {
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+
+	user, pass, _ := r.BasicAuth()
+	if h := r.Header.Get("Authorization"); strings.HasPrefix(h, "Bearer ") {
+		user, pass = "", strings.TrimPrefix(h, "Bearer ")
+	}
+
+	_, err := m.authenticateExternal(externalAuthReq{
+		ip:       host,
+		user:     user,
+		password: pass,
+		protocol: externalAuthProtoHTTP,
+		action:   action,
+	})
+	return err
+}
+
+// isLoopbackHost checks whether a host is a loopback address.
+func isLoopbackHost(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// warnUnauthenticatedListener logs a warning when a HTTP listener
+// is reachable from other hosts and no authentication method is in use.
+func warnUnauthenticatedListener(m *authManager, address string, p httpLoggerParent) {
+	host, _, _ := net.SplitHostPort(address)
+	if isLoopbackHost(host) || m.hasInternalUsers() || m.hasExternalAuth() {
+		return
+	}
+
+	p.log(logger.Warn, "listener is reachable from other hosts and no authentication "+
+		"method is configured; set authInternalUsers or externalAuthenticationURL")
+}
+
+// httpAuthenticate checks the credentials of a HTTP request and,
+// in case of failure, replies with 401 and returns an error.
+// Credentials are checked with the internal user database or, when it is not in use,
+// with the external authentication server. When no authentication method
+// is in use, all requests are accepted, except administrative actions
+// performed by other hosts, that are refused with 403.
+func httpAuthenticate(
+	m *authManager,
+	action conf.AuthAction,
+	w http.ResponseWriter,
+	r *http.Request,
+) error {
+	var err error
+	switch {
+	case m.hasInternalUsers():
+		err = m.authenticateHTTP(r, action)
+
+	case m.hasExternalAuth():
+		err = m.authenticateHTTPExternal(r, action)
+
+	default:
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		if action == conf.AuthActionAPIAdmin && !isLoopbackHost(host) {
+			w.WriteHeader(http.StatusForbidden)
+			return fmt.Errorf("administrative actions from other hosts require authentication")
+		}
+		return nil
+	}
+
+	if err != nil {
+		// requests without credentials are the first step of basic authentication
+		if r.Header.Get("Authorization") != "" {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			m.onFailure(net.ParseIP(host), "", err.Error())
+		}
+
+		w.Header().Set("WWW-Authenticate", `Basic realm="rtsp-simple-server"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return err
+	}
+
+	return nil
+}
+
+// httpAuthMiddleware is a gin middleware that checks credentials.
+func httpAuthMiddleware(m *authManager, action conf.AuthAction, p httpLoggerParent) func(*gin.Context) {
+	return func(ctx *gin.Context) {
+		err := httpAuthenticate(m, action, ctx.Writer, ctx.Request)
+		if err != nil {
+			p.log(logger.Info, "[conn %v] authentication failed: %v", ctx.ClientIP(), err)
+			ctx.Abort()
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+)
+
+// tlsSetClientCA configures a TLS listener in order to request
+// client certificates and verify them against a CA bundle.
+// Clients that don't provide a certificate are accepted, and can authenticate
+// in other ways.
+func tlsSetClientCA(tlsConfig *tls.Config, clientCA string) error {
+	if clientCA == "" {
+		return nil
+	}
+
+	byts, err := os.ReadFile(clientCA)
+	if err != nil {
+		return err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(byts) {
+		return fmt.Errorf("no certificates found in '%s'", clientCA)
+	}
+
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	tlsConfig.ClientCAs = pool
+	return nil
+}
+
+// tlsConnState returns the TLS state of a connection, or nil if the connection is not TLS.
+func tlsConnState(nconn net.Conn) *tls.ConnectionState {
+	if tc, ok := nconn.(*tls.Conn); ok {
+		state := tc.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+// clientCertUsername maps a verified client certificate to an username.
+// It returns an empty string if no verified certificate was provided.
+func clientCertUsername(state *tls.ConnectionState, field string) string {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return ""
+	}
+
+	cert := state.PeerCertificates[0]
+
+	switch field {
+	case "dnsName":
+		if len(cert.DNSNames) != 0 {
+			return cert.DNSNames[0]
+		}
+
+	case "emailAddress":
+		if len(cert.EmailAddresses) != 0 {
+			return cert.EmailAddresses[0]
+		}
+
+	case "uri":
+		if len(cert.URIs) != 0 {
+			return cert.URIs[0].String()
+		}
+
+	default:
+		return cert.Subject.CommonName
+	}
+
+	return ""
+}
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2"
+	"github.com/aler9/gortsplib/v2/pkg/media"
+	"github.com/stretchr/testify/require"
+)
+
+// generateTestClientCert generates a CA and a client certificate signed by it.
+func generateTestClientCert(t *testing.T, commonName string) ([]byte, tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	caDer, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	require.NoError(t, err)
+
+	ca, err := x509.ParseCertificate(caDer)
+	require.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:   big.NewInt(2),
+		Subject:        pkix.Name{CommonName: commonName},
+		EmailAddresses: []string{commonName + "@example.com"},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDer}),
+		tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestClientCertUsername(t *testing.T) {
+	_, crt := generateTestClientCert(t, "testcamera")
+
+	cert, err := x509.ParseCertificate(crt.Certificate[0])
+	require.NoError(t, err)
+
+	state := &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{cert},
+		VerifiedChains:   [][]*x509.Certificate{{cert}},
+	}
+
+	require.Equal(t, "testcamera", clientCertUsername(state, "commonName"))
+	require.Equal(t, "testcamera@example.com", clientCertUsername(state, "emailAddress"))
+	require.Equal(t, "", clientCertUsername(state, "dnsName"))
+
+	// unverified certificates are ignored
+	state.VerifiedChains = nil
+	require.Equal(t, "", clientCertUsername(state, "commonName"))
+}
+
+func TestRTSPServerAuthClientCert(t *testing.T) {
+	serverCertFpath, err := writeTempFile(serverCert)
+	require.NoError(t, err)
+	defer os.Remove(serverCertFpath)
+
+	serverKeyFpath, err := writeTempFile(serverKey)
+	require.NoError(t, err)
+	defer os.Remove(serverKeyFpath)
+
+	caPEM, clientCert := generateTestClientCert(t, "testpublisher")
+
+	clientCAFpath, err := writeTempFile(caPEM)
+	require.NoError(t, err)
+	defer os.Remove(clientCAFpath)
+
+	p, ok := newInstance("rtmpDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"webrtcDisable: yes\n" +
+		"encryption: strict\n" +
+		"protocols: [tcp]\n" +
+		"serverCert: " + serverCertFpath + "\n" +
+		"serverKey: " + serverKeyFpath + "\n" +
+		"clientCA: " + clientCAFpath + "\n" +
+		"paths:\n" +
+		"  all:\n" +
+		"    publishUser: testpublisher\n" +
+		"    publishPass: testpass\n")
+	require.Equal(t, true, ok)
+	defer p.Close()
+
+	t.Run("without certificate", func(t *testing.T) {
+		source := gortsplib.Client{TLSConfig: &tls.Config{InsecureSkipVerify: true}}
+		err := source.StartRecording("rtsps://localhost:8322/teststream", media.Medias{testMediaH264})
+		require.EqualError(t, err, "bad status code: 401 (Unauthorized)")
+	})
+
+	t.Run("with certificate", func(t *testing.T) {
+		source := gortsplib.Client{TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       []tls.Certificate{clientCert},
+		}}
+		err := source.StartRecording("rtsps://localhost:8322/teststream", media.Medias{testMediaH264})
+		require.NoError(t, err)
+		defer source.Close()
+	})
+}
@@ -0,0 +1,667 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+// name of the configuration of paths pulled from origins.
+// It can't be used by paths of the configuration, since it contains an invalid character.
+const pathConfNameCluster = "$cluster"
+
+// period during which a path that is not available on any origin
+// is not searched again.
+const clusterMissTTL = 5 * time.Second
+
+type clusterOriginPath struct {
+	ConfName string `json:"confName"`
+	Conf     struct {
+		SourceOnDemand bool   `json:"sourceOnDemand"`
+		RunOnDemand    string `json:"runOnDemand"`
+	} `json:"conf"`
+	SourceReady bool `json:"sourceReady"`
+}
+
+type clusterOriginPaths struct {
+	Items map[string]clusterOriginPath `json:"items"`
+}
+
+// canBePulled checks whether a path of an origin can be pulled by edges.
+func (p clusterOriginPath) canBePulled() bool {
+	// paths that are pulled from other origins are ignored,
+	// in order to avoid loops between servers that are origins of each other
+	if p.ConfName == pathConfNameCluster {
+		return false
+	}
+
+	return p.SourceReady || p.Conf.SourceOnDemand || p.Conf.RunOnDemand != ""
+}
+
+type clusterProtocol int
+
+const (
+	clusterProtocolRTSP clusterProtocol = iota
+	clusterProtocolRTMP
+	clusterProtocolHLS
+	clusterProtocolWebRTC
+)
+
+// clusterLoad is the load of a node, that is shared with sibling nodes.
+type clusterLoad struct {
+	Readers          int      `json:"readers"`
+	Bandwidth        float64  `json:"bandwidth"`
+	Overloaded       bool     `json:"overloaded"`
+	Paths            []string `json:"paths"`
+	Host             string   `json:"host"`
+	RTSPAddress      string   `json:"rtspAddress"`
+	RTMPAddress      string   `json:"rtmpAddress"`
+	HLSAddress       string   `json:"hlsAddress"`
+	HLSEncryption    bool     `json:"hlsEncryption"`
+	WebRTCAddress    string   `json:"webrtcAddress"`
+	WebRTCEncryption bool     `json:"webrtcEncryption"`
+}
+
+func (l *clusterLoad) hasPath(pathName string) bool {
+	for _, p := range l.Paths {
+		if p == pathName {
+			return true
+		}
+	}
+	return false
+}
+
+// hasApp checks whether the node serves a path of a RTMP application,
+// that is, a path that is equal to the application or that is inside it.
+func (l *clusterLoad) hasApp(app string) bool {
+	for _, p := range l.Paths {
+		if p == app || strings.HasPrefix(p, app+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// baseURL returns the URL of the node for the given protocol, or an empty string
+// if the protocol is disabled.
+func (l *clusterLoad) baseURL(host string, protocol clusterProtocol) string {
+	if l.Host != "" {
+		host = l.Host
+	}
+
+	var scheme string
+	var address string
+
+	switch protocol {
+	case clusterProtocolRTSP:
+		scheme, address = "rtsp", l.RTSPAddress
+
+	case clusterProtocolRTMP:
+		scheme, address = "rtmp", l.RTMPAddress
+
+	case clusterProtocolHLS:
+		scheme, address = "http", l.HLSAddress
+		if l.HLSEncryption {
+			scheme = "https"
+		}
+
+	default:
+		scheme, address = "http", l.WebRTCAddress
+		if l.WebRTCEncryption {
+			scheme = "https"
+		}
+	}
+
+	if address == "" {
+		return ""
+	}
+
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+
+	return scheme + "://" + net.JoinHostPort(host, port)
+}
+
+type clusterNode struct {
+	load    *clusterLoad
+	updated time.Time
+
+	// readers redirected to the node since the last update of its load
+	redirects int
+}
+
+// clusterLookup is a search of a path on origins, that is shared
+// by all readers that request the path at the same time.
+type clusterLookup struct {
+	done   chan struct{}
+	origin string
+	err    error
+}
+
+type clusterManagerParent interface {
+	Log(logger.Level, string, ...interface{})
+}
+
+// clusterManager finds paths that are not configured on origin servers,
+// and shares the load of the node with sibling nodes, in order to redirect
+// readers of overloaded nodes. It is shared between all paths and servers.
+type clusterManager struct {
+	parent clusterManagerParent
+
+	ctx       context.Context
+	ctxCancel func()
+	done      chan struct{}
+
+	mutex          sync.RWMutex
+	cnf            *conf.Conf
+	origins        []string
+	originRTSPPort int
+	httpClient     *http.Client
+	pathManager    apiPathManager
+	localLoad      *clusterLoad
+	localUpdated   time.Time
+	bytesReceived  map[string]uint64
+	nodes          map[string]*clusterNode
+	chConfReload   chan struct{}
+
+	lookupMutex sync.Mutex
+	lookups     map[string]*clusterLookup
+	misses      map[string]time.Time
+}
+
+func newClusterManager(cnf *conf.Conf, parent clusterManagerParent) *clusterManager {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	m := &clusterManager{
+		parent:        parent,
+		ctx:           ctx,
+		ctxCancel:     ctxCancel,
+		done:          make(chan struct{}),
+		localLoad:     &clusterLoad{},
+		bytesReceived: make(map[string]uint64),
+		nodes:         make(map[string]*clusterNode),
+		chConfReload:  make(chan struct{}, 1),
+		lookups:       make(map[string]*clusterLookup),
+		misses:        make(map[string]time.Time),
+	}
+	m.confReload(cnf)
+
+	go m.run()
+
+	return m
+}
+
+func (m *clusterManager) close() {
+	m.ctxCancel()
+	<-m.done
+}
+
+// confReload is called by core.
+func (m *clusterManager) confReload(cnf *conf.Conf) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.cnf = cnf
+	m.origins = cnf.ClusterOrigins
+	m.originRTSPPort = cnf.ClusterOriginRTSPPort
+	m.httpClient = &http.Client{
+		Timeout: time.Duration(cnf.ClusterTimeout),
+	}
+
+	// remove nodes that are not in the configuration anymore
+	nodes := make(map[string]*clusterNode)
+	for _, ur := range cnf.ClusterNodes {
+		if n, ok := m.nodes[ur]; ok {
+			nodes[ur] = n
+		} else {
+			nodes[ur] = &clusterNode{}
+		}
+	}
+	m.nodes = nodes
+
+	// origins may have changed
+	m.lookupMutex.Lock()
+	m.misses = make(map[string]time.Time)
+	m.lookupMutex.Unlock()
+
+	// apply the new interval
+	select {
+	case m.chConfReload <- struct{}{}:
+	default:
+	}
+}
+
+// pathManagerSet is called by pathManager.
+func (m *clusterManager) pathManagerSet(s apiPathManager) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.pathManager = s
+}
+
+func (m *clusterManager) run() {
+	defer close(m.done)
+
+	for {
+		m.mutex.RLock()
+		interval := time.Duration(m.cnf.ClusterLoadInterval)
+		m.mutex.RUnlock()
+
+		select {
+		case <-time.After(interval):
+			m.updateLocalLoad()
+			m.updateNodes()
+
+		case <-m.chConfReload:
+
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+// updateLocalLoad computes the load of the node.
+// Bandwidth is estimated by multiplying the incoming bitrate of every path
+// by the number of its readers.
+func (m *clusterManager) updateLocalLoad() {
+	m.mutex.RLock()
+	pm := m.pathManager
+	cnf := m.cnf
+	m.mutex.RUnlock()
+
+	load := &clusterLoad{
+		Paths:            []string{},
+		Host:             cnf.ClusterPublicHost,
+		HLSEncryption:    cnf.HLSEncryption,
+		WebRTCEncryption: cnf.WebRTCEncryption,
+	}
+	if !cnf.RTSPDisable {
+		load.RTSPAddress = cnf.RTSPAddress
+	}
+	if !cnf.RTMPDisable {
+		load.RTMPAddress = cnf.RTMPAddress
+	}
+	if !cnf.HLSDisable {
+		load.HLSAddress = cnf.HLSAddress
+	}
+	if !cnf.WebRTCDisable {
+		load.WebRTCAddress = cnf.WebRTCAddress
+	}
+
+	now := time.Now()
+	bytesReceived := make(map[string]uint64)
+
+	if pm != nil {
+		res := pm.apiPathsList()
+		if res.err == nil {
+			m.mutex.RLock()
+			elapsed := now.Sub(m.localUpdated).Seconds()
+			prevBytesReceived := m.bytesReceived
+			m.mutex.RUnlock()
+
+			for name, item := range res.data.Items {
+				load.Readers += len(item.Readers)
+				bytesReceived[name] = item.BytesReceived
+
+				if prev, ok := prevBytesReceived[name]; ok && item.BytesReceived >= prev {
+					bitrate := float64(item.BytesReceived-prev) * 8 / elapsed
+					load.Bandwidth += bitrate * float64(len(item.Readers))
+				}
+
+				if item.SourceReady {
+					load.Paths = append(load.Paths, name)
+				}
+			}
+		}
+	}
+
+	load.Overloaded = (cnf.ClusterMaxReaders != 0 && load.Readers >= cnf.ClusterMaxReaders) ||
+		(cnf.ClusterMaxBandwidth != 0 && load.Bandwidth >= float64(cnf.ClusterMaxBandwidth))
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.localLoad = load
+	m.localUpdated = now
+	m.bytesReceived = bytesReceived
+}
+
+func (m *clusterManager) fetchNodeLoad(httpClient *http.Client, ur string) (*clusterLoad, error) {
+	req, err := http.NewRequestWithContext(m.ctx, http.MethodGet, ur+"/v1/cluster/load", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	var load clusterLoad
+	err = json.NewDecoder(res.Body).Decode(&load)
+	if err != nil {
+		return nil, err
+	}
+
+	return &load, nil
+}
+
+// updateNodes fetches the load of sibling nodes.
+func (m *clusterManager) updateNodes() {
+	m.mutex.RLock()
+	httpClient := m.httpClient
+	urls := make([]string, 0, len(m.nodes))
+	for ur := range m.nodes {
+		urls = append(urls, ur)
+	}
+	m.mutex.RUnlock()
+
+	var wg sync.WaitGroup
+
+	for _, ur := range urls {
+		wg.Add(1)
+		go func(ur string) {
+			defer wg.Done()
+
+			load, err := m.fetchNodeLoad(httpClient, ur)
+			if err != nil {
+				m.log(logger.Debug, "unable to fetch load of node %s: %s", ur, err)
+				return
+			}
+
+			m.mutex.Lock()
+			defer m.mutex.Unlock()
+
+			if n, ok := m.nodes[ur]; ok {
+				n.load = load
+				n.updated = time.Now()
+				n.redirects = 0
+			}
+		}(ur)
+	}
+
+	wg.Wait()
+}
+
+// apiLoad is called by api.
+func (m *clusterManager) apiLoad() *clusterLoad {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return m.localLoad
+}
+
+// redirect returns the URL of the sibling node to which a reader of a path
+// must be redirected, or an empty string if the node is not overloaded.
+func (m *clusterManager) redirect(pathName string, protocol clusterProtocol) string {
+	return m.redirectTo(protocol, func(l *clusterLoad) bool {
+		return l.hasPath(pathName)
+	})
+}
+
+// redirectApp returns the URL of the sibling node to which a RTMP client
+// of an application must be redirected, or an empty string if the node is not overloaded.
+func (m *clusterManager) redirectApp(app string) string {
+	return m.redirectTo(clusterProtocolRTMP, func(l *clusterLoad) bool {
+		return l.hasApp(app)
+	})
+}
+
+// redirectTo returns the URL of the sibling node to which a reader must be redirected.
+// The chosen node is the one with the least readers, between the ones
+// that are not overloaded and that are serving the requested paths.
+// Readers redirected since the last update of the loads are counted too,
+// in order to spread them between nodes.
+func (m *clusterManager) redirectTo(protocol clusterProtocol, serves func(*clusterLoad) bool) string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if !m.localLoad.Overloaded {
+		return ""
+	}
+
+	// ignore loads that were not updated recently
+	maxAge := 3 * time.Duration(m.cnf.ClusterLoadInterval)
+
+	var best *clusterNode
+	bestURL := ""
+
+	for ur, n := range m.nodes {
+		if n.load == nil || time.Since(n.updated) > maxAge ||
+			n.load.Overloaded || !serves(n.load) {
+			continue
+		}
+
+		u, err := url.Parse(ur)
+		if err != nil {
+			continue
+		}
+
+		base := n.load.baseURL(u.Hostname(), protocol)
+		if base == "" {
+			continue
+		}
+
+		if best == nil || n.load.Readers+n.redirects < best.load.Readers+best.redirects ||
+			(n.load.Readers+n.redirects == best.load.Readers+best.redirects &&
+				n.load.Bandwidth < best.load.Bandwidth) {
+			best = n
+			bestURL = base
+		}
+	}
+
+	if best != nil {
+		best.redirects++
+	}
+
+	return bestURL
+}
+
+func (m *clusterManager) log(level logger.Level, format string, args ...interface{}) {
+	m.parent.Log(level, "[cluster] "+format, args...)
+}
+
+func (m *clusterManager) originHasPath(
+	ctx context.Context,
+	httpClient *http.Client,
+	origin string,
+	pathName string,
+) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, origin+"/v1/paths/list", nil)
+	if err != nil {
+		return false, err
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	var paths clusterOriginPaths
+	err = json.NewDecoder(res.Body).Decode(&paths)
+	if err != nil {
+		return false, err
+	}
+
+	p, ok := paths.Items[pathName]
+	return ok && p.canBePulled(), nil
+}
+
+// queryOrigins queries all origins in parallel and returns the one with the
+// highest priority, that is the first in the list, that publishes the path.
+func (m *clusterManager) queryOrigins(ctx context.Context, pathName string) (string, error) {
+	m.mutex.RLock()
+	origins := m.origins
+	httpClient := m.httpClient
+	m.mutex.RUnlock()
+
+	found := make([]bool, len(origins))
+	var wg sync.WaitGroup
+
+	for i, origin := range origins {
+		wg.Add(1)
+		go func(i int, origin string) {
+			defer wg.Done()
+
+			ok, err := m.originHasPath(ctx, httpClient, origin, pathName)
+			if err != nil {
+				m.log(logger.Warn, "unable to query origin %s: %s", origin, err)
+				return
+			}
+			found[i] = ok
+		}(i, origin)
+	}
+
+	wg.Wait()
+
+	for i, ok := range found {
+		if ok {
+			return origins[i], nil
+		}
+	}
+
+	return "", fmt.Errorf("path '%s' is not available on any origin", pathName)
+}
+
+// findOrigin returns the origin that publishes a path.
+// Concurrent searches of the same path are merged into a single one, and paths
+// that are not available on any origin are not searched again for clusterMissTTL.
+func (m *clusterManager) findOrigin(ctx context.Context, pathName string) (string, error) {
+	m.lookupMutex.Lock()
+
+	if t, ok := m.misses[pathName]; ok && time.Since(t) < clusterMissTTL {
+		m.lookupMutex.Unlock()
+		return "", fmt.Errorf("path '%s' is not available on any origin", pathName)
+	}
+
+	if l, ok := m.lookups[pathName]; ok {
+		m.lookupMutex.Unlock()
+
+		select {
+		case <-l.done:
+			return l.origin, l.err
+		case <-ctx.Done():
+			return "", fmt.Errorf("terminated")
+		}
+	}
+
+	l := &clusterLookup{done: make(chan struct{})}
+	m.lookups[pathName] = l
+	m.lookupMutex.Unlock()
+
+	l.origin, l.err = m.queryOrigins(ctx, pathName)
+
+	m.lookupMutex.Lock()
+	delete(m.lookups, pathName)
+	if l.err != nil {
+		now := time.Now()
+		for name, t := range m.misses {
+			if now.Sub(t) >= clusterMissTTL {
+				delete(m.misses, name)
+			}
+		}
+		m.misses[pathName] = now
+	}
+	m.lookupMutex.Unlock()
+
+	close(l.done)
+
+	return l.origin, l.err
+}
+
+// readConf returns the configuration that is used to authenticate readers
+// of a path that may be pulled from an origin, or nil if there are no origins.
+// It is called by pathManager.
+func (m *clusterManager) readConf(pathName string) (*conf.PathConf, error) {
+	m.mutex.RLock()
+	enabled := len(m.origins) != 0
+	cnf := m.cnf
+	m.mutex.RUnlock()
+
+	if !enabled {
+		return nil, nil
+	}
+
+	pathConf := &conf.PathConf{}
+	err := cnf.FillPathConf(pathConf, pathName)
+	if err != nil {
+		return nil, err
+	}
+
+	return pathConf, nil
+}
+
+// pathConf returns the configuration of a path that is pulled from an origin,
+// or nil if there are no origins. It is called by pathManager.
+func (m *clusterManager) pathConf(ctx context.Context, pathName string) (*conf.PathConf, error) {
+	m.mutex.RLock()
+	enabled := len(m.origins) != 0
+	m.mutex.RUnlock()
+
+	if !enabled {
+		return nil, nil
+	}
+
+	origin, err := m.findOrigin(ctx, pathName)
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mutex.RLock()
+	cnf := m.cnf
+	originRTSPPort := m.originRTSPPort
+	m.mutex.RUnlock()
+
+	source := url.URL{
+		Scheme: "rtsp",
+		User:   u.User,
+		Host:   net.JoinHostPort(u.Hostname(), strconv.FormatInt(int64(originRTSPPort), 10)),
+		Path:   "/" + pathName,
+	}
+
+	pathConf := &conf.PathConf{
+		Source:         source.String(),
+		SourceOnDemand: true,
+	}
+
+	err = cnf.FillPathConf(pathConf, pathName)
+	if err != nil {
+		return nil, err
+	}
+
+	m.log(logger.Info, "pulling path '%s' from %s", pathName, u.Host)
+
+	return pathConf, nil
+}
+
+// clusterRedirectURL returns the URL to which a reader is redirected.
+func clusterRedirectURL(base string, pathName string, rawQuery string) string {
+	u := base + "/" + pathName
+	if rawQuery != "" {
+		u += "?" + rawQuery
+	}
+	return u
+}
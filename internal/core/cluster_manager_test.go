@@ -0,0 +1,53 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+func TestClusterManagerRedirect(t *testing.T) {
+	m := &clusterManager{
+		cnf:       &conf.Conf{ClusterLoadInterval: conf.StringDuration(10 * time.Second)},
+		localLoad: &clusterLoad{Overloaded: true},
+		nodes: map[string]*clusterNode{
+			"http://node1:9997": {
+				load: &clusterLoad{
+					Readers:     1,
+					Paths:       []string{"live/cam1"},
+					RTSPAddress: ":8554",
+					RTMPAddress: ":1935",
+				},
+				updated: time.Now(),
+			},
+			"http://node2:9997": {
+				load: &clusterLoad{
+					Readers:     2,
+					Paths:       []string{"live/cam1"},
+					RTSPAddress: ":8554",
+					RTMPAddress: ":1935",
+				},
+				updated: time.Now(),
+			},
+		},
+	}
+
+	// redirected readers are counted until the next update of the loads
+	var urls []string
+	for i := 0; i < 3; i++ {
+		urls = append(urls, m.redirect("live/cam1", clusterProtocolRTSP))
+	}
+	require.Equal(t, "rtsp://node1:8554", urls[0])
+	require.ElementsMatch(t, []string{"rtsp://node1:8554", "rtsp://node2:8554"}, urls[1:])
+
+	require.Equal(t, "", m.redirect("live/cam2", clusterProtocolRTSP))
+
+	require.NotEqual(t, "", m.redirectApp("live"))
+	require.Equal(t, "", m.redirectApp("liv"))
+
+	m.localLoad.Overloaded = false
+	require.Equal(t, "", m.redirect("live/cam1", clusterProtocolRTSP))
+}
@@ -0,0 +1,289 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+const (
+	// timeout of requests, that is added to the wait time when long polling.
+	confRemoteTimeout = 10 * time.Second
+
+	// minimum pause between long polling requests, in case the server doesn't support them.
+	confRemoteMinPause = 1 * time.Second
+
+	// maximum size of a remote configuration.
+	confRemoteMaxSize = 10 * 1024 * 1024
+)
+
+type confRemoteUpdate struct {
+	byts    []byte
+	version uint64
+	sig     string
+}
+
+// checkVersion checks that a configuration is not older than the last one that was applied,
+// in order to prevent older signed configurations from being replayed.
+func (u *confRemoteUpdate) checkVersion(last *confRemoteUpdate) error {
+	if last == nil {
+		return nil
+	}
+
+	if u.version < last.version ||
+		(u.version == last.version && !bytes.Equal(u.byts, last.byts)) {
+		return fmt.Errorf("configuration version %d is not newer than the current one (%d)",
+			u.version, last.version)
+	}
+
+	return nil
+}
+
+// fetchConfRemote downloads a remote configuration.
+// If the configuration didn't change since the request with the given ETag, nil is returned.
+// Configurations that are older than last are discarded.
+func fetchConfRemote(
+	ctx context.Context,
+	httpClient *http.Client,
+	cnf *conf.Conf,
+	etag string,
+	wait time.Duration,
+	last *confRemoteUpdate,
+) (*confRemoteUpdate, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cnf.ConfURL, nil)
+	if err != nil {
+		return nil, "", err
+	}
+
+	req.Header.Set("Accept", "application/yaml, application/json")
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if wait != 0 {
+		req.Header.Set("Prefer", fmt.Sprintf("wait=%d", int(wait.Seconds())))
+	}
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	byts, err := io.ReadAll(io.LimitReader(res.Body, confRemoteMaxSize))
+	if err != nil {
+		return nil, "", err
+	}
+
+	v := res.Header.Get("X-Config-Version")
+	if v == "" {
+		return nil, "", fmt.Errorf("version is missing")
+	}
+
+	version, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid version: %s", err)
+	}
+
+	u := &confRemoteUpdate{
+		byts:    byts,
+		version: version,
+		sig:     res.Header.Get("X-Signature"),
+	}
+
+	err = conf.VerifyRemote(cnf.ConfURLPublicKey, u.version, u.byts, u.sig)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = u.checkVersion(last)
+	if err != nil {
+		return nil, "", err
+	}
+
+	return u, res.Header.Get("ETag"), nil
+}
+
+// readConfRemoteCache reads the last remote configuration that was applied successfully.
+func readConfRemoteCache(cnf *conf.Conf) (*confRemoteUpdate, error) {
+	byts, err := os.ReadFile(cnf.ConfURLCacheFile)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature file contains the version and the signature
+	sig, err := os.ReadFile(cnf.ConfURLCacheFile + ".sig")
+	if err != nil {
+		return nil, err
+	}
+
+	fields := strings.Fields(string(sig))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid signature file")
+	}
+
+	version, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid version: %s", err)
+	}
+
+	u := &confRemoteUpdate{
+		byts:    byts,
+		version: version,
+		sig:     fields[1],
+	}
+
+	err = conf.VerifyRemote(cnf.ConfURLPublicKey, u.version, u.byts, u.sig)
+	if err != nil {
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// writeConfRemoteCache writes a remote configuration on disk, in order to use it
+// when the server is not reachable at startup.
+func writeConfRemoteCache(cnf *conf.Conf, u *confRemoteUpdate) error {
+	err := conf.WriteFile(cnf.ConfURLCacheFile, u.byts)
+	if err != nil {
+		return err
+	}
+
+	return conf.WriteFile(cnf.ConfURLCacheFile+".sig",
+		[]byte(strconv.FormatUint(u.version, 10)+"\n"+u.sig+"\n"))
+}
+
+type confRemoteParent interface {
+	Log(logger.Level, string, ...interface{})
+}
+
+// confRemote polls a remote configuration.
+// Requests contain the ETag of the last configuration, in order to
+// allow the server to reply with 304 Not Modified. When long polling is enabled,
+// the server can keep requests open until the configuration changes.
+type confRemote struct {
+	cnf        *conf.Conf
+	parent     confRemoteParent
+	etag       string
+	last       *confRemoteUpdate
+	ctx        context.Context
+	ctxCancel  func()
+	httpClient *http.Client
+
+	// out
+	chUpdate chan *confRemoteUpdate
+	done     chan struct{}
+}
+
+func newConfRemote(
+	cnf *conf.Conf,
+	etag string,
+	last *confRemoteUpdate,
+	parent confRemoteParent,
+) *confRemote {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	timeout := confRemoteTimeout
+	if cnf.ConfURLLongPoll {
+		timeout += time.Duration(cnf.ConfURLInterval)
+	}
+
+	r := &confRemote{
+		cnf:        cnf,
+		parent:     parent,
+		etag:       etag,
+		last:       last,
+		ctx:        ctx,
+		ctxCancel:  ctxCancel,
+		httpClient: &http.Client{Timeout: timeout},
+		chUpdate:   make(chan *confRemoteUpdate),
+		done:       make(chan struct{}),
+	}
+
+	r.log(logger.Info, "polling %s", cnf.ConfURL)
+
+	go r.run()
+
+	return r
+}
+
+func (r *confRemote) close() {
+	r.log(logger.Info, "closing")
+	r.ctxCancel()
+	<-r.done
+}
+
+func (r *confRemote) log(level logger.Level, format string, args ...interface{}) {
+	r.parent.Log(level, "[conf remote] "+format, args...)
+}
+
+func (r *confRemote) run() {
+	defer close(r.done)
+
+	for {
+		pause := time.Duration(r.cnf.ConfURLInterval)
+		if r.cnf.ConfURLLongPoll {
+			pause = confRemoteMinPause
+		}
+
+		err := r.poll()
+		if err != nil {
+			r.log(logger.Warn, "unable to fetch configuration: %s", err)
+			pause = time.Duration(r.cnf.ConfURLInterval)
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *confRemote) poll() error {
+	var wait time.Duration
+	if r.cnf.ConfURLLongPoll {
+		wait = time.Duration(r.cnf.ConfURLInterval)
+	}
+
+	u, etag, err := fetchConfRemote(r.ctx, r.httpClient, r.cnf, r.etag, wait, r.last)
+	if err != nil {
+		return err
+	}
+
+	r.etag = etag
+
+	if u == nil || (r.last != nil && bytes.Equal(u.byts, r.last.byts)) {
+		return nil
+	}
+
+	r.last = u
+
+	select {
+	case r.chUpdate <- u:
+	case <-r.ctx.Done():
+	}
+
+	return nil
+}
+
+// update returns a channel that receives new remote configurations.
+func (r *confRemote) update() chan *confRemoteUpdate {
+	return r.chUpdate
+}
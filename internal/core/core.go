@@ -4,9 +4,13 @@ package core
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"reflect"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/aler9/gortsplib/v2"
@@ -22,6 +26,10 @@ import (
 
 var version = "v0.0.0"
 
+const (
+	coreDrainCheckPeriod = 1 * time.Second
+)
+
 // Core is an instance of rtsp-simple-server.
 type Core struct {
 	ctx             context.Context
@@ -31,6 +39,11 @@ type Core struct {
 	confFound       bool
 	logger          *logger.Logger
 	externalCmdPool *externalcmd.Pool
+	authManager     *authManager
+	limitManager    *limitManager
+	clusterManager  *clusterManager
+	eventBus        *eventBus
+	webhookManager  *webhookManager
 	metrics         *metrics
 	pprof           *pprof
 	pathManager     *pathManager
@@ -42,17 +55,85 @@ type Core struct {
 	webRTCServer    *webRTCServer
 	api             *api
 	confWatcher     *confwatcher.ConfWatcher
+	confRemote      *confRemote
+
+	// remote configuration
+	confRemoteLast *confRemoteUpdate
+	confRemoteETag string
+	confRemoteErr  error
 
 	// in
 	chAPIConfigSet chan *conf.Conf
+	interrupt      chan os.Signal
 
 	// out
 	done chan struct{}
 }
 
 var cli struct {
-	Version  bool   `help:"print version"`
-	Confpath string `arg:"" default:"rtsp-simple-server.yml"`
+	Version bool `help:"print version"`
+
+	Run struct {
+		Confpath string `arg:"" default:"rtsp-simple-server.yml"`
+	} `cmd:"" default:"withargs" help:"run the server (default command). A config file whose name is a command (i.e. validate) must be passed with 'run <confpath>' or '-- <confpath>'"`
+
+	Validate struct {
+		Confpath string `arg:"" default:"rtsp-simple-server.yml"`
+	} `cmd:"" help:"check a config file and print all errors and warnings"`
+
+	Encrypt struct {
+		Confpath    string `arg:"" default:"rtsp-simple-server.yml"`
+		Output      string `short:"o" help:"write the result into this file instead of printing it"`
+		SecretsOnly bool   `help:"encrypt only credentials and secrets, leaving the rest of the file in plain text"`
+	} `cmd:"" help:"encrypt a config file with the key in the RTSP_CONFKEY variable"`
+
+	Decrypt struct {
+		Confpath string `arg:"" default:"rtsp-simple-server.yml"`
+		Output   string `short:"o" help:"write the result into this file instead of printing it"`
+	} `cmd:"" help:"decrypt a config file with the key in the RTSP_CONFKEY variable"`
+}
+
+// encryptOrDecrypt encrypts or decrypts a configuration file.
+func encryptOrDecrypt(confPath string, output string, cb func(key string, byts []byte) ([]byte, error)) error {
+	key, err := conf.ConfKey()
+	if err != nil {
+		return err
+	}
+
+	byts, err := os.ReadFile(confPath)
+	if err != nil {
+		return err
+	}
+
+	byts, err = cb(key, byts)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = os.Stdout.Write(byts)
+		return err
+	}
+
+	return conf.WriteFile(output, byts)
+}
+
+// validate checks a configuration file and prints the result.
+func validate(confPath string) bool {
+	res := conf.ValidateFile(confPath)
+
+	for _, e := range res.Errors {
+		fmt.Printf("ERR: %s\n", e)
+	}
+	for _, w := range res.Warnings {
+		fmt.Printf("WAR: %s\n", w)
+	}
+
+	if res.OK() {
+		fmt.Printf("configuration is valid\n")
+	}
+
+	return res.OK()
 }
 
 // New allocates a core.
@@ -73,7 +154,13 @@ func New(args []string) (*Core, bool) {
 		panic(err)
 	}
 
-	_, err = parser.Parse(args)
+	// kong ignores the arguments that follow "--" when the default command is omitted,
+	// therefore the command is added explicitly.
+	if len(args) != 0 && args[0] == "--" {
+		args = append([]string{"run"}, args...)
+	}
+
+	kctx, err := parser.Parse(args)
 	parser.FatalIfErrorf(err)
 
 	if cli.Version {
@@ -81,13 +168,41 @@ func New(args []string) (*Core, bool) {
 		os.Exit(0)
 	}
 
+	switch strings.Split(kctx.Command(), " ")[0] {
+	case "validate":
+		if !validate(cli.Validate.Confpath) {
+			os.Exit(1)
+		}
+		os.Exit(0)
+
+	case "encrypt":
+		err := encryptOrDecrypt(cli.Encrypt.Confpath, cli.Encrypt.Output,
+			func(key string, byts []byte) ([]byte, error) {
+				return conf.EncryptFile(key, byts, cli.Encrypt.SecretsOnly)
+			})
+		if err != nil {
+			fmt.Printf("ERR: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+
+	case "decrypt":
+		err := encryptOrDecrypt(cli.Decrypt.Confpath, cli.Decrypt.Output, conf.DecryptFile)
+		if err != nil {
+			fmt.Printf("ERR: %s\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
 	ctx, ctxCancel := context.WithCancel(context.Background())
 
 	p := &Core{
 		ctx:            ctx,
 		ctxCancel:      ctxCancel,
-		confPath:       cli.Confpath,
+		confPath:       cli.Run.Confpath,
 		chAPIConfigSet: make(chan *conf.Conf),
+		interrupt:      make(chan os.Signal, 1),
 		done:           make(chan struct{}),
 	}
 
@@ -97,6 +212,10 @@ func New(args []string) (*Core, bool) {
 		return nil, false
 	}
 
+	if p.conf.ConfURL != "" {
+		p.loadConfRemote()
+	}
+
 	err = p.createResources(true)
 	if err != nil {
 		if p.logger != nil {
@@ -139,8 +258,14 @@ func (p *Core) run() {
 		return make(chan struct{})
 	}()
 
-	interrupt := make(chan os.Signal, 1)
-	signal.Notify(interrupt, os.Interrupt)
+	confRemoteUpdated := func() chan *confRemoteUpdate {
+		if p.confRemote != nil {
+			return p.confRemote.update()
+		}
+		return nil
+	}
+
+	signal.Notify(p.interrupt, os.Interrupt, syscall.SIGTERM)
 
 outer:
 	for {
@@ -148,18 +273,41 @@ outer:
 		case <-confChanged:
 			p.Log(logger.Info, "reloading configuration (file changed)")
 
-			newConf, _, err := conf.Load(p.confPath)
+			newConf, err := p.loadConf()
+			if err != nil {
+				p.Log(logger.Error, "%s", err)
+				break outer
+			}
+
+			err = p.reloadConf(newConf, false)
 			if err != nil {
 				p.Log(logger.Error, "%s", err)
 				break outer
 			}
 
+		case u := <-confRemoteUpdated():
+			p.Log(logger.Info, "reloading configuration (remote configuration changed)")
+
+			// an invalid remote configuration is discarded and the current one is kept
+			newConf, _, err := conf.LoadWithRemote(p.confPath, u.byts)
+			if err != nil {
+				p.Log(logger.Error, "%s", err)
+				break
+			}
+
 			err = p.reloadConf(newConf, false)
 			if err != nil {
 				p.Log(logger.Error, "%s", err)
 				break outer
 			}
 
+			p.confRemoteLast = u
+
+			err = writeConfRemoteCache(p.conf, u)
+			if err != nil {
+				p.Log(logger.Warn, "unable to cache remote configuration: %s", err)
+			}
+
 		case newConf := <-p.chAPIConfigSet:
 			p.Log(logger.Info, "reloading configuration (API request)")
 
@@ -169,8 +317,19 @@ outer:
 				break outer
 			}
 
-		case <-interrupt:
+			if p.conf.APIPersistConf {
+				err := p.persistConf()
+				if err != nil {
+					p.Log(logger.Error, "unable to write configuration file: %s", err)
+				}
+			}
+
+		case <-p.interrupt:
 			p.Log(logger.Info, "shutting down gracefully")
+
+			if p.conf.DrainTimeout != 0 {
+				p.drain()
+			}
 			break outer
 
 		case <-p.ctx.Done():
@@ -183,6 +342,106 @@ outer:
 	p.closeResources(nil, false)
 }
 
+// drain allows clients to finish their sessions before resources are closed.
+// It can be interrupted by a second signal.
+func (p *Core) drain() {
+	p.Log(logger.Info, "draining connections")
+
+	if p.api != nil {
+		p.api.drainStart()
+	}
+
+	// allow load balancers to notice that the server is not ready anymore
+	if p.conf.DrainDelay != 0 {
+		select {
+		case <-time.After(time.Duration(p.conf.DrainDelay)):
+		case <-p.interrupt:
+			return
+		case <-p.ctx.Done():
+			return
+		}
+	}
+
+	if p.rtspServer != nil {
+		p.rtspServer.drain()
+	}
+	if p.rtspsServer != nil {
+		p.rtspsServer.drain()
+	}
+	if p.rtmpServer != nil {
+		p.rtmpServer.drain(false)
+	}
+	if p.rtmpsServer != nil {
+		p.rtmpsServer.drain(false)
+	}
+	if p.hlsServer != nil {
+		p.hlsServer.drain()
+	}
+	if p.webRTCServer != nil {
+		p.webRTCServer.drain()
+	}
+
+	timeout := time.NewTimer(time.Duration(p.conf.DrainTimeout))
+	defer timeout.Stop()
+
+	checkTicker := time.NewTicker(coreDrainCheckPeriod)
+	defer checkTicker.Stop()
+
+outer:
+	for {
+		n := p.drainReadersCount()
+		if n == 0 {
+			break
+		}
+
+		select {
+		case <-checkTicker.C:
+
+		case <-timeout.C:
+			p.Log(logger.Info, "drain timeout reached, %d sessions are still active", n)
+			break outer
+
+		case <-p.interrupt:
+			return
+
+		case <-p.ctx.Done():
+			return
+		}
+	}
+
+	// RTMP readers, that can't be notified without being disconnected, and publishers,
+	// that feed the remaining readers, are notified last.
+	if p.rtmpServer != nil {
+		p.rtmpServer.drain(true)
+	}
+	if p.rtmpsServer != nil {
+		p.rtmpsServer.drain(true)
+	}
+}
+
+func (p *Core) drainReadersCount() int {
+	n := 0
+	if p.rtspServer != nil {
+		n += p.rtspServer.readersCount()
+	}
+	if p.rtspsServer != nil {
+		n += p.rtspsServer.readersCount()
+	}
+	if p.rtmpServer != nil {
+		n += p.rtmpServer.readersCount()
+	}
+	if p.rtmpsServer != nil {
+		n += p.rtmpsServer.readersCount()
+	}
+	if p.hlsServer != nil {
+		n += p.hlsServer.activeMuxersCount()
+	}
+	if p.webRTCServer != nil {
+		n += p.webRTCServer.connsCount()
+	}
+	return n
+}
+
 func (p *Core) createResources(initial bool) error {
 	var err error
 
@@ -202,6 +461,12 @@ func (p *Core) createResources(initial bool) error {
 		if !p.confFound {
 			p.Log(logger.Warn, "configuration file not found, using an empty configuration")
 		}
+		if p.confRemoteErr != nil {
+			p.Log(logger.Warn, "unable to load remote configuration: %s", p.confRemoteErr)
+			if p.confRemoteLast != nil {
+				p.Log(logger.Warn, "using cached remote configuration")
+			}
+		}
 
 		// on Linux, try to raise the number of file descriptors that can be opened
 		// to allow the maximum possible number of clients
@@ -211,12 +476,24 @@ func (p *Core) createResources(initial bool) error {
 		gin.SetMode(gin.ReleaseMode)
 
 		p.externalCmdPool = externalcmd.NewPool()
+
+		p.eventBus = newEventBus()
+		p.authManager = newAuthManager(p.conf, p.eventBus, p)
+		p.limitManager = newLimitManager(p.conf)
+		p.clusterManager = newClusterManager(p.conf, p)
+		p.webhookManager = newWebhookManager(p.conf, p.eventBus, p)
 	}
 
 	if p.conf.Metrics {
 		if p.metrics == nil {
 			p.metrics, err = newMetrics(
 				p.conf.MetricsAddress,
+				p.conf.MetricsEncryption,
+				p.conf.MetricsServerKey,
+				p.conf.MetricsServerCert,
+				p.authManager,
+				p.limitManager,
+				p.webhookManager,
 				p,
 			)
 			if err != nil {
@@ -229,6 +506,10 @@ func (p *Core) createResources(initial bool) error {
 		if p.pprof == nil {
 			p.pprof, err = newPPROF(
 				p.conf.PPROFAddress,
+				p.conf.PPROFEncryption,
+				p.conf.PPROFServerKey,
+				p.conf.PPROFServerCert,
+				p.authManager,
 				p,
 			)
 			if err != nil {
@@ -244,9 +525,12 @@ func (p *Core) createResources(initial bool) error {
 			p.conf.ReadTimeout,
 			p.conf.WriteTimeout,
 			p.conf.ReadBufferCount,
-			p.conf.Paths,
+			p.conf.EffectivePaths(),
 			p.externalCmdPool,
+			p.limitManager,
+			p.eventBus,
 			p.metrics,
+			p.clusterManager,
 			p,
 		)
 	}
@@ -259,7 +543,9 @@ func (p *Core) createResources(initial bool) error {
 			_, useMulticast := p.conf.Protocols[conf.Protocol(gortsplib.TransportUDPMulticast)]
 			p.rtspServer, err = newRTSPServer(
 				p.ctx,
-				p.conf.ExternalAuthenticationURL,
+				p.authManager,
+				p.limitManager,
+				p.eventBus,
 				p.conf.RTSPAddress,
 				p.conf.AuthMethods,
 				p.conf.ReadTimeout,
@@ -275,10 +561,12 @@ func (p *Core) createResources(initial bool) error {
 				false,
 				"",
 				"",
+				"",
 				p.conf.RTSPAddress,
 				p.conf.Protocols,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -296,7 +584,9 @@ func (p *Core) createResources(initial bool) error {
 		if p.rtspsServer == nil {
 			p.rtspsServer, err = newRTSPServer(
 				p.ctx,
-				p.conf.ExternalAuthenticationURL,
+				p.authManager,
+				p.limitManager,
+				p.eventBus,
 				p.conf.RTSPSAddress,
 				p.conf.AuthMethods,
 				p.conf.ReadTimeout,
@@ -312,10 +602,12 @@ func (p *Core) createResources(initial bool) error {
 				true,
 				p.conf.ServerCert,
 				p.conf.ServerKey,
+				p.conf.ClientCA,
 				p.conf.RTSPAddress,
 				p.conf.Protocols,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -333,7 +625,9 @@ func (p *Core) createResources(initial bool) error {
 		if p.rtmpServer == nil {
 			p.rtmpServer, err = newRTMPServer(
 				p.ctx,
-				p.conf.ExternalAuthenticationURL,
+				p.authManager,
+				p.limitManager,
+				p.eventBus,
 				p.conf.RTMPAddress,
 				p.conf.ReadTimeout,
 				p.conf.WriteTimeout,
@@ -341,9 +635,11 @@ func (p *Core) createResources(initial bool) error {
 				false,
 				"",
 				"",
+				"",
 				p.conf.RTSPAddress,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -361,7 +657,9 @@ func (p *Core) createResources(initial bool) error {
 		if p.rtmpsServer == nil {
 			p.rtmpsServer, err = newRTMPServer(
 				p.ctx,
-				p.conf.ExternalAuthenticationURL,
+				p.authManager,
+				p.limitManager,
+				p.eventBus,
 				p.conf.RTMPSAddress,
 				p.conf.ReadTimeout,
 				p.conf.WriteTimeout,
@@ -369,9 +667,11 @@ func (p *Core) createResources(initial bool) error {
 				true,
 				p.conf.RTMPServerCert,
 				p.conf.RTMPServerKey,
+				p.conf.RTMPClientCA,
 				p.conf.RTSPAddress,
 				p.conf.RunOnConnect,
 				p.conf.RunOnConnectRestart,
+				p.conf.RunOnDisconnect,
 				p.externalCmdPool,
 				p.metrics,
 				p.pathManager,
@@ -391,7 +691,9 @@ func (p *Core) createResources(initial bool) error {
 				p.conf.HLSEncryption,
 				p.conf.HLSServerKey,
 				p.conf.HLSServerCert,
-				p.conf.ExternalAuthenticationURL,
+				p.conf.HLSClientCA,
+				p.authManager,
+				p.limitManager,
 				p.conf.HLSAlwaysRemux,
 				p.conf.HLSVariant,
 				p.conf.HLSSegmentCount,
@@ -416,11 +718,14 @@ func (p *Core) createResources(initial bool) error {
 		if p.webRTCServer == nil {
 			p.webRTCServer, err = newWebRTCServer(
 				p.ctx,
-				p.conf.ExternalAuthenticationURL,
+				p.authManager,
+				p.limitManager,
+				p.eventBus,
 				p.conf.WebRTCAddress,
 				p.conf.WebRTCEncryption,
 				p.conf.WebRTCServerKey,
 				p.conf.WebRTCServerCert,
+				p.conf.WebRTCClientCA,
 				p.conf.WebRTCAllowOrigin,
 				p.conf.WebRTCTrustedProxies,
 				p.conf.WebRTCICEServers,
@@ -442,7 +747,15 @@ func (p *Core) createResources(initial bool) error {
 		if p.api == nil {
 			p.api, err = newAPI(
 				p.conf.APIAddress,
+				p.conf.APIEncryption,
+				p.conf.APIServerKey,
+				p.conf.APIServerCert,
 				p.conf,
+				p.confPath,
+				p.authManager,
+				p.eventBus,
+				p.clusterManager,
+				p.externalCmdPool,
 				p.pathManager,
 				p.rtspServer,
 				p.rtspsServer,
@@ -465,40 +778,66 @@ func (p *Core) createResources(initial bool) error {
 		}
 	}
 
+	if p.conf.ConfURL != "" && p.confRemote == nil {
+		p.confRemote = newConfRemote(p.conf, p.confRemoteETag, p.confRemoteLast, p)
+	}
+
+	if p.confWatcher != nil {
+		// files referenced with ${file:} are watched like included files
+		err = p.confWatcher.SetIncludes(append(p.conf.IncludePatterns(p.confPath),
+			p.conf.ReferencedFiles()...))
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
 func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
+	if newConf != nil {
+		p.authManager.confReload(newConf)
+		p.limitManager.confReload(newConf)
+		p.clusterManager.confReload(newConf)
+		p.webhookManager.confReload(newConf)
+	}
+
 	closeLogger := newConf == nil ||
 		!reflect.DeepEqual(newConf.LogDestinations, p.conf.LogDestinations) ||
 		newConf.LogFile != p.conf.LogFile
 
 	closeMetrics := newConf == nil ||
 		newConf.Metrics != p.conf.Metrics ||
-		newConf.MetricsAddress != p.conf.MetricsAddress
+		newConf.MetricsAddress != p.conf.MetricsAddress ||
+		newConf.MetricsEncryption != p.conf.MetricsEncryption ||
+		newConf.MetricsServerKey != p.conf.MetricsServerKey ||
+		newConf.MetricsServerCert != p.conf.MetricsServerCert
 
 	closePPROF := newConf == nil ||
 		newConf.PPROF != p.conf.PPROF ||
-		newConf.PPROFAddress != p.conf.PPROFAddress
+		newConf.PPROFAddress != p.conf.PPROFAddress ||
+		newConf.PPROFEncryption != p.conf.PPROFEncryption ||
+		newConf.PPROFServerKey != p.conf.PPROFServerKey ||
+		newConf.PPROFServerCert != p.conf.PPROFServerCert
 
 	closePathManager := newConf == nil ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
+		closeMetrics
+	if !closePathManager && (newConf.ReadTimeout != p.conf.ReadTimeout ||
 		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
-		closeMetrics
-	if !closePathManager && !reflect.DeepEqual(newConf.Paths, p.conf.Paths) {
-		p.pathManager.confReload(newConf.Paths)
+		!reflect.DeepEqual(newConf.EffectivePaths(), p.conf.EffectivePaths())) {
+		p.pathManager.confReload(newConf.ReadTimeout, newConf.WriteTimeout,
+			newConf.ReadBufferCount, newConf.EffectivePaths())
 	}
 
 	closeRTSPServer := newConf == nil ||
 		newConf.RTSPDisable != p.conf.RTSPDisable ||
 		newConf.Encryption != p.conf.Encryption ||
-		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		!reflect.DeepEqual(newConf.AuthMethods, p.conf.AuthMethods) ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
+		// buffers of sessions are allocated by the RTSP library with the value
+		// of the server, that can't be changed while the server is running
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
 		newConf.RTPAddress != p.conf.RTPAddress ||
@@ -508,26 +847,20 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.MulticastRTCPPort != p.conf.MulticastRTCPPort ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
 		closeMetrics ||
 		closePathManager
 
 	closeRTSPSServer := newConf == nil ||
 		newConf.RTSPDisable != p.conf.RTSPDisable ||
 		newConf.Encryption != p.conf.Encryption ||
-		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
 		newConf.RTSPSAddress != p.conf.RTSPSAddress ||
 		!reflect.DeepEqual(newConf.AuthMethods, p.conf.AuthMethods) ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
 		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.ServerCert != p.conf.ServerCert ||
 		newConf.ServerKey != p.conf.ServerKey ||
+		newConf.ClientCA != p.conf.ClientCA ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
 		!reflect.DeepEqual(newConf.Protocols, p.conf.Protocols) ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
 		closeMetrics ||
 		closePathManager
 
@@ -535,13 +868,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPEncryption != p.conf.RTMPEncryption ||
 		newConf.RTMPAddress != p.conf.RTMPAddress ||
-		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
-		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
 		closeMetrics ||
 		closePathManager
 
@@ -549,15 +876,10 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.RTMPDisable != p.conf.RTMPDisable ||
 		newConf.RTMPEncryption != p.conf.RTMPEncryption ||
 		newConf.RTMPSAddress != p.conf.RTMPSAddress ||
-		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
-		newConf.ReadTimeout != p.conf.ReadTimeout ||
-		newConf.WriteTimeout != p.conf.WriteTimeout ||
-		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		newConf.RTMPServerCert != p.conf.RTMPServerCert ||
 		newConf.RTMPServerKey != p.conf.RTMPServerKey ||
+		newConf.RTMPClientCA != p.conf.RTMPClientCA ||
 		newConf.RTSPAddress != p.conf.RTSPAddress ||
-		newConf.RunOnConnect != p.conf.RunOnConnect ||
-		newConf.RunOnConnectRestart != p.conf.RunOnConnectRestart ||
 		closeMetrics ||
 		closePathManager
 
@@ -567,7 +889,7 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.HLSEncryption != p.conf.HLSEncryption ||
 		newConf.HLSServerKey != p.conf.HLSServerKey ||
 		newConf.HLSServerCert != p.conf.HLSServerCert ||
-		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
+		newConf.HLSClientCA != p.conf.HLSClientCA ||
 		newConf.HLSAlwaysRemux != p.conf.HLSAlwaysRemux ||
 		newConf.HLSVariant != p.conf.HLSVariant ||
 		newConf.HLSSegmentCount != p.conf.HLSSegmentCount ||
@@ -577,21 +899,19 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		newConf.HLSAllowOrigin != p.conf.HLSAllowOrigin ||
 		!reflect.DeepEqual(newConf.HLSTrustedProxies, p.conf.HLSTrustedProxies) ||
 		newConf.HLSDirectory != p.conf.HLSDirectory ||
-		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		closePathManager ||
 		closeMetrics
 
 	closeWebRTCServer := newConf == nil ||
 		newConf.WebRTCDisable != p.conf.WebRTCDisable ||
-		newConf.ExternalAuthenticationURL != p.conf.ExternalAuthenticationURL ||
 		newConf.WebRTCAddress != p.conf.WebRTCAddress ||
 		newConf.WebRTCEncryption != p.conf.WebRTCEncryption ||
 		newConf.WebRTCServerKey != p.conf.WebRTCServerKey ||
 		newConf.WebRTCServerCert != p.conf.WebRTCServerCert ||
+		newConf.WebRTCClientCA != p.conf.WebRTCClientCA ||
 		newConf.WebRTCAllowOrigin != p.conf.WebRTCAllowOrigin ||
 		!reflect.DeepEqual(newConf.WebRTCTrustedProxies, p.conf.WebRTCTrustedProxies) ||
 		!reflect.DeepEqual(newConf.WebRTCICEServers, p.conf.WebRTCICEServers) ||
-		newConf.ReadBufferCount != p.conf.ReadBufferCount ||
 		closeMetrics ||
 		closePathManager ||
 		!reflect.DeepEqual(newConf.WebRTCICEHostNAT1To1IPs, p.conf.WebRTCICEHostNAT1To1IPs) ||
@@ -601,6 +921,9 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 	closeAPI := newConf == nil ||
 		newConf.API != p.conf.API ||
 		newConf.APIAddress != p.conf.APIAddress ||
+		newConf.APIEncryption != p.conf.APIEncryption ||
+		newConf.APIServerKey != p.conf.APIServerKey ||
+		newConf.APIServerCert != p.conf.APIServerCert ||
 		closePathManager ||
 		closeRTSPServer ||
 		closeRTSPSServer ||
@@ -608,11 +931,29 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		closeHLSServer ||
 		closeWebRTCServer
 
+	closeConfRemote := newConf == nil ||
+		newConf.ConfURL != p.conf.ConfURL ||
+		newConf.ConfURLInterval != p.conf.ConfURLInterval ||
+		newConf.ConfURLLongPoll != p.conf.ConfURLLongPoll ||
+		newConf.ConfURLPublicKey != p.conf.ConfURLPublicKey
+
 	if newConf == nil && p.confWatcher != nil {
 		p.confWatcher.Close()
 		p.confWatcher = nil
 	}
 
+	if closeConfRemote && p.confRemote != nil {
+		p.confRemote.close()
+		p.confRemoteETag = p.confRemote.etag
+		p.confRemote = nil
+
+		// configurations obtained from a different server are not reused
+		if newConf != nil && newConf.ConfURL != p.conf.ConfURL {
+			p.confRemoteLast = nil
+			p.confRemoteETag = ""
+		}
+	}
+
 	if p.api != nil {
 		if closeAPI {
 			p.api.close()
@@ -622,14 +963,22 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		}
 	}
 
-	if closeRTSPSServer && p.rtspsServer != nil {
-		p.rtspsServer.close()
-		p.rtspsServer = nil
+	if p.rtspsServer != nil {
+		if closeRTSPSServer {
+			p.rtspsServer.close()
+			p.rtspsServer = nil
+		} else {
+			p.rtspsServer.confReload(newConf)
+		}
 	}
 
-	if closeRTSPServer && p.rtspServer != nil {
-		p.rtspServer.close()
-		p.rtspServer = nil
+	if p.rtspServer != nil {
+		if closeRTSPServer {
+			p.rtspServer.close()
+			p.rtspServer = nil
+		} else {
+			p.rtspServer.confReload(newConf)
+		}
 	}
 
 	if closePathManager && p.pathManager != nil {
@@ -637,24 +986,40 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		p.pathManager = nil
 	}
 
-	if closeWebRTCServer && p.webRTCServer != nil {
-		p.webRTCServer.close()
-		p.webRTCServer = nil
+	if p.webRTCServer != nil {
+		if closeWebRTCServer {
+			p.webRTCServer.close()
+			p.webRTCServer = nil
+		} else {
+			p.webRTCServer.confReload(newConf)
+		}
 	}
 
-	if closeHLSServer && p.hlsServer != nil {
-		p.hlsServer.close()
-		p.hlsServer = nil
+	if p.hlsServer != nil {
+		if closeHLSServer {
+			p.hlsServer.close()
+			p.hlsServer = nil
+		} else {
+			p.hlsServer.confReload(newConf)
+		}
 	}
 
-	if closeRTMPSServer && p.rtmpsServer != nil {
-		p.rtmpsServer.close()
-		p.rtmpsServer = nil
+	if p.rtmpsServer != nil {
+		if closeRTMPSServer {
+			p.rtmpsServer.close()
+			p.rtmpsServer = nil
+		} else {
+			p.rtmpsServer.confReload(newConf)
+		}
 	}
 
-	if closeRTMPServer && p.rtmpServer != nil {
-		p.rtmpServer.close()
-		p.rtmpServer = nil
+	if p.rtmpServer != nil {
+		if closeRTMPServer {
+			p.rtmpServer.close()
+			p.rtmpServer = nil
+		} else {
+			p.rtmpServer.confReload(newConf)
+		}
 	}
 
 	if closePPROF && p.pprof != nil {
@@ -672,6 +1037,21 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 		p.externalCmdPool.Close()
 	}
 
+	if newConf == nil && p.webhookManager != nil {
+		p.webhookManager.close()
+		p.webhookManager = nil
+	}
+
+	if newConf == nil && p.clusterManager != nil {
+		p.clusterManager.close()
+		p.clusterManager = nil
+	}
+
+	if newConf == nil && p.authManager != nil {
+		p.authManager.close()
+		p.authManager = nil
+	}
+
 	if newConf == nil {
 		rpicamera.Cleanup()
 	}
@@ -685,7 +1065,85 @@ func (p *Core) closeResources(newConf *conf.Conf, calledByAPI bool) {
 func (p *Core) reloadConf(newConf *conf.Conf, calledByAPI bool) error {
 	p.closeResources(newConf, calledByAPI)
 	p.conf = newConf
-	return p.createResources(false)
+
+	err := p.createResources(false)
+	if err != nil {
+		return err
+	}
+
+	p.eventBus.publish(event{Type: eventTypeConfigReloaded})
+	return nil
+}
+
+// loadConfRemote fetches the remote configuration at startup.
+// If the server can't be reached, the last configuration that was applied is used.
+// The remote configuration must not be older than the cached one.
+func (p *Core) loadConfRemote() {
+	apply := func(u *confRemoteUpdate) error {
+		newConf, _, err := conf.LoadWithRemote(p.confPath, u.byts)
+		if err != nil {
+			return err
+		}
+
+		p.conf = newConf
+		p.confRemoteLast = u
+		return nil
+	}
+
+	cached, cacheErr := readConfRemoteCache(p.conf)
+
+	ctx, ctxCancel := context.WithTimeout(p.ctx, confRemoteTimeout)
+	defer ctxCancel()
+
+	u, etag, err := fetchConfRemote(ctx, &http.Client{}, p.conf, "", 0, cached)
+	if err == nil {
+		err = apply(u)
+		if err == nil {
+			p.confRemoteETag = etag
+			// the cache is optional
+			_ = writeConfRemoteCache(p.conf, u)
+			return
+		}
+	}
+
+	p.confRemoteErr = err
+
+	if cacheErr == nil {
+		err = apply(cached)
+		if err != nil {
+			p.confRemoteErr = fmt.Errorf("%s (cached configuration: %s)", p.confRemoteErr, err)
+		}
+	}
+}
+
+// loadConf loads the configuration file, together with the last remote configuration.
+func (p *Core) loadConf() (*conf.Conf, error) {
+	newConf, _, err := conf.Load(p.confPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if newConf.ConfURL == "" || newConf.ConfURL != p.conf.ConfURL || p.confRemoteLast == nil {
+		return newConf, nil
+	}
+
+	newConf, _, err = conf.LoadWithRemote(p.confPath, p.confRemoteLast.byts)
+	return newConf, err
+}
+
+// persistConf writes the current configuration into the configuration file.
+func (p *Core) persistConf() error {
+	byts, err := p.conf.Encode(p.confPath)
+	if err != nil {
+		return err
+	}
+
+	// do not reload the configuration after writing it
+	if p.confWatcher != nil {
+		p.confWatcher.IgnoreWrite(byts)
+	}
+
+	return conf.WriteFile(p.confPath, byts)
 }
 
 // apiConfigSet is called by api.
@@ -0,0 +1,60 @@
+package core
+
+import (
+	"net"
+	"sync"
+)
+
+// drainListener is a net.Listener that can stop accepting connections
+// without reporting an error to the server that is using it, since some
+// servers terminate as soon as Accept() fails.
+type drainListener struct {
+	net.Listener
+
+	drainOnce sync.Once
+	closeOnce sync.Once
+	drained   chan struct{}
+	closed    chan struct{}
+}
+
+func newDrainListener(ln net.Listener) *drainListener {
+	return &drainListener{
+		Listener: ln,
+		drained:  make(chan struct{}),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Accept implements net.Listener.
+func (l *drainListener) Accept() (net.Conn, error) {
+	nconn, err := l.Listener.Accept()
+	if err != nil {
+		select {
+		case <-l.drained:
+			<-l.closed
+			return nil, net.ErrClosed
+		default:
+		}
+		return nil, err
+	}
+
+	return nconn, nil
+}
+
+// Close implements net.Listener.
+func (l *drainListener) Close() error {
+	var err error
+	l.closeOnce.Do(func() {
+		close(l.closed)
+		err = l.Listener.Close()
+	})
+	return err
+}
+
+// drain closes the underlying listener, while Accept() blocks until Close() is called.
+func (l *drainListener) drain() {
+	l.drainOnce.Do(func() {
+		close(l.drained)
+		l.Listener.Close()
+	})
+}
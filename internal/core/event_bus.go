@@ -0,0 +1,199 @@
+package core
+
+import (
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+const (
+	// number of events kept in memory, that can be sent to clients that resume a stream.
+	eventBusHistorySize = 1000
+
+	// number of events that can be queued for a subscriber before it is disconnected.
+	eventBusSubscriberQueueSize = 256
+)
+
+type eventType string
+
+const (
+	eventTypePathCreated      eventType = "pathCreated"
+	eventTypePathRemoved      eventType = "pathRemoved"
+	eventTypeSourceReady      eventType = "sourceReady"
+	eventTypeSourceNotReady   eventType = "sourceNotReady"
+	eventTypeReaderAdded      eventType = "readerAdded"
+	eventTypeReaderRemoved    eventType = "readerRemoved"
+	eventTypePublisherAdded   eventType = "publisherAdded"
+	eventTypePublisherRemoved eventType = "publisherRemoved"
+	eventTypeConnOpened       eventType = "connOpened"
+	eventTypeConnClosed       eventType = "connClosed"
+	eventTypeAuthFailure      eventType = "authFailure"
+	eventTypeConfigReloaded   eventType = "configReloaded"
+
+	// sent to clients that resume a stream when some of the events they missed
+	// are not available anymore, in order to make them fetch the state again.
+	eventTypeEventsLost eventType = "eventsLost"
+)
+
+// event is a lifecycle event of the server.
+type event struct {
+	ID     uint64      `json:"id"`
+	Type   eventType   `json:"type"`
+	Time   time.Time   `json:"time"`
+	Path   string      `json:"path,omitempty"`
+	Source interface{} `json:"source,omitempty"`
+	Medias []string    `json:"medias,omitempty"`
+	Reader interface{} `json:"reader,omitempty"`
+	Conn   interface{} `json:"conn,omitempty"`
+	Query  string      `json:"query,omitempty"`
+	IP     string      `json:"ip,omitempty"`
+	Error  string      `json:"error,omitempty"`
+
+	// configuration of the path, used to find its webhook.
+	pathConf *conf.PathConf
+}
+
+type eventConn struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	RemoteAddr string `json:"remoteAddr"`
+}
+
+func newEventConn(typ string, id uuid.UUID, remoteAddr net.Addr) eventConn {
+	return eventConn{
+		Type:       typ,
+		ID:         id.String(),
+		RemoteAddr: remoteAddr.String(),
+	}
+}
+
+// eventQuerySecretParams are query parameters that contain credentials
+// and are removed from events, since events are sent to read-only API users.
+var eventQuerySecretParams = []string{"user", "pass", "sig"}
+
+// eventQueryRemoveSecrets removes credentials from the query of an event.
+func eventQueryRemoveSecrets(rawQuery string) string {
+	if rawQuery == "" {
+		return ""
+	}
+
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// do not risk exposing credentials
+		return ""
+	}
+
+	found := false
+	for _, k := range eventQuerySecretParams {
+		if _, ok := q[k]; ok {
+			delete(q, k)
+			found = true
+		}
+	}
+
+	if !found {
+		return rawQuery
+	}
+
+	return q.Encode()
+}
+
+type eventSubscriber struct {
+	ch chan *event
+}
+
+// eventBus dispatches events to subscribers.
+// Events are published without blocking: subscribers that are too slow
+// are disconnected, and can resume the stream by using the ID of the last
+// received event.
+type eventBus struct {
+	mutex       sync.Mutex
+	lastID      uint64
+	history     []*event
+	subscribers map[*eventSubscriber]struct{}
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{
+		subscribers: make(map[*eventSubscriber]struct{}),
+	}
+}
+
+// publish sends an event to all subscribers. It never blocks.
+func (b *eventBus) publish(e event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.lastID++
+	e.ID = b.lastID
+	e.Time = time.Now()
+	e.Query = eventQueryRemoveSecrets(e.Query)
+
+	b.history = append(b.history, &e)
+	if len(b.history) > eventBusHistorySize {
+		b.history = b.history[len(b.history)-eventBusHistorySize:]
+	}
+
+	for sub := range b.subscribers {
+		select {
+		case sub.ch <- &e:
+		default:
+			delete(b.subscribers, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// subscribe adds a subscriber. If lastID is not zero, events published
+// after the event with this ID are returned, in order to resume a stream.
+// If some of these events are not available anymore, they are preceded by an eventsLost event.
+func (b *eventBus) subscribe(lastID uint64) (*eventSubscriber, []*event) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	sub := &eventSubscriber{
+		ch: make(chan *event, eventBusSubscriberQueueSize),
+	}
+	b.subscribers[sub] = struct{}{}
+
+	var missed []*event
+
+	// when lastID is greater than the last published ID,
+	// the server has been restarted and all events are new.
+	if lastID != 0 {
+		for _, e := range b.history {
+			if e.ID > lastID || lastID > b.lastID {
+				missed = append(missed, e)
+			}
+		}
+
+		// events have been removed from the history, or the server has been restarted.
+		if lastID > b.lastID || (len(b.history) != 0 && b.history[0].ID > lastID+1) {
+			missed = append([]*event{{
+				// ID of the event that precedes the first returned one,
+				// in order to allow clients to resume the stream from this point.
+				ID:   b.lastID - uint64(len(missed)),
+				Type: eventTypeEventsLost,
+				Time: time.Now(),
+			}}, missed...)
+		}
+	}
+
+	return sub, missed
+}
+
+// unsubscribe removes a subscriber.
+func (b *eventBus) unsubscribe(sub *eventSubscriber) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := b.subscribers[sub]; ok {
+		delete(b.subscribers, sub)
+		close(sub.ch)
+	}
+}
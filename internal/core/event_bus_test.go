@@ -0,0 +1,99 @@
+package core
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventBusResume(t *testing.T) {
+	b := newEventBus()
+
+	for i := 0; i < 3; i++ {
+		b.publish(event{Type: eventTypePathCreated})
+	}
+
+	sub, missed := b.subscribe(0)
+	require.Equal(t, 0, len(missed))
+	b.unsubscribe(sub)
+
+	sub, missed = b.subscribe(1)
+	defer b.unsubscribe(sub)
+	require.Equal(t, 2, len(missed))
+	require.Equal(t, uint64(2), missed[0].ID)
+	require.Equal(t, uint64(3), missed[1].ID)
+
+	b.publish(event{Type: eventTypePathRemoved, Path: "mypath"})
+
+	e := <-sub.ch
+	require.Equal(t, uint64(4), e.ID)
+	require.Equal(t, eventTypePathRemoved, e.Type)
+	require.Equal(t, "mypath", e.Path)
+
+	// ID of a previous instance of the server
+	sub2, missed := b.subscribe(100)
+	defer b.unsubscribe(sub2)
+	require.Equal(t, 5, len(missed))
+	require.Equal(t, eventTypeEventsLost, missed[0].Type)
+	require.Equal(t, uint64(0), missed[0].ID)
+}
+
+func TestEventBusResumeLost(t *testing.T) {
+	b := newEventBus()
+
+	for i := 0; i < eventBusHistorySize+2; i++ {
+		b.publish(event{Type: eventTypePathCreated})
+	}
+
+	// event 2 is not in the history anymore
+	sub, missed := b.subscribe(1)
+	defer b.unsubscribe(sub)
+	require.Equal(t, eventBusHistorySize+1, len(missed))
+	require.Equal(t, eventTypeEventsLost, missed[0].Type)
+	require.Equal(t, uint64(2), missed[0].ID)
+	require.Equal(t, uint64(3), missed[1].ID)
+
+	// all missed events are in the history
+	sub2, missed := b.subscribe(2)
+	defer b.unsubscribe(sub2)
+	require.Equal(t, eventBusHistorySize, len(missed))
+	require.Equal(t, uint64(3), missed[0].ID)
+}
+
+func TestEventBusSlowSubscriber(t *testing.T) {
+	b := newEventBus()
+
+	sub, _ := b.subscribe(0)
+
+	for i := 0; i < eventBusSubscriberQueueSize+1; i++ {
+		b.publish(event{Type: eventTypePathCreated})
+	}
+
+	n := 0
+	for range sub.ch {
+		n++
+	}
+	require.Equal(t, eventBusSubscriberQueueSize, n)
+
+	// unsubscribing a removed subscriber is a no-op
+	b.unsubscribe(sub)
+}
+
+func TestEventBusQuerySecrets(t *testing.T) {
+	b := newEventBus()
+
+	sub, _ := b.subscribe(0)
+	defer b.unsubscribe(sub)
+
+	b.publish(event{Type: eventTypeReaderAdded, Query: "user=myuser&pass=mypass&param=value"})
+	e := <-sub.ch
+	require.Equal(t, "param=value", e.Query)
+
+	b.publish(event{Type: eventTypeReaderAdded, Query: "expires=1700000000&sig=abcd"})
+	e = <-sub.ch
+	require.Equal(t, "expires=1700000000", e.Query)
+
+	b.publish(event{Type: eventTypeReaderAdded, Query: "b=2&a=1"})
+	e = <-sub.ch
+	require.Equal(t, "b=2&a=1", e.Query)
+}
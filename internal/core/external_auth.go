@@ -2,11 +2,25 @@ package core
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/google/uuid"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+const (
+	externalAuthCacheMaxSize = 10000
+	externalAuthMaxBodySize  = 64 * 1024
 )
 
 type externalAuthProto string
@@ -16,19 +30,239 @@ const (
 	externalAuthProtoRTMP   externalAuthProto = "rtmp"
 	externalAuthProtoHLS    externalAuthProto = "hls"
 	externalAuthProtoWebRTC externalAuthProto = "webrtc"
+	externalAuthProtoHTTP   externalAuthProto = "http"
 )
 
-func externalAuth(
+type externalAuthReq struct {
+	ip       string
+	user     string
+	password string
+	path     string
+	protocol externalAuthProto
+	id       *uuid.UUID
+	publish  bool
+	query    string
+	certUser string
+	action   conf.AuthAction // used in place of publish by API, metrics and pprof requests
+}
+
+// externalAuthRes is the optional body of a successful response
+// of the external authentication server.
+type externalAuthRes struct {
+	// maximum duration of the session.
+	MaxSessionDuration conf.StringDuration `json:"maxSessionDuration"`
+
+	// time at which the session must be closed.
+	DisconnectAt *time.Time `json:"disconnectAt"`
+}
+
+// expiry returns the time at which a session that starts now must be closed.
+// A zero time means that the session never expires.
+func (r *externalAuthRes) expiry() time.Time {
+	var ret time.Time
+
+	if r.MaxSessionDuration > 0 {
+		ret = time.Now().Add(time.Duration(r.MaxSessionDuration))
+	}
+
+	if r.DisconnectAt != nil && (ret.IsZero() || r.DisconnectAt.Before(ret)) {
+		ret = *r.DisconnectAt
+	}
+
+	return ret
+}
+
+type externalAuthCacheKey struct {
+	ip       string
+	user     string
+	passHash string
+	path     string
+	action   string
+	query    string
+	certUser string
+}
+
+type externalAuthCacheEntry struct {
+	res    *externalAuthRes
+	err    error
+	expire time.Time
+}
+
+// removeHLSQueryParams removes parameters that are added by HLS clients
+// to every request, in order not to defeat caching.
+func removeHLSQueryParams(rawQuery string) string {
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawQuery
+	}
+
+	for k := range q {
+		if strings.HasPrefix(k, "_HLS_") {
+			delete(q, k)
+		}
+	}
+
+	return q.Encode()
+}
+
+// externalAuthClient performs external authentication through HTTP,
+// caching decisions.
+type externalAuthClient struct {
+	url              string
+	headers          http.Header
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	httpClient       *http.Client
+
+	cacheMutex sync.Mutex
+	cache      map[externalAuthCacheKey]externalAuthCacheEntry
+}
+
+func newExternalAuthClient(
 	ur string,
-	ip string,
-	user string,
-	password string,
-	path string,
-	protocol externalAuthProto,
-	id *uuid.UUID,
-	publish bool,
-	query string,
-) error {
+	timeout conf.StringDuration,
+	maxIdleConns int,
+	headers []string,
+	bearerToken string,
+	cacheTTL conf.StringDuration,
+	negativeCacheTTL conf.StringDuration,
+) *externalAuthClient {
+	h := make(http.Header)
+	for _, entry := range headers {
+		parts := strings.SplitN(entry, ":", 2)
+		h.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	if bearerToken != "" {
+		h.Set("Authorization", "Bearer "+bearerToken)
+	}
+
+	return &externalAuthClient{
+		url:              ur,
+		headers:          h,
+		cacheTTL:         time.Duration(cacheTTL),
+		negativeCacheTTL: time.Duration(negativeCacheTTL),
+		httpClient: &http.Client{
+			Timeout: time.Duration(timeout),
+			Transport: &http.Transport{
+				Proxy:               http.ProxyFromEnvironment,
+				MaxIdleConns:        maxIdleConns,
+				MaxIdleConnsPerHost: maxIdleConns,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		},
+		cache: make(map[externalAuthCacheKey]externalAuthCacheEntry),
+	}
+}
+
+func (c *externalAuthClient) close() {
+	c.httpClient.CloseIdleConnections()
+}
+
+// authenticate returns the time at which the session must be closed,
+// or a zero time if the session never expires.
+func (c *externalAuthClient) authenticate(req externalAuthReq) (time.Time, error) {
+	res, err := c.authenticateCached(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	expiry := res.expiry()
+	if !expiry.IsZero() && !expiry.After(time.Now()) {
+		return time.Time{}, fmt.Errorf("session expired")
+	}
+
+	return expiry, nil
+}
+
+func (c *externalAuthClient) authenticateCached(req externalAuthReq) (*externalAuthRes, error) {
+	if c.cacheTTL == 0 && c.negativeCacheTTL == 0 {
+		return c.do(req)
+	}
+
+	passHash := sha256.Sum256([]byte(req.password))
+
+	key := externalAuthCacheKey{
+		ip:       req.ip,
+		user:     req.user,
+		passHash: hex.EncodeToString(passHash[:]),
+		path:     req.path,
+		action:   req.actionName(),
+		query:    req.query,
+		certUser: req.certUser,
+	}
+	if req.protocol == externalAuthProtoHLS {
+		key.query = removeHLSQueryParams(key.query)
+	}
+
+	now := time.Now()
+
+	c.cacheMutex.Lock()
+	entry, ok := c.cache[key]
+	c.cacheMutex.Unlock()
+
+	if ok && now.Before(entry.expire) {
+		return entry.res, entry.err
+	}
+
+	res, err := c.do(req)
+
+	var ttl time.Duration
+	if err == nil {
+		ttl = c.cacheTTL
+	} else if _, ok := err.(externalAuthErrDenied); ok {
+		// do not cache network errors
+		ttl = c.negativeCacheTTL
+	}
+
+	if ttl != 0 {
+		c.cacheMutex.Lock()
+		defer c.cacheMutex.Unlock()
+
+		if len(c.cache) >= externalAuthCacheMaxSize {
+			for k, e := range c.cache {
+				if !now.Before(e.expire) {
+					delete(c.cache, k)
+				}
+			}
+
+			// cache is still full
+			if len(c.cache) >= externalAuthCacheMaxSize {
+				return res, err
+			}
+		}
+
+		c.cache[key] = externalAuthCacheEntry{
+			res:    res,
+			err:    err,
+			expire: now.Add(ttl),
+		}
+	}
+
+	return res, err
+}
+
+// externalAuthErrDenied is returned when the server explicitly denies authentication.
+type externalAuthErrDenied struct {
+	statusCode int
+}
+
+// Error implements the error interface.
+func (e externalAuthErrDenied) Error() string {
+	return fmt.Sprintf("bad status code: %d", e.statusCode)
+}
+
+func (req externalAuthReq) actionName() string {
+	if req.action != "" {
+		return string(req.action)
+	}
+	if req.publish {
+		return "publish"
+	}
+	return "read"
+}
+
+func (c *externalAuthClient) do(req externalAuthReq) (*externalAuthRes, error) {
 	enc, _ := json.Marshal(struct {
 		IP       string     `json:"ip"`
 		User     string     `json:"user"`
@@ -38,29 +272,55 @@ func externalAuth(
 		ID       *uuid.UUID `json:"id"`
 		Action   string     `json:"action"`
 		Query    string     `json:"query"`
+		CertUser string     `json:"clientCertUser"`
 	}{
-		IP:       ip,
-		User:     user,
-		Password: password,
-		Path:     path,
-		Protocol: string(protocol),
-		Action: func() string {
-			if publish {
-				return "publish"
-			}
-			return "read"
-		}(),
-		Query: query,
+		IP:       req.ip,
+		User:     req.user,
+		Password: req.password,
+		Path:     req.path,
+		Protocol: string(req.protocol),
+		ID:       req.id,
+		Action:   req.actionName(),
+		Query:    req.query,
+		CertUser: req.certUser,
 	})
-	res, err := http.Post(ur, "application/json", bytes.NewReader(enc))
+
+	hreq, err := http.NewRequest(http.MethodPost, c.url, bytes.NewReader(enc))
+	if err != nil {
+		return nil, err
+	}
+
+	for k, v := range c.headers {
+		hreq.Header[k] = v
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+
+	res, err := c.httpClient.Do(hreq)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode < 200 || res.StatusCode > 299 {
-		return fmt.Errorf("bad status code: %d", res.StatusCode)
+		return nil, externalAuthErrDenied{statusCode: res.StatusCode}
+	}
+
+	var out externalAuthRes
+
+	// the body is optional and is parsed only when it is JSON
+	if strings.HasPrefix(res.Header.Get("Content-Type"), "application/json") {
+		byts, err := io.ReadAll(io.LimitReader(res.Body, externalAuthMaxBodySize))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(bytes.TrimSpace(byts)) != 0 {
+			err = json.Unmarshal(byts, &out)
+			if err != nil {
+				return nil, fmt.Errorf("invalid response body: %s", err)
+			}
+		}
 	}
 
-	return nil
+	return &out, nil
 }
@@ -0,0 +1,127 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+func TestExternalAuthClient(t *testing.T) {
+	var count int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+
+		if r.Header.Get("Authorization") != "Bearer mytoken" ||
+			r.Header.Get("X-Custom") != "myvalue" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		var in struct {
+			User string `json:"user"`
+		}
+		json.NewDecoder(r.Body).Decode(&in)
+
+		if in.User != "myuser" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"maxSessionDuration":"1h"}`))
+	}))
+	defer s.Close()
+
+	c := newExternalAuthClient(
+		s.URL,
+		conf.StringDuration(5*time.Second),
+		10,
+		[]string{"X-Custom: myvalue"},
+		"mytoken",
+		conf.StringDuration(time.Minute),
+		conf.StringDuration(time.Minute))
+	defer c.close()
+
+	req := externalAuthReq{
+		ip:       "127.0.0.1",
+		user:     "myuser",
+		password: "mypass",
+		path:     "mypath",
+		protocol: externalAuthProtoHLS,
+		query:    "_HLS_msn=1",
+	}
+
+	expiry, err := c.authenticate(req)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), expiry, 10*time.Second)
+
+	// positive decision is cached
+	req.query = "_HLS_msn=2"
+	_, err = c.authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, int32(1), atomic.LoadInt32(&count))
+
+	// password is part of the cache key
+	req.password = "otherpass"
+	_, err = c.authenticate(req)
+	require.NoError(t, err)
+	require.Equal(t, int32(2), atomic.LoadInt32(&count))
+
+	// negative decision is cached
+	req.user = "otheruser"
+	_, err = c.authenticate(req)
+	require.EqualError(t, err, "bad status code: 401")
+	_, err = c.authenticate(req)
+	require.EqualError(t, err, "bad status code: 401")
+	require.Equal(t, int32(3), atomic.LoadInt32(&count))
+}
+
+func TestExternalAuthClientTimeout(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(5 * time.Second):
+		case <-done:
+		}
+	}))
+	defer s.Close()
+
+	c := newExternalAuthClient(
+		s.URL,
+		conf.StringDuration(200*time.Millisecond),
+		10,
+		nil,
+		"",
+		0,
+		0)
+	defer c.close()
+
+	start := time.Now()
+	_, err := c.authenticate(externalAuthReq{})
+	require.Error(t, err)
+	require.Less(t, time.Since(start), 2*time.Second)
+}
+
+func TestExternalAuthClientDisconnectAt(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"disconnectAt":"2000-01-01T00:00:00Z"}`))
+	}))
+	defer s.Close()
+
+	c := newExternalAuthClient(s.URL, conf.StringDuration(5*time.Second), 10, nil, "", 0, 0)
+	defer c.close()
+
+	_, err := c.authenticate(externalAuthReq{})
+	require.EqualError(t, err, "session expired")
+}
@@ -11,6 +11,7 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -58,20 +59,20 @@ type hlsMuxerParent interface {
 }
 
 type hlsMuxer struct {
-	remoteAddr                string
-	externalAuthenticationURL string
-	alwaysRemux               bool
-	variant                   conf.HLSVariant
-	segmentCount              int
-	segmentDuration           conf.StringDuration
-	partDuration              conf.StringDuration
-	segmentMaxSize            conf.StringSize
-	directory                 string
-	readBufferCount           int
-	wg                        *sync.WaitGroup
-	pathName                  string
-	pathManager               hlsMuxerPathManager
-	parent                    hlsMuxerParent
+	remoteAddr      string
+	authManager     *authManager
+	alwaysRemux     bool
+	variant         conf.HLSVariant
+	segmentCount    int
+	segmentDuration conf.StringDuration
+	partDuration    conf.StringDuration
+	segmentMaxSize  conf.StringSize
+	directory       string
+	readBufferCount int
+	wg              *sync.WaitGroup
+	pathName        string
+	pathManager     hlsMuxerPathManager
+	parent          hlsMuxerParent
 
 	ctx             context.Context
 	ctxCancel       func()
@@ -91,7 +92,7 @@ type hlsMuxer struct {
 func newHLSMuxer(
 	parentCtx context.Context,
 	remoteAddr string,
-	externalAuthenticationURL string,
+	authManager *authManager,
 	alwaysRemux bool,
 	variant conf.HLSVariant,
 	segmentCount int,
@@ -108,23 +109,23 @@ func newHLSMuxer(
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	m := &hlsMuxer{
-		remoteAddr:                remoteAddr,
-		externalAuthenticationURL: externalAuthenticationURL,
-		alwaysRemux:               alwaysRemux,
-		variant:                   variant,
-		segmentCount:              segmentCount,
-		segmentDuration:           segmentDuration,
-		partDuration:              partDuration,
-		segmentMaxSize:            segmentMaxSize,
-		directory:                 directory,
-		readBufferCount:           readBufferCount,
-		wg:                        wg,
-		pathName:                  pathName,
-		pathManager:               pathManager,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		created:                   time.Now(),
+		remoteAddr:      remoteAddr,
+		authManager:     authManager,
+		alwaysRemux:     alwaysRemux,
+		variant:         variant,
+		segmentCount:    segmentCount,
+		segmentDuration: segmentDuration,
+		partDuration:    partDuration,
+		segmentMaxSize:  segmentMaxSize,
+		directory:       directory,
+		readBufferCount: readBufferCount,
+		wg:              wg,
+		pathName:        pathName,
+		pathManager:     pathManager,
+		parent:          parent,
+		ctx:             ctx,
+		ctxCancel:       ctxCancel,
+		created:         time.Now(),
 		lastRequestTime: func() *int64 {
 			v := time.Now().UnixNano()
 			return &v
@@ -229,6 +230,10 @@ func (m *hlsMuxer) run() {
 			case err := <-innerErr:
 				innerCtxCancel()
 
+				if _, ok := err.(pathErrLimitReached); ok {
+					m.rejectQueuedRequests(http.StatusServiceUnavailable)
+				}
+
 				if m.alwaysRemux {
 					m.log(logger.Info, "ERR: %v", err)
 					m.clearQueuedRequests()
@@ -262,6 +267,19 @@ func (m *hlsMuxer) clearQueuedRequests() {
 	m.requests = nil
 }
 
+// rejectQueuedRequests replies to queued requests with an error status code.
+func (m *hlsMuxer) rejectQueuedRequests(status int) {
+	for _, req := range m.requests {
+		req.res <- &hlsMuxerResponse{
+			muxer: m,
+			cb: func() *gohlslib.MuxerFileResponse {
+				return &gohlslib.MuxerFileResponse{Status: status}
+			},
+		}
+	}
+	m.requests = nil
+}
+
 func (m *hlsMuxer) runInner(innerCtx context.Context, innerReady chan struct{}) error {
 	res := m.pathManager.readerAdd(pathReaderAddReq{
 		author:   m,
@@ -517,6 +535,11 @@ func (m *hlsMuxer) runWriter() error {
 	}
 }
 
+// lastRequest returns the time of the last request.
+func (m *hlsMuxer) lastRequest() time.Time {
+	return time.Unix(0, atomic.LoadInt64(m.lastRequestTime))
+}
+
 func (m *hlsMuxer) handleRequest(req *hlsMuxerRequest) func() *gohlslib.MuxerFileResponse {
 	atomic.StoreInt64(m.lastRequestTime, time.Now().UnixNano())
 
@@ -524,6 +547,7 @@ func (m *hlsMuxer) handleRequest(req *hlsMuxerRequest) func() *gohlslib.MuxerFil
 	if err != nil {
 		if terr, ok := err.(pathErrAuthCritical); ok {
 			m.log(logger.Info, "authentication error: %s", terr.message)
+			m.authManager.onFailure(net.ParseIP(req.ctx.ClientIP()), m.pathName, terr.message)
 			return func() *gohlslib.MuxerFileResponse {
 				return &gohlslib.MuxerFileResponse{
 					Status: http.StatusUnauthorized,
@@ -556,12 +580,25 @@ func (m *hlsMuxer) handleRequest(req *hlsMuxerRequest) func() *gohlslib.MuxerFil
 		}
 	}
 
+	// segments and parts are throttled one download at a time,
+	// in order to limit the bitrate of every HLS client.
+	bandwidthLimit := 0
+	if !strings.HasSuffix(req.file, ".m3u8") {
+		bandwidthLimit = m.path.safeConf().ReaderBandwidthLimit
+	}
+
 	return func() *gohlslib.MuxerFileResponse {
-		return m.muxer.File(
+		res := m.muxer.File(
 			req.file,
 			req.ctx.Query("_HLS_msn"),
 			req.ctx.Query("_HLS_part"),
 			req.ctx.Query("_HLS_skip"))
+
+		if res.Body != nil && bandwidthLimit != 0 {
+			res.Body = newThrottledReadCloser(res.Body, bandwidthLimit)
+		}
+
+		return res
 	}
 }
 
@@ -571,20 +608,48 @@ func (m *hlsMuxer) authenticate(ctx *gin.Context) error {
 	pathUser := pathConf.ReadUser
 	pathPass := pathConf.ReadPass
 
-	if m.externalAuthenticationURL != "" {
+	// IPs are checked before everything else, since a signed URL
+	// replaces credentials, not the IP restrictions of the path.
+	if pathIPs != nil {
+		ip := net.ParseIP(ctx.ClientIP())
+
+		if !ipEqualOrInRange(ip, pathIPs) {
+			return pathErrAuthCritical{
+				message: fmt.Sprintf("IP '%s' not allowed", ip),
+			}
+		}
+	}
+
+	// a valid signed URL grants read access without credentials.
+	// HLS requests are stateless, therefore expiry is enforced on each request.
+	_, ok, err := m.authManager.authenticateSignedURL(net.ParseIP(ctx.ClientIP()), m.pathName, ctx.Request.URL.RawQuery)
+	if err != nil {
+		return pathErrAuthCritical{
+			message: fmt.Sprintf("unauthorized: %s", err),
+		}
+	}
+
+	if ok {
+		return nil
+	}
+
+	certUser := m.authManager.clientCertUser(ctx.Request.TLS)
+
+	if m.authManager.hasExternalAuth() {
 		ip := net.ParseIP(ctx.ClientIP())
 		user, pass, ok := ctx.Request.BasicAuth()
 
-		err := externalAuth(
-			m.externalAuthenticationURL,
-			ip.String(),
-			user,
-			pass,
-			m.pathName,
-			externalAuthProtoHLS,
-			nil,
-			false,
-			ctx.Request.URL.RawQuery)
+		// HLS requests are stateless, therefore session expiry is enforced
+		// by the external authentication server on each request.
+		_, err := m.authManager.authenticateExternal(externalAuthReq{
+			ip:       ip.String(),
+			user:     user,
+			password: pass,
+			path:     m.pathName,
+			protocol: externalAuthProtoHLS,
+			query:    ctx.Request.URL.RawQuery,
+			certUser: certUser,
+		})
 		if err != nil {
 			if !ok {
 				return pathErrAuthNotCritical{}
@@ -596,17 +661,27 @@ func (m *hlsMuxer) authenticate(ctx *gin.Context) error {
 		}
 	}
 
-	if pathIPs != nil {
+	if m.authManager.hasInternalUsers() {
 		ip := net.ParseIP(ctx.ClientIP())
+		user, pass, ok := ctx.Request.BasicAuth()
+
+		var err error
+		if certUser == "" || m.authManager.authenticateClientCert(ip, certUser, conf.AuthActionRead, m.pathName) != nil {
+			err = m.authManager.authenticate(ip, user, pass, conf.AuthActionRead, m.pathName)
+		}
+		if err != nil {
+			if !ok {
+				return pathErrAuthNotCritical{}
+			}
 
-		if !ipEqualOrInRange(ip, pathIPs) {
 			return pathErrAuthCritical{
-				message: fmt.Sprintf("IP '%s' not allowed", ip),
+				message: fmt.Sprintf("unauthorized: %s", err),
 			}
 		}
 	}
 
-	if pathUser != "" {
+	// users authenticated with a client certificate don't need a password
+	if pathUser != "" && (certUser == "" || !pathUser.Check(certUser)) {
 		user, pass, ok := ctx.Request.BasicAuth()
 		if !ok {
 			return pathErrAuthNotCritical{}
@@ -1,6 +1,7 @@
 package core
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -8,17 +9,24 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"net/url"
 	gopath "path"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/bluenviron/gohlslib"
 	"github.com/gin-gonic/gin"
 
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+// muxers that received a request in this period are considered in use
+// while the server is draining.
+const hlsServerDrainInactivity = 5 * time.Second
+
 type nilWriter struct{}
 
 func (nilWriter) Write(p []byte) (int, error) {
@@ -50,32 +58,37 @@ type hlsServerAPIMuxersListSubReq struct {
 	res  chan struct{}
 }
 
+type hlsServerActiveMuxersCountReq struct {
+	res chan int
+}
+
 type hlsServerParent interface {
 	Log(logger.Level, string, ...interface{})
 }
 
 type hlsServer struct {
-	externalAuthenticationURL string
-	alwaysRemux               bool
-	variant                   conf.HLSVariant
-	segmentCount              int
-	segmentDuration           conf.StringDuration
-	partDuration              conf.StringDuration
-	segmentMaxSize            conf.StringSize
-	allowOrigin               string
-	trustedProxies            conf.IPsOrCIDRs
-	directory                 string
-	readBufferCount           int
-	pathManager               *pathManager
-	metrics                   *metrics
-	parent                    hlsServerParent
-
-	ctx       context.Context
-	ctxCancel func()
-	wg        sync.WaitGroup
-	ln        net.Listener
-	tlsConfig *tls.Config
-	muxers    map[string]*hlsMuxer
+	authManager     *authManager
+	alwaysRemux     bool
+	variant         conf.HLSVariant
+	segmentCount    int
+	segmentDuration conf.StringDuration
+	partDuration    conf.StringDuration
+	segmentMaxSize  conf.StringSize
+	allowOrigin     string
+	trustedProxies  conf.IPsOrCIDRs
+	directory       string
+	readBufferCount int
+	pathManager     *pathManager
+	metrics         *metrics
+	parent          hlsServerParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	wg         sync.WaitGroup
+	ln         net.Listener
+	tlsConfig  *tls.Config
+	certLoader *certloader.CertLoader
+	muxers     map[string]*hlsMuxer
 
 	// in
 	chPathSourceReady    chan *path
@@ -83,6 +96,9 @@ type hlsServer struct {
 	request              chan *hlsMuxerRequest
 	chMuxerClose         chan *hlsMuxer
 	chAPIMuxerList       chan hlsServerAPIMuxersListReq
+	chDrain              chan struct{}
+	chActiveMuxersCount  chan hlsServerActiveMuxersCountReq
+	chConfReload         chan *conf.Conf
 }
 
 func newHLSServer(
@@ -91,7 +107,9 @@ func newHLSServer(
 	encryption bool,
 	serverKey string,
 	serverCert string,
-	externalAuthenticationURL string,
+	clientCA string,
+	authManager *authManager,
+	limitManager *limitManager,
 	alwaysRemux bool,
 	variant conf.HLSVariant,
 	segmentCount int,
@@ -110,47 +128,56 @@ func newHLSServer(
 	if err != nil {
 		return nil, err
 	}
+	ln = newIPBanListener(ln, authManager)
+
+	// plain HTTP clients are notified with 503, while TLS clients can't
+	if encryption {
+		ln = newLimitListener(ln, limitManager, nil)
+	} else {
+		ln = newLimitListener(ln, limitManager, httpLimitReject)
+	}
 
 	var tlsConfig *tls.Config
+	var certLoader *certloader.CertLoader
 	if encryption {
-		crt, err := tls.LoadX509KeyPair(serverCert, serverKey)
+		tlsConfig, certLoader, err = newTLSConfig(serverCert, serverKey, clientCA, parent)
 		if err != nil {
 			ln.Close()
 			return nil, err
 		}
-
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{crt},
-		}
 	}
 
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &hlsServer{
-		externalAuthenticationURL: externalAuthenticationURL,
-		alwaysRemux:               alwaysRemux,
-		variant:                   variant,
-		segmentCount:              segmentCount,
-		segmentDuration:           segmentDuration,
-		partDuration:              partDuration,
-		segmentMaxSize:            segmentMaxSize,
-		allowOrigin:               allowOrigin,
-		trustedProxies:            trustedProxies,
-		directory:                 directory,
-		readBufferCount:           readBufferCount,
-		pathManager:               pathManager,
-		parent:                    parent,
-		metrics:                   metrics,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		ln:                        ln,
-		tlsConfig:                 tlsConfig,
-		muxers:                    make(map[string]*hlsMuxer),
-		chPathSourceReady:         make(chan *path),
-		chPathSourceNotReady:      make(chan *path),
-		request:                   make(chan *hlsMuxerRequest),
-		chMuxerClose:              make(chan *hlsMuxer),
-		chAPIMuxerList:            make(chan hlsServerAPIMuxersListReq),
+		authManager:          authManager,
+		alwaysRemux:          alwaysRemux,
+		variant:              variant,
+		segmentCount:         segmentCount,
+		segmentDuration:      segmentDuration,
+		partDuration:         partDuration,
+		segmentMaxSize:       segmentMaxSize,
+		allowOrigin:          allowOrigin,
+		trustedProxies:       trustedProxies,
+		directory:            directory,
+		readBufferCount:      readBufferCount,
+		pathManager:          pathManager,
+		parent:               parent,
+		metrics:              metrics,
+		ctx:                  ctx,
+		ctxCancel:            ctxCancel,
+		ln:                   ln,
+		tlsConfig:            tlsConfig,
+		certLoader:           certLoader,
+		muxers:               make(map[string]*hlsMuxer),
+		chPathSourceReady:    make(chan *path),
+		chPathSourceNotReady: make(chan *path),
+		request:              make(chan *hlsMuxerRequest),
+		chMuxerClose:         make(chan *hlsMuxer),
+		chAPIMuxerList:       make(chan hlsServerAPIMuxersListReq),
+		chDrain:              make(chan struct{}),
+		chActiveMuxersCount:  make(chan hlsServerActiveMuxersCountReq),
+		chConfReload:         make(chan *conf.Conf),
 	}
 
 	s.log(logger.Info, "listener opened on "+address)
@@ -159,6 +186,10 @@ func newHLSServer(
 
 	if s.metrics != nil {
 		s.metrics.hlsServerSet(s)
+
+		if s.certLoader != nil {
+			s.metrics.certLoaderSet("hls", s.certLoader)
+		}
 	}
 
 	s.wg.Add(1)
@@ -182,7 +213,7 @@ func (s *hlsServer) run() {
 	defer s.wg.Done()
 
 	router := gin.New()
-	router.NoRoute(httpLoggerMiddleware(s), s.onRequest)
+	router.NoRoute(httpLoggerMiddleware(s), ipBanMiddleware(s.authManager), s.onRequest)
 
 	tmp := make([]string, len(s.trustedProxies))
 	for i, entry := range s.trustedProxies {
@@ -202,6 +233,8 @@ func (s *hlsServer) run() {
 		go hs.Serve(s.ln)
 	}
 
+	draining := false
+
 outer:
 	for {
 		select {
@@ -228,6 +261,13 @@ outer:
 			case s.alwaysRemux:
 				req.res <- nil
 
+			case draining:
+				req.res <- &hlsMuxerResponse{
+					cb: func() *gohlslib.MuxerFileResponse {
+						return &gohlslib.MuxerFileResponse{Status: http.StatusServiceUnavailable}
+					},
+				}
+
 			default:
 				r := s.createMuxer(req.path, req.ctx.ClientIP())
 				r.processRequest(req)
@@ -250,6 +290,22 @@ outer:
 				muxers: muxers,
 			}
 
+		case newConf := <-s.chConfReload:
+			// parameters are applied to new muxers
+			s.readBufferCount = newConf.ReadBufferCount
+
+		case <-s.chDrain:
+			draining = true
+
+		case req := <-s.chActiveMuxersCount:
+			n := 0
+			for _, m := range s.muxers {
+				if time.Since(m.lastRequest()) < hlsServerDrainInactivity {
+					n++
+				}
+			}
+			req.res <- n
+
 		case <-s.ctx.Done():
 			break outer
 		}
@@ -264,6 +320,14 @@ outer:
 
 	if s.metrics != nil {
 		s.metrics.hlsServerSet(nil)
+
+		if s.certLoader != nil {
+			s.metrics.certLoaderSet("hls", nil)
+		}
+	}
+
+	if s.certLoader != nil {
+		s.certLoader.Close()
 	}
 }
 
@@ -314,6 +378,15 @@ func (s *hlsServer) onRequest(ctx *gin.Context) {
 
 	dir = strings.TrimSuffix(dir, "/")
 
+	// new readers of overloaded nodes are redirected to a sibling node
+	if fname == "" || fname == "index.m3u8" {
+		if u := s.pathManager.clusterRedirect(dir, clusterProtocolHLS); u != "" {
+			ctx.Writer.Header().Set("Location", clusterRedirectURL(u, dir+"/"+fname, ctx.Request.URL.RawQuery))
+			ctx.Writer.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+	}
+
 	hreq := &hlsMuxerRequest{
 		path: dir,
 		file: fname,
@@ -327,6 +400,16 @@ func (s *hlsServer) onRequest(ctx *gin.Context) {
 		if res1 != nil {
 			res := res1.cb()
 
+			// propagate the signature of signed URLs to the URLs contained
+			// in playlists, since players don't propagate queries.
+			if strings.HasSuffix(fname, ".m3u8") && res.Body != nil {
+				if q := hlsSignedURLQuery(ctx.Request.URL.Query()); q != "" {
+					byts, _ := io.ReadAll(res.Body)
+					res.Body.Close()
+					res.Body = io.NopCloser(bytes.NewReader(hlsPlaylistAppendQuery(byts, q)))
+				}
+			}
+
 			for k, v := range res.Header {
 				ctx.Writer.Header().Set(k, v)
 			}
@@ -344,11 +427,66 @@ func (s *hlsServer) onRequest(ctx *gin.Context) {
 	}
 }
 
+// hlsSignedURLQuery returns the signed URL parameters contained in a query.
+func hlsSignedURLQuery(query url.Values) string {
+	if query.Get("sig") == "" {
+		return ""
+	}
+
+	ret := make(url.Values)
+	for _, k := range []string{"expires", "sig", "ip"} {
+		if v, ok := query[k]; ok {
+			ret[k] = v
+		}
+	}
+	return ret.Encode()
+}
+
+// hlsPlaylistAppendQuery appends a query to all the URLs of a playlist.
+func hlsPlaylistAppendQuery(byts []byte, query string) []byte {
+	appendQuery := func(u string) string {
+		if strings.Contains(u, "?") {
+			return u + "&" + query
+		}
+		return u + "?" + query
+	}
+
+	lines := strings.Split(string(byts), "\n")
+
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\r")
+
+		switch {
+		case line == "":
+
+		case strings.HasPrefix(line, "#"):
+			start := strings.Index(line, `URI="`)
+			if start < 0 {
+				continue
+			}
+			start += len(`URI="`)
+
+			end := strings.Index(line[start:], `"`)
+			if end < 0 {
+				continue
+			}
+			end += start
+
+			lines[i] = line[:start] + appendQuery(line[start:end]) + line[end:]
+
+		default:
+			lines[i] = appendQuery(line)
+		}
+	}
+
+	return []byte(strings.Join(lines, "\n"))
+}
+
 func (s *hlsServer) createMuxer(pathName string, remoteAddr string) *hlsMuxer {
 	r := newHLSMuxer(
 		s.ctx,
 		remoteAddr,
-		s.externalAuthenticationURL,
+		s.authManager,
 		s.alwaysRemux,
 		s.variant,
 		s.segmentCount,
@@ -389,6 +527,38 @@ func (s *hlsServer) pathSourceNotReady(pa *path) {
 	}
 }
 
+// confReload is called by core.
+func (s *hlsServer) confReload(newConf *conf.Conf) {
+	select {
+	case s.chConfReload <- newConf:
+	case <-s.ctx.Done():
+	}
+}
+
+// drain is called by core.
+// Existing muxers keep serving readers, while requests that would create new muxers are refused.
+func (s *hlsServer) drain() {
+	select {
+	case s.chDrain <- struct{}{}:
+	case <-s.ctx.Done():
+	}
+}
+
+// activeMuxersCount is called by core.
+func (s *hlsServer) activeMuxersCount() int {
+	req := hlsServerActiveMuxersCountReq{
+		res: make(chan int),
+	}
+
+	select {
+	case s.chActiveMuxersCount <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		return 0
+	}
+}
+
 // apiMuxersList is called by api.
 func (s *hlsServer) apiMuxersList() hlsServerAPIMuxersListRes {
 	req := hlsServerAPIMuxersListReq{
@@ -92,3 +92,17 @@ func TestHLSServerNotFound(t *testing.T) {
 	defer res.Body.Close()
 	require.Equal(t, http.StatusNotFound, res.StatusCode)
 }
+
+func TestHLSPlaylistAppendQuery(t *testing.T) {
+	byts := hlsPlaylistAppendQuery([]byte("#EXTM3U\n"+
+		"#EXT-X-MAP:URI=\"init.mp4\"\n"+
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part.mp4?a=b\"\n"+
+		"#EXTINF:1,\n"+
+		"seg1.mp4\n"), "expires=1&sig=abc")
+
+	require.Equal(t, "#EXTM3U\n"+
+		"#EXT-X-MAP:URI=\"init.mp4?expires=1&sig=abc\"\n"+
+		"#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part.mp4?a=b&expires=1&sig=abc\"\n"+
+		"#EXTINF:1,\n"+
+		"seg1.mp4?expires=1&sig=abc\n", string(byts))
+}
@@ -13,16 +13,16 @@ import (
 
 type httpLoggerWriter struct {
 	gin.ResponseWriter
-	buf bytes.Buffer
+	bodySize int // body is not stored, since it can be a long-lived stream
 }
 
 func (w *httpLoggerWriter) Write(b []byte) (int, error) {
-	w.buf.Write(b)
+	w.bodySize += len(b)
 	return w.ResponseWriter.Write(b)
 }
 
 func (w *httpLoggerWriter) WriteString(s string) (int, error) {
-	w.buf.WriteString(s)
+	w.bodySize += len(s)
 	return w.ResponseWriter.WriteString(s)
 }
 
@@ -31,8 +31,8 @@ func (w *httpLoggerWriter) dump() string {
 	fmt.Fprintf(&buf, "%s %d %s\n", "HTTP/1.1", w.ResponseWriter.Status(), http.StatusText(w.ResponseWriter.Status()))
 	w.ResponseWriter.Header().Write(&buf)
 	buf.Write([]byte("\n"))
-	if w.buf.Len() > 0 {
-		fmt.Fprintf(&buf, "(body of %d bytes)", w.buf.Len())
+	if w.bodySize > 0 {
+		fmt.Fprintf(&buf, "(body of %d bytes)", w.bodySize)
 	}
 	return buf.String()
 }
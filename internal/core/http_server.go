@@ -0,0 +1,73 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
+)
+
+// httpServer is a HTTP server with optional TLS encryption,
+// that rejects connections from banned IPs.
+// It is shared by the API, the metrics and the pprof servers.
+type httpServer struct {
+	ln         net.Listener
+	certLoader *certloader.CertLoader
+	server     *http.Server
+}
+
+func newHTTPServer(
+	address string,
+	encryption bool,
+	serverKey string,
+	serverCert string,
+	authManager *authManager,
+	handler http.Handler,
+	parent certloader.Parent,
+) (*httpServer, error) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	ln = newIPBanListener(ln, authManager)
+
+	var tlsConfig *tls.Config
+	var certLoader *certloader.CertLoader
+	if encryption {
+		tlsConfig, certLoader, err = newTLSConfig(serverCert, serverKey, "", parent)
+		if err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	s := &httpServer{
+		ln:         ln,
+		certLoader: certLoader,
+		server: &http.Server{
+			Handler:   handler,
+			TLSConfig: tlsConfig,
+			ErrorLog:  log.New(&nilWriter{}, "", 0),
+		},
+	}
+
+	if tlsConfig != nil {
+		go s.server.ServeTLS(s.ln, "", "")
+	} else {
+		go s.server.Serve(s.ln)
+	}
+
+	return s, nil
+}
+
+func (s *httpServer) close() {
+	s.server.Shutdown(context.Background())
+	s.ln.Close() // in case Shutdown() is called before Serve()
+
+	if s.certLoader != nil {
+		s.certLoader.Close()
+	}
+}
@@ -0,0 +1,235 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maximum number of IPs whose failures are tracked.
+const ipBanTrackerMaxSize = 100000
+
+type ipBanTrackerAPIBansListItem struct {
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	Failures int       `json:"failures"`
+}
+
+type ipBanTrackerAPIBansListData struct {
+	Items map[string]ipBanTrackerAPIBansListItem `json:"items"`
+}
+
+type ipBan struct {
+	created  time.Time
+	expires  time.Time
+	failures int
+}
+
+// ipBanTracker counts authentication failures of IPs
+// and bans IPs that fail too many times.
+// It is shared between all servers.
+type ipBanTracker struct {
+	mutex       sync.Mutex
+	maxFailures int
+	window      time.Duration
+	duration    time.Duration
+	failures    map[string][]time.Time
+	bans        map[string]*ipBan
+}
+
+func newIPBanTracker() *ipBanTracker {
+	return &ipBanTracker{
+		failures: make(map[string][]time.Time),
+		bans:     make(map[string]*ipBan),
+	}
+}
+
+func (t *ipBanTracker) setConf(maxFailures int, window time.Duration, duration time.Duration) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.maxFailures = maxFailures
+	t.window = window
+	t.duration = duration
+
+	if maxFailures == 0 {
+		t.failures = make(map[string][]time.Time)
+		t.bans = make(map[string]*ipBan)
+	}
+}
+
+// onFailure records an authentication failure.
+// It returns true if the IP has been banned.
+func (t *ipBanTracker) onFailure(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.maxFailures == 0 {
+		return false
+	}
+
+	now := time.Now()
+	key := ip.String()
+
+	if _, ok := t.bans[key]; ok {
+		return false
+	}
+
+	if _, ok := t.failures[key]; !ok && len(t.failures) >= ipBanTrackerMaxSize {
+		t.prune(now)
+		if len(t.failures) >= ipBanTrackerMaxSize {
+			return false
+		}
+	}
+
+	// keep only failures inside the window
+	var failures []time.Time
+	for _, f := range t.failures[key] {
+		if now.Sub(f) < t.window {
+			failures = append(failures, f)
+		}
+	}
+	failures = append(failures, now)
+
+	if len(failures) < t.maxFailures {
+		t.failures[key] = failures
+		return false
+	}
+
+	delete(t.failures, key)
+	t.bans[key] = &ipBan{
+		created:  now,
+		expires:  now.Add(t.duration),
+		failures: len(failures),
+	}
+	return true
+}
+
+func (t *ipBanTracker) prune(now time.Time) {
+	for key, failures := range t.failures {
+		if now.Sub(failures[len(failures)-1]) >= t.window {
+			delete(t.failures, key)
+		}
+	}
+
+	for key, ban := range t.bans {
+		if !now.Before(ban.expires) {
+			delete(t.bans, key)
+		}
+	}
+}
+
+// isBanned returns whether an IP is banned.
+func (t *ipBanTracker) isBanned(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	key := ip.String()
+
+	ban, ok := t.bans[key]
+	if !ok {
+		return false
+	}
+
+	if !time.Now().Before(ban.expires) {
+		delete(t.bans, key)
+		return false
+	}
+
+	return true
+}
+
+// apiBansList is called by api.
+func (t *ipBanTracker) apiBansList() *ipBanTrackerAPIBansListData {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.prune(time.Now())
+
+	data := &ipBanTrackerAPIBansListData{
+		Items: make(map[string]ipBanTrackerAPIBansListItem),
+	}
+
+	for key, ban := range t.bans {
+		data.Items[key] = ipBanTrackerAPIBansListItem{
+			Created:  ban.created,
+			Expires:  ban.expires,
+			Failures: ban.failures,
+		}
+	}
+
+	return data
+}
+
+// apiBansRemove is called by api.
+func (t *ipBanTracker) apiBansRemove(ip string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return fmt.Errorf("invalid IP: %s", ip)
+	}
+	key := parsed.String()
+
+	if _, ok := t.bans[key]; !ok {
+		return fmt.Errorf("ban not found")
+	}
+
+	delete(t.bans, key)
+	return nil
+}
+
+// ipBanListener is a net.Listener that closes connections
+// coming from banned IPs as soon as they are accepted.
+type ipBanListener struct {
+	net.Listener
+	authManager *authManager
+}
+
+func newIPBanListener(ln net.Listener, authManager *authManager) net.Listener {
+	return &ipBanListener{
+		Listener:    ln,
+		authManager: authManager,
+	}
+}
+
+// Accept implements net.Listener.
+func (l *ipBanListener) Accept() (net.Conn, error) {
+	for {
+		nconn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if addr, ok := nconn.RemoteAddr().(*net.TCPAddr); ok && l.authManager.isBanned(addr.IP) {
+			nconn.Close()
+			continue
+		}
+
+		return nconn, nil
+	}
+}
+
+// ipBanMiddleware is a gin middleware that rejects requests of banned IPs.
+// It is needed when requests come from trusted proxies, since in this case
+// the IP of the client is known only after the request has been parsed.
+func ipBanMiddleware(m *authManager) func(*gin.Context) {
+	return func(ctx *gin.Context) {
+		if m.isBanned(net.ParseIP(ctx.ClientIP())) {
+			ctx.AbortWithStatus(http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPBanTracker(t *testing.T) {
+	tr := newIPBanTracker()
+	tr.setConf(3, 200*time.Millisecond, 200*time.Millisecond)
+
+	ip := net.ParseIP("192.168.0.1")
+
+	// failures outside the window are not counted
+	require.Equal(t, false, tr.onFailure(ip))
+	require.Equal(t, false, tr.onFailure(ip))
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, false, tr.onFailure(ip))
+	require.Equal(t, false, tr.onFailure(ip))
+	require.Equal(t, false, tr.isBanned(ip))
+
+	require.Equal(t, true, tr.onFailure(ip))
+	require.Equal(t, true, tr.isBanned(ip))
+	require.Equal(t, false, tr.isBanned(net.ParseIP("192.168.0.2")))
+
+	// bans expire
+	time.Sleep(250 * time.Millisecond)
+	require.Equal(t, false, tr.isBanned(ip))
+
+	// tracking can be disabled
+	tr.setConf(0, 0, 0)
+	for i := 0; i < 5; i++ {
+		require.Equal(t, false, tr.onFailure(ip))
+	}
+	require.Equal(t, false, tr.isBanned(ip))
+}
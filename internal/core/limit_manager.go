@@ -0,0 +1,199 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+const httpLimitRejectTimeout = 1 * time.Second
+
+type limitReason int
+
+const (
+	limitReasonConnsPerIP limitReason = iota
+	limitReasonReaders
+	limitReasonPathReaders
+	limitReasonPathBandwidth
+	limitReasonCount
+)
+
+func (r limitReason) String() string {
+	switch r {
+	case limitReasonConnsPerIP:
+		return "connsPerIP"
+	case limitReasonReaders:
+		return "readers"
+	case limitReasonPathReaders:
+		return "pathReaders"
+	}
+	return "pathBandwidth"
+}
+
+// limitManager enforces the global limits on connections and readers,
+// and counts connections and readers rejected because of any limit.
+// It is shared between all servers and paths.
+type limitManager struct {
+	rejections [limitReasonCount]uint64
+
+	mutex         sync.Mutex
+	maxConnsPerIP int
+	maxReaders    int
+	conns         map[string]int
+	readers       int
+}
+
+func newLimitManager(cnf *conf.Conf) *limitManager {
+	m := &limitManager{
+		conns: make(map[string]int),
+	}
+	m.confReload(cnf)
+	return m
+}
+
+// confReload is called by core.
+func (m *limitManager) confReload(cnf *conf.Conf) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.maxConnsPerIP = cnf.MaxConnsPerIP
+	m.maxReaders = cnf.MaxReaders
+}
+
+// onRejected records a rejection.
+func (m *limitManager) onRejected(reason limitReason) {
+	atomic.AddUint64(&m.rejections[reason], 1)
+}
+
+// rejectionCount returns the number of rejections due to a limit.
+func (m *limitManager) rejectionCount(reason limitReason) uint64 {
+	return atomic.LoadUint64(&m.rejections[reason])
+}
+
+// connOpen registers a connection of an IP.
+// It returns false if the IP reached the maximum number of connections.
+func (m *limitManager) connOpen(ip net.IP) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := ip.String()
+
+	if m.maxConnsPerIP != 0 && m.conns[key] >= m.maxConnsPerIP {
+		m.onRejected(limitReasonConnsPerIP)
+		return false
+	}
+
+	m.conns[key]++
+	return true
+}
+
+// connClose unregisters a connection of an IP.
+func (m *limitManager) connClose(ip net.IP) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key := ip.String()
+
+	m.conns[key]--
+	if m.conns[key] <= 0 {
+		delete(m.conns, key)
+	}
+}
+
+// readerAdd registers a reader.
+// It returns false if the server reached the maximum number of readers.
+func (m *limitManager) readerAdd() bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.maxReaders != 0 && m.readers >= m.maxReaders {
+		m.onRejected(limitReasonReaders)
+		return false
+	}
+
+	m.readers++
+	return true
+}
+
+// readerRemove unregisters a reader.
+func (m *limitManager) readerRemove() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.readers--
+}
+
+// limitConn is a net.Conn that unregisters itself from the limitManager when closed.
+type limitConn struct {
+	net.Conn
+	limitManager *limitManager
+	ip           net.IP
+	closeOnce    sync.Once
+}
+
+// Close implements net.Conn.
+func (c *limitConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.limitManager.connClose(c.ip)
+	})
+	return c.Conn.Close()
+}
+
+// limitListener is a net.Listener that rejects connections
+// of IPs that reached the maximum number of connections.
+type limitListener struct {
+	net.Listener
+	limitManager *limitManager
+	reject       func(net.Conn)
+}
+
+// newLimitListener allocates a limitListener.
+// reject, if not nil, is called before closing rejected connections,
+// in order to notify clients with a protocol-specific response.
+func newLimitListener(ln net.Listener, limitManager *limitManager, reject func(net.Conn)) net.Listener {
+	return &limitListener{
+		Listener:     ln,
+		limitManager: limitManager,
+		reject:       reject,
+	}
+}
+
+// Accept implements net.Listener.
+func (l *limitListener) Accept() (net.Conn, error) {
+	for {
+		nconn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		addr, ok := nconn.RemoteAddr().(*net.TCPAddr)
+		if !ok {
+			return nconn, nil
+		}
+
+		if !l.limitManager.connOpen(addr.IP) {
+			if l.reject != nil {
+				l.reject(nconn)
+			}
+			nconn.Close()
+			continue
+		}
+
+		return &limitConn{
+			Conn:         nconn,
+			limitManager: l.limitManager,
+			ip:           addr.IP,
+		}, nil
+	}
+}
+
+// httpLimitReject replies to rejected plain HTTP connections with 503.
+func httpLimitReject(nconn net.Conn) {
+	nconn.SetWriteDeadline(time.Now().Add(httpLimitRejectTimeout))
+	nconn.Write([]byte("HTTP/1.1 503 Service Unavailable\r\n" +
+		"Connection: close\r\n" +
+		"Content-Length: 0\r\n\r\n"))
+}
@@ -0,0 +1,71 @@
+package core
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+func TestLimitListener(t *testing.T) {
+	m := newLimitManager(&conf.Conf{MaxConnsPerIP: 1})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	ln = newLimitListener(ln, m, httpLimitReject)
+	defer ln.Close()
+
+	accepted := make(chan net.Conn)
+	go func() {
+		for {
+			nconn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- nconn
+		}
+	}()
+
+	conn1, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn1.Close()
+	nconn1 := <-accepted
+
+	conn2, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn2.Close()
+
+	res, err := http.ReadResponse(bufio.NewReader(conn2), nil)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+	require.Equal(t, uint64(1), m.rejectionCount(limitReasonConnsPerIP))
+
+	// the slot is released when the first connection is closed
+	nconn1.Close()
+
+	conn3, err := net.Dial("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer conn3.Close()
+	nconn3 := <-accepted
+	nconn3.Close()
+}
+
+func TestLimitManagerReaders(t *testing.T) {
+	m := newLimitManager(&conf.Conf{MaxReaders: 2})
+
+	require.Equal(t, true, m.readerAdd())
+	require.Equal(t, true, m.readerAdd())
+	require.Equal(t, false, m.readerAdd())
+	require.Equal(t, uint64(1), m.rejectionCount(limitReasonReaders))
+
+	m.readerRemove()
+	require.Equal(t, true, m.readerAdd())
+
+	m.confReload(&conf.Conf{})
+	require.Equal(t, true, m.readerAdd())
+}
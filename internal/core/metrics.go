@@ -1,16 +1,15 @@
 package core
 
 import (
-	"context"
 	"io"
-	"log"
-	"net"
 	"net/http"
 	"strconv"
 	"sync"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
+	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
@@ -23,10 +22,12 @@ type metricsParent interface {
 }
 
 type metrics struct {
-	parent metricsParent
+	authManager    *authManager
+	limitManager   *limitManager
+	webhookManager *webhookManager
+	parent         metricsParent
 
-	ln           net.Listener
-	server       *http.Server
+	httpServer   *httpServer
 	mutex        sync.Mutex
 	pathManager  apiPathManager
 	rtspServer   apiRTSPServer
@@ -34,42 +35,50 @@ type metrics struct {
 	rtmpServer   apiRTMPServer
 	hlsServer    apiHLSServer
 	webRTCServer apiWebRTCServer
+	certLoaders  map[string]*certloader.CertLoader
 }
 
 func newMetrics(
 	address string,
+	encryption bool,
+	serverKey string,
+	serverCert string,
+	authManager *authManager,
+	limitManager *limitManager,
+	webhookManager *webhookManager,
 	parent metricsParent,
 ) (*metrics, error) {
-	ln, err := net.Listen("tcp", address)
-	if err != nil {
-		return nil, err
-	}
-
 	m := &metrics{
-		parent: parent,
-		ln:     ln,
+		authManager:    authManager,
+		limitManager:   limitManager,
+		webhookManager: webhookManager,
+		parent:         parent,
+		certLoaders:    make(map[string]*certloader.CertLoader),
 	}
 
 	router := gin.New()
 	router.SetTrustedProxies(nil)
-	router.GET("/metrics", m.onMetrics)
+	router.GET("/metrics", httpAuthMiddleware(m.authManager, conf.AuthActionMetrics, m), m.onMetrics)
 
-	m.server = &http.Server{
-		Handler:  router,
-		ErrorLog: log.New(&nilWriter{}, "", 0),
+	var err error
+	m.httpServer, err = newHTTPServer(address, encryption, serverKey, serverCert, authManager, router, parent)
+	if err != nil {
+		return nil, err
 	}
 
-	m.log(logger.Info, "listener opened on "+address)
+	if m.httpServer.certLoader != nil {
+		m.certLoaders["metrics"] = m.httpServer.certLoader
+	}
 
-	go m.server.Serve(m.ln)
+	m.log(logger.Info, "listener opened on "+address)
+	warnUnauthenticatedListener(authManager, address, m)
 
 	return m, nil
 }
 
 func (m *metrics) close() {
 	m.log(logger.Info, "listener is closing")
-	m.server.Shutdown(context.Background())
-	m.ln.Close() // in case Shutdown() is called before Serve()
+	m.httpServer.close()
 }
 
 func (m *metrics) log(level logger.Level, format string, args ...interface{}) {
@@ -182,6 +191,25 @@ func (m *metrics) onMetrics(ctx *gin.Context) {
 		}
 	}
 
+	m.mutex.Lock()
+	for listener, cl := range m.certLoaders {
+		tags := "{listener=\"" + listener + "\"}"
+		out += metric("tls_cert_reloads"+tags, int64(cl.Reloads()))
+		out += metric("tls_cert_reload_errors"+tags, int64(cl.ReloadErrors()))
+	}
+	m.mutex.Unlock()
+
+	for reason := limitReason(0); reason < limitReasonCount; reason++ {
+		tags := "{reason=\"" + reason.String() + "\"}"
+		out += metric("limit_rejections"+tags, int64(m.limitManager.rejectionCount(reason)))
+	}
+
+	out += metric("webhook_deliveries", int64(m.webhookManager.deliveryCount()))
+	for reason := webhookFailureReason(0); reason < webhookFailureReasonCount; reason++ {
+		tags := "{reason=\"" + reason.String() + "\"}"
+		out += metric("webhook_failures"+tags, int64(m.webhookManager.failureCount(reason)))
+	}
+
 	ctx.Writer.WriteHeader(http.StatusOK)
 	io.WriteString(ctx.Writer, out)
 }
@@ -227,3 +255,15 @@ func (m *metrics) webRTCServerSet(s apiWebRTCServer) {
 	defer m.mutex.Unlock()
 	m.webRTCServer = s
 }
+
+// certLoaderSet is called by servers with encryption.
+func (m *metrics) certLoaderSet(listener string, cl *certloader.CertLoader) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if cl == nil {
+		delete(m.certLoaders, listener)
+	} else {
+		m.certLoaders[listener] = cl
+	}
+}
@@ -118,6 +118,15 @@ func TestMetrics(t *testing.T) {
 			`rtmp_conns\{id=".*?",state="publish"\} 1`+"\n"+
 			`rtmp_conns_bytes_received\{id=".*?",state="publish"\} [0-9]+`+"\n"+
 			`rtmp_conns_bytes_sent\{id=".*?",state="publish"\} [0-9]+`+"\n"+
+			`tls_cert_reloads\{listener="rtsps"\} 0`+"\n"+
+			`tls_cert_reload_errors\{listener="rtsps"\} 0`+"\n"+
+			`limit_rejections\{reason="connsPerIP"\} 0`+"\n"+
+			`limit_rejections\{reason="readers"\} 0`+"\n"+
+			`limit_rejections\{reason="pathReaders"\} 0`+"\n"+
+			`limit_rejections\{reason="pathBandwidth"\} 0`+"\n"+
+			`webhook_deliveries 0`+"\n"+
+			`webhook_failures\{reason="queueFull"\} 0`+"\n"+
+			`webhook_failures\{reason="retriesExhausted"\} 0`+"\n"+
 			"$",
 		string(bo))
 }
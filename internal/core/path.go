@@ -40,6 +40,15 @@ func (e pathErrNoOnePublishing) Error() string {
 	return fmt.Sprintf("no one is publishing to path '%s'", e.pathName)
 }
 
+type pathErrNotConfigured struct {
+	pathName string
+}
+
+// Error implements the error interface.
+func (e pathErrNotConfigured) Error() string {
+	return fmt.Sprintf("path '%s' is not configured", e.pathName)
+}
+
 type pathErrAuthNotCritical struct {
 	message  string
 	response *base.Response
@@ -60,6 +69,15 @@ func (pathErrAuthCritical) Error() string {
 	return "critical authentication error"
 }
 
+type pathErrLimitReached struct {
+	message string
+}
+
+// Error implements the error interface.
+func (e pathErrLimitReached) Error() string {
+	return e.message
+}
+
 type pathParent interface {
 	log(logger.Level, string, ...interface{})
 	pathSourceReady(*path)
@@ -124,6 +142,7 @@ type pathReaderSetupPlayRes struct {
 type pathReaderAddReq struct {
 	author       reader
 	pathName     string
+	query        string
 	authenticate authenticateFunc
 	res          chan pathReaderSetupPlayRes
 }
@@ -136,6 +155,8 @@ type pathPublisherAnnounceRes struct {
 type pathPublisherAddReq struct {
 	author       publisher
 	pathName     string
+	query        string
+	priority     func() int // called after authentication
 	authenticate authenticateFunc
 	res          chan pathPublisherAnnounceRes
 }
@@ -158,13 +179,14 @@ type pathPublisherStopReq struct {
 }
 
 type pathAPIPathsListItem struct {
-	ConfName      string         `json:"confName"`
-	Conf          *conf.PathConf `json:"conf"`
-	Source        interface{}    `json:"source"`
-	SourceReady   bool           `json:"sourceReady"`
-	Tracks        []string       `json:"tracks"`
-	BytesReceived uint64         `json:"bytesReceived"`
-	Readers       []interface{}  `json:"readers"`
+	ConfName      string        `json:"confName"`
+	Conf          interface{}   `json:"conf"` // *conf.PathConf, redacted by the API
+	Source        interface{}   `json:"source"`
+	SourceReady   bool          `json:"sourceReady"`
+	Standby       interface{}   `json:"standby"`
+	Tracks        []string      `json:"tracks"`
+	BytesReceived uint64        `json:"bytesReceived"`
+	Readers       []interface{} `json:"readers"`
 }
 
 type pathAPIPathsListData struct {
@@ -186,6 +208,10 @@ type pathAPIPathsListSubReq struct {
 	res  chan struct{}
 }
 
+type pathReaderInfo struct {
+	query string
+}
+
 type path struct {
 	rtspAddress     string
 	readTimeout     conf.StringDuration
@@ -197,17 +223,32 @@ type path struct {
 	matches         []string
 	wg              *sync.WaitGroup
 	externalCmdPool *externalcmd.Pool
+	limitManager    *limitManager
+	eventBus        *eventBus
 	parent          pathParent
 
 	ctx                            context.Context
 	ctxCancel                      func()
 	confMutex                      sync.RWMutex
 	source                         source
+	sourceQuery                    string
+	sourcePriority                 int
+	sourceForwardStream            *stream
+	standby                        publisher
+	standbyQuery                   string
+	standbyPriority                int
+	standbyStream                  *stream
+	standbyCheckTimer              *time.Timer
+	standbyLastBytes               uint64
+	standbyLastData                time.Time
 	bytesReceived                  *uint64
 	stream                         *stream
-	readers                        map[reader]struct{}
+	streamReadyTime                time.Time
+	streamReadyBytes               uint64
+	readers                        map[reader]pathReaderInfo
 	describeRequestsOnHold         []pathDescribeReq
 	readerAddRequestsOnHold        []pathReaderAddReq
+	onInitCmd                      *externalcmd.Cmd
 	onDemandCmd                    *externalcmd.Cmd
 	onReadyCmd                     *externalcmd.Cmd
 	onDemandStaticSourceState      pathOnDemandState
@@ -246,6 +287,8 @@ func newPath(
 	matches []string,
 	wg *sync.WaitGroup,
 	externalCmdPool *externalcmd.Pool,
+	limitManager *limitManager,
+	eventBus *eventBus,
 	parent pathParent,
 ) *path {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
@@ -261,15 +304,18 @@ func newPath(
 		matches:                        matches,
 		wg:                             wg,
 		externalCmdPool:                externalCmdPool,
+		limitManager:                   limitManager,
+		eventBus:                       eventBus,
 		parent:                         parent,
 		ctx:                            ctx,
 		ctxCancel:                      ctxCancel,
 		bytesReceived:                  new(uint64),
-		readers:                        make(map[reader]struct{}),
+		readers:                        make(map[reader]pathReaderInfo),
 		onDemandStaticSourceReadyTimer: newEmptyTimer(),
 		onDemandStaticSourceCloseTimer: newEmptyTimer(),
 		onDemandPublisherReadyTimer:    newEmptyTimer(),
 		onDemandPublisherCloseTimer:    newEmptyTimer(),
+		standbyCheckTimer:              newEmptyTimer(),
 		chReloadConf:                   make(chan *conf.PathConf),
 		chSourceStaticSetReady:         make(chan pathSourceStaticSetReadyReq),
 		chSourceStaticSetNotReady:      make(chan pathSourceStaticSetNotReadyReq),
@@ -305,14 +351,18 @@ func (pa *path) log(level logger.Level, format string, args ...interface{}) {
 	pa.parent.log(level, "[path "+pa.name+"] "+format, args...)
 }
 
+func pathConfHasStaticSource(pathConf *conf.PathConf) bool {
+	return strings.HasPrefix(pathConf.Source, "rtsp://") ||
+		strings.HasPrefix(pathConf.Source, "rtsps://") ||
+		strings.HasPrefix(pathConf.Source, "rtmp://") ||
+		strings.HasPrefix(pathConf.Source, "rtmps://") ||
+		strings.HasPrefix(pathConf.Source, "http://") ||
+		strings.HasPrefix(pathConf.Source, "https://") ||
+		pathConf.Source == "rpiCamera"
+}
+
 func (pa *path) hasStaticSource() bool {
-	return strings.HasPrefix(pa.conf.Source, "rtsp://") ||
-		strings.HasPrefix(pa.conf.Source, "rtsps://") ||
-		strings.HasPrefix(pa.conf.Source, "rtmp://") ||
-		strings.HasPrefix(pa.conf.Source, "rtmps://") ||
-		strings.HasPrefix(pa.conf.Source, "http://") ||
-		strings.HasPrefix(pa.conf.Source, "https://") ||
-		pa.conf.Source == "rpiCamera"
+	return pathConfHasStaticSource(pa.conf)
 }
 
 func (pa *path) hasOnDemandStaticSource() bool {
@@ -348,18 +398,9 @@ func (pa *path) run() {
 		}
 	}
 
-	var onInitCmd *externalcmd.Cmd
-	if pa.conf.RunOnInit != "" {
-		pa.log(logger.Info, "runOnInit command started")
-		onInitCmd = externalcmd.NewCmd(
-			pa.externalCmdPool,
-			pa.conf.RunOnInit,
-			pa.conf.RunOnInitRestart,
-			pa.externalCmdEnv(),
-			func(co int) {
-				pa.log(logger.Info, "runOnInit command exited with code %d", co)
-			})
-	}
+	pa.publishEvent(event{Type: eventTypePathCreated})
+
+	pa.onInitCmdStart()
 
 	err := func() error {
 		for {
@@ -413,14 +454,11 @@ func (pa *path) run() {
 					return fmt.Errorf("not in use")
 				}
 
-			case newConf := <-pa.chReloadConf:
-				if pa.hasStaticSource() {
-					go pa.source.(*sourceStatic).reloadConf(newConf)
-				}
+			case <-pa.standbyCheckTimer.C:
+				pa.standbyCheck()
 
-				pa.confMutex.Lock()
-				pa.conf = newConf
-				pa.confMutex.Unlock()
+			case newConf := <-pa.chReloadConf:
+				pa.doReloadConf(newConf)
 
 			case req := <-pa.chSourceStaticSetReady:
 				err := pa.sourceSetReady(req.medias, req.generateRTPPackets)
@@ -519,11 +557,9 @@ func (pa *path) run() {
 	pa.onDemandStaticSourceCloseTimer.Stop()
 	pa.onDemandPublisherReadyTimer.Stop()
 	pa.onDemandPublisherCloseTimer.Stop()
+	pa.standbyCheckTimer.Stop()
 
-	if onInitCmd != nil {
-		onInitCmd.Close()
-		pa.log(logger.Info, "runOnInit command stopped")
-	}
+	pa.onInitCmdStop()
 
 	for _, req := range pa.describeRequestsOnHold {
 		req.res <- pathDescribeRes{err: fmt.Errorf("terminated")}
@@ -545,15 +581,43 @@ func (pa *path) run() {
 		}
 	}
 
+	if pa.standby != nil {
+		pa.standby.close()
+		pa.doStandbyRemove()
+	}
+
 	if pa.onDemandCmd != nil {
 		pa.onDemandCmd.Close()
 		pa.log(logger.Info, "runOnDemand command stopped")
 	}
 
+	pa.publishEvent(event{Type: eventTypePathRemoved})
+
 	pa.log(logger.Debug, "destroyed (%v)", err)
 }
 
+func (pa *path) publishEvent(e event) {
+	e.Path = pa.name
+	e.pathConf = pa.conf
+	pa.eventBus.publish(e)
+}
+
+func (pa *path) sourceDescribe() interface{} {
+	if pa.source == nil {
+		return nil
+	}
+	return pa.source.apiSourceDescribe()
+}
+
 func (pa *path) shouldClose() bool {
+	// paths pulled from origins are closed together with their source
+	if pa.confName == pathConfNameCluster {
+		return pa.onDemandStaticSourceState == pathOnDemandStateInitial &&
+			len(pa.readers) == 0 &&
+			len(pa.describeRequestsOnHold) == 0 &&
+			len(pa.readerAddRequestsOnHold) == 0
+	}
+
 	return pa.conf.Regexp != nil &&
 		pa.source == nil &&
 		len(pa.readers) == 0 &&
@@ -577,6 +641,70 @@ func (pa *path) externalCmdEnv() externalcmd.Environment {
 	return env
 }
 
+// externalCmdSourceEnv returns the environment of commands related to the source.
+func (pa *path) externalCmdSourceEnv() externalcmd.Environment {
+	env := pa.externalCmdEnv()
+	env["RTSP_QUERY"] = pa.sourceQuery
+
+	if pa.source != nil {
+		env["RTSP_SOURCE_TYPE"], env["RTSP_SOURCE_ID"] = describeTypeID(pa.source.apiSourceDescribe())
+		env["RTSP_REMOTE_ADDR"] = remoteAddrString(pa.source)
+	}
+
+	return env
+}
+
+// externalCmdReaderEnv returns the environment of commands related to a reader.
+func (pa *path) externalCmdReaderEnv(r reader, query string) externalcmd.Environment {
+	env := pa.externalCmdEnv()
+	env["RTSP_READER_TYPE"], env["RTSP_READER_ID"] = describeTypeID(r.apiReaderDescribe())
+	env["RTSP_REMOTE_ADDR"] = remoteAddrString(r)
+	env["RTSP_QUERY"] = query
+	return env
+}
+
+func (pa *path) doReloadConf(newConf *conf.PathConf) {
+	if pa.hasStaticSource() {
+		go pa.source.(*sourceStatic).reloadConf(newConf)
+	}
+
+	restartOnInit := newConf.RunOnInit != pa.conf.RunOnInit ||
+		newConf.RunOnInitRestart != pa.conf.RunOnInitRestart
+
+	pa.confMutex.Lock()
+	pa.conf = newConf
+	pa.confMutex.Unlock()
+
+	if restartOnInit {
+		pa.onInitCmdStop()
+		pa.onInitCmdStart()
+	}
+}
+
+func (pa *path) onInitCmdStart() {
+	if pa.conf.RunOnInit != "" {
+		pa.log(logger.Info, "runOnInit command started")
+		pa.onInitCmd = externalcmd.NewCmd(
+			pa.externalCmdPool,
+			"runOnInit",
+			pa.conf.RunOnInit,
+			pa.conf.RunOnInitRestart,
+			pa.externalCmdEnv(),
+			pa.log,
+			func(co int) {
+				pa.log(logger.Info, "runOnInit command exited with code %d", co)
+			})
+	}
+}
+
+func (pa *path) onInitCmdStop() {
+	if pa.onInitCmd != nil {
+		pa.onInitCmd.Close()
+		pa.onInitCmd = nil
+		pa.log(logger.Info, "runOnInit command stopped")
+	}
+}
+
 func (pa *path) onDemandStaticSourceStart() {
 	pa.source.(*sourceStatic).start()
 
@@ -608,9 +736,11 @@ func (pa *path) onDemandPublisherStart() {
 	pa.log(logger.Info, "runOnDemand command started")
 	pa.onDemandCmd = externalcmd.NewCmd(
 		pa.externalCmdPool,
+		"runOnDemand",
 		pa.conf.RunOnDemand,
 		pa.conf.RunOnDemandRestart,
 		pa.externalCmdEnv(),
+		pa.log,
 		func(co int) {
 			pa.log(logger.Info, "runOnDemand command exited with code %d", co)
 		})
@@ -650,20 +780,29 @@ func (pa *path) onDemandPublisherStop() {
 }
 
 func (pa *path) sourceSetReady(medias media.Medias, allocateEncoder bool) error {
-	stream, err := newStream(medias, allocateEncoder, pa.bytesReceived)
+	stream, err := newStream(
+		medias,
+		allocateEncoder,
+		pa.bytesReceived,
+		pa.conf.ReaderBandwidthLimit,
+		pa.conf.BandwidthLimit)
 	if err != nil {
 		return err
 	}
 
 	pa.stream = stream
+	pa.streamReadyTime = time.Now()
+	pa.streamReadyBytes = atomic.LoadUint64(pa.bytesReceived)
 
 	if pa.conf.RunOnReady != "" {
 		pa.log(logger.Info, "runOnReady command started")
 		pa.onReadyCmd = externalcmd.NewCmd(
 			pa.externalCmdPool,
+			"runOnReady",
 			pa.conf.RunOnReady,
 			pa.conf.RunOnReadyRestart,
-			pa.externalCmdEnv(),
+			pa.externalCmdSourceEnv(),
+			pa.log,
 			func(co int) {
 				pa.log(logger.Info, "runOnReady command exited with code %d", co)
 			})
@@ -671,12 +810,25 @@ func (pa *path) sourceSetReady(medias media.Medias, allocateEncoder bool) error
 
 	pa.parent.pathSourceReady(pa)
 
+	pa.publishEvent(event{
+		Type:   eventTypeSourceReady,
+		Source: pa.sourceDescribe(),
+		Medias: mediasDescription(medias),
+		Query:  pa.sourceQuery,
+	})
+
 	return nil
 }
 
 func (pa *path) sourceSetNotReady() {
 	pa.parent.pathSourceNotReady(pa)
 
+	pa.publishEvent(event{
+		Type:   eventTypeSourceNotReady,
+		Source: pa.sourceDescribe(),
+		Query:  pa.sourceQuery,
+	})
+
 	for r := range pa.readers {
 		pa.doReaderRemove(r)
 		r.close()
@@ -688,14 +840,98 @@ func (pa *path) sourceSetNotReady() {
 		pa.log(logger.Info, "runOnReady command stopped")
 	}
 
+	if pa.conf.RunOnNotReady != "" {
+		pa.log(logger.Info, "runOnNotReady command launched")
+		externalcmd.RunOneShot(
+			pa.externalCmdPool,
+			"runOnNotReady",
+			pa.conf.RunOnNotReady,
+			pa.externalCmdSourceEnv(),
+			pa.log,
+			func(co int) {
+				pa.log(logger.Info, "runOnNotReady command exited with code %d", co)
+			})
+	}
+
 	if pa.stream != nil {
 		pa.stream.close()
 		pa.stream = nil
 	}
+
+	if pa.sourceForwardStream != nil {
+		pa.sourceForwardStream.close()
+		pa.sourceForwardStream = nil
+	}
+
+	pa.standbyCheckSchedule()
 }
 
 func (pa *path) doReaderRemove(r reader) {
+	info := pa.readers[r]
 	delete(pa.readers, r)
+	pa.limitManager.readerRemove()
+
+	if _, ok := r.(*rtspSession); ok && pa.stream != nil {
+		pa.stream.rtspReaderRemove(r)
+	}
+
+	pa.publishEvent(event{
+		Type:   eventTypeReaderRemoved,
+		Reader: r.apiReaderDescribe(),
+		Query:  info.query,
+	})
+
+	if pa.conf.RunOnUnread != "" {
+		pa.log(logger.Info, "runOnUnread command launched")
+		externalcmd.RunOneShot(
+			pa.externalCmdPool,
+			"runOnUnread",
+			pa.conf.RunOnUnread,
+			pa.externalCmdReaderEnv(r, info.query),
+			pa.log,
+			func(co int) {
+				pa.log(logger.Info, "runOnUnread command exited with code %d", co)
+			})
+	}
+}
+
+// streamBitrate returns the average incoming bitrate of the stream, in bits per second.
+func (pa *path) streamBitrate() float64 {
+	elapsed := time.Since(pa.streamReadyTime)
+	if elapsed < time.Second {
+		elapsed = time.Second
+	}
+
+	received := atomic.LoadUint64(pa.bytesReceived) - pa.streamReadyBytes
+	return float64(received*8) / elapsed.Seconds()
+}
+
+// checkReaderLimits checks whether a new reader can be added without exceeding
+// the limits of the path. Bandwidth is estimated by multiplying the incoming bitrate
+// by the number of readers.
+func (pa *path) checkReaderLimits() error {
+	if pa.conf.MaxReaders != 0 && len(pa.readers) >= pa.conf.MaxReaders {
+		pa.limitManager.onRejected(limitReasonPathReaders)
+		return pathErrLimitReached{
+			message: fmt.Sprintf("path '%s' reached the maximum number of readers (%d)", pa.name, pa.conf.MaxReaders),
+		}
+	}
+
+	if pa.conf.MaxBandwidth != 0 &&
+		pa.streamBitrate()*float64(len(pa.readers)+1) > float64(pa.conf.MaxBandwidth) {
+		pa.limitManager.onRejected(limitReasonPathBandwidth)
+		return pathErrLimitReached{
+			message: fmt.Sprintf("path '%s' reached the maximum bandwidth (%d bit/s)", pa.name, pa.conf.MaxBandwidth),
+		}
+	}
+
+	if !pa.limitManager.readerAdd() {
+		return pathErrLimitReached{
+			message: "the server reached the maximum number of readers",
+		}
+	}
+
+	return nil
 }
 
 func (pa *path) doPublisherRemove() {
@@ -707,7 +943,18 @@ func (pa *path) doPublisherRemove() {
 		}
 	}
 
+	// the publisher may have been removed by onDemandPublisherStop()
+	if pa.source != nil {
+		pa.publishEvent(event{
+			Type:   eventTypePublisherRemoved,
+			Source: pa.sourceDescribe(),
+			Query:  pa.sourceQuery,
+		})
+	}
+
 	pa.source = nil
+	pa.sourceQuery = ""
+	pa.sourcePriority = 0
 }
 
 func (pa *path) handleDescribe(req pathDescribeReq) {
@@ -762,8 +1009,16 @@ func (pa *path) handleDescribe(req pathDescribeReq) {
 }
 
 func (pa *path) handlePublisherRemove(req pathPublisherRemoveReq) {
-	if pa.source == req.author {
-		pa.doPublisherRemove()
+	switch {
+	case pa.source == req.author:
+		if pa.standby != nil {
+			pa.standbyTakeover("primary publisher disconnected", false)
+		} else {
+			pa.doPublisherRemove()
+		}
+
+	case pa.standby == req.author:
+		pa.doStandbyRemove()
 	}
 	close(req.res)
 }
@@ -776,6 +1031,13 @@ func (pa *path) handlePublisherAdd(req pathPublisherAddReq) {
 		return
 	}
 
+	priority := req.priority()
+
+	if pa.source != nil && pa.conf.PublisherStandby {
+		pa.handleStandbyAdd(req, priority)
+		return
+	}
+
 	if pa.source != nil {
 		if pa.conf.DisablePublisherOverride {
 			req.res <- pathPublisherAnnounceRes{err: fmt.Errorf("someone is already publishing to path '%s'", pa.name)}
@@ -788,11 +1050,24 @@ func (pa *path) handlePublisherAdd(req pathPublisherAddReq) {
 	}
 
 	pa.source = req.author
+	pa.sourceQuery = req.query
+	pa.sourcePriority = priority
+
+	pa.publishEvent(event{
+		Type:   eventTypePublisherAdded,
+		Source: pa.sourceDescribe(),
+		Query:  req.query,
+	})
 
 	req.res <- pathPublisherAnnounceRes{path: pa}
 }
 
 func (pa *path) handlePublisherStart(req pathPublisherStartReq) {
+	if pa.standby != nil && pa.standby == req.author {
+		pa.handleStandbyStart(req)
+		return
+	}
+
 	if pa.source != req.author {
 		req.res <- pathPublisherRecordRes{err: fmt.Errorf("publisher is not assigned to this path anymore")}
 		return
@@ -824,9 +1099,23 @@ func (pa *path) handlePublisherStart(req pathPublisherStartReq) {
 	}
 
 	req.res <- pathPublisherRecordRes{stream: pa.stream}
+
+	pa.standbyUpdate()
 }
 
 func (pa *path) handlePublisherStop(req pathPublisherStopReq) {
+	if pa.standby != nil && req.author == pa.standby {
+		pa.doStandbyStop()
+		close(req.res)
+		return
+	}
+
+	if req.author == pa.source && pa.standby != nil {
+		pa.standbyTakeover("primary publisher stopped", true)
+		close(req.res)
+		return
+	}
+
 	if req.author == pa.source && pa.stream != nil {
 		if pa.hasOnDemandPublisher() && pa.onDemandPublisherState != pathOnDemandStateInitial {
 			pa.onDemandPublisherStop()
@@ -837,6 +1126,184 @@ func (pa *path) handlePublisherStop(req pathPublisherStopReq) {
 	close(req.res)
 }
 
+func (pa *path) handleStandbyAdd(req pathPublisherAddReq, priority int) {
+	if pa.standby != nil {
+		if priority <= pa.standbyPriority {
+			req.res <- pathPublisherAnnounceRes{err: fmt.Errorf("someone is already publishing to path '%s'", pa.name)}
+			return
+		}
+
+		pa.log(logger.Info, "closing existing standby publisher")
+		pa.standby.close()
+		pa.doStandbyRemove()
+	}
+
+	pa.standby = req.author
+	pa.standbyQuery = req.query
+	pa.standbyPriority = priority
+
+	pa.log(logger.Info, "standby publisher added with priority %d", priority)
+
+	req.res <- pathPublisherAnnounceRes{path: pa}
+}
+
+func (pa *path) handleStandbyStart(req pathPublisherStartReq) {
+	stream, err := newStandbyStream(req.medias, req.generateRTPPackets)
+	if err != nil {
+		req.res <- pathPublisherRecordRes{err: err}
+		return
+	}
+
+	if pa.standbyStream != nil {
+		pa.standbyStream.close()
+	}
+	pa.standbyStream = stream
+
+	req.res <- pathPublisherRecordRes{stream: stream}
+
+	pa.standbyUpdate()
+}
+
+func (pa *path) doStandbyStop() {
+	if pa.standbyStream != nil {
+		pa.standbyStream.close()
+		pa.standbyStream = nil
+	}
+
+	pa.standbyCheckSchedule()
+}
+
+func (pa *path) doStandbyRemove() {
+	pa.doStandbyStop()
+
+	pa.standby = nil
+	pa.standbyQuery = ""
+	pa.standbyPriority = 0
+}
+
+// standbyUpdate switches to the standby publisher if it has a higher priority
+// than the primary one, otherwise it starts monitoring the primary publisher.
+func (pa *path) standbyUpdate() {
+	if pa.stream != nil && pa.standbyStream != nil && pa.standbyPriority > pa.sourcePriority {
+		pa.standbyTakeover("standby publisher has a higher priority", true)
+		return
+	}
+
+	pa.standbyCheckSchedule()
+}
+
+// standbyCheckSchedule starts monitoring the primary publisher
+// when both publishers are publishing.
+func (pa *path) standbyCheckSchedule() {
+	pa.standbyCheckTimer.Stop()
+
+	if pa.stream == nil || pa.standbyStream == nil {
+		pa.standbyCheckTimer = newEmptyTimer()
+		return
+	}
+
+	pa.standbyLastBytes = atomic.LoadUint64(pa.bytesReceived)
+	pa.standbyLastData = time.Now()
+	pa.standbyCheckTimer = time.NewTimer(time.Duration(pa.conf.PublisherStandbyTimeout) / 4)
+}
+
+// standbyCheck switches to the standby publisher when the primary one
+// didn't send any data within publisherStandbyTimeout.
+func (pa *path) standbyCheck() {
+	if pa.stream == nil || pa.standbyStream == nil {
+		return
+	}
+
+	now := time.Now()
+	bytes := atomic.LoadUint64(pa.bytesReceived)
+
+	if bytes != pa.standbyLastBytes {
+		pa.standbyLastBytes = bytes
+		pa.standbyLastData = now
+	} else if now.Sub(pa.standbyLastData) >= time.Duration(pa.conf.PublisherStandbyTimeout) {
+		pa.standbyTakeover("primary publisher timed out", true)
+		return
+	}
+
+	pa.standbyCheckTimer = time.NewTimer(time.Duration(pa.conf.PublisherStandbyTimeout) / 4)
+}
+
+// standbyTakeover replaces the primary publisher with the standby one.
+// When the two publishers have the same medias, data of the standby publisher
+// is routed into the existing stream and readers are not disconnected.
+func (pa *path) standbyTakeover(reason string, closePrimary bool) {
+	pa.log(logger.Info, "switching to standby publisher: %s", reason)
+
+	if closePrimary {
+		pa.source.(publisher).close()
+	}
+
+	standbyStream := pa.standbyStream
+
+	seamless := false
+	if pa.stream != nil && standbyStream != nil {
+		err := standbyStream.forwardTo(pa.stream)
+		if err != nil {
+			pa.log(logger.Warn, "disconnecting readers since the standby publisher is not compatible: %v", err)
+		} else {
+			seamless = true
+		}
+	}
+
+	if !seamless && pa.stream != nil {
+		pa.sourceSetNotReady()
+	}
+
+	pa.publishEvent(event{
+		Type:   eventTypePublisherRemoved,
+		Source: pa.sourceDescribe(),
+		Query:  pa.sourceQuery,
+	})
+
+	pa.source = pa.standby
+	pa.sourceQuery = pa.standbyQuery
+	pa.sourcePriority = pa.standbyPriority
+	pa.standby = nil
+	pa.standbyQuery = ""
+	pa.standbyPriority = 0
+	pa.standbyStream = nil
+
+	pa.publishEvent(event{
+		Type:   eventTypePublisherAdded,
+		Source: pa.sourceDescribe(),
+		Query:  pa.sourceQuery,
+	})
+
+	if seamless {
+		if pa.sourceForwardStream != nil {
+			pa.sourceForwardStream.stopForward()
+			pa.sourceForwardStream.close()
+		}
+		pa.sourceForwardStream = standbyStream
+		pa.standbyCheckSchedule()
+		return
+	}
+
+	// the new primary publisher becomes ready when it starts publishing
+	if standbyStream == nil {
+		return
+	}
+
+	err := pa.sourceSetReady(standbyStream.medias(), standbyStream.generateRTPPackets)
+	if err == nil {
+		err = standbyStream.forwardTo(pa.stream)
+	}
+	if err != nil {
+		pa.log(logger.Warn, "%v", err)
+		standbyStream.close()
+		pa.source.(publisher).close()
+		pa.doPublisherRemove()
+		return
+	}
+
+	pa.sourceForwardStream = standbyStream
+}
+
 func (pa *path) handleReaderRemove(req pathReaderRemoveReq) {
 	if _, ok := pa.readers[req.author]; ok {
 		pa.doReaderRemove(req.author)
@@ -882,7 +1349,27 @@ func (pa *path) handleReaderAdd(req pathReaderAddReq) {
 }
 
 func (pa *path) handleReaderAddPost(req pathReaderAddReq) {
-	pa.readers[req.author] = struct{}{}
+	// readers can be added multiple times, i.e. when setupping multiple medias with RTSP
+	if _, ok := pa.readers[req.author]; !ok {
+		err := pa.checkReaderLimits()
+		if err != nil {
+			req.res <- pathReaderSetupPlayRes{err: err}
+			return
+		}
+
+		pa.readers[req.author] = pathReaderInfo{query: req.query}
+
+		if _, ok := req.author.(*rtspSession); ok {
+			pa.stream.rtspReaderAdd()
+		}
+
+		pa.publishEvent(event{
+			Type:   eventTypeReaderAdded,
+			Reader: req.author.apiReaderDescribe(),
+			Medias: mediasDescription(pa.stream.medias()),
+			Query:  req.query,
+		})
+	}
 
 	if pa.hasOnDemandStaticSource() {
 		if pa.onDemandStaticSourceState == pathOnDemandStateClosing {
@@ -915,6 +1402,12 @@ func (pa *path) handleAPIPathsList(req pathAPIPathsListSubReq) {
 			return pa.source.apiSourceDescribe()
 		}(),
 		SourceReady: pa.stream != nil,
+		Standby: func() interface{} {
+			if pa.standby == nil {
+				return nil
+			}
+			return pa.standby.apiSourceDescribe()
+		}(),
 		Tracks: func() []string {
 			if pa.stream == nil {
 				return []string{}
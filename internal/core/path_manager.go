@@ -3,6 +3,7 @@ package core
 import (
 	"context"
 	"fmt"
+	"reflect"
 	"sync"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
@@ -10,10 +11,28 @@ import (
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
+// pathConfCanBeUpdated checks whether paths associated with a configuration
+// can be updated in place, without being recreated and without disconnecting clients.
+// Parameters that are not listed here require the recreation of paths.
 func pathConfCanBeUpdated(oldPathConf *conf.PathConf, newPathConf *conf.PathConf) bool {
+	// switching on-demand publishing on or off changes the state machine of the path
+	if (oldPathConf.RunOnDemand == "") != (newPathConf.RunOnDemand == "") {
+		return false
+	}
+
 	var copy conf.PathConf
 	cloneStruct(&copy, oldPathConf)
 
+	// parameters are compared after being merged with templates
+	copy.Extends = newPathConf.Extends
+
+	copy.SourceOnDemandStartTimeout = newPathConf.SourceOnDemandStartTimeout
+	copy.SourceOnDemandCloseAfter = newPathConf.SourceOnDemandCloseAfter
+	copy.SourceRedirect = newPathConf.SourceRedirect
+	copy.DisablePublisherOverride = newPathConf.DisablePublisherOverride
+	copy.PublisherStandbyTimeout = newPathConf.PublisherStandbyTimeout
+	copy.Fallback = newPathConf.Fallback
+
 	copy.RPICameraBrightness = newPathConf.RPICameraBrightness
 	copy.RPICameraContrast = newPathConf.RPICameraContrast
 	copy.RPICameraSaturation = newPathConf.RPICameraSaturation
@@ -27,9 +46,53 @@ func pathConfCanBeUpdated(oldPathConf *conf.PathConf, newPathConf *conf.PathConf
 	copy.RPICameraEV = newPathConf.RPICameraEV
 	copy.RPICameraFPS = newPathConf.RPICameraFPS
 
+	// credentials and IPs are checked when clients are added
+	copy.PublishUser = newPathConf.PublishUser
+	copy.PublishPass = newPathConf.PublishPass
+	copy.PublishIPs = newPathConf.PublishIPs
+	copy.ReadUser = newPathConf.ReadUser
+	copy.ReadPass = newPathConf.ReadPass
+	copy.ReadIPs = newPathConf.ReadIPs
+
+	// limits are checked when clients are added or when the stream is created
+	copy.MaxReaders = newPathConf.MaxReaders
+	copy.MaxBandwidth = newPathConf.MaxBandwidth
+	copy.ReaderBandwidthLimit = newPathConf.ReaderBandwidthLimit
+	copy.BandwidthLimit = newPathConf.BandwidthLimit
+
+	// commands are read when they are launched; runOnInit is restarted by the path
+	copy.RunOnInit = newPathConf.RunOnInit
+	copy.RunOnInitRestart = newPathConf.RunOnInitRestart
+	copy.RunOnDemand = newPathConf.RunOnDemand
+	copy.RunOnDemandRestart = newPathConf.RunOnDemandRestart
+	copy.RunOnDemandStartTimeout = newPathConf.RunOnDemandStartTimeout
+	copy.RunOnDemandCloseAfter = newPathConf.RunOnDemandCloseAfter
+	copy.RunOnReady = newPathConf.RunOnReady
+	copy.RunOnReadyRestart = newPathConf.RunOnReadyRestart
+	copy.RunOnNotReady = newPathConf.RunOnNotReady
+	copy.RunOnRead = newPathConf.RunOnRead
+	copy.RunOnReadRestart = newPathConf.RunOnReadRestart
+	copy.RunOnUnread = newPathConf.RunOnUnread
+
+	copy.WebhookURL = newPathConf.WebhookURL
+	copy.WebhookSecret = newPathConf.WebhookSecret
+
 	return newPathConf.Equal(&copy)
 }
 
+type pathManagerConfReloadReq struct {
+	readTimeout     conf.StringDuration
+	writeTimeout    conf.StringDuration
+	readBufferCount int
+	pathConfs       map[string]*conf.PathConf
+}
+
+type pathManagerClusterPathAddReq struct {
+	pathName string
+	pathConf *conf.PathConf
+	res      chan struct{}
+}
+
 type pathManagerHLSServer interface {
 	pathSourceReady(*path)
 	pathSourceNotReady(*path)
@@ -46,7 +109,10 @@ type pathManager struct {
 	readBufferCount int
 	pathConfs       map[string]*conf.PathConf
 	externalCmdPool *externalcmd.Pool
+	limitManager    *limitManager
+	eventBus        *eventBus
 	metrics         *metrics
+	clusterManager  *clusterManager
 	parent          pathManagerParent
 
 	ctx         context.Context
@@ -57,7 +123,7 @@ type pathManager struct {
 	pathsByConf map[string]map[*path]struct{}
 
 	// in
-	chConfReload         chan map[string]*conf.PathConf
+	chConfReload         chan pathManagerConfReloadReq
 	chPathClose          chan *path
 	chPathSourceReady    chan *path
 	chPathSourceNotReady chan *path
@@ -66,6 +132,7 @@ type pathManager struct {
 	chPublisherAdd       chan pathPublisherAddReq
 	chHLSServerSet       chan pathManagerHLSServer
 	chAPIPathsList       chan pathAPIPathsListReq
+	chClusterPathAdd     chan pathManagerClusterPathAddReq
 }
 
 func newPathManager(
@@ -76,7 +143,10 @@ func newPathManager(
 	readBufferCount int,
 	pathConfs map[string]*conf.PathConf,
 	externalCmdPool *externalcmd.Pool,
+	limitManager *limitManager,
+	eventBus *eventBus,
 	metrics *metrics,
+	clusterManager *clusterManager,
 	parent pathManagerParent,
 ) *pathManager {
 	ctx, ctxCancel := context.WithCancel(parentCtx)
@@ -88,13 +158,16 @@ func newPathManager(
 		readBufferCount:      readBufferCount,
 		pathConfs:            pathConfs,
 		externalCmdPool:      externalCmdPool,
+		limitManager:         limitManager,
+		eventBus:             eventBus,
 		metrics:              metrics,
+		clusterManager:       clusterManager,
 		parent:               parent,
 		ctx:                  ctx,
 		ctxCancel:            ctxCancel,
 		paths:                make(map[string]*path),
 		pathsByConf:          make(map[string]map[*path]struct{}),
-		chConfReload:         make(chan map[string]*conf.PathConf),
+		chConfReload:         make(chan pathManagerConfReloadReq),
 		chPathClose:          make(chan *path),
 		chPathSourceReady:    make(chan *path),
 		chPathSourceNotReady: make(chan *path),
@@ -103,6 +176,7 @@ func newPathManager(
 		chPublisherAdd:       make(chan pathPublisherAddReq),
 		chHLSServerSet:       make(chan pathManagerHLSServer),
 		chAPIPathsList:       make(chan pathAPIPathsListReq),
+		chClusterPathAdd:     make(chan pathManagerClusterPathAddReq),
 	}
 
 	for pathConfName, pathConf := range pm.pathConfs {
@@ -115,6 +189,8 @@ func newPathManager(
 		pm.metrics.pathManagerSet(pm)
 	}
 
+	pm.clusterManager.pathManagerSet(pm)
+
 	pm.log(logger.Debug, "path manager created")
 
 	pm.wg.Add(1)
@@ -140,41 +216,8 @@ func (pm *pathManager) run() {
 outer:
 	for {
 		select {
-		case newPathConfs := <-pm.chConfReload:
-			for confName, pathConf := range pm.pathConfs {
-				if newPathConf, ok := newPathConfs[confName]; ok {
-					// configuration has changed
-					if !newPathConf.Equal(pathConf) {
-						if pathConfCanBeUpdated(pathConf, newPathConf) { // paths associated with the configuration can be updated
-							for pa := range pm.pathsByConf[confName] {
-								go pa.reloadConf(newPathConf)
-							}
-						} else { // paths associated with the configuration must be recreated
-							for pa := range pm.pathsByConf[confName] {
-								pm.removePath(pa)
-								pa.close()
-								pa.wait() // avoid conflicts between sources
-							}
-						}
-					}
-				} else {
-					// configuration has been deleted, remove associated paths
-					for pa := range pm.pathsByConf[confName] {
-						pm.removePath(pa)
-						pa.close()
-						pa.wait() // avoid conflicts between sources
-					}
-				}
-			}
-
-			pm.pathConfs = newPathConfs
-
-			// add new paths
-			for pathConfName, pathConf := range pm.pathConfs {
-				if _, ok := pm.paths[pathConfName]; !ok && pathConf.Regexp == nil {
-					pm.createPath(pathConfName, pathConf, pathConfName, nil)
-				}
-			}
+		case req := <-pm.chConfReload:
+			pm.doConfReload(req)
 
 		case pa := <-pm.chPathClose:
 			if pmpa, ok := pm.paths[pa.name]; !ok || pmpa != pa {
@@ -265,6 +308,13 @@ outer:
 
 			req.res <- pathPublisherAnnounceRes{path: pm.paths[req.pathName]}
 
+		case req := <-pm.chClusterPathAdd:
+			// the path may have been configured or pulled in the meanwhile
+			if _, _, _, err := pm.findPathConf(req.pathName); err != nil {
+				pm.createPath(pathConfNameCluster, req.pathConf, req.pathName, nil)
+			}
+			close(req.res)
+
 		case s := <-pm.chHLSServerSet:
 			pm.hlsServer = s
 
@@ -289,6 +339,70 @@ outer:
 	if pm.metrics != nil {
 		pm.metrics.pathManagerSet(nil)
 	}
+
+	pm.clusterManager.pathManagerSet(nil)
+}
+
+func (pm *pathManager) doConfReload(req pathManagerConfReloadReq) {
+	// timeouts are used by static sources only
+	staticSourcesChanged := req.readTimeout != pm.readTimeout ||
+		req.writeTimeout != pm.writeTimeout ||
+		req.readBufferCount != pm.readBufferCount
+
+	pm.readTimeout = req.readTimeout
+	pm.writeTimeout = req.writeTimeout
+	pm.readBufferCount = req.readBufferCount
+
+	for confName, pathConf := range pm.pathConfs {
+		if newPathConf, ok := req.pathConfs[confName]; ok {
+			mustBeRecreated := staticSourcesChanged && pathConfHasStaticSource(pathConf)
+
+			// configuration has changed
+			if !mustBeRecreated && !newPathConf.Equal(pathConf) {
+				mustBeRecreated = !pathConfCanBeUpdated(pathConf, newPathConf)
+
+				if !mustBeRecreated { // paths associated with the configuration can be updated
+					for pa := range pm.pathsByConf[confName] {
+						go pa.reloadConf(newPathConf)
+					}
+				}
+			}
+
+			if mustBeRecreated { // paths associated with the configuration must be recreated
+				for pa := range pm.pathsByConf[confName] {
+					pm.removePath(pa)
+					pa.close()
+					pa.wait() // avoid conflicts between sources
+				}
+			}
+		} else {
+			// configuration has been deleted, remove associated paths
+			for pa := range pm.pathsByConf[confName] {
+				pm.removePath(pa)
+				pa.close()
+				pa.wait() // avoid conflicts between sources
+			}
+		}
+	}
+
+	pm.pathConfs = req.pathConfs
+
+	// paths pulled from origins are replaced by paths of the configuration
+	for pa := range pm.pathsByConf[pathConfNameCluster] {
+		if _, _, _, err := pm.findConfiguredPathConf(pa.name); err != nil {
+			continue
+		}
+		pm.removePath(pa)
+		pa.close()
+		pa.wait() // avoid conflicts between sources
+	}
+
+	// add new paths
+	for pathConfName, pathConf := range pm.pathConfs {
+		if _, ok := pm.paths[pathConfName]; !ok && pathConf.Regexp == nil {
+			pm.createPath(pathConfName, pathConf, pathConfName, nil)
+		}
+	}
 }
 
 func (pm *pathManager) createPath(
@@ -309,6 +423,8 @@ func (pm *pathManager) createPath(
 		matches,
 		&pm.wg,
 		pm.externalCmdPool,
+		pm.limitManager,
+		pm.eventBus,
 		pm)
 
 	pm.paths[name] = pa
@@ -328,6 +444,20 @@ func (pm *pathManager) removePath(pa *path) {
 }
 
 func (pm *pathManager) findPathConf(name string) (string, *conf.PathConf, []string, error) {
+	pathConfName, pathConf, pathMatches, err := pm.findConfiguredPathConf(name)
+	if err == nil {
+		return pathConfName, pathConf, pathMatches, nil
+	}
+
+	// path pulled from an origin
+	if pa, ok := pm.paths[name]; ok && pa.confName == pathConfNameCluster {
+		return pathConfNameCluster, pa.conf, nil, nil
+	}
+
+	return "", nil, nil, err
+}
+
+func (pm *pathManager) findConfiguredPathConf(name string) (string, *conf.PathConf, []string, error) {
 	err := conf.IsValidPathName(name)
 	if err != nil {
 		return "", nil, nil, fmt.Errorf("invalid path name: %s (%s)", err, name)
@@ -348,13 +478,25 @@ func (pm *pathManager) findPathConf(name string) (string, *conf.PathConf, []stri
 		}
 	}
 
-	return "", nil, nil, fmt.Errorf("path '%s' is not configured", name)
+	return "", nil, nil, pathErrNotConfigured{pathName: name}
 }
 
 // confReload is called by core.
-func (pm *pathManager) confReload(pathConfs map[string]*conf.PathConf) {
+func (pm *pathManager) confReload(
+	readTimeout conf.StringDuration,
+	writeTimeout conf.StringDuration,
+	readBufferCount int,
+	pathConfs map[string]*conf.PathConf,
+) {
+	req := pathManagerConfReloadReq{
+		readTimeout:     readTimeout,
+		writeTimeout:    writeTimeout,
+		readBufferCount: readBufferCount,
+		pathConfs:       pathConfs,
+	}
+
 	select {
-	case pm.chConfReload <- pathConfs:
+	case pm.chConfReload <- req:
 	case <-pm.ctx.Done():
 	}
 }
@@ -389,20 +531,35 @@ func (pm *pathManager) onPathClose(pa *path) {
 // describe is called by a reader or publisher.
 func (pm *pathManager) describe(req pathDescribeReq) pathDescribeRes {
 	req.res = make(chan pathDescribeRes)
-	select {
-	case pm.chDescribe <- req:
-		res1 := <-req.res
-		if res1.err != nil {
-			return res1
+
+	res1 := pm.describePath(req)
+	if res1.err != nil {
+		authenticate, ok, err := pm.clusterPathAdd(req.pathName, req.authenticate, res1.err)
+		if !ok {
+			return pathDescribeRes{err: err}
 		}
 
-		res2 := res1.path.describe(req)
-		if res2.err != nil {
-			return res2
+		// the path has been pulled from an origin: repeat the request once.
+		req.authenticate = authenticate
+		res1 = pm.describePath(req)
+		if res1.err != nil {
+			return res1
 		}
+	}
 
-		res2.path = res1.path
+	res2 := res1.path.describe(req)
+	if res2.err != nil {
 		return res2
+	}
+
+	res2.path = res1.path
+	return res2
+}
+
+func (pm *pathManager) describePath(req pathDescribeReq) pathDescribeRes {
+	select {
+	case pm.chDescribe <- req:
+		return <-req.res
 
 	case <-pm.ctx.Done():
 		return pathDescribeRes{err: fmt.Errorf("terminated")}
@@ -429,20 +586,115 @@ func (pm *pathManager) publisherAdd(req pathPublisherAddReq) pathPublisherAnnoun
 // readerSetupPlay is called by a reader.
 func (pm *pathManager) readerAdd(req pathReaderAddReq) pathReaderSetupPlayRes {
 	req.res = make(chan pathReaderSetupPlayRes)
-	select {
-	case pm.chReaderAdd <- req:
-		res := <-req.res
+
+	res := pm.readerAddPath(req)
+	if res.err != nil {
+		authenticate, ok, err := pm.clusterPathAdd(req.pathName, req.authenticate, res.err)
+		if !ok {
+			return pathReaderSetupPlayRes{err: err}
+		}
+
+		// the path has been pulled from an origin: repeat the request once.
+		req.authenticate = authenticate
+		res = pm.readerAddPath(req)
 		if res.err != nil {
 			return res
 		}
+	}
 
-		return res.path.readerAdd(req)
+	return res.path.readerAdd(req)
+}
+
+func (pm *pathManager) readerAddPath(req pathReaderAddReq) pathReaderSetupPlayRes {
+	select {
+	case pm.chReaderAdd <- req:
+		return <-req.res
 
 	case <-pm.ctx.Done():
 		return pathReaderSetupPlayRes{err: fmt.Errorf("terminated")}
 	}
 }
 
+// clusterPathAdd pulls a path that is not configured from an origin.
+// It returns true if the path has been added, together with the function
+// that must be used to authenticate the reader when the request is repeated,
+// otherwise the error that must be returned to the reader.
+func (pm *pathManager) clusterPathAdd(
+	pathName string,
+	authenticate authenticateFunc,
+	err error,
+) (authenticateFunc, bool, error) {
+	if _, ok := err.(pathErrNotConfigured); !ok {
+		return nil, false, err
+	}
+
+	readConf, err2 := pm.clusterManager.readConf(pathName)
+	if err2 != nil || readConf == nil {
+		return nil, false, err
+	}
+
+	// readers are authenticated before querying origins,
+	// in order to prevent anonymous users from flooding origins with requests.
+	if authenticate != nil {
+		err2 = authenticate(
+			readConf.ReadIPs,
+			readConf.ReadUser,
+			readConf.ReadPass)
+		if err2 != nil {
+			return nil, false, err2
+		}
+
+		// the reader is not authenticated twice against the same credentials,
+		// in order not to count failures twice and not to call the external
+		// authentication service again. Credentials may differ if the path
+		// has been configured in the meanwhile.
+		authenticateAgain := authenticate
+		authenticate = func(pathIPs []fmt.Stringer, pathUser conf.Credential, pathPass conf.Credential) error {
+			if reflect.DeepEqual(pathIPs, []fmt.Stringer(readConf.ReadIPs)) &&
+				pathUser == readConf.ReadUser && pathPass == readConf.ReadPass {
+				return nil
+			}
+			return authenticateAgain(pathIPs, pathUser, pathPass)
+		}
+	}
+
+	pathConf, err2 := pm.clusterManager.pathConf(pm.ctx, pathName)
+	if err2 != nil {
+		pm.log(logger.Debug, "[cluster] %s", err2)
+		return nil, false, err
+	}
+	if pathConf == nil {
+		return nil, false, err
+	}
+
+	req := pathManagerClusterPathAddReq{
+		pathName: pathName,
+		pathConf: pathConf,
+		res:      make(chan struct{}),
+	}
+
+	select {
+	case pm.chClusterPathAdd <- req:
+		<-req.res
+		return authenticate, true, nil
+
+	case <-pm.ctx.Done():
+		return nil, false, err
+	}
+}
+
+// clusterRedirect returns the URL of the node to which a reader must be redirected,
+// or an empty string. It is called by readers.
+func (pm *pathManager) clusterRedirect(pathName string, protocol clusterProtocol) string {
+	return pm.clusterManager.redirect(pathName, protocol)
+}
+
+// clusterRedirectApp returns the URL of the node to which a RTMP client of an application
+// must be redirected, or an empty string. It is called by rtmpConn.
+func (pm *pathManager) clusterRedirectApp(app string) string {
+	return pm.clusterManager.redirectApp(app)
+}
+
 // hlsServerSet is called by hlsServer.
 func (pm *pathManager) hlsServerSet(s pathManagerHLSServer) {
 	select {
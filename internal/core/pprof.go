@@ -1,14 +1,12 @@
 package core
 
 import (
-	"context"
-	"log"
-	"net"
 	"net/http"
 
 	// start pprof
 	_ "net/http/pprof"
 
+	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
@@ -17,44 +15,53 @@ type pprofParent interface {
 }
 
 type pprof struct {
-	parent pprofParent
+	authManager *authManager
+	parent      pprofParent
 
-	ln     net.Listener
-	server *http.Server
+	httpServer *httpServer
 }
 
 func newPPROF(
 	address string,
+	encryption bool,
+	serverKey string,
+	serverCert string,
+	authManager *authManager,
 	parent pprofParent,
 ) (*pprof, error) {
-	ln, err := net.Listen("tcp", address)
-	if err != nil {
-		return nil, err
-	}
-
 	pp := &pprof{
-		parent: parent,
-		ln:     ln,
+		authManager: authManager,
+		parent:      parent,
 	}
 
-	pp.server = &http.Server{
-		Handler:  http.DefaultServeMux,
-		ErrorLog: log.New(&nilWriter{}, "", 0),
+	var err error
+	pp.httpServer, err = newHTTPServer(address, encryption, serverKey, serverCert,
+		authManager, http.HandlerFunc(pp.onRequest), parent)
+	if err != nil {
+		return nil, err
 	}
 
 	pp.log(logger.Info, "listener opened on "+address)
-
-	go pp.server.Serve(pp.ln)
+	warnUnauthenticatedListener(authManager, address, pp)
 
 	return pp, nil
 }
 
 func (pp *pprof) close() {
 	pp.log(logger.Info, "listener is closing")
-	pp.server.Shutdown(context.Background())
-	pp.ln.Close() // in case Shutdown() is called before Serve()
+	pp.httpServer.close()
 }
 
 func (pp *pprof) log(level logger.Level, format string, args ...interface{}) {
 	pp.parent.Log(level, "[pprof] "+format, args...)
 }
+
+func (pp *pprof) onRequest(w http.ResponseWriter, r *http.Request) {
+	err := httpAuthenticate(pp.authManager, conf.AuthActionPPROF, w, r)
+	if err != nil {
+		pp.log(logger.Info, "[conn %v] authentication failed: %v", r.RemoteAddr, err)
+		return
+	}
+
+	http.DefaultServeMux.ServeHTTP(w, r)
+}
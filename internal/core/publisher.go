@@ -1,7 +1,34 @@
 package core
 
+import (
+	"net/url"
+	"strconv"
+)
+
 // publisher is an entity that can publish a stream.
 type publisher interface {
 	source
 	close()
 }
+
+// publisherPriority returns the priority of a publisher, that is used by paths
+// with standby publishers. When the internal user database is in use, the priority
+// is the one of the user that has been verified during authentication, in order
+// to prevent publishers from raising their own priority; otherwise it is read from the query.
+func publisherPriority(m *authManager, verifiedUser string, rawQuery string) int {
+	if m.hasInternalUsers() {
+		return m.publisherPriority(verifiedUser)
+	}
+
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return 0
+	}
+
+	p, err := strconv.Atoi(q.Get("priority"))
+	if err != nil {
+		return 0
+	}
+
+	return p
+}
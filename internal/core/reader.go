@@ -5,3 +5,11 @@ type reader interface {
 	close()
 	apiReaderDescribe() interface{}
 }
+
+// readerNonRefFramesDropper is implemented by readers that are able to read
+// streams in which single non-reference frames are missing.
+// Readers that compute DTS from the picture order count need all frames
+// of a GOP, therefore bandwidth shaping drops whole GOPs only.
+type readerNonRefFramesDropper interface {
+	canDropNonRefFrames() bool
+}
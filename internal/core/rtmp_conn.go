@@ -42,7 +42,7 @@ func pathNameAndQuery(inURL *url.URL) (string, url.Values, string) {
 type rtmpConnState int
 
 const (
-	rtmpConnStateIdle rtmpConnState = iota //nolint:deadcode,varcheck
+	rtmpConnStateIdle rtmpConnState = iota
 	rtmpConnStateRead
 	rtmpConnStatePublish
 )
@@ -50,6 +50,7 @@ const (
 type rtmpConnPathManager interface {
 	readerAdd(req pathReaderAddReq) pathReaderSetupPlayRes
 	publisherAdd(req pathPublisherAddReq) pathPublisherAnnounceRes
+	clusterRedirectApp(app string) string
 }
 
 type rtmpConnParent interface {
@@ -58,40 +59,50 @@ type rtmpConnParent interface {
 }
 
 type rtmpConn struct {
-	isTLS                     bool
-	externalAuthenticationURL string
-	rtspAddress               string
-	readTimeout               conf.StringDuration
-	writeTimeout              conf.StringDuration
-	readBufferCount           int
-	runOnConnect              string
-	runOnConnectRestart       bool
-	wg                        *sync.WaitGroup
-	conn                      *rtmp.Conn
-	nconn                     net.Conn
-	externalCmdPool           *externalcmd.Pool
-	pathManager               rtmpConnPathManager
-	parent                    rtmpConnParent
+	isTLS               bool
+	authManager         *authManager
+	eventBus            *eventBus
+	rtspAddress         string
+	readTimeout         conf.StringDuration
+	writeTimeout        conf.StringDuration
+	readBufferCount     int
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
+	wg                  *sync.WaitGroup
+	conn                *rtmp.Conn
+	nconn               net.Conn
+	externalCmdPool     *externalcmd.Pool
+	pathManager         rtmpConnPathManager
+	parent              rtmpConnParent
 
 	ctx       context.Context
 	ctxCancel func()
 	uuid      uuid.UUID
 	created   time.Time
 	// path       *path
-	state      rtmpConnState
-	stateMutex sync.Mutex
+	state        rtmpConnState
+	stateMutex   sync.Mutex
+	authExpiry   time.Time // filled by authenticate()
+	authVerified string    // filled by authenticate()
+	drainOnce    sync.Once
+
+	// in
+	chDrain chan struct{}
 }
 
 func newRTMPConn(
 	parentCtx context.Context,
 	isTLS bool,
-	externalAuthenticationURL string,
+	authManager *authManager,
+	eventBus *eventBus,
 	rtspAddress string,
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
 	readBufferCount int,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	wg *sync.WaitGroup,
 	nconn net.Conn,
 	externalCmdPool *externalcmd.Pool,
@@ -101,28 +112,36 @@ func newRTMPConn(
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	c := &rtmpConn{
-		isTLS:                     isTLS,
-		externalAuthenticationURL: externalAuthenticationURL,
-		rtspAddress:               rtspAddress,
-		readTimeout:               readTimeout,
-		writeTimeout:              writeTimeout,
-		readBufferCount:           readBufferCount,
-		runOnConnect:              runOnConnect,
-		runOnConnectRestart:       runOnConnectRestart,
-		wg:                        wg,
-		conn:                      rtmp.NewConn(nconn),
-		nconn:                     nconn,
-		externalCmdPool:           externalCmdPool,
-		pathManager:               pathManager,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		uuid:                      uuid.New(),
-		created:                   time.Now(),
+		isTLS:               isTLS,
+		authManager:         authManager,
+		eventBus:            eventBus,
+		rtspAddress:         rtspAddress,
+		readTimeout:         readTimeout,
+		writeTimeout:        writeTimeout,
+		readBufferCount:     readBufferCount,
+		runOnConnect:        runOnConnect,
+		runOnConnectRestart: runOnConnectRestart,
+		runOnDisconnect:     runOnDisconnect,
+		wg:                  wg,
+		conn:                rtmp.NewConn(nconn),
+		nconn:               nconn,
+		externalCmdPool:     externalCmdPool,
+		pathManager:         pathManager,
+		parent:              parent,
+		ctx:                 ctx,
+		ctxCancel:           ctxCancel,
+		uuid:                uuid.New(),
+		created:             time.Now(),
+		chDrain:             make(chan struct{}),
 	}
 
 	c.log(logger.Info, "opened")
 
+	c.eventBus.publish(event{
+		Type: eventTypeConnOpened,
+		Conn: c.eventConn(),
+	})
+
 	c.wg.Add(1)
 	go c.run()
 
@@ -133,6 +152,34 @@ func (c *rtmpConn) close() {
 	c.ctxCancel()
 }
 
+// drain is called by rtmpServer.
+func (c *rtmpConn) drain() {
+	c.drainOnce.Do(func() {
+		close(c.chDrain)
+	})
+}
+
+func (c *rtmpConn) isDraining() bool {
+	select {
+	case <-c.chDrain:
+		return true
+	default:
+		return false
+	}
+}
+
+// writeUnpublish notifies the client that the stream has been unpublished
+// and returns the error that terminates the connection.
+func (c *rtmpConn) writeUnpublish(isPublishing bool) error {
+	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
+	err := c.conn.WriteUnpublish(isPublishing)
+	if err != nil {
+		return err
+	}
+
+	return fmt.Errorf("server is shutting down")
+}
+
 func (c *rtmpConn) remoteAddr() net.Addr {
 	return c.nconn.RemoteAddr()
 }
@@ -154,17 +201,30 @@ func (c *rtmpConn) safeState() rtmpConnState {
 func (c *rtmpConn) run() {
 	defer c.wg.Done()
 
+	if c.runOnDisconnect != "" {
+		defer func() {
+			c.log(logger.Info, "runOnDisconnect command launched")
+			externalcmd.RunOneShot(
+				c.externalCmdPool,
+				"runOnDisconnect",
+				c.runOnDisconnect,
+				c.externalCmdEnv(),
+				c.log,
+				func(co int) {
+					c.log(logger.Info, "runOnDisconnect command exited with code %d", co)
+				})
+		}()
+	}
+
 	if c.runOnConnect != "" {
 		c.log(logger.Info, "runOnConnect command started")
-		_, port, _ := net.SplitHostPort(c.rtspAddress)
 		onConnectCmd := externalcmd.NewCmd(
 			c.externalCmdPool,
+			"runOnConnect",
 			c.runOnConnect,
 			c.runOnConnectRestart,
-			externalcmd.Environment{
-				"RTSP_PATH": "",
-				"RTSP_PORT": port,
-			},
+			c.externalCmdEnv(),
+			c.log,
 			func(co int) {
 				c.log(logger.Info, "runOnConnect command exited with code %d", co)
 			})
@@ -197,6 +257,35 @@ func (c *rtmpConn) run() {
 	c.parent.connClose(c)
 
 	c.log(logger.Info, "closed (%v)", err)
+
+	c.eventBus.publish(event{
+		Type:  eventTypeConnClosed,
+		Conn:  c.eventConn(),
+		Error: err.Error(),
+	})
+}
+
+func (c *rtmpConn) connType() string {
+	if c.isTLS {
+		return "rtmpsConn"
+	}
+	return "rtmpConn"
+}
+
+func (c *rtmpConn) eventConn() eventConn {
+	return newEventConn(c.connType(), c.uuid, c.remoteAddr())
+}
+
+func (c *rtmpConn) externalCmdEnv() externalcmd.Environment {
+	_, port, _ := net.SplitHostPort(c.rtspAddress)
+
+	return externalcmd.Environment{
+		"RTSP_PATH":        "",
+		"RTSP_PORT":        port,
+		"RTSP_CONN_TYPE":   c.connType(),
+		"RTSP_CONN_ID":     c.uuid.String(),
+		"RTSP_REMOTE_ADDR": c.remoteAddr().String(),
+	}
 }
 
 func (c *rtmpConn) runInner(ctx context.Context) error {
@@ -207,7 +296,14 @@ func (c *rtmpConn) runInner(ctx context.Context) error {
 
 	c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
 	c.nconn.SetWriteDeadline(time.Now().Add(time.Duration(c.writeTimeout)))
-	u, isPublishing, err := c.conn.InitializeServer()
+	u, isPublishing, err := c.conn.InitializeServerWithRedirect(func(u *url.URL) string {
+		// clients of overloaded nodes are redirected to a sibling node
+		app, _, rawQuery := pathNameAndQuery(u)
+		if ru := c.pathManager.clusterRedirectApp(app); ru != "" {
+			return clusterRedirectURL(ru, app, rawQuery)
+		}
+		return ""
+	})
 	if err != nil {
 		return err
 	}
@@ -224,6 +320,7 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 	res := c.pathManager.readerAdd(pathReaderAddReq{
 		author:   c,
 		pathName: pathName,
+		query:    rawQuery,
 		authenticate: func(
 			pathIPs []fmt.Stringer,
 			pathUser conf.Credential,
@@ -235,6 +332,8 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 
 	if res.err != nil {
 		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			c.authManager.onFailure(c.ip(), pathName, terr.message)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtmpConnPauseAfterAuthError)
 			return errors.New(terr.message)
@@ -248,6 +347,14 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		path.readerRemove(pathReaderRemoveReq{author: c})
 	}()
 
+	if !c.authExpiry.IsZero() {
+		t := time.AfterFunc(time.Until(c.authExpiry), func() {
+			c.log(logger.Info, "session expired")
+			c.close()
+		})
+		defer t.Stop()
+	}
+
 	c.stateMutex.Lock()
 	c.state = rtmpConnStateRead
 	c.stateMutex.Unlock()
@@ -270,6 +377,17 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		ringBuffer.Close()
 	}()
 
+	// wake up the writer when the server starts draining
+	go func() {
+		select {
+		case <-c.chDrain:
+			ringBuffer.Push(func() error {
+				return nil
+			})
+		case <-ctx.Done():
+		}
+	}()
+
 	var medias media.Medias
 	if videoMedia != nil {
 		medias = append(medias, videoMedia)
@@ -430,9 +548,11 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 		c.log(logger.Info, "runOnRead command started")
 		onReadCmd := externalcmd.NewCmd(
 			c.externalCmdPool,
+			"runOnRead",
 			pathConf.RunOnRead,
 			pathConf.RunOnReadRestart,
-			path.externalCmdEnv(),
+			path.externalCmdReaderEnv(c, rawQuery),
+			c.log,
 			func(co int) {
 				c.log(logger.Info, "runOnRead command exited with code %d", co)
 			})
@@ -456,6 +576,10 @@ func (c *rtmpConn) runRead(ctx context.Context, u *url.URL) error {
 			return fmt.Errorf("terminated")
 		}
 
+		if c.isDraining() {
+			return c.writeUnpublish(false)
+		}
+
 		err := item.(func() error)()
 		if err != nil {
 			return err
@@ -469,6 +593,10 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 	res := c.pathManager.publisherAdd(pathPublisherAddReq{
 		author:   c,
 		pathName: pathName,
+		query:    rawQuery,
+		priority: func() int {
+			return publisherPriority(c.authManager, c.authVerified, rawQuery)
+		},
 		authenticate: func(
 			pathIPs []fmt.Stringer,
 			pathUser conf.Credential,
@@ -480,6 +608,8 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 
 	if res.err != nil {
 		if terr, ok := res.err.(pathErrAuthCritical); ok {
+			c.authManager.onFailure(c.ip(), pathName, terr.message)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtmpConnPauseAfterAuthError)
 			return errors.New(terr.message)
@@ -493,6 +623,14 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 		path.publisherRemove(pathPublisherRemoveReq{author: c})
 	}()
 
+	if !c.authExpiry.IsZero() {
+		t := time.AfterFunc(time.Until(c.authExpiry), func() {
+			c.log(logger.Info, "session expired")
+			c.close()
+		})
+		defer t.Stop()
+	}
+
 	c.stateMutex.Lock()
 	c.state = rtmpConnStatePublish
 	c.stateMutex.Unlock()
@@ -564,10 +702,29 @@ func (c *rtmpConn) runPublish(ctx context.Context, u *url.URL) error {
 		}
 	}
 
+	// interrupt ReadMessage() when the server starts draining
+	go func() {
+		select {
+		case <-c.chDrain:
+			c.nconn.SetReadDeadline(time.Now())
+		case <-ctx.Done():
+		}
+	}()
+
 	for {
 		c.nconn.SetReadDeadline(time.Now().Add(time.Duration(c.readTimeout)))
+
+		// the deadline must be set before checking, otherwise it may override
+		// the one set by the drain routine.
+		if c.isDraining() {
+			return c.writeUnpublish(true)
+		}
+
 		msg, err := c.conn.ReadMessage()
 		if err != nil {
+			if c.isDraining() {
+				return c.writeUnpublish(true)
+			}
 			return err
 		}
 
@@ -635,17 +792,50 @@ func (c *rtmpConn) authenticate(
 	query url.Values,
 	rawQuery string,
 ) error {
-	if c.externalAuthenticationURL != "" {
-		err := externalAuth(
-			c.externalAuthenticationURL,
-			c.ip().String(),
-			query.Get("user"),
-			query.Get("pass"),
-			pathName,
-			externalAuthProtoRTMP,
-			&c.uuid,
-			isPublishing,
-			rawQuery)
+	c.authExpiry = time.Time{}
+	c.authVerified = ""
+
+	// IPs are checked before everything else, since a signed URL
+	// replaces credentials, not the IP restrictions of the path.
+	if pathIPs != nil {
+		ip := c.ip()
+		if !ipEqualOrInRange(ip, pathIPs) {
+			return pathErrAuthCritical{
+				message: fmt.Sprintf("IP '%s' not allowed", ip),
+			}
+		}
+	}
+
+	// a valid signed URL grants read access without credentials
+	if !isPublishing {
+		expiry, ok, err := c.authManager.authenticateSignedURL(c.ip(), pathName, rawQuery)
+		if err != nil {
+			return pathErrAuthCritical{
+				message: fmt.Sprintf("unauthorized: %s", err),
+			}
+		}
+
+		if ok {
+			c.authExpiry = expiry
+			return nil
+		}
+	}
+
+	certUser := c.authManager.clientCertUser(tlsConnState(c.nconn))
+
+	if c.authManager.hasExternalAuth() {
+		var err error
+		c.authExpiry, err = c.authManager.authenticateExternal(externalAuthReq{
+			ip:       c.ip().String(),
+			user:     query.Get("user"),
+			password: query.Get("pass"),
+			path:     pathName,
+			protocol: externalAuthProtoRTMP,
+			id:       &c.uuid,
+			publish:  isPublishing,
+			query:    rawQuery,
+			certUser: certUser,
+		})
 		if err != nil {
 			return pathErrAuthCritical{
 				message: fmt.Sprintf("external authentication failed: %s", err),
@@ -653,16 +843,28 @@ func (c *rtmpConn) authenticate(
 		}
 	}
 
-	if pathIPs != nil {
-		ip := c.ip()
-		if !ipEqualOrInRange(ip, pathIPs) {
+	if c.authManager.hasInternalUsers() {
+		action := conf.AuthActionRead
+		if isPublishing {
+			action = conf.AuthActionPublish
+		}
+
+		verified := certUser
+		var err error
+		if certUser == "" || c.authManager.authenticateClientCert(c.ip(), certUser, action, pathName) != nil {
+			verified, err = c.authManager.authenticateUser(c.ip(), query.Get("user"), query.Get("pass"), action, pathName)
+		}
+		if err != nil {
 			return pathErrAuthCritical{
-				message: fmt.Sprintf("IP '%s' not allowed", ip),
+				message: fmt.Sprintf("unauthorized: %s", err),
 			}
 		}
+
+		c.authVerified = verified
 	}
 
-	if pathUser != "" {
+	// users authenticated with a client certificate don't need a password
+	if pathUser != "" && (certUser == "" || !pathUser.Check(certUser)) {
 		if query.Get("user") != string(pathUser) ||
 			query.Get("pass") != string(pathPass) {
 			return pathErrAuthCritical{
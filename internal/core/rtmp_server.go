@@ -8,6 +8,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
@@ -43,39 +44,61 @@ type rtmpServerAPIConnsKickReq struct {
 	res chan rtmpServerAPIConnsKickRes
 }
 
+type rtmpServerDrainRes struct {
+	conns   []*rtmpConn
+	timeout time.Duration
+}
+
+type rtmpServerDrainReq struct {
+	clients bool
+	res     chan rtmpServerDrainRes
+}
+
+type rtmpServerReadersCountReq struct {
+	res chan int
+}
+
 type rtmpServerParent interface {
 	Log(logger.Level, string, ...interface{})
 }
 
 type rtmpServer struct {
-	externalAuthenticationURL string
-	readTimeout               conf.StringDuration
-	writeTimeout              conf.StringDuration
-	readBufferCount           int
-	isTLS                     bool
-	rtspAddress               string
-	runOnConnect              string
-	runOnConnectRestart       bool
-	externalCmdPool           *externalcmd.Pool
-	metrics                   *metrics
-	pathManager               *pathManager
-	parent                    rtmpServerParent
-
-	ctx       context.Context
-	ctxCancel func()
-	wg        sync.WaitGroup
-	ln        net.Listener
-	conns     map[*rtmpConn]struct{}
+	authManager         *authManager
+	eventBus            *eventBus
+	readTimeout         conf.StringDuration
+	writeTimeout        conf.StringDuration
+	readBufferCount     int
+	isTLS               bool
+	rtspAddress         string
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
+	externalCmdPool     *externalcmd.Pool
+	metrics             *metrics
+	pathManager         *pathManager
+	parent              rtmpServerParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	wg         sync.WaitGroup
+	ln         net.Listener
+	certLoader *certloader.CertLoader
+	conns      map[*rtmpConn]struct{}
 
 	// in
+	chConfReload   chan *conf.Conf
 	chConnClose    chan *rtmpConn
 	chAPIConnsList chan rtmpServerAPIConnsListReq
 	chAPIConnsKick chan rtmpServerAPIConnsKickReq
+	chDrain        chan rtmpServerDrainReq
+	chReadersCount chan rtmpServerReadersCountReq
 }
 
 func newRTMPServer(
 	parentCtx context.Context,
-	externalAuthenticationURL string,
+	authManager *authManager,
+	limitManager *limitManager,
+	eventBus *eventBus,
 	address string,
 	readTimeout conf.StringDuration,
 	writeTimeout conf.StringDuration,
@@ -83,25 +106,38 @@ func newRTMPServer(
 	isTLS bool,
 	serverCert string,
 	serverKey string,
+	clientCA string,
 	rtspAddress string,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	externalCmdPool *externalcmd.Pool,
 	metrics *metrics,
 	pathManager *pathManager,
 	parent rtmpServerParent,
 ) (*rtmpServer, error) {
+	var certLoader *certloader.CertLoader
+
 	ln, err := func() (net.Listener, error) {
+		ln, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+		ln = newIPBanListener(ln, authManager)
+		ln = newLimitListener(ln, limitManager, nil)
+
 		if !isTLS {
-			return net.Listen("tcp", address)
+			return ln, nil
 		}
 
-		cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+		var tlsConfig *tls.Config
+		tlsConfig, certLoader, err = newTLSConfig(serverCert, serverKey, clientCA, parent)
 		if err != nil {
+			ln.Close()
 			return nil, err
 		}
 
-		return tls.Listen("tcp", address, &tls.Config{Certificates: []tls.Certificate{cert}})
+		return tls.NewListener(ln, tlsConfig), nil
 	}()
 	if err != nil {
 		return nil, err
@@ -110,31 +146,41 @@ func newRTMPServer(
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &rtmpServer{
-		externalAuthenticationURL: externalAuthenticationURL,
-		readTimeout:               readTimeout,
-		writeTimeout:              writeTimeout,
-		readBufferCount:           readBufferCount,
-		rtspAddress:               rtspAddress,
-		runOnConnect:              runOnConnect,
-		runOnConnectRestart:       runOnConnectRestart,
-		isTLS:                     isTLS,
-		externalCmdPool:           externalCmdPool,
-		metrics:                   metrics,
-		pathManager:               pathManager,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		ln:                        ln,
-		conns:                     make(map[*rtmpConn]struct{}),
-		chConnClose:               make(chan *rtmpConn),
-		chAPIConnsList:            make(chan rtmpServerAPIConnsListReq),
-		chAPIConnsKick:            make(chan rtmpServerAPIConnsKickReq),
+		authManager:         authManager,
+		eventBus:            eventBus,
+		readTimeout:         readTimeout,
+		writeTimeout:        writeTimeout,
+		readBufferCount:     readBufferCount,
+		rtspAddress:         rtspAddress,
+		runOnConnect:        runOnConnect,
+		runOnConnectRestart: runOnConnectRestart,
+		runOnDisconnect:     runOnDisconnect,
+		isTLS:               isTLS,
+		externalCmdPool:     externalCmdPool,
+		metrics:             metrics,
+		pathManager:         pathManager,
+		parent:              parent,
+		ctx:                 ctx,
+		ctxCancel:           ctxCancel,
+		ln:                  ln,
+		certLoader:          certLoader,
+		conns:               make(map[*rtmpConn]struct{}),
+		chConfReload:        make(chan *conf.Conf),
+		chConnClose:         make(chan *rtmpConn),
+		chAPIConnsList:      make(chan rtmpServerAPIConnsListReq),
+		chAPIConnsKick:      make(chan rtmpServerAPIConnsKickReq),
+		chDrain:             make(chan rtmpServerDrainReq),
+		chReadersCount:      make(chan rtmpServerReadersCountReq),
 	}
 
 	s.log(logger.Info, "listener opened on %s", address)
 
 	if s.metrics != nil {
 		s.metrics.rtmpServerSet(s)
+
+		if s.certLoader != nil {
+			s.metrics.certLoaderSet("rtmps", s.certLoader)
+		}
 	}
 
 	s.wg.Add(1)
@@ -188,10 +234,17 @@ func (s *rtmpServer) run() {
 		}
 	}()
 
+	draining := false
+
 outer:
 	for {
 		select {
 		case err := <-acceptErr:
+			// the listener has been closed on purpose
+			if draining {
+				continue
+			}
+
 			s.log(logger.Error, "%s", err)
 			break outer
 
@@ -199,13 +252,15 @@ outer:
 			c := newRTMPConn(
 				s.ctx,
 				s.isTLS,
-				s.externalAuthenticationURL,
+				s.authManager,
+				s.eventBus,
 				s.rtspAddress,
 				s.readTimeout,
 				s.writeTimeout,
 				s.readBufferCount,
 				s.runOnConnect,
 				s.runOnConnectRestart,
+				s.runOnDisconnect,
 				&s.wg,
 				nconn,
 				s.externalCmdPool,
@@ -213,6 +268,15 @@ outer:
 				s)
 			s.conns[c] = struct{}{}
 
+		case newConf := <-s.chConfReload:
+			// parameters are applied to new connections
+			s.readTimeout = newConf.ReadTimeout
+			s.writeTimeout = newConf.WriteTimeout
+			s.readBufferCount = newConf.ReadBufferCount
+			s.runOnConnect = newConf.RunOnConnect
+			s.runOnConnectRestart = newConf.RunOnConnectRestart
+			s.runOnDisconnect = newConf.RunOnDisconnect
+
 		case c := <-s.chConnClose:
 			delete(s.conns, c)
 
@@ -259,6 +323,38 @@ outer:
 				req.res <- rtmpServerAPIConnsKickRes{fmt.Errorf("not found")}
 			}
 
+		case req := <-s.chDrain:
+			if !draining {
+				draining = true
+				s.ln.Close()
+				s.log(logger.Info, "listener is draining")
+			}
+
+			var conns []*rtmpConn
+			if req.clients {
+				for c := range s.conns {
+					c.drain()
+
+					if c.safeState() != rtmpConnStateIdle {
+						conns = append(conns, c)
+					}
+				}
+			}
+
+			req.res <- rtmpServerDrainRes{
+				conns:   conns,
+				timeout: time.Duration(s.writeTimeout),
+			}
+
+		case req := <-s.chReadersCount:
+			n := 0
+			for c := range s.conns {
+				if c.safeState() == rtmpConnStateRead {
+					n++
+				}
+			}
+			req.res <- n
+
 		case <-s.ctx.Done():
 			break outer
 		}
@@ -270,6 +366,14 @@ outer:
 
 	if s.metrics != nil {
 		s.metrics.rtmpServerSet(s)
+
+		if s.certLoader != nil {
+			s.metrics.certLoaderSet("rtmps", nil)
+		}
+	}
+
+	if s.certLoader != nil {
+		s.certLoader.Close()
 	}
 }
 
@@ -281,6 +385,59 @@ func (s *rtmpServer) connClose(c *rtmpConn) {
 	}
 }
 
+// confReload is called by core.
+func (s *rtmpServer) confReload(newConf *conf.Conf) {
+	select {
+	case s.chConfReload <- newConf:
+	case <-s.ctx.Done():
+	}
+}
+
+// drain is called by core.
+// It stops accepting connections. When clients is true, it also notifies
+// readers and publishers that the server is shutting down, then waits for them
+// to disconnect.
+func (s *rtmpServer) drain(clients bool) {
+	req := rtmpServerDrainReq{
+		clients: clients,
+		res:     make(chan rtmpServerDrainRes),
+	}
+
+	select {
+	case s.chDrain <- req:
+	case <-s.ctx.Done():
+		return
+	}
+
+	res := <-req.res
+
+	t := time.NewTimer(res.timeout)
+	defer t.Stop()
+
+	for _, c := range res.conns {
+		select {
+		case <-c.ctx.Done():
+		case <-t.C:
+			return
+		}
+	}
+}
+
+// readersCount is called by core.
+func (s *rtmpServer) readersCount() int {
+	req := rtmpServerReadersCountReq{
+		res: make(chan int),
+	}
+
+	select {
+	case s.chReadersCount <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		return 0
+	}
+}
+
 // apiConnsList is called by api.
 func (s *rtmpServer) apiConnsList() rtmpServerAPIConnsListRes {
 	req := rtmpServerAPIConnsListReq{
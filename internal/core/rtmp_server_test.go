@@ -3,6 +3,7 @@ package core //nolint:dupl
 import (
 	"crypto/tls"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"testing"
@@ -183,11 +184,13 @@ func TestRTMPServerPublishRead(t *testing.T) {
 func TestRTMPServerAuth(t *testing.T) {
 	for _, ca := range []string{
 		"internal",
+		"users",
 		"external",
 	} {
 		t.Run(ca, func(t *testing.T) {
 			var conf string
-			if ca == "internal" {
+			switch ca {
+			case "internal":
 				conf = "paths:\n" +
 					"  all:\n" +
 					"    publishUser: testpublisher\n" +
@@ -196,7 +199,23 @@ func TestRTMPServerAuth(t *testing.T) {
 					"    readUser: testreader\n" +
 					"    readPass: testpass\n" +
 					"    readIPs: [127.0.0.0/16]\n"
-			} else {
+
+			case "users":
+				conf = "authInternalUsers:\n" +
+					"- user: testpublisher\n" +
+					"  pass: sha256:E9JJ8stBJ7QM+nV4ZoUCeHk/gU3tPFh/5YieiJp6n2w=\n" +
+					"  ips: [127.0.0.0/16]\n" +
+					"  permissions:\n" +
+					"  - action: publish\n" +
+					"    path: teststream\n" +
+					"- user: testreader\n" +
+					"  pass: testpass\n" +
+					"  permissions:\n" +
+					"  - action: read\n" +
+					"paths:\n" +
+					"  all:\n"
+
+			default:
 				conf = "externalAuthenticationURL: http://localhost:9120/auth\n" +
 					"paths:\n" +
 					"  all:\n"
@@ -432,3 +451,80 @@ func TestRTMPServerAuthFail(t *testing.T) {
 		require.EqualError(t, err, "EOF")
 	})
 }
+
+func TestRTMPServerPublisherStandbyUserPriority(t *testing.T) {
+	p, ok := newInstance("rtspDisable: yes\n" +
+		"hlsDisable: yes\n" +
+		"webrtcDisable: yes\n" +
+		"api: yes\n" +
+		"authInternalUsers:\n" +
+		"- user: any\n" +
+		"  permissions:\n" +
+		"  - action: publish\n" +
+		"  - action: api\n" +
+		"- user: highprio\n" +
+		"  pass: testpass\n" +
+		"  publisherPriority: 10\n" +
+		"  permissions:\n" +
+		"  - action: publish\n" +
+		"paths:\n" +
+		"  all:\n" +
+		"    publisherStandby: yes\n")
+	require.Equal(t, true, ok)
+	defer p.Close()
+
+	publish := func(query string) net.Conn {
+		u, err := url.Parse("rtmp://127.0.0.1:1935/teststream" + query)
+		require.NoError(t, err)
+
+		nconn, err := net.Dial("tcp", u.Host)
+		require.NoError(t, err)
+		conn := rtmp.NewConn(nconn)
+
+		err = conn.InitializeClient(u, true)
+		require.NoError(t, err)
+
+		err = conn.WriteTracks(&format.H264{
+			PayloadTyp: 96,
+			SPS: []byte{ // 1920x1080 baseline
+				0x67, 0x42, 0xc0, 0x28, 0xd9, 0x00, 0x78, 0x02,
+				0x27, 0xe5, 0x84, 0x00, 0x00, 0x03, 0x00, 0x04,
+				0x00, 0x00, 0x03, 0x00, 0xf0, 0x3c, 0x60, 0xc9, 0x20,
+			},
+			PPS:               []byte{0x08, 0x06, 0x07, 0x08},
+			PacketizationMode: 1,
+		}, nil)
+		require.NoError(t, err)
+
+		time.Sleep(500 * time.Millisecond)
+
+		return nconn
+	}
+
+	hasStandby := func() bool {
+		var out struct {
+			Items map[string]struct {
+				SourceReady bool        `json:"sourceReady"`
+				Standby     interface{} `json:"standby"`
+			} `json:"items"`
+		}
+		err := httpRequest(http.MethodGet, "http://localhost:9997/v1/paths/list", nil, &out)
+		require.NoError(t, err)
+		require.Equal(t, true, out.Items["teststream"].SourceReady)
+		return out.Items["teststream"].Standby != nil
+	}
+
+	nconn1 := publish("")
+	defer nconn1.Close()
+
+	// a publisher that claims to be a user without knowing its password
+	// is accepted by the "any" user, but doesn't obtain its priority.
+	nconn2 := publish("?user=highprio&pass=wrongpass")
+	defer nconn2.Close()
+	require.Equal(t, true, hasStandby())
+
+	// the verified user takes over immediately.
+	nconn3 := publish("?user=highprio&pass=testpass")
+	defer nconn3.Close()
+	require.Equal(t, false, hasStandby())
+}
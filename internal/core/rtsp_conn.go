@@ -1,6 +1,10 @@
 package core
 
 import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
@@ -20,23 +24,36 @@ import (
 
 const (
 	rtspConnPauseAfterAuthError = 2 * time.Second
+	rtspAuthRealm               = "IPCAM"
 )
 
+func md5Hex(in string) string {
+	h := md5.Sum([]byte(in))
+	return hex.EncodeToString(h[:])
+}
+
+func generateNonce() string {
+	byts := make([]byte, 16)
+	rand.Read(byts)
+	return hex.EncodeToString(byts)
+}
+
 type rtspConnParent interface {
 	log(logger.Level, string, ...interface{})
 }
 
 type rtspConn struct {
-	externalAuthenticationURL string
-	rtspAddress               string
-	authMethods               []headers.AuthMethod
-	readTimeout               conf.StringDuration
-	runOnConnect              string
-	runOnConnectRestart       bool
-	externalCmdPool           *externalcmd.Pool
-	pathManager               *pathManager
-	conn                      *gortsplib.ServerConn
-	parent                    rtspConnParent
+	authManager         *authManager
+	rtspAddress         string
+	authMethods         []headers.AuthMethod
+	readTimeout         conf.StringDuration
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
+	externalCmdPool     *externalcmd.Pool
+	pathManager         *pathManager
+	conn                *gortsplib.ServerConn
+	parent              rtspConnParent
 
 	uuid          uuid.UUID
 	created       time.Time
@@ -45,56 +62,83 @@ type rtspConn struct {
 	authPass      string
 	authValidator *auth.Validator
 	authFailures  int
+	authNonce     string
+	authExpiry    time.Time // filled by authenticate()
+	authVerified  string    // filled by authenticate()
 }
 
 func newRTSPConn(
-	externalAuthenticationURL string,
+	authManager *authManager,
 	rtspAddress string,
 	authMethods []headers.AuthMethod,
 	readTimeout conf.StringDuration,
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	externalCmdPool *externalcmd.Pool,
 	pathManager *pathManager,
 	conn *gortsplib.ServerConn,
 	parent rtspConnParent,
 ) *rtspConn {
 	c := &rtspConn{
-		externalAuthenticationURL: externalAuthenticationURL,
-		rtspAddress:               rtspAddress,
-		authMethods:               authMethods,
-		readTimeout:               readTimeout,
-		runOnConnect:              runOnConnect,
-		runOnConnectRestart:       runOnConnectRestart,
-		externalCmdPool:           externalCmdPool,
-		pathManager:               pathManager,
-		conn:                      conn,
-		parent:                    parent,
-		uuid:                      uuid.New(),
-		created:                   time.Now(),
+		authManager:         authManager,
+		rtspAddress:         rtspAddress,
+		authMethods:         authMethods,
+		readTimeout:         readTimeout,
+		runOnConnect:        runOnConnect,
+		runOnConnectRestart: runOnConnectRestart,
+		runOnDisconnect:     runOnDisconnect,
+		externalCmdPool:     externalCmdPool,
+		pathManager:         pathManager,
+		conn:                conn,
+		parent:              parent,
+		uuid:                uuid.New(),
+		created:             time.Now(),
+		authNonce:           generateNonce(),
 	}
 
 	c.log(logger.Info, "opened")
 
 	if c.runOnConnect != "" {
 		c.log(logger.Info, "runOnConnect command started")
-		_, port, _ := net.SplitHostPort(c.rtspAddress)
 		c.onConnectCmd = externalcmd.NewCmd(
 			c.externalCmdPool,
+			"runOnConnect",
 			c.runOnConnect,
 			c.runOnConnectRestart,
-			externalcmd.Environment{
-				"RTSP_PATH": "",
-				"RTSP_PORT": port,
-			},
+			c.externalCmdEnv(),
+			c.log,
 			func(co int) {
-				c.log(logger.Info, "runOnInit command exited with code %d", co)
+				c.log(logger.Info, "runOnConnect command exited with code %d", co)
 			})
 	}
 
 	return c
 }
 
+func (c *rtspConn) connType() string {
+	if _, ok := c.conn.NetConn().(*tls.Conn); ok {
+		return "rtspsConn"
+	}
+	return "rtspConn"
+}
+
+func (c *rtspConn) eventConn() eventConn {
+	return newEventConn(c.connType(), c.uuid, c.remoteAddr())
+}
+
+func (c *rtspConn) externalCmdEnv() externalcmd.Environment {
+	_, port, _ := net.SplitHostPort(c.rtspAddress)
+
+	return externalcmd.Environment{
+		"RTSP_PATH":        "",
+		"RTSP_PORT":        port,
+		"RTSP_CONN_TYPE":   c.connType(),
+		"RTSP_CONN_ID":     c.uuid.String(),
+		"RTSP_REMOTE_ADDR": c.remoteAddr().String(),
+	}
+}
+
 func (c *rtspConn) log(level logger.Level, format string, args ...interface{}) {
 	c.parent.log(level, "[conn %v] "+format, append([]interface{}{c.conn.NetConn().RemoteAddr()}, args...)...)
 }
@@ -122,7 +166,44 @@ func (c *rtspConn) authenticate(
 	req *base.Request,
 	baseURL *url.URL,
 ) error {
-	if c.externalAuthenticationURL != "" {
+	c.authExpiry = time.Time{}
+	c.authVerified = ""
+
+	// IPs are checked before everything else, since a signed URL
+	// replaces credentials, not the IP restrictions of the path.
+	if pathIPs != nil {
+		ip := c.ip()
+		if !ipEqualOrInRange(ip, pathIPs) {
+			return pathErrAuthCritical{
+				message: fmt.Sprintf("IP '%s' not allowed", ip),
+				response: &base.Response{
+					StatusCode: base.StatusUnauthorized,
+				},
+			}
+		}
+	}
+
+	// a valid signed URL grants read access without credentials
+	if !isPublishing {
+		expiry, ok, err := c.authManager.authenticateSignedURL(c.ip(), path, query)
+		if err != nil {
+			return pathErrAuthCritical{
+				message: "unauthorized: " + err.Error(),
+				response: &base.Response{
+					StatusCode: base.StatusUnauthorized,
+				},
+			}
+		}
+
+		if ok {
+			c.authExpiry = expiry
+			return nil
+		}
+	}
+
+	certUser := c.authManager.clientCertUser(tlsConnState(c.conn.NetConn()))
+
+	if c.authManager.hasExternalAuth() {
 		username := ""
 		password := ""
 
@@ -133,16 +214,17 @@ func (c *rtspConn) authenticate(
 			password = auth.BasicPass
 		}
 
-		err = externalAuth(
-			c.externalAuthenticationURL,
-			c.ip().String(),
-			username,
-			password,
-			path,
-			externalAuthProtoRTSP,
-			&c.uuid,
-			isPublishing,
-			query)
+		c.authExpiry, err = c.authManager.authenticateExternal(externalAuthReq{
+			ip:       c.ip().String(),
+			user:     username,
+			password: password,
+			path:     path,
+			protocol: externalAuthProtoRTSP,
+			id:       &c.uuid,
+			publish:  isPublishing,
+			query:    query,
+			certUser: certUser,
+		})
 		if err != nil {
 			c.authFailures++
 
@@ -177,19 +259,38 @@ func (c *rtspConn) authenticate(
 		}
 	}
 
-	if pathIPs != nil {
-		ip := c.ip()
-		if !ipEqualOrInRange(ip, pathIPs) {
-			return pathErrAuthCritical{
-				message: fmt.Sprintf("IP '%s' not allowed", ip),
+	if c.authManager.hasInternalUsers() {
+		verified, err := c.authenticateInternal(path, isPublishing, req, baseURL, certUser)
+		if err != nil {
+			c.authFailures++
+
+			// allow up to 3 failures, like with path credentials
+			if c.authFailures > 3 {
+				return pathErrAuthCritical{
+					message: "unauthorized: " + err.Error(),
+					response: &base.Response{
+						StatusCode: base.StatusUnauthorized,
+					},
+				}
+			}
+
+			return pathErrAuthNotCritical{
 				response: &base.Response{
 					StatusCode: base.StatusUnauthorized,
+					Header: base.Header{
+						"WWW-Authenticate": c.internalAuthHeader(),
+					},
 				},
 			}
 		}
+
+		// login successful, reset authFailures
+		c.authFailures = 0
+		c.authVerified = verified
 	}
 
-	if pathUser != "" {
+	// users authenticated with a client certificate don't need a password
+	if pathUser != "" && (certUser == "" || !pathUser.Check(certUser)) {
 		// reset authValidator every time the credentials change
 		if c.authValidator == nil || c.authUser != string(pathUser) || c.authPass != string(pathPass) {
 			c.authUser = string(pathUser)
@@ -233,6 +334,109 @@ func (c *rtspConn) authenticate(
 	return nil
 }
 
+func (c *rtspConn) authenticateInternal(
+	path string,
+	isPublishing bool,
+	req *base.Request,
+	baseURL *url.URL,
+	certUser string,
+) (string, error) {
+	action := conf.AuthActionRead
+	if isPublishing {
+		action = conf.AuthActionPublish
+	}
+
+	if certUser != "" && c.authManager.authenticateClientCert(c.ip(), certUser, action, path) == nil {
+		return certUser, nil
+	}
+
+	var auth headers.Authorization
+	err := auth.Unmarshal(req.Header["Authorization"])
+	if err != nil {
+		return c.authManager.authenticateUser(c.ip(), "", "", action, path)
+	}
+
+	if !c.authMethodEnabled(auth.Method) {
+		return "", fmt.Errorf("authentication method not allowed")
+	}
+
+	if auth.Method == headers.AuthBasic {
+		return c.authManager.authenticateUser(c.ip(), auth.BasicUser, auth.BasicPass, action, path)
+	}
+
+	if auth.DigestValues.Realm == nil ||
+		auth.DigestValues.Nonce == nil ||
+		auth.DigestValues.Username == nil ||
+		auth.DigestValues.URI == nil ||
+		auth.DigestValues.Response == nil {
+		return "", fmt.Errorf("invalid digest authorization")
+	}
+
+	if *auth.DigestValues.Realm != rtspAuthRealm {
+		return "", fmt.Errorf("wrong realm")
+	}
+
+	if *auth.DigestValues.Nonce != c.authNonce {
+		return "", fmt.Errorf("wrong nonce")
+	}
+
+	ur := req.URL.String()
+	if *auth.DigestValues.URI != ur {
+		// in SETUP requests, VLC strips the control attribute.
+		// try again with the base URL.
+		if baseURL == nil || *auth.DigestValues.URI != baseURL.String() {
+			return "", fmt.Errorf("wrong URL")
+		}
+		ur = baseURL.String()
+	}
+
+	user := *auth.DigestValues.Username
+
+	// digest requires the password in plain text.
+	return c.authManager.authenticateWith(c.ip(), user, func(pass conf.Credential) bool {
+		if pass.IsHashed() {
+			return false
+		}
+		response := md5Hex(md5Hex(user+":"+rtspAuthRealm+":"+string(pass)) +
+			":" + c.authNonce + ":" + md5Hex(string(req.Method)+":"+ur))
+		return *auth.DigestValues.Response == response
+	}, action, path)
+}
+
+func (c *rtspConn) authMethodEnabled(method headers.AuthMethod) bool {
+	for _, m := range c.authMethods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// internalAuthHeader generates the WWW-Authenticate header used with internal users.
+func (c *rtspConn) internalAuthHeader() base.HeaderValue {
+	realm := rtspAuthRealm
+	var ret base.HeaderValue
+
+	for _, m := range c.authMethods {
+		switch m {
+		case headers.AuthBasic:
+			ret = append(ret, headers.Authenticate{
+				Method: headers.AuthBasic,
+				Realm:  &realm,
+			}.Marshal()...)
+
+		case headers.AuthDigest:
+			ret = append(ret, headers.Authenticate{
+				Method: headers.AuthDigest,
+				Realm:  &realm,
+				Nonce:  &c.authNonce,
+			}.Marshal()...)
+		}
+	}
+
+	return ret
+}
+
 // onClose is called by rtspServer.
 func (c *rtspConn) onClose(err error) {
 	c.log(logger.Info, "closed (%v)", err)
@@ -241,6 +445,19 @@ func (c *rtspConn) onClose(err error) {
 		c.onConnectCmd.Close()
 		c.log(logger.Info, "runOnConnect command stopped")
 	}
+
+	if c.runOnDisconnect != "" {
+		c.log(logger.Info, "runOnDisconnect command launched")
+		externalcmd.RunOneShot(
+			c.externalCmdPool,
+			"runOnDisconnect",
+			c.runOnDisconnect,
+			c.externalCmdEnv(),
+			c.log,
+			func(co int) {
+				c.log(logger.Info, "runOnDisconnect command exited with code %d", co)
+			})
+	}
 }
 
 // onRequest is called by rtspServer.
@@ -282,6 +499,8 @@ func (c *rtspConn) onDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx,
 			return terr.response, nil, nil
 
 		case pathErrAuthCritical:
+			c.authManager.onFailure(c.ip(), ctx.Path, terr.message)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(rtspConnPauseAfterAuthError)
 
@@ -308,6 +527,18 @@ func (c *rtspConn) onDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx,
 		}, nil, nil
 	}
 
+	// readers of overloaded nodes are redirected to a sibling node
+	if u := c.pathManager.clusterRedirect(ctx.Path, clusterProtocolRTSP); u != "" {
+		u = clusterRedirectURL(u, ctx.Path, ctx.Query)
+		c.log(logger.Info, "redirecting to %s", u)
+		return &base.Response{
+			StatusCode: base.StatusFound,
+			Header: base.Header{
+				"Location": base.HeaderValue{u},
+			},
+		}, nil, nil
+	}
+
 	return &base.Response{
 		StatusCode: base.StatusOK,
 	}, res.stream.rtspStream, nil
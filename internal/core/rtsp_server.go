@@ -2,10 +2,11 @@ package core
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
+	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/aler9/gortsplib/v2"
@@ -13,6 +14,7 @@ import (
 	"github.com/aler9/gortsplib/v2/pkg/headers"
 	"github.com/aler9/gortsplib/v2/pkg/liberrors"
 
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/externalcmd"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
@@ -59,6 +61,11 @@ type rtspServerParent interface {
 	Log(logger.Level, string, ...interface{})
 }
 
+func isRTSPSessionReading(state gortsplib.ServerSessionState) bool {
+	return state == gortsplib.ServerSessionStatePrePlay ||
+		state == gortsplib.ServerSessionStatePlay
+}
+
 func printAddresses(srv *gortsplib.Server) string {
 	var ret []string
 
@@ -76,31 +83,39 @@ func printAddresses(srv *gortsplib.Server) string {
 }
 
 type rtspServer struct {
-	externalAuthenticationURL string
-	authMethods               []headers.AuthMethod
-	readTimeout               conf.StringDuration
-	isTLS                     bool
-	rtspAddress               string
-	protocols                 map[conf.Protocol]struct{}
-	runOnConnect              string
-	runOnConnectRestart       bool
-	externalCmdPool           *externalcmd.Pool
-	metrics                   *metrics
-	pathManager               *pathManager
-	parent                    rtspServerParent
-
-	ctx       context.Context
-	ctxCancel func()
-	wg        sync.WaitGroup
-	srv       *gortsplib.Server
-	mutex     sync.RWMutex
-	conns     map[*gortsplib.ServerConn]*rtspConn
-	sessions  map[*gortsplib.ServerSession]*rtspSession
+	authManager         *authManager
+	eventBus            *eventBus
+	authMethods         []headers.AuthMethod
+	readTimeout         conf.StringDuration
+	isTLS               bool
+	rtspAddress         string
+	protocols           map[conf.Protocol]struct{}
+	runOnConnect        string
+	runOnConnectRestart bool
+	runOnDisconnect     string
+	externalCmdPool     *externalcmd.Pool
+	metrics             *metrics
+	pathManager         *pathManager
+	parent              rtspServerParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	wg         sync.WaitGroup
+	srv        *gortsplib.Server
+	ln         *drainListener
+	tln        *timeoutListener
+	certLoader *certloader.CertLoader
+	mutex      sync.RWMutex
+	conns      map[*gortsplib.ServerConn]*rtspConn
+	sessions   map[*gortsplib.ServerSession]*rtspSession
+	draining   atomic.Bool
 }
 
 func newRTSPServer(
 	parentCtx context.Context,
-	externalAuthenticationURL string,
+	authManager *authManager,
+	limitManager *limitManager,
+	eventBus *eventBus,
 	address string,
 	authMethods []headers.AuthMethod,
 	readTimeout conf.StringDuration,
@@ -116,10 +131,12 @@ func newRTSPServer(
 	isTLS bool,
 	serverCert string,
 	serverKey string,
+	clientCA string,
 	rtspAddress string,
 	protocols map[conf.Protocol]struct{},
 	runOnConnect string,
 	runOnConnectRestart bool,
+	runOnDisconnect string,
 	externalCmdPool *externalcmd.Pool,
 	metrics *metrics,
 	pathManager *pathManager,
@@ -128,22 +145,24 @@ func newRTSPServer(
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &rtspServer{
-		externalAuthenticationURL: externalAuthenticationURL,
-		authMethods:               authMethods,
-		readTimeout:               readTimeout,
-		isTLS:                     isTLS,
-		rtspAddress:               rtspAddress,
-		protocols:                 protocols,
-		runOnConnect:              runOnConnect,
-		runOnConnectRestart:       runOnConnectRestart,
-		externalCmdPool:           externalCmdPool,
-		metrics:                   metrics,
-		pathManager:               pathManager,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		conns:                     make(map[*gortsplib.ServerConn]*rtspConn),
-		sessions:                  make(map[*gortsplib.ServerSession]*rtspSession),
+		authManager:         authManager,
+		eventBus:            eventBus,
+		authMethods:         authMethods,
+		readTimeout:         readTimeout,
+		isTLS:               isTLS,
+		rtspAddress:         rtspAddress,
+		protocols:           protocols,
+		runOnConnect:        runOnConnect,
+		runOnConnectRestart: runOnConnectRestart,
+		runOnDisconnect:     runOnDisconnect,
+		externalCmdPool:     externalCmdPool,
+		metrics:             metrics,
+		pathManager:         pathManager,
+		parent:              parent,
+		ctx:                 ctx,
+		ctxCancel:           ctxCancel,
+		conns:               make(map[*gortsplib.ServerConn]*rtspConn),
+		sessions:            make(map[*gortsplib.ServerSession]*rtspSession),
 	}
 
 	s.srv = &gortsplib.Server{
@@ -153,6 +172,16 @@ func newRTSPServer(
 		ReadBufferCount:  readBufferCount,
 		WriteBufferCount: readBufferCount,
 		RTSPAddress:      address,
+		Listen: func(network string, address string) (net.Listener, error) {
+			ln, err := net.Listen(network, address)
+			if err != nil {
+				return nil, err
+			}
+			s.tln = newTimeoutListener(newLimitListener(newIPBanListener(ln, authManager), limitManager, nil),
+				readTimeout, writeTimeout)
+			s.ln = newDrainListener(s.tln)
+			return s.ln, nil
+		},
 	}
 
 	if useUDP {
@@ -167,16 +196,18 @@ func newRTSPServer(
 	}
 
 	if isTLS {
-		cert, err := tls.LoadX509KeyPair(serverCert, serverKey)
+		var err error
+		s.srv.TLSConfig, s.certLoader, err = newTLSConfig(serverCert, serverKey, clientCA, parent)
 		if err != nil {
 			return nil, err
 		}
-
-		s.srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
 	}
 
 	err := s.srv.Start()
 	if err != nil {
+		if s.certLoader != nil {
+			s.certLoader.Close()
+		}
 		return nil, err
 	}
 
@@ -187,6 +218,7 @@ func newRTSPServer(
 			metrics.rtspServerSet(s)
 		} else {
 			metrics.rtspsServerSet(s)
+			metrics.certLoaderSet("rtsps", s.certLoader)
 		}
 	}
 
@@ -239,19 +271,47 @@ outer:
 			s.metrics.rtspServerSet(nil)
 		} else {
 			s.metrics.rtspsServerSet(nil)
+			s.metrics.certLoaderSet("rtsps", nil)
 		}
 	}
+
+	if s.certLoader != nil {
+		s.certLoader.Close()
+	}
+}
+
+// confReload is called by core.
+// Commands are applied to new connections.
+func (s *rtspServer) confReload(newConf *conf.Conf) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// timeouts are applied to new connections
+	s.readTimeout = newConf.ReadTimeout
+	s.tln.setTimeouts(newConf.ReadTimeout, newConf.WriteTimeout)
+
+	s.runOnConnect = newConf.RunOnConnect
+	s.runOnConnectRestart = newConf.RunOnConnectRestart
+	s.runOnDisconnect = newConf.RunOnDisconnect
 }
 
 // OnConnOpen implements gortsplib.ServerHandlerOnConnOpen.
 func (s *rtspServer) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
+	s.mutex.RLock()
+	readTimeout := s.readTimeout
+	runOnConnect := s.runOnConnect
+	runOnConnectRestart := s.runOnConnectRestart
+	runOnDisconnect := s.runOnDisconnect
+	s.mutex.RUnlock()
+
 	c := newRTSPConn(
-		s.externalAuthenticationURL,
+		s.authManager,
 		s.rtspAddress,
 		s.authMethods,
-		s.readTimeout,
-		s.runOnConnect,
-		s.runOnConnectRestart,
+		readTimeout,
+		runOnConnect,
+		runOnConnectRestart,
+		runOnDisconnect,
 		s.externalCmdPool,
 		s.pathManager,
 		ctx.Conn,
@@ -261,6 +321,11 @@ func (s *rtspServer) OnConnOpen(ctx *gortsplib.ServerHandlerOnConnOpenCtx) {
 	s.mutex.Unlock()
 
 	ctx.Conn.SetUserData(c)
+
+	s.eventBus.publish(event{
+		Type: eventTypeConnOpened,
+		Conn: c.eventConn(),
+	})
 }
 
 // OnConnClose implements gortsplib.ServerHandlerOnConnClose.
@@ -270,6 +335,12 @@ func (s *rtspServer) OnConnClose(ctx *gortsplib.ServerHandlerOnConnCloseCtx) {
 	delete(s.conns, ctx.Conn)
 	s.mutex.Unlock()
 	c.onClose(ctx.Error)
+
+	s.eventBus.publish(event{
+		Type:  eventTypeConnClosed,
+		Conn:  c.eventConn(),
+		Error: ctx.Error.Error(),
+	})
 }
 
 // OnRequest implements gortsplib.ServerHandlerOnRequest.
@@ -315,12 +386,24 @@ func (s *rtspServer) OnSessionClose(ctx *gortsplib.ServerHandlerOnSessionCloseCt
 // OnDescribe implements gortsplib.ServerHandlerOnDescribe.
 func (s *rtspServer) OnDescribe(ctx *gortsplib.ServerHandlerOnDescribeCtx,
 ) (*base.Response, *gortsplib.ServerStream, error) {
+	if s.draining.Load() {
+		return &base.Response{
+			StatusCode: base.StatusServiceUnavailable,
+		}, nil, nil
+	}
+
 	c := ctx.Conn.UserData().(*rtspConn)
 	return c.onDescribe(ctx)
 }
 
 // OnAnnounce implements gortsplib.ServerHandlerOnAnnounce.
 func (s *rtspServer) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*base.Response, error) {
+	if s.draining.Load() {
+		return &base.Response{
+			StatusCode: base.StatusServiceUnavailable,
+		}, nil
+	}
+
 	c := ctx.Conn.UserData().(*rtspConn)
 	se := ctx.Session.UserData().(*rtspSession)
 	return se.onAnnounce(c, ctx)
@@ -328,6 +411,12 @@ func (s *rtspServer) OnAnnounce(ctx *gortsplib.ServerHandlerOnAnnounceCtx) (*bas
 
 // OnSetup implements gortsplib.ServerHandlerOnSetup.
 func (s *rtspServer) OnSetup(ctx *gortsplib.ServerHandlerOnSetupCtx) (*base.Response, *gortsplib.ServerStream, error) {
+	if s.draining.Load() {
+		return &base.Response{
+			StatusCode: base.StatusServiceUnavailable,
+		}, nil, nil
+	}
+
 	c := ctx.Conn.UserData().(*rtspConn)
 	se := ctx.Session.UserData().(*rtspSession)
 	return se.onSetup(c, ctx)
@@ -357,6 +446,39 @@ func (s *rtspServer) OnDecodeError(ctx *gortsplib.ServerHandlerOnDecodeErrorCtx)
 	se.onDecodeError(ctx)
 }
 
+// drain is called by core.
+// It stops accepting connections and requests, and sends a RTCP BYE packet to readers,
+// in order to notify them that the stream is ending.
+func (s *rtspServer) drain() {
+	if s.draining.Swap(true) {
+		return
+	}
+
+	s.ln.drain()
+	s.log(logger.Info, "listener is draining")
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	for _, se := range s.sessions {
+		se.writeGoodbye()
+	}
+}
+
+// readersCount is called by core.
+func (s *rtspServer) readersCount() int {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	n := 0
+	for _, se := range s.sessions {
+		if isRTSPSessionReading(se.safeState()) {
+			n++
+		}
+	}
+	return n
+}
+
 // apiConnsList is called by api and metrics.
 func (s *rtspServer) apiConnsList() rtspServerAPIConnsListRes {
 	select {
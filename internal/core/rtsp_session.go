@@ -13,6 +13,7 @@ import (
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/url"
 	"github.com/google/uuid"
+	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 
 	"github.com/aler9/rtsp-simple-server/internal/conf"
@@ -50,6 +51,7 @@ type rtspSession struct {
 	state      gortsplib.ServerSessionState
 	stateMutex sync.Mutex
 	onReadCmd  *externalcmd.Cmd // read
+	expiry     *time.Timer
 }
 
 func newRTSPSession(
@@ -89,6 +91,28 @@ func (s *rtspSession) safeState() gortsplib.ServerSessionState {
 	return s.state
 }
 
+// writeGoodbye sends a RTCP BYE packet with the SSRCs of the stream to a reader,
+// in order to notify it that the stream is ending.
+// If no packet has been sent yet, the packet doesn't contain any SSRC.
+func (s *rtspSession) writeGoodbye() {
+	s.stateMutex.Lock()
+	st := s.state
+	stream := s.stream
+	s.stateMutex.Unlock()
+
+	// multicast sessions don't have a dedicated write queue
+	if st != gortsplib.ServerSessionStatePlay || stream == nil ||
+		*s.session.SetuppedTransport() == gortsplib.TransportUDPMulticast {
+		return
+	}
+
+	for _, medi := range s.session.SetuppedMedias() {
+		s.session.WritePacketRTCP(medi, &rtcp.Goodbye{
+			Sources: stream.rtspSSRCs(medi),
+		})
+	}
+}
+
 func (s *rtspSession) remoteAddr() net.Addr {
 	return s.author.NetConn().RemoteAddr()
 }
@@ -98,8 +122,24 @@ func (s *rtspSession) log(level logger.Level, format string, args ...interface{}
 	s.parent.log(level, "[session %s] "+format, append([]interface{}{id}, args...)...)
 }
 
+// setExpiry closes the session at the given time, if it is not zero.
+func (s *rtspSession) setExpiry(t time.Time) {
+	if t.IsZero() || s.expiry != nil {
+		return
+	}
+
+	s.expiry = time.AfterFunc(time.Until(t), func() {
+		s.log(logger.Info, "session expired")
+		s.session.Close()
+	})
+}
+
 // onClose is called by rtspServer.
 func (s *rtspSession) onClose(err error) {
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+
 	if s.session.State() == gortsplib.ServerSessionStatePlay {
 		if s.onReadCmd != nil {
 			s.onReadCmd.Close()
@@ -117,7 +157,10 @@ func (s *rtspSession) onClose(err error) {
 	}
 
 	s.path = nil
+
+	s.stateMutex.Lock()
 	s.stream = nil
+	s.stateMutex.Unlock()
 
 	s.log(logger.Info, "destroyed (%v)", err)
 }
@@ -134,6 +177,10 @@ func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnno
 	res := s.pathManager.publisherAdd(pathPublisherAddReq{
 		author:   s,
 		pathName: ctx.Path,
+		query:    ctx.Query,
+		priority: func() int {
+			return publisherPriority(c.authManager, c.authVerified, ctx.Query)
+		},
 		authenticate: func(
 			pathIPs []fmt.Stringer,
 			pathUser conf.Credential,
@@ -150,6 +197,8 @@ func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnno
 			return terr.response, nil
 
 		case pathErrAuthCritical:
+			c.authManager.onFailure(c.ip(), ctx.Path, terr.message)
+
 			// wait some seconds to stop brute force attacks
 			<-time.After(pauseAfterAuthError)
 
@@ -163,6 +212,7 @@ func (s *rtspSession) onAnnounce(c *rtspConn, ctx *gortsplib.ServerHandlerOnAnno
 	}
 
 	s.path = res.path
+	s.setExpiry(c.authExpiry)
 
 	s.stateMutex.Lock()
 	s.state = gortsplib.ServerSessionStatePreRecord
@@ -200,6 +250,7 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 		res := s.pathManager.readerAdd(pathReaderAddReq{
 			author:   s,
 			pathName: ctx.Path,
+			query:    ctx.Query,
 			authenticate: func(
 				pathIPs []fmt.Stringer,
 				pathUser conf.Credential,
@@ -229,6 +280,8 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 				return terr.response, nil, nil
 
 			case pathErrAuthCritical:
+				c.authManager.onFailure(c.ip(), ctx.Path, terr.message)
+
 				// wait some seconds to stop brute force attacks
 				<-time.After(pauseAfterAuthError)
 
@@ -239,6 +292,11 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 					StatusCode: base.StatusNotFound,
 				}, nil, res.err
 
+			case pathErrLimitReached:
+				return &base.Response{
+					StatusCode: base.StatusNotEnoughBandwidth,
+				}, nil, res.err
+
 			default:
 				return &base.Response{
 					StatusCode: base.StatusBadRequest,
@@ -246,8 +304,20 @@ func (s *rtspSession) onSetup(c *rtspConn, ctx *gortsplib.ServerHandlerOnSetupCt
 			}
 		}
 
+		// multicast readers share the same packets, therefore they can't be shaped one by one.
+		if ctx.Transport == gortsplib.TransportUDPMulticast && res.stream.readerBandwidthLimit != 0 {
+			if s.session.State() == gortsplib.ServerSessionStateInitial {
+				res.path.readerRemove(pathReaderRemoveReq{author: s})
+			}
+
+			return &base.Response{
+				StatusCode: base.StatusUnsupportedTransport,
+			}, nil, fmt.Errorf("UDP-multicast can't be used when readerBandwidthLimit is set")
+		}
+
 		s.path = res.path
 		s.stream = res.stream
+		s.setExpiry(c.authExpiry)
 
 		s.stateMutex.Lock()
 		s.state = gortsplib.ServerSessionStatePrePlay
@@ -280,14 +350,18 @@ func (s *rtspSession) onPlay(ctx *gortsplib.ServerHandlerOnPlayCtx) (*base.Respo
 			s.log(logger.Info, "runOnRead command started")
 			s.onReadCmd = externalcmd.NewCmd(
 				s.externalCmdPool,
+				"runOnRead",
 				pathConf.RunOnRead,
 				pathConf.RunOnReadRestart,
-				s.path.externalCmdEnv(),
+				s.path.externalCmdReaderEnv(s, ctx.Query),
+				s.log,
 				func(co int) {
 					s.log(logger.Info, "runOnRead command exited with code %d", co)
 				})
 		}
 
+		s.stream.rtspReaderStart(s, s.session)
+
 		s.stateMutex.Lock()
 		s.state = gortsplib.ServerSessionStatePlay
 		s.stateMutex.Unlock()
@@ -423,6 +497,8 @@ func (s *rtspSession) onPause(ctx *gortsplib.ServerHandlerOnPauseCtx) (*base.Res
 			s.onReadCmd.Close()
 		}
 
+		s.stream.rtspReaderStop(s)
+
 		s.stateMutex.Lock()
 		s.state = gortsplib.ServerSessionStatePrePlay
 		s.stateMutex.Unlock()
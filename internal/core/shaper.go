@@ -0,0 +1,483 @@
+package core
+
+import (
+	"io"
+	"sync"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h264"
+	"github.com/aler9/gortsplib/v2/pkg/codecs/h265"
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/pion/rtp"
+
+	"github.com/aler9/rtsp-simple-server/internal/formatprocessor"
+)
+
+type shaperFrameType int
+
+const (
+	// audio, parameters and metadata, that are never dropped.
+	shaperFrameOther shaperFrameType = iota
+	shaperFrameKey
+	shaperFrameRef
+	shaperFrameNonRef
+)
+
+// tokenBucket limits a bitrate.
+// The bucket holds at most one second of data.
+type tokenBucket struct {
+	rate float64 // bytes per second
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bitrate int) *tokenBucket {
+	rate := float64(bitrate) / 8
+
+	return &tokenBucket{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += b.rate * now.Sub(b.last).Seconds()
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+}
+
+// exhausted returns whether the bucket is empty.
+func (b *tokenBucket) exhausted(now time.Time) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.refill(now)
+	return b.tokens <= 0
+}
+
+// consume removes tokens from the bucket.
+// The bucket can go below zero, in order to allow frames bigger than the bucket.
+func (b *tokenBucket) consume(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens -= float64(n)
+}
+
+// wait blocks until the bucket is not empty.
+func (b *tokenBucket) wait() {
+	for {
+		b.mutex.Lock()
+		now := time.Now()
+		b.refill(now)
+		tokens := b.tokens
+		b.mutex.Unlock()
+
+		if tokens > 0 {
+			return
+		}
+
+		time.Sleep(time.Duration((1 - tokens) / b.rate * float64(time.Second)))
+	}
+}
+
+// throttledReadCloser is a io.ReadCloser whose bitrate is limited by a token bucket.
+type throttledReadCloser struct {
+	io.ReadCloser
+	bucket *tokenBucket
+}
+
+func newThrottledReadCloser(rc io.ReadCloser, bitrate int) *throttledReadCloser {
+	return &throttledReadCloser{
+		ReadCloser: rc,
+		bucket:     newTokenBucket(bitrate),
+	}
+}
+
+// Read implements io.Reader.
+func (r *throttledReadCloser) Read(p []byte) (int, error) {
+	// read at most a tenth of second of data at once, in order to send data smoothly.
+	if maxSize := int(r.bucket.rate / 10); maxSize > 0 && len(p) > maxSize {
+		p = p[:maxSize]
+	}
+
+	r.bucket.wait()
+
+	n, err := r.ReadCloser.Read(p)
+	r.bucket.consume(n)
+	return n, err
+}
+
+type shaperRTPState int
+
+const (
+	shaperRTPStateIdle shaperRTPState = iota
+	shaperRTPStateForwarding
+	shaperRTPStateDropping
+)
+
+// shaper decides which frames can be sent when bandwidth is limited.
+// When a token bucket is exhausted, non-reference frames are dropped;
+// if a bucket is still exhausted when a reference frame arrives,
+// the rest of the GOP is dropped, until the next key frame.
+type shaper struct {
+	reader     *tokenBucket
+	path       *tokenBucket
+	dropNonRef bool
+
+	mutex           sync.Mutex
+	waitingKeyFrame map[format.Format]bool
+	rtpStates       map[format.Format]shaperRTPState
+}
+
+// newShaper allocates a shaper. It returns nil if there are no limits.
+// When dropNonRef is false, non-reference frames are handled like reference frames.
+func newShaper(reader *tokenBucket, path *tokenBucket, dropNonRef bool) *shaper {
+	if reader == nil && path == nil {
+		return nil
+	}
+
+	return &shaper{
+		reader:          reader,
+		path:            path,
+		dropNonRef:      dropNonRef,
+		waitingKeyFrame: make(map[format.Format]bool),
+		rtpStates:       make(map[format.Format]shaperRTPState),
+	}
+}
+
+func (s *shaper) exhausted(now time.Time) bool {
+	return (s.reader != nil && s.reader.exhausted(now)) ||
+		(s.path != nil && s.path.exhausted(now))
+}
+
+// consume charges the reader bucket with the size of a frame,
+// and the path bucket with the size multiplied by the number of readers that receive it.
+func (s *shaper) consume(size int, readers int) {
+	if s.reader != nil {
+		s.reader.consume(size)
+	}
+	if s.path != nil {
+		s.path.consume(size * readers)
+	}
+}
+
+func (s *shaper) allowFrame(forma format.Format, typ shaperFrameType, size int, readers int) bool {
+	now := time.Now()
+
+	if typ == shaperFrameNonRef && !s.dropNonRef {
+		typ = shaperFrameRef
+	}
+
+	switch typ {
+	case shaperFrameKey:
+		if s.exhausted(now) {
+			s.waitingKeyFrame[forma] = true
+			return false
+		}
+		s.waitingKeyFrame[forma] = false
+
+	case shaperFrameRef:
+		if s.waitingKeyFrame[forma] {
+			return false
+		}
+		if s.exhausted(now) {
+			s.waitingKeyFrame[forma] = true
+			return false
+		}
+
+	case shaperFrameNonRef:
+		if s.waitingKeyFrame[forma] || s.exhausted(now) {
+			return false
+		}
+	}
+
+	s.consume(size, readers)
+	return true
+}
+
+// allowUnit returns whether a decoded unit can be sent to a reader.
+func (s *shaper) allowUnit(forma format.Format, unit formatprocessor.Unit) bool {
+	typ, size := shaperUnitFrame(unit)
+	if size == 0 {
+		return true
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.allowFrame(forma, typ, size, 1)
+}
+
+// allowRTP returns whether a RTP packet can be sent to readers.
+// The decision is taken on the first packet of a frame and is kept until the end of the frame.
+func (s *shaper) allowRTP(forma format.Format, pkt *rtp.Packet, readers int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	state := s.rtpStates[forma]
+
+	if state == shaperRTPStateIdle {
+		typ := shaperRTPFrame(forma, pkt)
+		if typ != shaperFrameOther {
+			if s.allowFrame(forma, typ, 0, readers) {
+				state = shaperRTPStateForwarding
+			} else {
+				state = shaperRTPStateDropping
+			}
+		}
+	}
+
+	if pkt.Marker {
+		s.rtpStates[forma] = shaperRTPStateIdle
+	} else {
+		s.rtpStates[forma] = state
+	}
+
+	if state == shaperRTPStateDropping {
+		return false
+	}
+
+	s.consume(pkt.MarshalSize(), readers)
+	return true
+}
+
+func shaperH264NALUFrame(nalu []byte) shaperFrameType {
+	switch h264.NALUType(nalu[0] & 0x1F) {
+	case h264.NALUTypeIDR:
+		return shaperFrameKey
+
+	case h264.NALUTypeNonIDR, h264.NALUTypeDataPartitionA:
+		if (nalu[0]>>5)&0x03 == 0 {
+			return shaperFrameNonRef
+		}
+		return shaperFrameRef
+	}
+
+	return shaperFrameOther
+}
+
+func shaperH265NALUFrame(nalu []byte) shaperFrameType {
+	typ := h265.NALUType((nalu[0] >> 1) & 0x3F)
+
+	switch {
+	case typ >= h265.NALUType_BLA_W_LP && typ <= h265.NALUType_RSV_IRAP_VCL23:
+		return shaperFrameKey
+
+	// sub-layer non-reference pictures have even types
+	case typ <= h265.NALUType_RSV_VCL_N14 && typ%2 == 0:
+		return shaperFrameNonRef
+
+	case typ < h265.NALUType_BLA_W_LP:
+		return shaperFrameRef
+	}
+
+	return shaperFrameOther
+}
+
+// shaperAUFrame returns the type of an access unit,
+// that is the type of its most important NALU.
+func shaperAUFrame(au [][]byte, naluFrame func([]byte) shaperFrameType) shaperFrameType {
+	ret := shaperFrameOther
+
+	for _, nalu := range au {
+		if len(nalu) < 2 {
+			continue
+		}
+
+		switch typ := naluFrame(nalu); typ {
+		case shaperFrameKey:
+			return typ
+
+		case shaperFrameRef:
+			ret = typ
+
+		case shaperFrameNonRef:
+			if ret == shaperFrameOther {
+				ret = typ
+			}
+		}
+	}
+
+	return ret
+}
+
+func shaperVP9FrameIsKey(frame []byte) bool {
+	bit := func(i int) byte {
+		return (frame[0] >> (7 - i)) & 0x01
+	}
+
+	profile := bit(2) | bit(3)<<1
+	i := 4
+	if profile == 3 {
+		i++
+	}
+
+	// show_existing_frame, frame_type
+	return bit(i) == 0 && bit(i+1) == 0
+}
+
+// shaperUnitFrame returns type and size of a decoded unit.
+func shaperUnitFrame(unit formatprocessor.Unit) (shaperFrameType, int) {
+	switch tunit := unit.(type) {
+	case *formatprocessor.UnitH264:
+		size := 0
+		for _, nalu := range tunit.AU {
+			size += len(nalu)
+		}
+		return shaperAUFrame(tunit.AU, shaperH264NALUFrame), size
+
+	case *formatprocessor.UnitH265:
+		size := 0
+		for _, nalu := range tunit.AU {
+			size += len(nalu)
+		}
+		return shaperAUFrame(tunit.AU, shaperH265NALUFrame), size
+
+	case *formatprocessor.UnitVP8:
+		if len(tunit.Frame) == 0 {
+			return shaperFrameOther, 0
+		}
+		if tunit.Frame[0]&0x01 == 0 {
+			return shaperFrameKey, len(tunit.Frame)
+		}
+		return shaperFrameRef, len(tunit.Frame)
+
+	case *formatprocessor.UnitVP9:
+		if len(tunit.Frame) == 0 {
+			return shaperFrameOther, 0
+		}
+		if shaperVP9FrameIsKey(tunit.Frame) {
+			return shaperFrameKey, len(tunit.Frame)
+		}
+		return shaperFrameRef, len(tunit.Frame)
+
+	case *formatprocessor.UnitMPEG4Audio:
+		size := 0
+		for _, au := range tunit.AUs {
+			size += len(au)
+		}
+		return shaperFrameOther, size
+
+	case *formatprocessor.UnitOpus:
+		return shaperFrameOther, len(tunit.Frame)
+	}
+
+	size := 0
+	for _, pkt := range unit.GetRTPPackets() {
+		size += pkt.MarshalSize()
+	}
+	return shaperFrameOther, size
+}
+
+func shaperVP8RTPFrame(payload []byte) shaperFrameType {
+	if len(payload) < 1 {
+		return shaperFrameOther
+	}
+
+	// non-reference frame
+	if payload[0]&0x20 != 0 {
+		return shaperFrameNonRef
+	}
+
+	// start of partition 0
+	if payload[0]&0x10 == 0 || payload[0]&0x07 != 0 {
+		return shaperFrameRef
+	}
+
+	i := 1
+	if payload[0]&0x80 != 0 {
+		if len(payload) < 2 {
+			return shaperFrameRef
+		}
+		ext := payload[1]
+		i++
+
+		if ext&0x80 != 0 { // picture ID
+			if len(payload) > i && payload[i]&0x80 != 0 {
+				i += 2
+			} else {
+				i++
+			}
+		}
+		if ext&0x40 != 0 { // TL0PICIDX
+			i++
+		}
+		if ext&0x30 != 0 { // TID, KEYIDX
+			i++
+		}
+	}
+
+	if len(payload) <= i {
+		return shaperFrameRef
+	}
+
+	if payload[i]&0x01 == 0 {
+		return shaperFrameKey
+	}
+	return shaperFrameRef
+}
+
+func shaperVP9RTPFrame(payload []byte) shaperFrameType {
+	if len(payload) < 1 {
+		return shaperFrameOther
+	}
+
+	// inter-picture predicted frame
+	if payload[0]&0x40 != 0 {
+		return shaperFrameRef
+	}
+	return shaperFrameKey
+}
+
+// shaperRTPFrame returns the type of the frame a RTP packet belongs to.
+func shaperRTPFrame(forma format.Format, pkt *rtp.Packet) shaperFrameType {
+	payload := pkt.Payload
+
+	switch forma.(type) {
+	case *format.H264:
+		if len(payload) < 2 {
+			return shaperFrameOther
+		}
+
+		switch h264.NALUType(payload[0] & 0x1F) {
+		case h264.NALUTypeFUA:
+			// rebuild the NALU header with NRI and the original type
+			return shaperH264NALUFrame([]byte{(payload[0] & 0xE0) | (payload[1] & 0x1F)})
+
+		case h264.NALUTypeSTAPA:
+			// parameters are usually sent together with key frames
+			return shaperFrameKey
+		}
+
+		return shaperH264NALUFrame(payload)
+
+	case *format.H265:
+		if len(payload) < 3 {
+			return shaperFrameOther
+		}
+
+		switch h265.NALUType((payload[0] >> 1) & 0x3F) {
+		case h265.NALUType_FragmentationUnit:
+			return shaperH265NALUFrame([]byte{(payload[2] & 0x3F) << 1})
+
+		case h265.NALUType_AggregationUnit:
+			return shaperFrameKey
+		}
+
+		return shaperH265NALUFrame(payload)
+
+	case *format.VP8:
+		return shaperVP8RTPFrame(payload)
+
+	case *format.VP9:
+		return shaperVP9RTPFrame(payload)
+	}
+
+	return shaperFrameOther
+}
@@ -0,0 +1,121 @@
+package core
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/pion/rtp"
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/formatprocessor"
+)
+
+func shaperTestH264Unit(header byte, size int) *formatprocessor.UnitH264 {
+	return &formatprocessor.UnitH264{
+		AU: [][]byte{append([]byte{header}, bytes.Repeat([]byte{0}, size-1)...)},
+	}
+}
+
+func TestShaperUnits(t *testing.T) {
+	forma := &format.H264{}
+
+	idr := func() formatprocessor.Unit { return shaperTestH264Unit(0x65, 2000) }
+	ref := func() formatprocessor.Unit { return shaperTestH264Unit(0x41, 100) }
+	nonRef := func() formatprocessor.Unit { return shaperTestH264Unit(0x01, 100) }
+	audio := &formatprocessor.UnitMPEG4Audio{AUs: [][]byte{{1, 2, 3}}}
+
+	// 1000 bytes per second
+	bucket := newTokenBucket(8000)
+	sh := newShaper(bucket, nil, true)
+
+	require.Equal(t, true, sh.allowUnit(forma, idr()))
+
+	// the bucket is exhausted
+	require.Equal(t, false, sh.allowUnit(forma, nonRef()))
+	require.Equal(t, true, sh.allowUnit(forma, audio))
+	require.Equal(t, false, sh.allowUnit(forma, ref()))
+
+	// the bucket is refilled, but the GOP has been broken
+	bucket.last = bucket.last.Add(-3 * time.Second)
+	require.Equal(t, false, sh.allowUnit(forma, ref()))
+	require.Equal(t, false, sh.allowUnit(forma, nonRef()))
+
+	require.Equal(t, true, sh.allowUnit(forma, idr()))
+	bucket.last = bucket.last.Add(-3 * time.Second)
+	require.Equal(t, true, sh.allowUnit(forma, nonRef()))
+	require.Equal(t, true, sh.allowUnit(forma, ref()))
+}
+
+func TestShaperNonRefFramesNotDroppable(t *testing.T) {
+	forma := &format.H264{}
+
+	bucket := newTokenBucket(8000)
+	sh := newShaper(bucket, nil, false)
+
+	require.Equal(t, true, sh.allowUnit(forma, shaperTestH264Unit(0x65, 2000)))
+
+	// non-reference frames are handled like reference frames,
+	// therefore the rest of the GOP is dropped.
+	require.Equal(t, false, sh.allowUnit(forma, shaperTestH264Unit(0x01, 100)))
+	bucket.last = bucket.last.Add(-3 * time.Second)
+	require.Equal(t, false, sh.allowUnit(forma, shaperTestH264Unit(0x01, 100)))
+}
+
+func TestShaperRTP(t *testing.T) {
+	forma := &format.H264{}
+
+	fuaPacket := func(typ byte, start bool, end bool) *rtp.Packet {
+		header := typ & 0x1F
+		if start {
+			header |= 0x80
+		}
+		if end {
+			header |= 0x40
+		}
+		return &rtp.Packet{
+			Header:  rtp.Header{Marker: end},
+			Payload: append([]byte{0x7C, header}, bytes.Repeat([]byte{0}, 998)...),
+		}
+	}
+
+	// path bucket, 1000 bytes per second, shared by 2 readers
+	bucket := newTokenBucket(8000)
+	sh := newShaper(nil, bucket, true)
+
+	// the frame is forwarded entirely, even if the bucket gets exhausted in the middle
+	require.Equal(t, true, sh.allowRTP(forma, fuaPacket(5, true, false), 2))
+	require.Equal(t, true, sh.allowRTP(forma, fuaPacket(5, false, false), 2))
+	require.Equal(t, true, sh.allowRTP(forma, fuaPacket(5, false, true), 2))
+
+	// the next frame is dropped entirely
+	bucket.last = bucket.last.Add(-2 * time.Second)
+	require.Equal(t, false, sh.allowRTP(forma, fuaPacket(1, true, false), 2))
+	bucket.last = bucket.last.Add(-10 * time.Second)
+	require.Equal(t, false, sh.allowRTP(forma, fuaPacket(1, false, true), 2))
+
+	// until the next key frame
+	require.Equal(t, true, sh.allowRTP(forma, fuaPacket(5, true, true), 2))
+}
+
+func TestShaperVP9FrameIsKey(t *testing.T) {
+	require.Equal(t, true, shaperVP9FrameIsKey([]byte{0x82}))
+	require.Equal(t, false, shaperVP9FrameIsKey([]byte{0x86}))
+}
+
+func TestThrottledReadCloser(t *testing.T) {
+	// 1000 bytes per second
+	r := newThrottledReadCloser(io.NopCloser(bytes.NewReader(make([]byte, 1500))), 8000)
+
+	start := time.Now()
+	byts, err := io.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, 1500, len(byts))
+
+	// the first second of data is sent at once, the rest is throttled.
+	elapsed := time.Since(start)
+	require.GreaterOrEqual(t, elapsed, 400*time.Millisecond)
+	require.Less(t, elapsed, 2*time.Second)
+}
@@ -0,0 +1,62 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// signedURLSignature computes the signature of a reader URL.
+// The signature is the hex-encoded HMAC-SHA256 of "path\nexpires\nip",
+// where ip is empty when the URL is not bound to an IP.
+func signedURLSignature(secret string, path string, expires string, ip string) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(path + "\n" + expires + "\n" + ip))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// signedURLCheck checks the signature contained in the query of a reader URL.
+// It returns whether the URL is signed and, in this case, the time at which
+// the signature expires.
+func signedURLCheck(
+	secret string,
+	ip net.IP,
+	path string,
+	rawQuery string,
+) (time.Time, bool, error) {
+	query, _ := url.ParseQuery(rawQuery)
+
+	sig := query.Get("sig")
+	if sig == "" {
+		return time.Time{}, false, nil
+	}
+
+	expires := query.Get("expires")
+	tmp, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return time.Time{}, true, fmt.Errorf("invalid 'expires' parameter")
+	}
+	expiry := time.Unix(tmp, 0)
+
+	boundIP := query.Get("ip")
+
+	expected := signedURLSignature(secret, path, expires, boundIP)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return time.Time{}, true, fmt.Errorf("invalid signature")
+	}
+
+	if !expiry.After(time.Now()) {
+		return time.Time{}, true, fmt.Errorf("signature expired")
+	}
+
+	if boundIP != "" && !net.ParseIP(boundIP).Equal(ip) {
+		return time.Time{}, true, fmt.Errorf("signature is bound to another IP")
+	}
+
+	return expiry, true, nil
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"net"
 	"strings"
 
 	"github.com/aler9/gortsplib/v2/pkg/media"
@@ -43,3 +44,23 @@ func sourceMediaInfo(medias media.Medias) string {
 		}(),
 		strings.Join(mediasDescription(medias), ", "))
 }
+
+// describeTypeID returns type and ID of the output of apiSourceDescribe() or apiReaderDescribe().
+// The ID is empty when the entity is not a client.
+func describeTypeID(desc interface{}) (string, string) {
+	var out struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+	}
+	cloneStruct(&out, desc)
+	return out.Type, out.ID
+}
+
+// remoteAddrString returns the remote address of a source or reader,
+// or an empty string if it is not a client.
+func remoteAddrString(i interface{}) string {
+	if ra, ok := i.(interface{ remoteAddr() net.Addr }); ok {
+		return ra.remoteAddr().String()
+	}
+	return ""
+}
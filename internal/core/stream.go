@@ -1,27 +1,74 @@
 package core
 
 import (
+	"sync"
+	"sync/atomic"
+	"time"
+
 	"github.com/aler9/gortsplib/v2"
 	"github.com/aler9/gortsplib/v2/pkg/format"
 	"github.com/aler9/gortsplib/v2/pkg/media"
+	"github.com/aler9/gortsplib/v2/pkg/rtcpsender"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
 
 	"github.com/aler9/rtsp-simple-server/internal/formatprocessor"
 )
 
+// period of the RTCP sender reports of RTSP sessions that are shaped on their own.
+// It is the same period used by gortsplib.
+const rtspSenderReportPeriod = 10 * time.Second
+
 type stream struct {
-	bytesReceived *uint64
-	rtspStream    *gortsplib.ServerStream
-	smedias       map[*media.Media]*streamMedia
+	generateRTPPackets   bool
+	bytesReceived        *uint64
+	readerBandwidthLimit int
+	pathBucket           *tokenBucket
+	rtspStream           *gortsplib.ServerStream
+	smedias              map[*media.Media]*streamMedia
+
+	// when there's no reader limit, RTSP readers share the same packets,
+	// therefore they are shaped together.
+	rtspShaper  *shaper
+	rtspReaders int64
+
+	// when there's a reader limit, packets are written to every RTSP session
+	// through its own shaper, and rtspStream is only used to setup sessions.
+	// A nil map means that the stream is closed.
+	rtspShapedMutex sync.RWMutex
+	rtspShaped      map[reader]*streamRTSPReader
+
+	shapersMutex sync.Mutex
+	shapers      map[reader]*shaper
+
+	// data of standby streams is dropped until they're forwarded to another stream.
+	standby bool
+	forward atomic.Pointer[streamForward]
 }
 
 func newStream(
 	medias media.Medias,
 	generateRTPPackets bool,
 	bytesReceived *uint64,
+	readerBandwidthLimit int,
+	bandwidthLimit int,
 ) (*stream, error) {
 	s := &stream{
-		bytesReceived: bytesReceived,
-		rtspStream:    gortsplib.NewServerStream(medias),
+		generateRTPPackets:   generateRTPPackets,
+		bytesReceived:        bytesReceived,
+		readerBandwidthLimit: readerBandwidthLimit,
+		rtspStream:           gortsplib.NewServerStream(medias),
+		shapers:              make(map[reader]*shaper),
+	}
+
+	if bandwidthLimit != 0 {
+		s.pathBucket = newTokenBucket(bandwidthLimit)
+	}
+
+	if readerBandwidthLimit != 0 {
+		s.rtspShaped = make(map[reader]*streamRTSPReader)
+	} else {
+		s.rtspShaper = newShaper(nil, s.pathBucket, true)
 	}
 
 	s.smedias = make(map[*media.Media]*streamMedia)
@@ -37,7 +84,25 @@ func newStream(
 	return s, nil
 }
 
+// newStandbyStream allocates a stream that receives data of a standby publisher.
+func newStandbyStream(medias media.Medias, generateRTPPackets bool) (*stream, error) {
+	s, err := newStream(medias, generateRTPPackets, new(uint64), 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	s.standby = true
+	return s, nil
+}
+
 func (s *stream) close() {
+	s.rtspShapedMutex.Lock()
+	for _, sr := range s.rtspShaped {
+		sr.close()
+	}
+	s.rtspShaped = nil
+	s.rtspShapedMutex.Unlock()
+
 	s.rtspStream.Close()
 }
 
@@ -45,9 +110,46 @@ func (s *stream) medias() media.Medias {
 	return s.rtspStream.Medias()
 }
 
+func (s *stream) newShaper(dropNonRef bool) *shaper {
+	var readerBucket *tokenBucket
+	if s.readerBandwidthLimit != 0 {
+		readerBucket = newTokenBucket(s.readerBandwidthLimit)
+	}
+
+	return newShaper(readerBucket, s.pathBucket, dropNonRef)
+}
+
+func (s *stream) readerShaper(r reader) *shaper {
+	s.shapersMutex.Lock()
+	defer s.shapersMutex.Unlock()
+
+	if sh, ok := s.shapers[r]; ok {
+		return sh
+	}
+
+	dropNonRef := false
+	if d, ok := r.(readerNonRefFramesDropper); ok {
+		dropNonRef = d.canDropNonRefFrames()
+	}
+
+	sh := s.newShaper(dropNonRef)
+	s.shapers[r] = sh
+	return sh
+}
+
 func (s *stream) readerAdd(r reader, medi *media.Media, forma format.Format, cb func(formatprocessor.Unit)) {
 	sm := s.smedias[medi]
 	sf := sm.formats[forma]
+
+	if sh := s.readerShaper(r); sh != nil {
+		ccb := cb
+		cb = func(unit formatprocessor.Unit) {
+			if sh.allowUnit(forma, unit) {
+				ccb(unit)
+			}
+		}
+	}
+
 	sf.readerAdd(r, cb)
 }
 
@@ -57,10 +159,161 @@ func (s *stream) readerRemove(r reader) {
 			sf.readerRemove(r)
 		}
 	}
+
+	s.shapersMutex.Lock()
+	delete(s.shapers, r)
+	s.shapersMutex.Unlock()
+}
+
+// rtspSSRCs returns the SSRCs of the RTP packets of a media that have been sent to RTSP readers.
+func (s *stream) rtspSSRCs(medi *media.Media) []uint32 {
+	sm, ok := s.smedias[medi]
+	if !ok {
+		return nil
+	}
+
+	var ret []uint32
+	for _, sf := range sm.formats {
+		if ssrc := sf.ssrc.Load(); ssrc != nil {
+			ret = append(ret, *ssrc)
+		}
+	}
+	return ret
+}
+
+// rtspReaderAdd is called by path.
+func (s *stream) rtspReaderAdd() {
+	atomic.AddInt64(&s.rtspReaders, 1)
+}
+
+// rtspReaderRemove is called by path.
+func (s *stream) rtspReaderRemove(r reader) {
+	atomic.AddInt64(&s.rtspReaders, -1)
+	s.rtspReaderStop(r)
+}
+
+// rtspReaderStart is called by rtspSession when it starts playing.
+// When there's a reader limit, packets are written to the session through a dedicated shaper.
+func (s *stream) rtspReaderStart(r reader, session *gortsplib.ServerSession) {
+	if s.readerBandwidthLimit == 0 {
+		return
+	}
+
+	s.rtspShapedMutex.Lock()
+	defer s.rtspShapedMutex.Unlock()
+
+	if s.rtspShaped == nil {
+		return
+	}
+
+	if _, ok := s.rtspShaped[r]; ok {
+		return
+	}
+
+	s.rtspShaped[r] = newStreamRTSPReader(session, s.newShaper(true))
+}
+
+// rtspReaderStop is called by rtspSession when it stops playing.
+func (s *stream) rtspReaderStop(r reader) {
+	if s.readerBandwidthLimit == 0 {
+		return
+	}
+
+	s.rtspShapedMutex.Lock()
+	defer s.rtspShapedMutex.Unlock()
+
+	if sr, ok := s.rtspShaped[r]; ok {
+		sr.close()
+		delete(s.rtspShaped, r)
+	}
+}
+
+func (s *stream) writeRTSPShaped(medi *media.Media, forma format.Format, pkt *rtp.Packet, ntp time.Time) {
+	s.rtspShapedMutex.RLock()
+	defer s.rtspShapedMutex.RUnlock()
+
+	for _, sr := range s.rtspShaped {
+		sr.writePacketRTP(medi, forma, pkt, ntp)
+	}
 }
 
 func (s *stream) writeData(medi *media.Media, forma format.Format, data formatprocessor.Unit) error {
+	if s.standby {
+		if fw := s.forward.Load(); fw != nil {
+			return fw.writeData(medi, forma, data)
+		}
+		return nil
+	}
+
 	sm := s.smedias[medi]
 	sf := sm.formats[forma]
-	return sf.writeData(s, medi, data)
+	return sf.writeData(s, medi, forma, data)
+}
+
+// forwardTo starts forwarding data of a standby stream to another stream.
+// Streams must have the same medias and formats, in order to allow
+// readers of the target stream to keep on reading without interruptions.
+func (s *stream) forwardTo(target *stream) error {
+	fw, err := newStreamForward(s, target)
+	if err != nil {
+		return err
+	}
+
+	s.forward.Store(fw)
+	return nil
+}
+
+// stopForward stops forwarding data of a standby stream.
+func (s *stream) stopForward() {
+	s.forward.Store(nil)
+}
+
+// streamRTSPReader is a RTSP session that is shaped on its own.
+type streamRTSPReader struct {
+	session     *gortsplib.ServerSession
+	shaper      *shaper
+	rtcpSenders map[format.Format]*rtcpsender.RTCPSender
+}
+
+func newStreamRTSPReader(session *gortsplib.ServerSession, sh *shaper) *streamRTSPReader {
+	sr := &streamRTSPReader{
+		session:     session,
+		shaper:      sh,
+		rtcpSenders: make(map[format.Format]*rtcpsender.RTCPSender),
+	}
+
+	// sender reports are generated by the session, since the
+	// reports of rtspStream don't match the packets that are sent.
+	for _, medi := range session.SetuppedMedias() {
+		cmedia := medi
+		for _, forma := range medi.Formats {
+			rs := rtcpsender.New(forma.ClockRate(), func(pkt rtcp.Packet) {
+				session.WritePacketRTCP(cmedia, pkt)
+			})
+			rs.Start(rtspSenderReportPeriod)
+			sr.rtcpSenders[forma] = rs
+		}
+	}
+
+	return sr
+}
+
+func (sr *streamRTSPReader) close() {
+	for _, rs := range sr.rtcpSenders {
+		rs.Close()
+	}
+}
+
+func (sr *streamRTSPReader) writePacketRTP(medi *media.Media, forma format.Format, pkt *rtp.Packet, ntp time.Time) {
+	rs, ok := sr.rtcpSenders[forma]
+	if !ok { // media has not been setupped
+		return
+	}
+
+	if !sr.shaper.allowRTP(forma, pkt, 1) {
+		return
+	}
+
+	rs.ProcessPacket(pkt, ntp, forma.PTSEqualsDTS(pkt))
+	sr.session.WritePacketRTP(medi, pkt)
 }
@@ -14,6 +14,9 @@ type streamFormat struct {
 	proc           formatprocessor.Processor
 	mutex          sync.RWMutex
 	nonRTSPReaders map[reader]func(formatprocessor.Unit)
+
+	// SSRC of the last RTP packet of the format.
+	ssrc atomic.Pointer[uint32]
 }
 
 func newStreamFormat(forma format.Format, generateRTPPackets bool) (*streamFormat, error) {
@@ -42,7 +45,7 @@ func (sf *streamFormat) readerRemove(r reader) {
 	delete(sf.nonRTSPReaders, r)
 }
 
-func (sf *streamFormat) writeData(s *stream, medi *media.Media, data formatprocessor.Unit) error {
+func (sf *streamFormat) writeData(s *stream, medi *media.Media, forma format.Format, data formatprocessor.Unit) error {
 	sf.mutex.RLock()
 	defer sf.mutex.RUnlock()
 
@@ -56,6 +59,24 @@ func (sf *streamFormat) writeData(s *stream, medi *media.Media, data formatproce
 	// forward RTP packets to RTSP readers
 	for _, pkt := range data.GetRTPPackets() {
 		atomic.AddUint64(s.bytesReceived, uint64(pkt.MarshalSize()))
+
+		if cur := sf.ssrc.Load(); cur == nil || *cur != pkt.SSRC {
+			ssrc := pkt.SSRC
+			sf.ssrc.Store(&ssrc)
+		}
+
+		if s.readerBandwidthLimit != 0 {
+			s.writeRTSPShaped(medi, forma, pkt, data.GetNTP())
+			continue
+		}
+
+		if s.rtspShaper != nil {
+			readers := int(atomic.LoadInt64(&s.rtspReaders))
+			if readers != 0 && !s.rtspShaper.allowRTP(forma, pkt, readers) {
+				continue
+			}
+		}
+
 		s.rtspStream.WritePacketRTPWithNTP(medi, pkt, data.GetNTP())
 	}
 
@@ -0,0 +1,96 @@
+package core
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/aler9/gortsplib/v2/pkg/format"
+	"github.com/aler9/gortsplib/v2/pkg/media"
+
+	"github.com/aler9/rtsp-simple-server/internal/formatprocessor"
+)
+
+// streamForward routes data of a stream into another stream with the same medias.
+type streamForward struct {
+	target  *stream
+	medias  map[*media.Media]*media.Media
+	formats map[format.Format]format.Format
+}
+
+func newStreamForward(source *stream, target *stream) (*streamForward, error) {
+	if source.generateRTPPackets != target.generateRTPPackets {
+		return nil, fmt.Errorf("publishers use different protocols")
+	}
+
+	sourceMedias := source.medias()
+	targetMedias := target.medias()
+
+	if len(sourceMedias) != len(targetMedias) {
+		return nil, fmt.Errorf("publishers have a different number of medias")
+	}
+
+	fw := &streamForward{
+		target:  target,
+		medias:  make(map[*media.Media]*media.Media),
+		formats: make(map[format.Format]format.Format),
+	}
+
+	for i, sm := range sourceMedias {
+		tm := targetMedias[i]
+
+		if sm.Type != tm.Type || len(sm.Formats) != len(tm.Formats) {
+			return nil, fmt.Errorf("media %d is different", i+1)
+		}
+
+		for j, sf := range sm.Formats {
+			tf := tm.Formats[j]
+
+			if reflect.TypeOf(sf) != reflect.TypeOf(tf) || sf.ClockRate() != tf.ClockRate() {
+				return nil, fmt.Errorf("format %d of media %d is different", j+1, i+1)
+			}
+
+			fw.formats[sf] = tf
+		}
+
+		fw.medias[sm] = tm
+	}
+
+	// parameters are also updated by format processors when they're sent in-band.
+	for sf, tf := range fw.formats {
+		switch sf := sf.(type) {
+		case *format.H264:
+			tf := tf.(*format.H264)
+			if sps := sf.SafeSPS(); sps != nil {
+				tf.SafeSetSPS(sps)
+			}
+			if pps := sf.SafePPS(); pps != nil {
+				tf.SafeSetPPS(pps)
+			}
+
+		case *format.H265:
+			tf := tf.(*format.H265)
+			if vps := sf.SafeVPS(); vps != nil {
+				tf.SafeSetVPS(vps)
+			}
+			if sps := sf.SafeSPS(); sps != nil {
+				tf.SafeSetSPS(sps)
+			}
+			if pps := sf.SafePPS(); pps != nil {
+				tf.SafeSetPPS(pps)
+			}
+		}
+	}
+
+	return fw, nil
+}
+
+func (fw *streamForward) writeData(medi *media.Media, forma format.Format, data formatprocessor.Unit) error {
+	tf := fw.formats[forma]
+
+	// payload types of the two publishers may differ
+	for _, pkt := range data.GetRTPPackets() {
+		pkt.PayloadType = tf.PayloadType()
+	}
+
+	return fw.target.writeData(fw.medias[medi], tf, data)
+}
@@ -0,0 +1,91 @@
+package core
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+)
+
+// timeoutConn is a net.Conn that replaces the deadlines set by the server
+// that is using it with the ones obtained from its own timeouts.
+type timeoutConn struct {
+	net.Conn
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+// SetDeadline implements net.Conn.
+func (c *timeoutConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// SetReadDeadline implements net.Conn.
+func (c *timeoutConn) SetReadDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = time.Now().Add(c.readTimeout)
+	}
+	return c.Conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline implements net.Conn.
+func (c *timeoutConn) SetWriteDeadline(t time.Time) error {
+	if !t.IsZero() {
+		t = time.Now().Add(c.writeTimeout)
+	}
+	return c.Conn.SetWriteDeadline(t)
+}
+
+// timeoutListener is a net.Listener that allows to change the read and write
+// timeouts of servers that can't be changed once the server is started.
+// Timeouts are applied to connections when they are accepted,
+// therefore changes are applied to new connections.
+type timeoutListener struct {
+	net.Listener
+
+	mutex        sync.RWMutex
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+}
+
+func newTimeoutListener(
+	ln net.Listener,
+	readTimeout conf.StringDuration,
+	writeTimeout conf.StringDuration,
+) *timeoutListener {
+	return &timeoutListener{
+		Listener:     ln,
+		readTimeout:  time.Duration(readTimeout),
+		writeTimeout: time.Duration(writeTimeout),
+	}
+}
+
+// Accept implements net.Listener.
+func (l *timeoutListener) Accept() (net.Conn, error) {
+	nconn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return &timeoutConn{
+		Conn:         nconn,
+		readTimeout:  l.readTimeout,
+		writeTimeout: l.writeTimeout,
+	}, nil
+}
+
+func (l *timeoutListener) setTimeouts(readTimeout conf.StringDuration, writeTimeout conf.StringDuration) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.readTimeout = time.Duration(readTimeout)
+	l.writeTimeout = time.Duration(writeTimeout)
+}
@@ -0,0 +1,34 @@
+package core
+
+import (
+	"crypto/tls"
+
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
+)
+
+// newTLSConfig allocates the TLS configuration of a listener.
+// The certificate is reloaded when its files change, without
+// affecting existing connections.
+func newTLSConfig(
+	serverCert string,
+	serverKey string,
+	clientCA string,
+	parent certloader.Parent,
+) (*tls.Config, *certloader.CertLoader, error) {
+	cl, err := certloader.New(serverCert, serverKey, parent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		GetCertificate: cl.GetCertificate,
+	}
+
+	err = tlsSetClientCA(tlsConfig, clientCA)
+	if err != nil {
+		cl.Close()
+		return nil, nil, err
+	}
+
+	return tlsConfig, cl, nil
+}
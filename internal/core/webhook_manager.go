@@ -0,0 +1,281 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+const (
+	// number of deliveries that can be queued before new ones are discarded.
+	webhookQueueSize = 1024
+
+	// number of deliveries that are performed in parallel.
+	webhookWorkerCount = 4
+
+	// pause before the first retry, that is doubled at every attempt.
+	webhookRetryPause = 1 * time.Second
+)
+
+type webhookFailureReason int
+
+const (
+	webhookFailureReasonQueueFull webhookFailureReason = iota
+	webhookFailureReasonRetriesExhausted
+	webhookFailureReasonCount
+)
+
+func (r webhookFailureReason) String() string {
+	if r == webhookFailureReasonQueueFull {
+		return "queueFull"
+	}
+	return "retriesExhausted"
+}
+
+type webhookDelivery struct {
+	url    string
+	secret string
+	e      *event
+	body   []byte
+}
+
+type webhookManagerParent interface {
+	Log(logger.Level, string, ...interface{})
+}
+
+// webhookManager sends events to HTTP endpoints.
+// Events are received from the eventBus and delivered asynchronously,
+// in order not to slow down the components that publish them.
+type webhookManager struct {
+	eventBus *eventBus
+	parent   webhookManagerParent
+
+	ctx        context.Context
+	ctxCancel  func()
+	wg         sync.WaitGroup
+	httpClient *http.Client
+	queue      chan webhookDelivery
+	deliveries uint64
+	failures   [webhookFailureReasonCount]uint64
+
+	mutex      sync.RWMutex
+	url        string
+	secret     string
+	timeout    time.Duration
+	maxRetries int
+}
+
+func newWebhookManager(cnf *conf.Conf, eventBus *eventBus, parent webhookManagerParent) *webhookManager {
+	ctx, ctxCancel := context.WithCancel(context.Background())
+
+	m := &webhookManager{
+		eventBus:   eventBus,
+		parent:     parent,
+		ctx:        ctx,
+		ctxCancel:  ctxCancel,
+		httpClient: &http.Client{},
+		queue:      make(chan webhookDelivery, webhookQueueSize),
+	}
+	m.confReload(cnf)
+
+	// subscribe before returning, in order not to miss events.
+	sub, _ := m.eventBus.subscribe(0)
+
+	m.wg.Add(1)
+	go m.run(sub)
+
+	for i := 0; i < webhookWorkerCount; i++ {
+		m.wg.Add(1)
+		go m.runWorker()
+	}
+
+	return m
+}
+
+func (m *webhookManager) close() {
+	m.ctxCancel()
+	m.wg.Wait()
+	m.httpClient.CloseIdleConnections()
+}
+
+// confReload is called by core.
+func (m *webhookManager) confReload(cnf *conf.Conf) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.url = cnf.WebhookURL
+	m.secret = cnf.WebhookSecret
+	m.timeout = time.Duration(cnf.WebhookTimeout)
+	m.maxRetries = cnf.WebhookMaxRetries
+}
+
+func (m *webhookManager) log(level logger.Level, format string, args ...interface{}) {
+	m.parent.Log(level, "[webhook] "+format, args...)
+}
+
+// deliveryCount returns the number of events delivered successfully.
+func (m *webhookManager) deliveryCount() uint64 {
+	return atomic.LoadUint64(&m.deliveries)
+}
+
+// failureCount returns the number of events that could not be delivered.
+func (m *webhookManager) failureCount(reason webhookFailureReason) uint64 {
+	return atomic.LoadUint64(&m.failures[reason])
+}
+
+func (m *webhookManager) run(sub *eventSubscriber) {
+	defer m.wg.Done()
+
+	var lastID uint64
+
+	for {
+		select {
+		case e, ok := <-sub.ch:
+			if !ok {
+				// the subscriber has been removed because it was too slow; resume.
+				var missed []*event
+				sub, missed = m.eventBus.subscribe(lastID)
+				for _, e := range missed {
+					m.enqueue(e)
+					lastID = e.ID
+				}
+				continue
+			}
+
+			m.enqueue(e)
+			lastID = e.ID
+
+		case <-m.ctx.Done():
+			m.eventBus.unsubscribe(sub)
+			return
+		}
+	}
+}
+
+func (m *webhookManager) enqueue(e *event) {
+	m.mutex.RLock()
+	globalURL := m.url
+	globalSecret := m.secret
+	m.mutex.RUnlock()
+
+	var deliveries []webhookDelivery
+
+	if globalURL != "" {
+		deliveries = append(deliveries, webhookDelivery{url: globalURL, secret: globalSecret})
+	}
+
+	if e.pathConf != nil && e.pathConf.WebhookURL != "" && e.pathConf.WebhookURL != globalURL {
+		deliveries = append(deliveries, webhookDelivery{url: e.pathConf.WebhookURL, secret: e.pathConf.WebhookSecret})
+	}
+
+	if deliveries == nil {
+		return
+	}
+
+	body, _ := json.Marshal(e)
+
+	for _, d := range deliveries {
+		d.e = e
+		d.body = body
+
+		select {
+		case m.queue <- d:
+		default:
+			atomic.AddUint64(&m.failures[webhookFailureReasonQueueFull], 1)
+			m.log(logger.Warn, "queue is full, event %d (%s) discarded", e.ID, e.Type)
+		}
+	}
+}
+
+func (m *webhookManager) runWorker() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case d := <-m.queue:
+			m.deliver(d)
+
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *webhookManager) deliver(d webhookDelivery) {
+	m.mutex.RLock()
+	timeout := m.timeout
+	maxRetries := m.maxRetries
+	m.mutex.RUnlock()
+
+	pause := webhookRetryPause
+
+	for attempt := 0; ; attempt++ {
+		err := m.do(d, timeout)
+		if err == nil {
+			atomic.AddUint64(&m.deliveries, 1)
+			return
+		}
+
+		if attempt >= maxRetries {
+			atomic.AddUint64(&m.failures[webhookFailureReasonRetriesExhausted], 1)
+			m.log(logger.Warn, "unable to deliver event %d (%s) to %s: %v", d.e.ID, d.e.Type, d.url, err)
+			return
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-m.ctx.Done():
+			return
+		}
+
+		pause *= 2
+	}
+}
+
+func (m *webhookManager) do(d webhookDelivery, timeout time.Duration) error {
+	ctx, ctxCancel := context.WithTimeout(m.ctx, timeout)
+	defer ctxCancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-ID", fmt.Sprintf("%d", d.e.ID))
+	req.Header.Set("X-Event-Type", string(d.e.Type))
+
+	if d.secret != "" {
+		req.Header.Set("X-Signature-256", webhookSignature(d.secret, d.body))
+	}
+
+	res, err := m.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("bad status code: %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// webhookSignature returns the HMAC-SHA256 signature of a body.
+func webhookSignature(secret string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write(body)
+	return "sha256=" + hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,125 @@
+package core
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/conf"
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+type nilWebhookManagerParent struct{}
+
+func (nilWebhookManagerParent) Log(logger.Level, string, ...interface{}) {}
+
+func TestWebhookManager(t *testing.T) {
+	type received struct {
+		header http.Header
+		body   []byte
+	}
+
+	globalRecv := make(chan received, 10)
+	global := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		globalRecv <- received{r.Header, body}
+	}))
+	defer global.Close()
+
+	pathRecv := make(chan received, 10)
+	pathSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		pathRecv <- received{r.Header, body}
+	}))
+	defer pathSrv.Close()
+
+	b := newEventBus()
+
+	m := newWebhookManager(&conf.Conf{
+		WebhookURL:        global.URL,
+		WebhookSecret:     "globalsecret",
+		WebhookTimeout:    conf.StringDuration(5 * time.Second),
+		WebhookMaxRetries: 1,
+	}, b, nilWebhookManagerParent{})
+	defer m.close()
+
+	b.publish(event{
+		Type:  eventTypeReaderAdded,
+		Path:  "mypath",
+		Query: "key=val",
+		pathConf: &conf.PathConf{
+			WebhookURL:    pathSrv.URL,
+			WebhookSecret: "pathsecret",
+		},
+	})
+
+	for _, ca := range []struct {
+		ch     chan received
+		secret string
+	}{
+		{globalRecv, "globalsecret"},
+		{pathRecv, "pathsecret"},
+	} {
+		r := <-ca.ch
+		require.Equal(t, "application/json", r.header.Get("Content-Type"))
+		require.Equal(t, "1", r.header.Get("X-Event-ID"))
+		require.Equal(t, "readerAdded", r.header.Get("X-Event-Type"))
+		require.Equal(t, webhookSignature(ca.secret, r.body), r.header.Get("X-Signature-256"))
+
+		var e event
+		err := json.Unmarshal(r.body, &e)
+		require.NoError(t, err)
+		require.Equal(t, "mypath", e.Path)
+		require.Equal(t, "key=val", e.Query)
+	}
+
+	// events without a path are sent to the global webhook only
+	b.publish(event{Type: eventTypeConfigReloaded})
+
+	r := <-globalRecv
+	require.Equal(t, "configReloaded", r.header.Get("X-Event-Type"))
+
+	select {
+	case <-pathRecv:
+		t.Errorf("should not happen")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	require.Eventually(t, func() bool {
+		return m.deliveryCount() == 3
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestWebhookManagerRetries(t *testing.T) {
+	var count int32
+
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&count, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer s.Close()
+
+	b := newEventBus()
+
+	m := newWebhookManager(&conf.Conf{
+		WebhookURL:        s.URL,
+		WebhookTimeout:    conf.StringDuration(5 * time.Second),
+		WebhookMaxRetries: 1,
+	}, b, nilWebhookManagerParent{})
+	defer m.close()
+
+	b.publish(event{Type: eventTypeConfigReloaded})
+
+	require.Eventually(t, func() bool {
+		return m.failureCount(webhookFailureReasonRetriesExhausted) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.Equal(t, int32(2), atomic.LoadInt32(&count))
+	require.Equal(t, uint64(0), m.deliveryCount())
+}
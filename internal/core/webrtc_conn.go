@@ -95,6 +95,7 @@ type webRTCConn struct {
 	iceServers        []string
 	wg                *sync.WaitGroup
 	pathManager       webRTCConnPathManager
+	eventBus          *eventBus
 	parent            webRTCConnParent
 	iceUDPMux         ice.UDPMux
 	iceTCPMux         ice.TCPMux
@@ -118,6 +119,7 @@ func newWebRTCConn(
 	iceServers []string,
 	wg *sync.WaitGroup,
 	pathManager webRTCConnPathManager,
+	eventBus *eventBus,
 	parent webRTCConnParent,
 	iceHostNAT1To1IPs []string,
 	iceUDPMux ice.UDPMux,
@@ -132,6 +134,7 @@ func newWebRTCConn(
 		iceServers:        iceServers,
 		wg:                wg,
 		pathManager:       pathManager,
+		eventBus:          eventBus,
 		parent:            parent,
 		ctx:               ctx,
 		ctxCancel:         ctxCancel,
@@ -145,6 +148,11 @@ func newWebRTCConn(
 
 	c.log(logger.Info, "opened")
 
+	c.eventBus.publish(event{
+		Type: eventTypeConnOpened,
+		Conn: newEventConn("webRTCConn", c.uuid, c.remoteAddr()),
+	})
+
 	wg.Add(1)
 	go c.run()
 
@@ -282,6 +290,12 @@ func (c *webRTCConn) run() {
 	c.parent.connClose(c)
 
 	c.log(logger.Info, "closed (%v)", err)
+
+	c.eventBus.publish(event{
+		Type:  eventTypeConnClosed,
+		Conn:  newEventConn("webRTCConn", c.uuid, c.remoteAddr()),
+		Error: err.Error(),
+	})
 }
 
 func (c *webRTCConn) runInner(ctx context.Context) error {
@@ -877,3 +891,8 @@ func (c *webRTCConn) apiReaderDescribe() interface{} {
 		ID   string `json:"id"`
 	}{"webRTCConn", c.uuid.String()}
 }
+
+// canDropNonRefFrames implements readerNonRefFramesDropper.
+func (c *webRTCConn) canDropNonRefFrames() bool {
+	return true
+}
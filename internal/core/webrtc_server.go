@@ -17,6 +17,7 @@ import (
 	"github.com/pion/ice/v2"
 	"github.com/pion/webrtc/v3"
 
+	"github.com/aler9/rtsp-simple-server/internal/certloader"
 	"github.com/aler9/rtsp-simple-server/internal/conf"
 	"github.com/aler9/rtsp-simple-server/internal/logger"
 	"github.com/aler9/rtsp-simple-server/internal/websocket"
@@ -57,6 +58,10 @@ type webRTCServerAPIConnsKickReq struct {
 	res chan webRTCServerAPIConnsKickRes
 }
 
+type webRTCServerConnsCountReq struct {
+	res chan int
+}
+
 type webRTCConnNewReq struct {
 	pathName string
 	wsconn   *websocket.ServerConn
@@ -68,14 +73,15 @@ type webRTCServerParent interface {
 }
 
 type webRTCServer struct {
-	externalAuthenticationURL string
-	allowOrigin               string
-	trustedProxies            conf.IPsOrCIDRs
-	iceServers                []string
-	readBufferCount           int
-	pathManager               *pathManager
-	metrics                   *metrics
-	parent                    webRTCServerParent
+	authManager     *authManager
+	eventBus        *eventBus
+	allowOrigin     string
+	trustedProxies  conf.IPsOrCIDRs
+	iceServers      []string
+	readBufferCount int
+	pathManager     *pathManager
+	metrics         *metrics
+	parent          webRTCServerParent
 
 	ctx               context.Context
 	ctxCancel         func()
@@ -83,6 +89,7 @@ type webRTCServer struct {
 	udpMuxLn          net.PacketConn
 	tcpMuxLn          net.Listener
 	tlsConfig         *tls.Config
+	certLoader        *certloader.CertLoader
 	conns             map[*webRTCConn]struct{}
 	iceHostNAT1To1IPs []string
 	iceUDPMux         ice.UDPMux
@@ -93,6 +100,9 @@ type webRTCServer struct {
 	chConnClose    chan *webRTCConn
 	chAPIConnsList chan webRTCServerAPIConnsListReq
 	chAPIConnsKick chan webRTCServerAPIConnsKickReq
+	chDrain        chan struct{}
+	chConnsCount   chan webRTCServerConnsCountReq
+	chConfReload   chan *conf.Conf
 
 	// out
 	done chan struct{}
@@ -100,11 +110,14 @@ type webRTCServer struct {
 
 func newWebRTCServer(
 	parentCtx context.Context,
-	externalAuthenticationURL string,
+	authManager *authManager,
+	limitManager *limitManager,
+	eventBus *eventBus,
 	address string,
 	encryption bool,
 	serverKey string,
 	serverCert string,
+	clientCA string,
 	allowOrigin string,
 	trustedProxies conf.IPsOrCIDRs,
 	iceServers []string,
@@ -120,18 +133,23 @@ func newWebRTCServer(
 	if err != nil {
 		return nil, err
 	}
+	ln = newIPBanListener(ln, authManager)
+
+	// plain HTTP clients are notified with 503, while TLS clients can't
+	if encryption {
+		ln = newLimitListener(ln, limitManager, nil)
+	} else {
+		ln = newLimitListener(ln, limitManager, httpLimitReject)
+	}
 
 	var tlsConfig *tls.Config
+	var certLoader *certloader.CertLoader
 	if encryption {
-		crt, err := tls.LoadX509KeyPair(serverCert, serverKey)
+		tlsConfig, certLoader, err = newTLSConfig(serverCert, serverKey, clientCA, parent)
 		if err != nil {
 			ln.Close()
 			return nil, err
 		}
-
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{crt},
-		}
 	}
 
 	var iceUDPMux ice.UDPMux
@@ -157,29 +175,34 @@ func newWebRTCServer(
 	ctx, ctxCancel := context.WithCancel(parentCtx)
 
 	s := &webRTCServer{
-		externalAuthenticationURL: externalAuthenticationURL,
-		allowOrigin:               allowOrigin,
-		trustedProxies:            trustedProxies,
-		iceServers:                iceServers,
-		readBufferCount:           readBufferCount,
-		pathManager:               pathManager,
-		metrics:                   metrics,
-		parent:                    parent,
-		ctx:                       ctx,
-		ctxCancel:                 ctxCancel,
-		ln:                        ln,
-		udpMuxLn:                  udpMuxLn,
-		tcpMuxLn:                  tcpMuxLn,
-		tlsConfig:                 tlsConfig,
-		iceUDPMux:                 iceUDPMux,
-		iceTCPMux:                 iceTCPMux,
-		iceHostNAT1To1IPs:         iceHostNAT1To1IPs,
-		conns:                     make(map[*webRTCConn]struct{}),
-		connNew:                   make(chan webRTCConnNewReq),
-		chConnClose:               make(chan *webRTCConn),
-		chAPIConnsList:            make(chan webRTCServerAPIConnsListReq),
-		chAPIConnsKick:            make(chan webRTCServerAPIConnsKickReq),
-		done:                      make(chan struct{}),
+		authManager:       authManager,
+		eventBus:          eventBus,
+		allowOrigin:       allowOrigin,
+		trustedProxies:    trustedProxies,
+		iceServers:        iceServers,
+		readBufferCount:   readBufferCount,
+		pathManager:       pathManager,
+		metrics:           metrics,
+		parent:            parent,
+		ctx:               ctx,
+		ctxCancel:         ctxCancel,
+		ln:                ln,
+		udpMuxLn:          udpMuxLn,
+		tcpMuxLn:          tcpMuxLn,
+		tlsConfig:         tlsConfig,
+		certLoader:        certLoader,
+		iceUDPMux:         iceUDPMux,
+		iceTCPMux:         iceTCPMux,
+		iceHostNAT1To1IPs: iceHostNAT1To1IPs,
+		conns:             make(map[*webRTCConn]struct{}),
+		connNew:           make(chan webRTCConnNewReq),
+		chConnClose:       make(chan *webRTCConn),
+		chAPIConnsList:    make(chan webRTCServerAPIConnsListReq),
+		chAPIConnsKick:    make(chan webRTCServerAPIConnsKickReq),
+		chDrain:           make(chan struct{}),
+		chConnsCount:      make(chan webRTCServerConnsCountReq),
+		chConfReload:      make(chan *conf.Conf),
+		done:              make(chan struct{}),
 	}
 
 	str := "listener opened on " + address + " (HTTP)"
@@ -193,6 +216,10 @@ func newWebRTCServer(
 
 	if s.metrics != nil {
 		s.metrics.webRTCServerSet(s)
+
+		if s.certLoader != nil {
+			s.metrics.certLoaderSet("webrtc", s.certLoader)
+		}
 	}
 
 	go s.run()
@@ -218,7 +245,7 @@ func (s *webRTCServer) run() {
 	defer rp.close()
 
 	router := gin.New()
-	router.NoRoute(rp.mw, httpLoggerMiddleware(s), s.onRequest)
+	router.NoRoute(rp.mw, httpLoggerMiddleware(s), ipBanMiddleware(s.authManager), s.onRequest)
 
 	tmp := make([]string, len(s.trustedProxies))
 	for i, entry := range s.trustedProxies {
@@ -239,11 +266,18 @@ func (s *webRTCServer) run() {
 	}
 
 	var wg sync.WaitGroup
+	draining := false
 
 outer:
 	for {
 		select {
 		case req := <-s.connNew:
+			// existing connections can finish, while new ones are refused
+			if draining {
+				req.res <- nil
+				continue
+			}
+
 			c := newWebRTCConn(
 				s.ctx,
 				s.readBufferCount,
@@ -252,6 +286,7 @@ outer:
 				s.iceServers,
 				&wg,
 				s.pathManager,
+				s.eventBus,
 				s,
 				s.iceHostNAT1To1IPs,
 				s.iceUDPMux,
@@ -299,6 +334,16 @@ outer:
 				req.res <- webRTCServerAPIConnsKickRes{fmt.Errorf("not found")}
 			}
 
+		case newConf := <-s.chConfReload:
+			// parameters are applied to new sessions
+			s.readBufferCount = newConf.ReadBufferCount
+
+		case <-s.chDrain:
+			draining = true
+
+		case req := <-s.chConnsCount:
+			req.res <- len(s.conns)
+
 		case <-s.ctx.Done():
 			break outer
 		}
@@ -318,6 +363,13 @@ outer:
 	if s.tcpMuxLn != nil {
 		s.tcpMuxLn.Close()
 	}
+
+	if s.certLoader != nil {
+		if s.metrics != nil {
+			s.metrics.certLoaderSet("webrtc", nil)
+		}
+		s.certLoader.Close()
+	}
 }
 
 func (s *webRTCServer) onRequest(ctx *gin.Context) {
@@ -368,10 +420,11 @@ func (s *webRTCServer) onRequest(ctx *gin.Context) {
 		return
 	}
 
-	err := s.authenticate(res.path, ctx)
+	expiry, err := s.authenticate(res.path, ctx)
 	if err != nil {
 		if terr, ok := err.(pathErrAuthCritical); ok {
 			s.log(logger.Info, "authentication error: %s", terr.message)
+			s.authManager.onFailure(net.ParseIP(ctx.ClientIP()), dir, terr.message)
 			ctx.Writer.Header().Set("WWW-Authenticate", `Basic realm="rtsp-simple-server"`)
 			ctx.Writer.WriteHeader(http.StatusUnauthorized)
 			return
@@ -384,6 +437,13 @@ func (s *webRTCServer) onRequest(ctx *gin.Context) {
 
 	switch fname {
 	case "":
+		// readers of overloaded nodes are redirected to a sibling node
+		if u := s.pathManager.clusterRedirect(dir, clusterProtocolWebRTC); u != "" {
+			ctx.Writer.Header().Set("Location", clusterRedirectURL(u, dir+"/", ctx.Request.URL.RawQuery))
+			ctx.Writer.WriteHeader(http.StatusTemporaryRedirect)
+			return
+		}
+
 		ctx.Writer.Header().Set("Content-Type", "text/html")
 		ctx.Writer.WriteHeader(http.StatusOK)
 		ctx.Writer.Write(webrtcIndex)
@@ -401,6 +461,14 @@ func (s *webRTCServer) onRequest(ctx *gin.Context) {
 			return
 		}
 
+		if !expiry.IsZero() {
+			t := time.AfterFunc(time.Until(expiry), func() {
+				c.log(logger.Info, "session expired")
+				c.close()
+			})
+			defer t.Stop()
+		}
+
 		c.wait()
 	}
 }
@@ -420,61 +488,99 @@ func (s *webRTCServer) newConn(dir string, wsconn *websocket.ServerConn) *webRTC
 	}
 }
 
-func (s *webRTCServer) authenticate(pa *path, ctx *gin.Context) error {
+// authenticate returns the time at which the session must be closed,
+// or a zero time if the session never expires.
+func (s *webRTCServer) authenticate(pa *path, ctx *gin.Context) (time.Time, error) {
 	pathConf := pa.safeConf()
 	pathIPs := pathConf.ReadIPs
 	pathUser := pathConf.ReadUser
 	pathPass := pathConf.ReadPass
 
-	if s.externalAuthenticationURL != "" {
+	// IPs are checked before everything else, since a signed URL
+	// replaces credentials, not the IP restrictions of the path.
+	if pathIPs != nil {
+		ip := net.ParseIP(ctx.ClientIP())
+
+		if !ipEqualOrInRange(ip, pathIPs) {
+			return time.Time{}, pathErrAuthCritical{
+				message: fmt.Sprintf("IP '%s' not allowed", ip),
+			}
+		}
+	}
+
+	// a valid signed URL grants read access without credentials
+	expiry, ok, err := s.authManager.authenticateSignedURL(net.ParseIP(ctx.ClientIP()), pa.name, ctx.Request.URL.RawQuery)
+	if err != nil {
+		return time.Time{}, pathErrAuthCritical{
+			message: fmt.Sprintf("unauthorized: %s", err),
+		}
+	}
+
+	if ok {
+		return expiry, nil
+	}
+
+	certUser := s.authManager.clientCertUser(ctx.Request.TLS)
+
+	if s.authManager.hasExternalAuth() {
 		ip := net.ParseIP(ctx.ClientIP())
 		user, pass, ok := ctx.Request.BasicAuth()
 
-		err := externalAuth(
-			s.externalAuthenticationURL,
-			ip.String(),
-			user,
-			pass,
-			pa.name,
-			externalAuthProtoWebRTC,
-			nil,
-			false,
-			ctx.Request.URL.RawQuery)
+		var err error
+		expiry, err = s.authManager.authenticateExternal(externalAuthReq{
+			ip:       ip.String(),
+			user:     user,
+			password: pass,
+			path:     pa.name,
+			protocol: externalAuthProtoWebRTC,
+			query:    ctx.Request.URL.RawQuery,
+			certUser: certUser,
+		})
 		if err != nil {
 			if !ok {
-				return pathErrAuthNotCritical{}
+				return time.Time{}, pathErrAuthNotCritical{}
 			}
 
-			return pathErrAuthCritical{
+			return time.Time{}, pathErrAuthCritical{
 				message: fmt.Sprintf("external authentication failed: %s", err),
 			}
 		}
 	}
 
-	if pathIPs != nil {
+	if s.authManager.hasInternalUsers() {
 		ip := net.ParseIP(ctx.ClientIP())
+		user, pass, ok := ctx.Request.BasicAuth()
 
-		if !ipEqualOrInRange(ip, pathIPs) {
-			return pathErrAuthCritical{
-				message: fmt.Sprintf("IP '%s' not allowed", ip),
+		var err error
+		if certUser == "" || s.authManager.authenticateClientCert(ip, certUser, conf.AuthActionRead, pa.name) != nil {
+			err = s.authManager.authenticate(ip, user, pass, conf.AuthActionRead, pa.name)
+		}
+		if err != nil {
+			if !ok {
+				return time.Time{}, pathErrAuthNotCritical{}
+			}
+
+			return time.Time{}, pathErrAuthCritical{
+				message: fmt.Sprintf("unauthorized: %s", err),
 			}
 		}
 	}
 
-	if pathUser != "" {
+	// users authenticated with a client certificate don't need a password
+	if pathUser != "" && (certUser == "" || !pathUser.Check(certUser)) {
 		user, pass, ok := ctx.Request.BasicAuth()
 		if !ok {
-			return pathErrAuthNotCritical{}
+			return time.Time{}, pathErrAuthNotCritical{}
 		}
 
 		if user != string(pathUser) || pass != string(pathPass) {
-			return pathErrAuthCritical{
+			return time.Time{}, pathErrAuthCritical{
 				message: "invalid credentials",
 			}
 		}
 	}
 
-	return nil
+	return expiry, nil
 }
 
 // connClose is called by webRTCConn.
@@ -485,6 +591,37 @@ func (s *webRTCServer) connClose(c *webRTCConn) {
 	}
 }
 
+// confReload is called by core.
+func (s *webRTCServer) confReload(newConf *conf.Conf) {
+	select {
+	case s.chConfReload <- newConf:
+	case <-s.ctx.Done():
+	}
+}
+
+// drain is called by core.
+func (s *webRTCServer) drain() {
+	select {
+	case s.chDrain <- struct{}{}:
+	case <-s.ctx.Done():
+	}
+}
+
+// connsCount is called by core.
+func (s *webRTCServer) connsCount() int {
+	req := webRTCServerConnsCountReq{
+		res: make(chan int),
+	}
+
+	select {
+	case s.chConnsCount <- req:
+		return <-req.res
+
+	case <-s.ctx.Done():
+		return 0
+	}
+}
+
 // apiConnsList is called by api.
 func (s *webRTCServer) apiConnsList() webRTCServerAPIConnsListRes {
 	req := webRTCServerAPIConnsListReq{
@@ -2,88 +2,391 @@
 package externalcmd
 
 import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"os/exec"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/google/uuid"
+	"github.com/kballard/go-shellquote"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
 )
 
 const (
-	restartPause = 5 * time.Second
+	// pause before the first restart, that is doubled at every restart.
+	restartPauseMin = 5 * time.Second
+
+	// maximum pause between restarts. Commands that run longer than this
+	// are considered stable, and the pause is reset.
+	restartPauseMax = 2 * time.Minute
+
+	// time given to commands to exit after being interrupted, before being killed.
+	terminateTimeout = 10 * time.Second
+
+	// maximum length of a line of output.
+	maxOutputLineSize = 64 * 1024
 )
 
 // Environment is a Cmd environment.
 type Environment map[string]string
 
+// variables that are substituted into the command string, in addition to
+// being passed to the command through its environment.
+// Variables whose value is controlled by clients, like RTSP_QUERY or RTSP_REMOTE_ADDR,
+// must not be listed here, otherwise clients would be able to inject arbitrary commands.
+var substitutedEnv = map[string]struct{}{
+	"RTSP_PATH":        {},
+	"RTSP_PORT":        {},
+	"RTSP_CONN_TYPE":   {},
+	"RTSP_CONN_ID":     {},
+	"RTSP_SOURCE_TYPE": {},
+	"RTSP_SOURCE_ID":   {},
+	"RTSP_READER_TYPE": {},
+	"RTSP_READER_ID":   {},
+}
+
+// isSubstituted checks whether a variable is substituted into the command string.
+// Regular expression groups (G1, G2, ...) are extracted from path names, that are validated.
+func isSubstituted(key string) bool {
+	if _, ok := substitutedEnv[key]; ok {
+		return true
+	}
+
+	if len(key) < 2 || key[0] != 'G' {
+		return false
+	}
+
+	for _, c := range key[1:] {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// LogFunc is the function used to print the output of commands.
+type LogFunc func(logger.Level, string, ...interface{})
+
 // Cmd is an external command.
 type Cmd struct {
 	pool    *Pool
+	name    string
 	cmdstr  string
 	restart bool
 	env     Environment
+	oneShot bool
+	log     LogFunc
 	onExit  func(int)
 
+	id           uuid.UUID
+	created      time.Time
+	mutex        sync.Mutex
+	pid          int
+	started      time.Time
+	restarts     int
+	lastExitCode *int
+
 	// in
 	terminate chan struct{}
 }
 
-// NewCmd allocates a Cmd.
-func NewCmd(
+func newCmd(
 	pool *Pool,
+	name string,
 	cmdstr string,
 	restart bool,
 	env Environment,
+	oneShot bool,
+	log LogFunc,
 	onExit func(int),
 ) *Cmd {
 	for key, val := range env {
-		cmdstr = strings.ReplaceAll(cmdstr, "$"+key, val)
+		if isSubstituted(key) {
+			cmdstr = strings.ReplaceAll(cmdstr, "$"+key, val)
+		}
 	}
 
 	e := &Cmd{
-		pool:      pool,
-		cmdstr:    cmdstr,
-		restart:   restart,
-		env:       env,
-		onExit:    onExit,
-		terminate: make(chan struct{}),
+		pool:    pool,
+		name:    name,
+		cmdstr:  cmdstr,
+		restart: restart,
+		env:     env,
+		oneShot: oneShot,
+		log:     log,
+		onExit:  onExit,
+		id:      uuid.New(),
+		created: time.Now(),
 	}
 
-	pool.wg.Add(1)
+	// one-shot commands can't be terminated by their owner, they are killed
+	// only when the pool is closed and they don't exit in time.
+	if !oneShot {
+		e.terminate = make(chan struct{})
+	} else {
+		e.terminate = pool.terminate
+	}
+
+	pool.add(e)
 
 	go e.run()
 
 	return e
 }
 
+// NewCmd allocates a Cmd.
+// name is the name of the setting that contains the command,
+// and is used to prefix the output of the command in logs.
+func NewCmd(
+	pool *Pool,
+	name string,
+	cmdstr string,
+	restart bool,
+	env Environment,
+	log LogFunc,
+	onExit func(int),
+) *Cmd {
+	return newCmd(pool, name, cmdstr, restart, env, false, log, onExit)
+}
+
+// RunOneShot runs a command once. The command can't be terminated, since it is
+// meant to notify that something has ended; Pool.Close() waits for its exit,
+// and kills it if it doesn't exit in time.
+func RunOneShot(
+	pool *Pool,
+	name string,
+	cmdstr string,
+	env Environment,
+	log LogFunc,
+	onExit func(int),
+) {
+	newCmd(pool, name, cmdstr, false, env, true, log, onExit)
+}
+
 // Close closes the command. It doesn't wait for the command to exit.
 func (e *Cmd) Close() {
 	close(e.terminate)
 }
 
+func (e *Cmd) info() CmdInfo {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	return CmdInfo{
+		ID:           e.id,
+		Name:         e.name,
+		Cmd:          e.cmdstr,
+		Path:         e.env["RTSP_PATH"],
+		Created:      e.created,
+		PID:          e.pid,
+		Started:      e.started,
+		Restarts:     e.restarts,
+		LastExitCode: e.lastExitCode,
+	}
+}
+
 func (e *Cmd) run() {
-	defer e.pool.wg.Done()
+	defer e.pool.remove(e)
+
+	pause := restartPauseMin
 
 	for {
-		ok := func() bool {
-			c, ok := e.runInner()
-			if !ok {
-				return false
-			}
+		started := time.Now()
+
+		c, ok := e.runInner()
+		if !ok {
+			return
+		}
 
-			e.onExit(c)
+		e.mutex.Lock()
+		e.lastExitCode = &c
+		e.mutex.Unlock()
 
-			if !e.restart {
-				<-e.terminate
-				return false
+		e.onExit(c)
+
+		if e.oneShot {
+			return
+		}
+
+		if !e.restart {
+			<-e.terminate
+			return
+		}
+
+		if time.Since(started) >= restartPauseMax {
+			pause = restartPauseMin
+		}
+
+		select {
+		case <-time.After(pause):
+		case <-e.terminate:
+			return
+		}
+
+		pause *= 2
+		if pause > restartPauseMax {
+			pause = restartPauseMax
+		}
+
+		e.mutex.Lock()
+		e.restarts++
+		e.mutex.Unlock()
+	}
+}
+
+func (e *Cmd) runInner() (int, bool) {
+	cmdparts, err := shellquote.Split(e.cmdstr)
+	if err != nil || len(cmdparts) == 0 {
+		e.log(logger.Error, "[%s] invalid command: %s", e.name, e.cmdstr)
+		return 0, true
+	}
+
+	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
+
+	cmd.Env = append([]string(nil), os.Environ()...)
+	for key, val := range e.env {
+		cmd.Env = append(cmd.Env, key+"="+val)
+	}
+
+	group := newProcessGroup(cmd)
+
+	closeOutput, err := e.pipeOutput(cmd)
+	if err != nil {
+		e.log(logger.Error, "[%s] %s", e.name, err)
+		return 0, true
+	}
+
+	err = cmd.Start()
+	closeOutput()
+	if err != nil {
+		e.log(logger.Error, "[%s] %s", e.name, err)
+		return 0, true
+	}
+
+	err = group.start()
+	if err != nil {
+		e.log(logger.Warn, "[%s] unable to track children of the command: %s", e.name, err)
+	}
+	defer group.close()
+
+	e.mutex.Lock()
+	e.pid = cmd.Process.Pid
+	e.started = time.Now()
+	e.mutex.Unlock()
+
+	defer func() {
+		e.mutex.Lock()
+		e.pid = 0
+		e.mutex.Unlock()
+	}()
+
+	cmdDone := make(chan int)
+	go func() {
+		cmdDone <- func() int {
+			err := cmd.Wait()
+			if err == nil {
+				return 0
+			}
+			ee, ok := err.(*exec.ExitError)
+			if !ok {
+				return 0
 			}
+			return ee.ExitCode()
+		}()
+	}()
+
+	select {
+	case <-e.terminate:
+		// one-shot commands already had the time to exit.
+		if !e.oneShot {
+			group.interrupt()
 
 			select {
-			case <-time.After(restartPause):
-				return true
-			case <-e.terminate:
-				return false
+			case <-cmdDone:
+			case <-time.After(terminateTimeout):
+				group.kill()
+				<-cmdDone
 			}
-		}()
-		if !ok {
-			break
+		} else {
+			group.kill()
+			<-cmdDone
+		}
+
+		// kill children that are still alive.
+		group.kill()
+		return 0, false
+
+	case c := <-cmdDone:
+		return c, true
+	}
+}
+
+// pipeOutput routes stdout and stderr of the command into the logger.
+// Pipes are used instead of io.Writers, in order not to wait for children
+// that inherited them when the command exits.
+// The returned function must be called after the command has been started.
+func (e *Cmd) pipeOutput(cmd *exec.Cmd) (func(), error) {
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	stderrR, stderrW, err := os.Pipe()
+	if err != nil {
+		stdoutR.Close()
+		stdoutW.Close()
+		return nil, err
+	}
+
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	go e.readOutput(stdoutR)
+	go e.readOutput(stderrR)
+
+	return func() {
+		stdoutW.Close()
+		stderrW.Close()
+	}, nil
+}
+
+func (e *Cmd) readOutput(r io.ReadCloser) {
+	defer r.Close()
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 4096), maxOutputLineSize)
+	scanner.Split(scanOutputLines)
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) != 0 {
+			e.log(logger.Info, "[%s] %s", e.name, line)
 		}
 	}
+
+	// in case of lines that are too long, keep reading in order not to block the command.
+	io.Copy(io.Discard, r) //nolint:errcheck
+}
+
+// scanOutputLines splits output into lines, that can be terminated by \n or by \r,
+// that is used by progress indicators.
+func scanOutputLines(data []byte, atEOF bool) (int, []byte, error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
 }
@@ -4,56 +4,35 @@
 package externalcmd
 
 import (
-	"os"
 	"os/exec"
 	"syscall"
-
-	"github.com/kballard/go-shellquote"
 )
 
-func (e *Cmd) runInner() (int, bool) {
-	cmdparts, err := shellquote.Split(e.cmdstr)
-	if err != nil {
-		return 0, true
-	}
-
-	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
-
-	cmd.Env = append([]string(nil), os.Environ()...)
-	for key, val := range e.env {
-		cmd.Env = append(cmd.Env, key+"="+val)
-	}
-
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Start()
-	if err != nil {
-		return 0, true
-	}
-
-	cmdDone := make(chan int)
-	go func() {
-		cmdDone <- func() int {
-			err := cmd.Wait()
-			if err == nil {
-				return 0
-			}
-			ee, ok := err.(*exec.ExitError)
-			if !ok {
-				return 0
-			}
-			return ee.ExitCode()
-		}()
-	}()
-
-	select {
-	case <-e.terminate:
-		syscall.Kill(cmd.Process.Pid, syscall.SIGINT)
-		<-cmdDone
-		return 0, false
-
-	case c := <-cmdDone:
-		return c, true
-	}
+// processGroup allows to terminate a command and its children.
+type processGroup struct {
+	cmd *exec.Cmd
+}
+
+// newProcessGroup places the command into a dedicated process group,
+// in order to be able to terminate its children too.
+// It must be called before starting the command.
+func newProcessGroup(cmd *exec.Cmd) *processGroup {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return &processGroup{cmd: cmd}
+}
+
+// start must be called after starting the command.
+func (g *processGroup) start() error {
+	return nil
+}
+
+func (g *processGroup) close() {
+}
+
+func (g *processGroup) interrupt() {
+	syscall.Kill(-g.cmd.Process.Pid, syscall.SIGINT) //nolint:errcheck
+}
+
+func (g *processGroup) kill() {
+	syscall.Kill(-g.cmd.Process.Pid, syscall.SIGKILL) //nolint:errcheck
 }
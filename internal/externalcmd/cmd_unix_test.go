@@ -0,0 +1,128 @@
+//go:build !windows
+// +build !windows
+
+package externalcmd
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/aler9/rtsp-simple-server/internal/logger"
+)
+
+type testLog struct {
+	mutex sync.Mutex
+	lines []string
+}
+
+func (l *testLog) log(_ logger.Level, format string, args ...interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func (l *testLog) get() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.lines...)
+}
+
+func TestCmdOutput(t *testing.T) {
+	pool := NewPool()
+	l := &testLog{}
+
+	RunOneShot(
+		pool,
+		"runOnTest",
+		"sh -c 'echo $MYVAR; echo world >&2; printf \"a\\rb\"'",
+		Environment{"MYVAR": "hello"},
+		l.log,
+		func(co int) {
+			require.Equal(t, 0, co)
+		})
+
+	pool.Close()
+
+	require.Eventually(t, func() bool {
+		return len(l.get()) == 4
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.ElementsMatch(t, []string{
+		"[runOnTest] hello",
+		"[runOnTest] world",
+		"[runOnTest] a",
+		"[runOnTest] b",
+	}, l.get())
+}
+
+func TestCmdKillProcessGroup(t *testing.T) {
+	pool := NewPool()
+	l := &testLog{}
+
+	c := NewCmd(
+		pool,
+		"runOnTest",
+		"sh -c 'sleep 30 & echo $!; wait'",
+		false,
+		nil,
+		l.log,
+		func(co int) {})
+
+	var childPID int
+
+	require.Eventually(t, func() bool {
+		lines := l.get()
+		if len(lines) == 0 {
+			return false
+		}
+		var err error
+		childPID, err = strconv.Atoi(lines[0][len("[runOnTest] "):])
+		require.NoError(t, err)
+		return true
+	}, 5*time.Second, 50*time.Millisecond)
+
+	list := pool.List()
+	require.Equal(t, 1, len(list))
+	require.Equal(t, "runOnTest", list[0].Name)
+	require.NotEqual(t, 0, list[0].PID)
+
+	c.Close()
+	pool.Close()
+
+	require.Equal(t, 0, len(pool.List()))
+
+	// the child has been killed together with the shell.
+	require.Eventually(t, func() bool {
+		return syscall.Kill(childPID, 0) != nil
+	}, 5*time.Second, 50*time.Millisecond)
+}
+
+func TestCmdClientVariablesNotSubstituted(t *testing.T) {
+	pool := NewPool()
+	l := &testLog{}
+
+	RunOneShot(
+		pool,
+		"runOnTest",
+		"sh -c 'echo $RTSP_PATH $RTSP_QUERY'",
+		Environment{
+			"RTSP_PATH":  "mypath",
+			"RTSP_QUERY": "a=$(echo injected)",
+		},
+		l.log,
+		func(co int) {})
+
+	pool.Close()
+
+	require.Eventually(t, func() bool {
+		return len(l.get()) == 1
+	}, 5*time.Second, 50*time.Millisecond)
+
+	require.Equal(t, []string{"[runOnTest] mypath a=$(echo injected)"}, l.get())
+}
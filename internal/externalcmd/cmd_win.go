@@ -4,57 +4,84 @@
 package externalcmd
 
 import (
-	"os"
 	"os/exec"
+	"unsafe"
 
-	"github.com/kballard/go-shellquote"
+	"golang.org/x/sys/windows"
 )
 
-func (e *Cmd) runInner() (int, bool) {
-	cmdparts, err := shellquote.Split(e.cmdstr)
+// processGroup allows to terminate a command and its children.
+// On Windows, the command is placed into a job object, that contains
+// the processes created by the command too.
+type processGroup struct {
+	cmd *exec.Cmd
+	job windows.Handle
+}
+
+// newProcessGroup must be called before starting the command.
+func newProcessGroup(cmd *exec.Cmd) *processGroup {
+	return &processGroup{cmd: cmd}
+}
+
+// start must be called after starting the command.
+// Processes created by the command before start() is called are not part of the group.
+func (g *processGroup) start() error {
+	job, err := windows.CreateJobObject(nil, nil)
 	if err != nil {
-		return 0, true
+		return err
 	}
 
-	cmd := exec.Command(cmdparts[0], cmdparts[1:]...)
-
-	cmd.Env = append([]string(nil), os.Environ()...)
-	for key, val := range e.env {
-		cmd.Env = append(cmd.Env, key+"="+val)
+	// processes of the job are killed when the server exits.
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(
+		job,
+		windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)),
+		uint32(unsafe.Sizeof(info)))
+	if err != nil {
+		windows.CloseHandle(job) //nolint:errcheck
+		return err
 	}
 
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE,
+		false, uint32(g.cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job) //nolint:errcheck
+		return err
+	}
+	defer windows.CloseHandle(process) //nolint:errcheck
 
-	err = cmd.Start()
+	err = windows.AssignProcessToJobObject(job, process)
 	if err != nil {
-		return 0, true
+		windows.CloseHandle(job) //nolint:errcheck
+		return err
 	}
 
-	cmdDone := make(chan int)
-	go func() {
-		cmdDone <- func() int {
-			err := cmd.Wait()
-			if err == nil {
-				return 0
-			}
-			ee, ok := err.(*exec.ExitError)
-			if !ok {
-				return 0
-			}
-			return ee.ExitCode()
-		}()
-	}()
-
-	select {
-	case <-e.terminate:
-		// on Windows, it's not possible to send os.Interrupt to a process.
-		// Kill() is the only supported way.
-		cmd.Process.Kill()
-		<-cmdDone
-		return 0, false
-
-	case c := <-cmdDone:
-		return c, true
+	g.job = job
+	return nil
+}
+
+func (g *processGroup) close() {
+	if g.job != 0 {
+		windows.CloseHandle(g.job) //nolint:errcheck
+	}
+}
+
+func (g *processGroup) interrupt() {
+	// on Windows, it's not possible to send os.Interrupt to a process.
+	// Killing is the only supported way.
+	g.kill()
+}
+
+func (g *processGroup) kill() {
+	if g.job != 0 {
+		windows.TerminateJobObject(g.job, 1) //nolint:errcheck
+		return
 	}
+
+	g.cmd.Process.Kill() //nolint:errcheck
 }
@@ -1,20 +1,95 @@
 package externalcmd
 
 import (
+	"sort"
 	"sync"
+	"time"
+
+	"github.com/google/uuid"
 )
 
+// CmdInfo contains informations about a command.
+type CmdInfo struct {
+	ID      uuid.UUID
+	Name    string
+	Cmd     string
+	Path    string
+	Created time.Time
+
+	// PID is zero when the command is not running.
+	PID      int
+	Started  time.Time
+	Restarts int
+
+	// LastExitCode is nil when the command never exited.
+	LastExitCode *int
+}
+
 // Pool is a pool of external commands.
 type Pool struct {
-	wg sync.WaitGroup
+	wg        sync.WaitGroup
+	terminate chan struct{}
+
+	mutex sync.Mutex
+	cmds  map[*Cmd]struct{}
 }
 
 // NewPool allocates a Pool.
 func NewPool() *Pool {
-	return &Pool{}
+	return &Pool{
+		terminate: make(chan struct{}),
+		cmds:      make(map[*Cmd]struct{}),
+	}
 }
 
 // Close waits for all external commands to exit.
+// One-shot commands that are still running after terminateTimeout are killed,
+// in order not to block the shutdown.
 func (p *Pool) Close() {
-	p.wg.Wait()
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return
+	case <-time.After(terminateTimeout):
+	}
+
+	close(p.terminate)
+	<-done
+}
+
+// List returns informations about the commands of the pool, ordered by creation time.
+func (p *Pool) List() []CmdInfo {
+	p.mutex.Lock()
+	ret := make([]CmdInfo, 0, len(p.cmds))
+	for e := range p.cmds {
+		ret = append(ret, e.info())
+	}
+	p.mutex.Unlock()
+
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Created.Before(ret[j].Created)
+	})
+
+	return ret
+}
+
+func (p *Pool) add(e *Cmd) {
+	p.wg.Add(1)
+
+	p.mutex.Lock()
+	p.cmds[e] = struct{}{}
+	p.mutex.Unlock()
+}
+
+func (p *Pool) remove(e *Cmd) {
+	p.mutex.Lock()
+	delete(p.cmds, e)
+	p.mutex.Unlock()
+
+	p.wg.Done()
 }
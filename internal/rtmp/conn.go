@@ -57,6 +57,39 @@ func resultIsOK2(res *message.MsgCommandAMF0) bool {
 	return v == 1
 }
 
+func redirectURL(res *message.MsgCommandAMF0) (string, bool) {
+	if len(res.Arguments) < 2 {
+		return "", false
+	}
+
+	ma, ok := res.Arguments[1].(flvio.AMFMap)
+	if !ok {
+		return "", false
+	}
+
+	ex, ok := ma.GetV("ex")
+	if !ok {
+		return "", false
+	}
+
+	exm, ok := ex.(flvio.AMFMap)
+	if !ok {
+		return "", false
+	}
+
+	return exm.GetString("redirect")
+}
+
+// RedirectError is returned when the server redirects the client to another URL.
+type RedirectError struct {
+	URL string
+}
+
+// Error implements the error interface.
+func (e RedirectError) Error() string {
+	return "redirected to " + e.URL
+}
+
 func splitPath(u *url.URL) (app, stream string) {
 	nu := *u
 	nu.ForceQuery = false
@@ -159,6 +192,13 @@ func (c *Conn) readCommandResult(commandID int, commandName string, isValid func
 
 				return nil
 			}
+
+			if cmd.CommandID == commandID && cmd.Name == "_error" {
+				if u, ok := redirectURL(cmd); ok {
+					return RedirectError{URL: u}
+				}
+				return fmt.Errorf("server refused connect request")
+			}
 		}
 	}
 }
@@ -327,6 +367,15 @@ func (c *Conn) InitializeClient(u *url.URL, isPublishing bool) error {
 
 // InitializeServer performs the initialization of a server-side connection.
 func (c *Conn) InitializeServer() (*url.URL, bool, error) {
+	return c.InitializeServerWithRedirect(nil)
+}
+
+// InitializeServerWithRedirect performs the initialization of a server-side connection.
+// redirect is called with the URL of the application requested by the client
+// and, if it returns a non-empty URL, the connect request is refused
+// and the client is redirected to that URL.
+// Publishers that declare themselves in the connect request are never redirected.
+func (c *Conn) InitializeServerWithRedirect(redirect func(*url.URL) string) (*url.URL, bool, error) {
 	err := handshake.DoServer(c.bc, false)
 	if err != nil {
 		return nil, false, err
@@ -367,6 +416,38 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 
 	tcURL = strings.Trim(tcURL, "'")
 
+	if typ, _ := ma.GetString("type"); redirect != nil && typ != "nonprivate" {
+		u, err := createURL(tcURL, connectpath, "")
+		if err != nil {
+			return nil, false, err
+		}
+
+		if ru := redirect(u); ru != "" {
+			err = c.mrw.Write(&message.MsgCommandAMF0{
+				ChunkStreamID: cmd.ChunkStreamID,
+				Name:          "_error",
+				CommandID:     cmd.CommandID,
+				Arguments: []interface{}{
+					nil,
+					flvio.AMFMap{
+						{K: "level", V: "error"},
+						{K: "code", V: "NetConnection.Connect.Rejected"},
+						{K: "description", V: "redirect"},
+						{K: "ex", V: flvio.AMFMap{
+							{K: "code", V: float64(302)},
+							{K: "redirect", V: ru},
+						}},
+					},
+				},
+			})
+			if err != nil {
+				return nil, false, err
+			}
+
+			return nil, false, RedirectError{URL: ru}
+		}
+	}
+
 	err = c.mrw.Write(&message.MsgSetWindowAckSize{
 		Value: 2500000,
 	})
@@ -574,6 +655,31 @@ func (c *Conn) InitializeServer() (*url.URL, bool, error) {
 	}
 }
 
+// WriteUnpublish notifies a reader or a publisher that the stream has been unpublished,
+// i.e. because the server is shutting down.
+// It must be called after InitializeServer.
+func (c *Conn) WriteUnpublish(isPublishing bool) error {
+	code := "NetStream.Play.UnpublishNotify"
+	if isPublishing {
+		code = "NetStream.Unpublish.Success"
+	}
+
+	return c.mrw.Write(&message.MsgCommandAMF0{
+		ChunkStreamID:   5,
+		MessageStreamID: 0x1000000,
+		Name:            "onStatus",
+		CommandID:       0,
+		Arguments: []interface{}{
+			nil,
+			flvio.AMFMap{
+				{K: "level", V: "status"},
+				{K: "code", V: code},
+				{K: "description", V: "stream is unpublished"},
+			},
+		},
+	})
+}
+
 // ReadMessage reads a message.
 func (c *Conn) ReadMessage() (message.Message, error) {
 	return c.mrw.Read()
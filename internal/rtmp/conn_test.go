@@ -471,6 +471,42 @@ func TestInitializeServer(t *testing.T) {
 	}
 }
 
+func TestInitializeServerRedirect(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:9121")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		conn, err := ln.Accept()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rconn := NewConn(conn)
+		_, _, err = rconn.InitializeServerWithRedirect(func(u *url.URL) string {
+			require.Equal(t, "rtmp://127.0.0.1:9121/stream/", u.String())
+			return "rtmp://127.0.0.1:9122/stream"
+		})
+		require.Equal(t, RedirectError{URL: "rtmp://127.0.0.1:9122/stream"}, err)
+	}()
+
+	u, err := url.Parse("rtmp://127.0.0.1:9121/stream")
+	require.NoError(t, err)
+
+	nconn, err := net.Dial("tcp", u.Host)
+	require.NoError(t, err)
+	defer nconn.Close()
+
+	conn := NewConn(nconn)
+	err = conn.InitializeClient(u, false)
+	require.Equal(t, RedirectError{URL: "rtmp://127.0.0.1:9122/stream"}, err)
+
+	<-done
+}
+
 func TestReadTracks(t *testing.T) {
 	sps := []byte{
 		0x67, 0x64, 0x00, 0x0c, 0xac, 0x3b, 0x50, 0xb0,